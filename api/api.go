@@ -0,0 +1,15 @@
+// api - схемы сообщений kafka во всех поддерживаемых кодировках, встроенные в бинарник
+package api
+
+import "embed"
+
+// Schemas - JSON-схемы (schema), схемы Avro (avro) и Protobuf (proto)
+//
+//go:embed schema/*.json avro/*.avsc proto/*.proto
+var Schemas embed.FS
+
+// схемы Avro, по ним кодируются и разбираются сообщения
+const (
+	AvroSendRequest  = "avro/send-request.v1.avsc"
+	AvroLetterStatus = "avro/letter-status.v1.avsc"
+)
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/maris-cyber/mailsender/internal/kfk"
+)
+
+// mailsender dlq-replay [-max N] [-idle 10s]
+// возвращает сообщения из KAFKA_TOPIC_DLQ в KAFKA_TOPIC_MAILSENDER после исправления отправителя
+func dlqReplay(args []string) int {
+	fs := flag.NewFlagSet("dlq-replay", flag.ContinueOnError)
+	max := fs.Int("max", 0, "сколько сообщений вернуть, 0 - все")
+	idle := fs.Duration("idle", 10*time.Second, "закончить, если столько времени нет новых сообщений")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	k, err := kfk.New(ctx, nil, nil)
+	if err != nil {
+		zap.S().Errorf("Can't connect to kafka: %v", err)
+
+		return 1
+	}
+
+	n, err := k.ReplayDLQ(ctx, *max, *idle)
+
+	zap.S().Infof("DLQ replayed %d messages", n)
+
+	if err != nil {
+		zap.S().Errorf("DLQ replay error: %v", err)
+
+		return 1
+	}
+
+	return 0
+}
@@ -3,7 +3,14 @@ Main стартует сервисы:
 limiter - сервис, который регулирует rate limit для отправки почты;
 mailer - сервис, который отправляет письма по smtp
 параллельно несколькими воркерами;
-kfk - сервис, который читает и пишет в kafka;
+tmpl - реестр шаблонов писем с версиями (хранится в той же базе, что и очередь);
+track - отслеживание открытий писем и переходов по ссылкам;
+suppress - список подавления, очередь не отдаёт mailer'у письма на эти адреса;
+addrcheck - проверка адресов получателей при поступлении писем;
+bounce - разбор отказов доставки и жалоб из maildir, адреса попадают в список подавления;
+kfk - сервис, который читает и пишет в kafka (JSON, Protobuf или Avro, см. codec),
+статусы писем отправляет из outbox в базе;
+ingress - источники писем для очереди: kafka, http, каталог с файлами, поток redis, smtp (INGRESS_SOURCES);
 mng - сервис, который читает и пишет в mongodb;
 queue - сервис, который делает очередь с помощью той реализации
 базы данных, которую ему передадут при создании (mem или mng).
@@ -14,6 +21,10 @@ queue - сервис, который делает очередь с помощь
 
 http был прикручен для тестов, да так и остался.
 
+Служебные команды:
+mailsender dlq-replay [-max N] [-idle 10s] - вернуть сообщения из DLQ в топик для mailsender.
+mailsender sendmail [-t] [-i] [-f from] [-F name] [адресат ...] - поставить в очередь сообщение со stdin, как sendmail.
+
 P.S. Проект старый, теперь многое сделал бы иначе.
 */
 package main
@@ -21,29 +32,70 @@ package main
 import (
 	"context"
 	"crypto/rand"
-	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
 
+	"github.com/maris-cyber/mailsender/internal/addrcheck"
+	"github.com/maris-cyber/mailsender/internal/bounce"
+	"github.com/maris-cyber/mailsender/internal/db/mem"
 	"github.com/maris-cyber/mailsender/internal/db/mng"
+	"github.com/maris-cyber/mailsender/internal/envelope"
+	"github.com/maris-cyber/mailsender/internal/ingress"
 	"github.com/maris-cyber/mailsender/internal/kfk"
 	"github.com/maris-cyber/mailsender/internal/letter"
 	"github.com/maris-cyber/mailsender/internal/limiter"
 	"github.com/maris-cyber/mailsender/internal/mailer"
+	"github.com/maris-cyber/mailsender/internal/outbox"
 	"github.com/maris-cyber/mailsender/internal/queue"
+	"github.com/maris-cyber/mailsender/internal/suppress"
+	"github.com/maris-cyber/mailsender/internal/tmpl"
+	"github.com/maris-cyber/mailsender/internal/track"
 
 	"sync"
 )
 
+// заголовки http-запроса: сквозной ID и ключ запроса для ключей идемпотентности писем
+const (
+	headerCorrelationID  = "X-Correlation-ID"
+	headerIdempotencyKey = "Idempotency-Key"
+)
+
+// сколько ждать kafka при остановке, больше KAFKA_PROFILE_FLUSH_TIMEOUT по умолчанию
+const kfkStopTimeout = 15 * time.Second
+
 var kH *kfk.DB
+var httpIn *ingress.HTTPSource
+var mH *mailer.Mailer
+var tplReg tmpl.Registry
+var tracker *track.Tracker
+var evtDB eventStore
+var supDB suppress.Store
+var validator *addrcheck.Validator
 var cancelCtx context.CancelFunc
 var srv http.Server
 var ctx context.Context
 
+// storage - база очереди со всем, что в ней хранится: mng или, в локальном режиме, mem
+type storage interface {
+	queue.Qdb
+	queue.Outbox
+	outbox.Store
+	tmpl.Registry
+	suppress.Store
+	bounce.Store
+	eventStore
+}
+
 func main() {
 	var (
 		ctxMng       context.Context
@@ -59,6 +111,19 @@ func main() {
 	defer logger.Sync()
 	zap.ReplaceGlobals(logger)
 
+	// служебные команды
+	if len(os.Args) > 1 && os.Args[1] == "dlq-replay" {
+		code := dlqReplay(os.Args[2:])
+		logger.Sync()
+		os.Exit(code)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "sendmail" {
+		code := sendmail(os.Args[2:])
+		logger.Sync()
+		os.Exit(code)
+	}
+
 	ctx, cancelCtx = context.WithCancel(context.Background())
 	wg := &sync.WaitGroup{}
 
@@ -68,7 +133,7 @@ func main() {
 
 	// канал для передачии из очереди в kafka
 	chanFromQuToKfk := make(chan *letter.Letter, 1)
-	// канал для передачии из kafka в очередь
+	// канал для передачии из kafka и других источников в очередь
 	chanFrmKfkToQu := make(chan *letter.Letter, 1)
 
 	// инициализировать и запустить rate limit для пула воркеров, отправляющих почту
@@ -82,17 +147,13 @@ func main() {
 
 	go lmt.Run(ctx)
 
-	// инициализировать и запустить почтовик
-	var mH *mailer.Mailer
-
+	// инициализировать почтовик
 	if mH, err = mailer.New(ctx, lmt, mailerWG); err != nil {
 		zap.S().Fatalf("Can't initialize Mailer: %s", err)
 	} else {
 		zap.S().Debug("Mailer started")
 	}
 
-	mH.Run(ctx)
-
 	// инициализировать и запустить kafka
 	if kH, err = kfk.New(ctx, &chanFromQuToKfk, &chanFrmKfkToQu); err != nil {
 		zap.S().Fatalf("Can't Connect to kafka: %s", err)
@@ -100,19 +161,91 @@ func main() {
 		zap.S().Debug("Kafka started")
 	}
 
-	go kH.Run(ctx)
+	// проверка адресов получателей при поступлении писем
+	if validator, err = addrcheck.New(); err != nil {
+		zap.S().Fatalf("Address check config error: %v", err)
+	}
+
+	kH.SetValidator(validator)
+
+	// не в горутине: к остановке Publisher должен быть запущен, иначе Stop не дождётся записи статусов
+	kH.Run(ctx)
+
+	// источники писем для очереди
+	if err = runSources(ctx, chanFrmKfkToQu); err != nil {
+		zap.S().Fatalf("Ingress config error: %v", err)
+	}
 
 	// создание коннектора к базе для очереди
 	// отдельный контекст для монго, чтобы выключалась после всех
 	ctxMng, cancelCtxMng = context.WithCancel(context.Background())
 
-	var db *mng.DB
+	// в локальном режиме kafka очередь, шаблоны, события, список подавления и outbox тоже в памяти
+	var db storage
+
+	if kH.Local() {
+		db, err = mem.New(ctxMng)
+	} else {
+		db, err = mng.New(ctxMng)
+	}
 
-	db, err = mng.New(ctxMng)
 	if err != nil {
-		zap.S().Fatalf("Mongo error: %v\n", err)
+		zap.S().Fatalf("Queue db error: %v\n", err)
 	} else {
-		zap.S().Debug("Mongo started")
+		zap.S().Debugf("Queue db started, local %v", kH.Local())
+	}
+
+	// реестр шаблонов писем в той же базе
+	// если задан каталог с шаблонами, отсутствующие в реестре шаблоны из него публикуются
+	tplReg = db
+
+	if ds, err := tmpl.NewDirStore(); err != nil {
+		zap.S().Debugf("Templates dir not configured: %v", err)
+	} else if err = tmpl.Import(tplReg, ds); err != nil {
+		zap.S().Errorf("tmpl.Import error: %v", err)
+	}
+
+	// события по письмам и список подавления в той же базе
+	evtDB = db
+	supDB = db
+
+	// отслеживание открытий и переходов, если задан секрет для подписи
+	if tracker, err = track.New(); err != nil {
+		zap.S().Fatalf("Tracking config error: %v", err)
+	}
+
+	// отписка по ссылке из письма должна дойти до kafka событием, без топика событий она бы потерялась
+	if tracker != nil && !kH.Events() {
+		zap.S().Fatalf("Tracking config error: %s is required for unsubscribe events", kfk.KAFKA_TOPIC_EVT)
+	}
+
+	// отправитель конверта VERP, если задан адрес для отказов
+	verp, err := bounce.NewVERPFromEnv()
+	if err != nil {
+		zap.S().Fatalf("Bounce config error: %v", err)
+	}
+
+	// запустить почтовик
+	mH.SetTemplates(tplReg)
+	mH.SetTracker(tracker)
+	mH.SetVERP(verp)
+	mH.Run(ctx)
+
+	// разбор отказов и жалоб из maildir, если он задан
+	if verp != nil {
+		md, err := bounce.NewMaildir(bounce.NewProcessor(verp, db, supDB, recordEvent))
+		if err != nil {
+			zap.S().Fatalf("Bounce maildir error: %v", err)
+		}
+
+		// жалоба должна дойти до profile событием, без топика событий она бы потерялась
+		if md != nil && !kH.Events() {
+			zap.S().Fatalf("Bounce config error: %s is required for bounce and complaint events", kfk.KAFKA_TOPIC_EVT)
+		}
+
+		if md != nil {
+			go md.Run(ctx)
+		}
 	}
 
 	// инициализировать и запустить очередь
@@ -125,6 +258,17 @@ func main() {
 		zap.S().Debug("Queue started")
 	}
 
+	qH.SetTemplates(tplReg)
+	qH.SetSuppressions(supDB)
+
+	// с KAFKA_OUTBOX=true статусы писем сохраняются в outbox в той же транзакции, что и результат,
+	// и уходят в kafka через relay, даже если kafka была недоступна; иначе - сразу через Publisher
+	if kH.Outbox() {
+		qH.SetOutbox(db)
+
+		go kH.NewRelay(db).Run(ctx)
+	}
+
 	wg.Add(1)
 	go qH.Run(ctx, "awaiting")
 
@@ -141,8 +285,17 @@ func main() {
 	})
 	MailSenderRouter.Route("/post", func(r chi.Router) {
 		r.Post("/", getTask)
+		r.Post("/message", getMessage)
 	})
 
+	MailSenderRouter.Route("/templates", templatesRouter)
+	MailSenderRouter.Route("/suppressions", suppressionsRouter)
+
+	if tracker != nil {
+		MailSenderRouter.Route("/t", trackRouter)
+		MailSenderRouter.Route("/unsubscribe", unsubscribeRouter)
+	}
+
 	MailSenderRouter.Route("/halt", func(r chi.Router) {
 		r.Post("/", sayBye)
 	})
@@ -159,6 +312,14 @@ func main() {
 
 	// дождаться завершения очереди
 	wg.Wait()
+
+	// дождаться, пока kafka допишет накопленные статусы
+	stopCtx, cancelStop := context.WithTimeout(context.Background(), kfkStopTimeout)
+	if err = kH.Stop(stopCtx); err != nil {
+		zap.S().Errorf("kH.Stop error: %v", err)
+	}
+
+	cancelStop()
 	// остановить коннектор к mongo
 	cancelCtxMng()
 }
@@ -183,29 +344,170 @@ func getTask(w http.ResponseWriter, r *http.Request) {
 		err error
 	)
 
-	// проверить, что на вход пришёл массив писем
-	dec := json.NewDecoder(r.Body)
-	err = dec.Decode(&tL)
+	// проверить, что на вход пришёл массив писем или запрос в конверте (api/schema/send-request.v1.json)
+	msgs, err := io.ReadAll(r.Body)
+	if err == nil {
+		tL, _, err = envelope.DecodeRequest(msgs)
+	}
 
 	smpl := "[{\"Subject\":\" тема\",\"Body\":\"сообщение\\n\",\"Addresses\":[\"uuunet@mailto.plus\",\"yhuzfu@mailto.plus\"]}]"
 
 	if err != nil {
 		http.Error(w, "Ожидаю МАССИВ писем, в каждом письме МАССИВ адресатов.\nОбразец:"+smpl+"\n"+err.Error(), http.StatusInternalServerError)
-	} else {
-		// отдать в кафку как будто задание получено из bodyshop
-		msgs, err := json.Marshal(&tL)
+	} else if bad := invalidAddresses(r.Context(), tL); len(bad) > 0 {
+		// неправильные адреса сразу возвращаются отправителю, в kafka письма не попадают
+		http.Error(w, "Неправильные адреса:\n"+strings.Join(bad, "\n"), http.StatusBadRequest)
+	} else if httpIn != nil {
+		// поставить в очередь сразу, ответ - когда очередь сохранила письма
+		_, err = httpIn.Accept(r.Context(), msgs, r.Header.Get(headerIdempotencyKey), r.Header.Get(headerCorrelationID))
 		if err != nil {
-			zap.S().Debugf("can't json.Marshal: %v", err)
+			zap.S().Errorf("httpIn.Accept error: %v\n", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		}
-		key := make([]byte, 16)
-		_, err = rand.Read(key)
-		if err != nil {
-			zap.S().Debugf("can't generate key for Kfk", err)
+	} else {
+		// отдать в кафку как будто задание получено из bodyshop, в том же формате, в каком пришло
+		// ключ запроса становится ключом сообщения, из него строятся ключи идемпотентности писем
+		key := []byte(r.Header.Get(headerIdempotencyKey))
+		if len(key) == 0 {
+			key = make([]byte, 16)
+			_, err = rand.Read(key)
+			if err != nil {
+				zap.S().Debugf("can't generate key for Kfk", err)
+			}
+		}
+		// сквозной ID запроса передаётся дальше в заголовке сообщения
+		var headers []kafka.Header
+		if id := letter.CleanCorrelationID(r.Header.Get(headerCorrelationID)); id != "" {
+			headers = append(headers, kafka.Header{Key: kfk.HeaderCorrelationID, Value: []byte(id)})
 		}
+
 		ctx := r.Context()
-		err = kH.WriteToMS(ctx, key, msgs)
+		err = kH.WriteToMS(ctx, key, msgs, headers...)
 		if err != nil {
 			zap.S().Errorf("kH.WriteToMS error; %v\n", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		}
 	}
 }
+
+// getMessage ставит в очередь сообщение RFC 5322 из тела запроса для адресатов из параметров rcpt,
+// как принятое по smtp; так письма отдаёт mailsender sendmail
+// исходное сообщение через kafka не передаётся, поэтому нужен источник http
+func getMessage(w http.ResponseWriter, r *http.Request) {
+	if httpIn == nil {
+		http.Error(w, "Сообщения принимаются только с источником http (INGRESS_SOURCES)", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	rcpts := r.URL.Query()["rcpt"]
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if _, _, err = ingress.ParseMessage(b, rcpts); err != nil {
+		http.Error(w, "Ожидаю сообщение RFC 5322\n"+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if bad := invalidAddresses(r.Context(), []letter.Letter{{Addresses: rcpts}}); len(bad) > 0 {
+		http.Error(w, "Неправильные адреса:\n"+strings.Join(bad, "\n"), http.StatusBadRequest)
+
+		return
+	}
+
+	// ответ - когда очередь сохранила письмо
+	err = httpIn.AcceptMessage(r.Context(), b, rcpts, r.Header.Get(headerIdempotencyKey), r.Header.Get(headerCorrelationID))
+	if err != nil {
+		zap.S().Errorf("httpIn.AcceptMessage error: %v\n", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+}
+
+// адреса писем, не прошедшие проверку, с причинами
+func invalidAddresses(ctx context.Context, tL []letter.Letter) []string {
+	var bad []string
+
+	for i := range tL {
+		addresses := append([]string(nil), tL[i].Addresses...)
+		for _, rcpt := range tL[i].Recipients {
+			addresses = append(addresses, rcpt.Address)
+		}
+
+		if len(addresses) == 0 {
+			bad = append(bad, fmt.Sprintf("письмо %d: нет адресатов", i))
+		}
+
+		for _, a := range addresses {
+			if _, err := validator.Check(ctx, a); err != nil {
+				bad = append(bad, fmt.Sprintf("письмо %d: %q: %v", i, a, err))
+			}
+		}
+	}
+
+	return bad
+}
+
+// runSources запускает источники писем из INGRESS_SOURCES
+// http не запускает своего сервера: запросы в /post ставятся в очередь сразу, а не через kafka
+func runSources(ctx context.Context, ch chan *letter.Letter) error {
+	enabled, err := ingress.Enabled()
+	if err != nil {
+		return err
+	}
+
+	var sources []ingress.Source
+
+	if enabled[ingress.Kafka] {
+		sources = append(sources, kH.Source())
+	}
+
+	if enabled[ingress.HTTP] {
+		httpIn = ingress.NewHTTP(&ch, validator)
+		sources = append(sources, httpIn)
+	}
+
+	if enabled[ingress.Spool] {
+		sp, err := ingress.NewSpool(&ch, validator)
+		if err != nil {
+			return err
+		}
+
+		sources = append(sources, sp)
+	}
+
+	if enabled[ingress.Redis] {
+		rs, err := ingress.NewRedis(&ch, validator)
+		if err != nil {
+			return err
+		}
+
+		sources = append(sources, rs)
+	}
+
+	if enabled[ingress.SMTP] {
+		ss, err := ingress.NewSMTP(&ch, validator)
+		if err != nil {
+			return err
+		}
+
+		sources = append(sources, ss)
+	}
+
+	for _, src := range sources {
+		zap.S().Debugf("Ingress %s started", src.Name())
+
+		go func(src ingress.Source) {
+			if err := src.Run(ctx); err != nil {
+				zap.S().Errorf("Ingress %s error: %v", src.Name(), err)
+			}
+		}(src)
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/addrcheck"
+	"github.com/maris-cyber/mailsender/internal/kfk"
+)
+
+func Test_GetTask(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Setenv(kfk.KAFKA_MODE, "local")
+	t.Setenv(kfk.KAFKA_TOPIC_MS, "mailsender")
+	t.Setenv(kfk.KAFKA_TOPIC_PRF, "profile")
+	t.Setenv(kfk.KAFKA_GROUPID, "mailsender")
+
+	var err error
+
+	if validator, err = addrcheck.New(); err != nil {
+		t.Fatalf("addrcheck.New error: %v", err)
+	}
+
+	if kH, err = kfk.New(ctx, nil, nil); err != nil {
+		t.Fatalf("kfk.New error: %v", err)
+	}
+
+	defer func() { validator, kH = nil, nil }()
+
+	req := `[{"Subject":"тема","Body":"сообщение","Addresses":["a@example.com"]}]`
+
+	post := func(key string) int {
+		r := httptest.NewRequest(http.MethodPost, "/post", strings.NewReader(req)).WithContext(ctx)
+		if key != "" {
+			r.Header.Set(headerIdempotencyKey, key)
+		}
+
+		w := httptest.NewRecorder()
+		getTask(w, r)
+
+		return w.Code
+	}
+
+	// ключ запроса становится ключом сообщения kafka
+	if code := post("req-1"); code != http.StatusOK {
+		t.Fatalf("getTask = %d", code)
+	}
+
+	msg, err := kH.Reader.FetchMessage(ctx)
+	if err != nil || string(msg.Key) != "req-1" || string(msg.Value) != req {
+		t.Errorf("kafka message %q %q, %v", msg.Key, msg.Value, err)
+	}
+
+	// без ключа - случайный
+	if code := post(""); code != http.StatusOK {
+		t.Fatalf("getTask without key = %d", code)
+	}
+
+	if msg, err = kH.Reader.FetchMessage(ctx); err != nil || len(msg.Key) == 0 {
+		t.Errorf("kafka message without key %q, %v", msg.Key, err)
+	}
+
+	// запрос, не записанный в kafka, не должен выглядеть принятым
+	kH.Writer4MS.Close()
+
+	if code := post("req-2"); code != http.StatusServiceUnavailable {
+		t.Errorf("getTask with kafka error = %d", code)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/maris-cyber/mailsender/internal/addrcheck"
+	"github.com/maris-cyber/mailsender/internal/db/mng"
+	"github.com/maris-cyber/mailsender/internal/ingress"
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"github.com/maris-cyber/mailsender/internal/mailer"
+	"github.com/maris-cyber/mailsender/internal/queue"
+)
+
+const SENDMAIL_URL = "SENDMAIL_URL" // адрес работающего mailsender (http://localhost:8000), без него письмо пишется в базу очереди
+
+// коды завершения как у sendmail (sysexits.h)
+const (
+	exUsage    = 64 // неправильные аргументы
+	exDataErr  = 65 // неправильное сообщение или нет адресатов
+	exTempFail = 75 // не удалось поставить в очередь, можно повторить
+)
+
+const sendmailTimeout = 30 * time.Second
+
+// errRejected - mailsender отказался принять сообщение, повтор не поможет
+var errRejected = errors.New("message rejected")
+
+// параметры командной строки sendmail
+type sendmailArgs struct {
+	fromHeaders bool     // -t: адресаты из To, Cc и Bcc
+	ignoreDots  bool     // -i, -oi: строка из одной точки не заканчивает сообщение
+	from        string   // -f, -r: отправитель
+	fullName    string   // -F: имя отправителя
+	rcpts       []string // адресаты из командной строки
+}
+
+// mailsender sendmail [-t] [-i] [-f from] [-F name] [адресат ...] < сообщение
+// ставит сообщение со stdin в очередь, как /usr/sbin/sendmail:
+// через работающий mailsender (SENDMAIL_URL) или сразу в базу очереди
+func sendmail(args []string) int {
+	sa, err := parseSendmailArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: %v\nusage: mailsender sendmail [-t] [-i] [-f from] [-F name] [recipient ...]\n", err)
+
+		return exUsage
+	}
+
+	b, err := readMessage(os.Stdin, sa.ignoreDots)
+	if err != nil {
+		zap.S().Errorf("sendmail: can't read message: %v", err)
+
+		return exDataErr
+	}
+
+	b = completeHeaders(b, sa)
+
+	rcpts := sa.rcpts
+	if sa.fromHeaders {
+		if rcpts, err = headerRecipients(b, rcpts); err != nil {
+			zap.S().Errorf("sendmail: %v", err)
+
+			return exDataErr
+		}
+	}
+
+	if len(rcpts) == 0 {
+		zap.S().Errorf("sendmail: no recipients")
+
+		return exDataErr
+	}
+
+	ltr, key, err := ingress.ParseMessage(b, rcpts)
+	if err != nil {
+		zap.S().Errorf("sendmail: malformed message: %v", err)
+
+		return exDataErr
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	ctx, cancelTimeout := context.WithTimeout(ctx, sendmailTimeout)
+	defer cancelTimeout()
+
+	if u := os.Getenv(SENDMAIL_URL); u != "" {
+		err = postMessage(ctx, u, b, rcpts)
+	} else {
+		err = putLetter(ctx, ltr, key)
+	}
+
+	if err != nil {
+		zap.S().Errorf("sendmail: can't enqueue: %v", err)
+
+		if errors.Is(err, errRejected) {
+			return exDataErr
+		}
+
+		return exTempFail
+	}
+
+	return 0
+}
+
+func parseSendmailArgs(args []string) (sendmailArgs, error) {
+	var sa sendmailArgs
+
+	// значение флага: слитно (-fa@b.c) или следующим аргументом (-f a@b.c)
+	value := func(i *int, a string) (string, error) {
+		if len(a) > 2 {
+			return a[2:], nil
+		}
+
+		if *i+1 >= len(args) {
+			return "", fmt.Errorf("%s needs a value", a)
+		}
+
+		*i++
+
+		return args[*i], nil
+	}
+
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+
+		if a == "--" {
+			sa.rcpts = append(sa.rcpts, args[i+1:]...)
+
+			break
+		}
+
+		if !strings.HasPrefix(a, "-") || a == "-" {
+			sa.rcpts = append(sa.rcpts, a)
+
+			continue
+		}
+
+		var err error
+
+		switch {
+		case a == "-t":
+			sa.fromHeaders = true
+		case a == "-i", a == "-oi":
+			sa.ignoreDots = true
+		case strings.HasPrefix(a, "-f"), strings.HasPrefix(a, "-r"):
+			sa.from, err = value(&i, a)
+		case strings.HasPrefix(a, "-F"):
+			sa.fullName, err = value(&i, a)
+		case a == "-bm":
+			// обычный режим: прочитать сообщение и отправить
+		case strings.HasPrefix(a, "-b"):
+			err = fmt.Errorf("mode %s not supported", a)
+		case strings.HasPrefix(a, "-o"), strings.HasPrefix(a, "-B"), strings.HasPrefix(a, "-N"),
+			strings.HasPrefix(a, "-R"), strings.HasPrefix(a, "-V"), a == "-v", a == "-U":
+			// настройки доставки sendmail здесь ничего не значат
+		default:
+			err = fmt.Errorf("unknown option %s", a)
+		}
+
+		if err != nil {
+			return sa, err
+		}
+	}
+
+	return sa, nil
+}
+
+// readMessage читает сообщение; без -i строка из одной точки заканчивает его, как у sendmail
+func readMessage(r io.Reader, ignoreDots bool) ([]byte, error) {
+	if ignoreDots {
+		return io.ReadAll(r)
+	}
+
+	var buf bytes.Buffer
+
+	br := bufio.NewReader(r)
+
+	for {
+		line, err := br.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == "." && strings.HasSuffix(line, "\n") {
+			return buf.Bytes(), nil
+		}
+
+		buf.WriteString(line)
+
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// completeHeaders добавляет From и Date, если их нет в сообщении:
+// From - из -f и -F, а без -f - пользователь smtp, от которого mailsender отправляет письма
+func completeHeaders(b []byte, sa sendmailArgs) []byte {
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return b
+	}
+
+	var add []string
+
+	if msg.Header.Get("From") == "" {
+		from := sa.from
+		if from == "" {
+			from = os.Getenv(mailer.SMTP_USER)
+		}
+
+		if from != "" {
+			a := mail.Address{Name: sa.fullName, Address: from}
+			add = append(add, "From: "+a.String())
+		}
+	}
+
+	if msg.Header.Get("Date") == "" {
+		add = append(add, "Date: "+time.Now().Format(time.RFC1123Z))
+	}
+
+	if len(add) == 0 {
+		return b
+	}
+
+	return append([]byte(strings.Join(add, "\r\n")+"\r\n"), b...)
+}
+
+// headerRecipients добавляет к rcpts адресатов из To, Cc и Bcc (-t)
+func headerRecipients(b []byte, rcpts []string) ([]string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("malformed message: %v", err)
+	}
+
+	res := append([]string(nil), rcpts...)
+
+	for _, h := range []string{"To", "Cc", "Bcc"} {
+		if msg.Header.Get(h) == "" {
+			continue
+		}
+
+		as, err := msg.Header.AddressList(h)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s: %v", h, err)
+		}
+
+		for _, a := range as {
+			res = append(res, a.Address)
+		}
+	}
+
+	return res, nil
+}
+
+// postMessage отдаёт сообщение в /post/message работающего mailsender,
+// ключ запроса и сквозной ID он возьмёт из сообщения, как для принятого по smtp
+func postMessage(ctx context.Context, u string, b []byte, rcpts []string) error {
+	q := url.Values{"rcpt": rcpts}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(u, "/")+"/post/message?"+q.Encode(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "message/rfc822")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+		if resp.StatusCode/100 == 4 {
+			return fmt.Errorf("%w: %s: %s", errRejected, resp.Status, strings.TrimSpace(string(msg)))
+		}
+
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+// putLetter записывает письмо в базу очереди, его отправит работающий mailsender
+func putLetter(ctx context.Context, ltr letter.Letter, key string) error {
+	val, err := addrcheck.New()
+	if err != nil {
+		return err
+	}
+
+	// свой контекст для mongo, чтобы отключиться после записи
+	ctxMng, cancelMng := context.WithCancel(context.Background())
+	defer cancelMng()
+
+	db, err := mng.New(ctxMng)
+	if err != nil {
+		return err
+	}
+
+	qH, err := queue.New(ctx, db, nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	qH.SetOutbox(db)
+
+	tL := []letter.Letter{ltr}
+	ingress.Prepare(ctx, tL, key, "", val)
+
+	err = qH.Put(ctx, &tL[0])
+	if errors.Is(err, letter.ErrDuplicate) {
+		tL[0].Log().Debugf("sendmail: letter %s already queued", key)
+
+		return nil
+	}
+
+	return err
+}
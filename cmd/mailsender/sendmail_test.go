@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/maris-cyber/mailsender/internal/addrcheck"
+	"github.com/maris-cyber/mailsender/internal/ingress"
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"github.com/maris-cyber/mailsender/internal/mailer"
+)
+
+func Test_ParseSendmailArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want sendmailArgs
+		bad  bool
+	}{
+		{[]string{"a@b.c"}, sendmailArgs{rcpts: []string{"a@b.c"}}, false},
+		{[]string{"-fa@b.c", "x@y.z"}, sendmailArgs{from: "a@b.c", rcpts: []string{"x@y.z"}}, false},
+		{[]string{"-f", "a@b.c", "x@y.z"}, sendmailArgs{from: "a@b.c", rcpts: []string{"x@y.z"}}, false},
+		{[]string{"-r", "a@b.c", "-F", "Робот", "x@y.z"}, sendmailArgs{from: "a@b.c", fullName: "Робот", rcpts: []string{"x@y.z"}}, false},
+		{[]string{"-oi", "-t"}, sendmailArgs{ignoreDots: true, fromHeaders: true}, false},
+		{[]string{"-i", "-bm", "-oem", "-v", "x@y.z"}, sendmailArgs{ignoreDots: true, rcpts: []string{"x@y.z"}}, false},
+		{[]string{"x@y.z", "--", "-t", "-i"}, sendmailArgs{rcpts: []string{"x@y.z", "-t", "-i"}}, false},
+		{[]string{"-f"}, sendmailArgs{}, true},
+		{[]string{"-bp"}, sendmailArgs{}, true},
+		{[]string{"-x", "x@y.z"}, sendmailArgs{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSendmailArgs(tt.args)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("parseSendmailArgs(%q) = %+v, want error", tt.args, got)
+			}
+
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSendmailArgs(%q) = %+v, %v, want %+v", tt.args, got, err, tt.want)
+		}
+	}
+}
+
+func Test_ReadMessage(t *testing.T) {
+	tests := []struct {
+		in         string
+		ignoreDots bool
+		want       string
+	}{
+		{"Subject: a\n\nbody\n", false, "Subject: a\n\nbody\n"},
+		{"Subject: a\n\nbody\n.\nafter\n", false, "Subject: a\n\nbody\n"},
+		{"Subject: a\r\n\r\nbody\r\n.\r\nafter\r\n", false, "Subject: a\r\n\r\nbody\r\n"},
+		{"Subject: a\n\nbody\n.\nafter\n", true, "Subject: a\n\nbody\n.\nafter\n"},
+		{"Subject: a\n\n..\n. \n", false, "Subject: a\n\n..\n. \n"},
+		{"Subject: a\n\nbody\n.", false, "Subject: a\n\nbody\n."},
+	}
+
+	for _, tt := range tests {
+		got, err := readMessage(strings.NewReader(tt.in), tt.ignoreDots)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("readMessage(%q, %v) = %q, %v, want %q", tt.in, tt.ignoreDots, got, err, tt.want)
+		}
+	}
+}
+
+func Test_HeaderRecipients(t *testing.T) {
+	tests := []struct {
+		msg   string
+		rcpts []string
+		want  []string
+		bad   bool
+	}{
+		{"To: a@b.c\r\n\r\nbody", nil, []string{"a@b.c"}, false},
+		{"To: A <a@b.c>, d@e.f\r\nCc: g@h.i\r\nBcc: hidden@b.c\r\n\r\nbody", []string{"x@y.z"},
+			[]string{"x@y.z", "a@b.c", "d@e.f", "g@h.i", "hidden@b.c"}, false},
+		{"Subject: нет адресатов\r\n\r\nbody", nil, nil, false},
+		{"To: not an address\r\n\r\nbody", nil, nil, true},
+		{"no headers", nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := headerRecipients([]byte(tt.msg), tt.rcpts)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("headerRecipients(%q) = %q, want error", tt.msg, got)
+			}
+
+			continue
+		}
+
+		if err != nil || strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("headerRecipients(%q, %q) = %q, %v, want %q", tt.msg, tt.rcpts, got, err, tt.want)
+		}
+	}
+}
+
+func Test_CompleteHeaders(t *testing.T) {
+	t.Setenv(mailer.SMTP_USER, "robot@example.com")
+
+	tests := []struct {
+		msg      string
+		sa       sendmailArgs
+		from     string // ожидаемый добавленный From, пустой - не добавляется
+		withDate bool
+	}{
+		{"Subject: a\r\n\r\nbody", sendmailArgs{}, "From: <robot@example.com>", true},
+		{"Subject: a\r\n\r\nbody", sendmailArgs{from: "a@b.c", fullName: "Ann"}, `From: "Ann" <a@b.c>`, true},
+		{"From: x@y.z\r\nSubject: a\r\n\r\nbody", sendmailArgs{from: "a@b.c"}, "", true},
+		{"From: x@y.z\r\nDate: Mon, 02 Jan 2006 15:04:05 +0000\r\n\r\nbody", sendmailArgs{}, "", false},
+	}
+
+	for _, tt := range tests {
+		got := string(completeHeaders([]byte(tt.msg), tt.sa))
+
+		if !strings.HasSuffix(got, tt.msg) {
+			t.Errorf("completeHeaders(%q) = %q, message changed", tt.msg, got)
+
+			continue
+		}
+
+		added := strings.TrimSuffix(got, tt.msg)
+
+		if tt.from != "" && !strings.HasPrefix(added, tt.from+"\r\n") || tt.from == "" && strings.Contains(added, "From:") {
+			t.Errorf("completeHeaders(%q, %+v) added %q, want From %q", tt.msg, tt.sa, added, tt.from)
+		}
+
+		if strings.Contains(added, "Date: ") != tt.withDate {
+			t.Errorf("completeHeaders(%q) added %q, want Date %v", tt.msg, added, tt.withDate)
+		}
+	}
+
+	// сообщение, которое не разобрать, не меняется
+	if got := completeHeaders([]byte("no headers"), sendmailArgs{}); string(got) != "no headers" {
+		t.Errorf("completeHeaders broken message = %q", got)
+	}
+}
+
+func Test_PostMessage(t *testing.T) {
+	msg := "To: a@b.c\r\nSubject: a\r\n\r\nbody\r\n"
+
+	var (
+		gotRcpts []string
+		gotBody  string
+		status   = http.StatusOK
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/post/message" {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		b, _ := io.ReadAll(r.Body)
+		gotRcpts, gotBody = r.URL.Query()["rcpt"], string(b)
+
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+
+	if err := postMessage(ctx, srv.URL+"/", []byte(msg), []string{"a@b.c", "x+tag@y.z"}); err != nil {
+		t.Fatalf("postMessage error: %v", err)
+	}
+
+	if strings.Join(gotRcpts, ",") != "a@b.c,x+tag@y.z" || gotBody != msg {
+		t.Errorf("posted %q, %q", gotRcpts, gotBody)
+	}
+
+	// отказ не повторяется (65), ошибка сервера - повторяется (75)
+	status = http.StatusBadRequest
+
+	if err := postMessage(ctx, srv.URL, []byte(msg), []string{"a@b.c"}); !errors.Is(err, errRejected) {
+		t.Errorf("postMessage rejected = %v", err)
+	}
+
+	status = http.StatusServiceUnavailable
+
+	if err := postMessage(ctx, srv.URL, []byte(msg), []string{"a@b.c"}); err == nil || errors.Is(err, errRejected) {
+		t.Errorf("postMessage unavailable = %v", err)
+	}
+}
+
+func Test_GetMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	msg := "Message-ID: <1@example.com>\r\nTo: a@example.com\r\nSubject: a\r\n\r\nbody\r\n"
+
+	post := func(query, body string) int {
+		w := httptest.NewRecorder()
+		getMessage(w, httptest.NewRequest(http.MethodPost, "/post/message?"+query, strings.NewReader(body)).WithContext(ctx))
+
+		return w.Code
+	}
+
+	var err error
+
+	if validator, err = addrcheck.New(); err != nil {
+		t.Fatalf("addrcheck.New error: %v", err)
+	}
+
+	defer func() { validator, httpIn = nil, nil }()
+
+	// без источника http исходное сообщение не принять
+	if code := post("rcpt=a@example.com", msg); code != http.StatusServiceUnavailable {
+		t.Errorf("getMessage without http ingress = %d", code)
+	}
+
+	// очередь: сохраняет письмо и подтверждает
+	ch := make(chan *letter.Letter)
+	saved := make(chan *letter.Letter, 1)
+	httpIn = ingress.NewHTTP(&ch, validator)
+
+	go func() {
+		for {
+			select {
+			case ltr := <-ch:
+				saved <- ltr
+				ltr.Acknowledge(nil)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if code := post("rcpt=a@example.com", "no headers"); code != http.StatusBadRequest {
+		t.Errorf("getMessage broken message = %d", code)
+	}
+
+	if code := post("rcpt=not-an-address", msg); code != http.StatusBadRequest {
+		t.Errorf("getMessage bad address = %d", code)
+	}
+
+	if code := post("", msg); code != http.StatusBadRequest {
+		t.Errorf("getMessage without recipients = %d", code)
+	}
+
+	if code := post("rcpt=a@example.com&rcpt=b@example.com", msg); code != http.StatusOK {
+		t.Fatalf("getMessage = %d", code)
+	}
+
+	ltr := <-saved
+	if strings.Join(ltr.Addresses, ",") != "a@example.com,b@example.com" || ltr.Raw == "" || !strings.HasPrefix(ltr.KafkaKey, "1@example.com:") {
+		t.Errorf("letter %+v", ltr)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"github.com/maris-cyber/mailsender/internal/suppress"
+)
+
+// эндпойнты списка подавления:
+// POST   /suppressions                                  - добавить запись
+// GET    /suppressions/{address}                        - записи для адреса
+// DELETE /suppressions/{address}?scope=tenant&value=... - удалить запись, по умолчанию scope=global
+func suppressionsRouter(r chi.Router) {
+	r.Post("/", addSuppression)
+	r.Get("/{address}", findSuppressions)
+	r.Delete("/{address}", removeSuppression)
+}
+
+func addSuppression(w http.ResponseWriter, r *http.Request) {
+	var e suppress.Entry
+
+	smpl := "{\"Address\":\"suocq@mailto.plus\",\"Scope\":\"global|tenant|category\",\"Value\":\"токен или категория\",\"Reason\":\"manual\"}"
+
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil || e.Address == "" || !e.Valid() {
+		http.Error(w, "Ожидаю запись списка подавления.\nОбразец:"+smpl, http.StatusBadRequest)
+
+		return
+	}
+
+	if e.Reason == "" {
+		e.Reason = suppress.Manual
+	}
+
+	if err := supDB.AddSuppression(&e); err != nil {
+		zap.S().Errorf("AddSuppression error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, &e)
+}
+
+func findSuppressions(w http.ResponseWriter, r *http.Request) {
+	res, err := supDB.FindSuppressions([]string{chi.URLParam(r, "address")})
+	if err != nil {
+		zap.S().Errorf("FindSuppressions error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func removeSuppression(w http.ResponseWriter, r *http.Request) {
+	scope := r.URL.Query().Get("scope")
+	if scope == "" {
+		scope = suppress.Global
+	}
+
+	if err := supDB.RemoveSuppression(chi.URLParam(r, "address"), scope, r.URL.Query().Get("value")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
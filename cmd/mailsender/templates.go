@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"github.com/maris-cyber/mailsender/internal/tmpl"
+)
+
+// эндпойнты реестра шаблонов:
+// GET    /templates                         - все версии всех шаблонов
+// POST   /templates                         - новая версия-черновик
+// GET    /templates/{id}                    - все версии шаблона
+// GET    /templates/{id}/{version}          - версия шаблона, 0 - последняя опубликованная
+// PUT    /templates/{id}/{version}          - изменить черновик
+// DELETE /templates/{id}/{version}          - удалить черновик
+// POST   /templates/{id}/{version}/publish  - опубликовать черновик
+// POST   /templates/{id}/{version}/preview  - итоговое MIME сообщение с тестовыми данными
+func templatesRouter(r chi.Router) {
+	r.Get("/", listTemplates)
+	r.Post("/", createTemplate)
+	r.Get("/{id}", listTemplates)
+	r.Get("/{id}/{version}", getTemplate)
+	r.Put("/{id}/{version}", updateTemplate)
+	r.Delete("/{id}/{version}", deleteTemplate)
+	r.Post("/{id}/{version}/publish", publishTemplate)
+	r.Post("/{id}/{version}/preview", previewTemplate)
+}
+
+// тестовые данные для предпросмотра
+type previewSample struct {
+	Vars      map[string]string
+	Locale    string
+	Recipient *letter.Recipient
+}
+
+func listTemplates(w http.ResponseWriter, r *http.Request) {
+	res, err := tplReg.ListTemplates(chi.URLParam(r, "id"))
+	if err != nil {
+		templateError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func createTemplate(w http.ResponseWriter, r *http.Request) {
+	var t tmpl.Template
+
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Ожидаю шаблон: {\"ID\":\"welcome\",\"Subject\":\"...\",\"HTML\":\"...\",\"Text\":\"...\"}\n"+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if err := tplReg.CreateTemplate(&t); err != nil {
+		templateError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, &t)
+}
+
+func getTemplate(w http.ResponseWriter, r *http.Request) {
+	id, version, ok := templateParams(w, r)
+	if !ok {
+		return
+	}
+
+	t, err := tplReg.GetTemplate(id, version)
+	if err != nil {
+		templateError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t)
+}
+
+func updateTemplate(w http.ResponseWriter, r *http.Request) {
+	var t tmpl.Template
+
+	id, version, ok := templateParams(w, r)
+	if !ok {
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	t.ID, t.Version = id, version
+
+	if err := tplReg.UpdateTemplate(&t); err != nil {
+		templateError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &t)
+}
+
+func deleteTemplate(w http.ResponseWriter, r *http.Request) {
+	id, version, ok := templateParams(w, r)
+	if !ok {
+		return
+	}
+
+	if err := tplReg.DeleteTemplate(id, version); err != nil {
+		templateError(w, err)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func publishTemplate(w http.ResponseWriter, r *http.Request) {
+	id, version, ok := templateParams(w, r)
+	if !ok {
+		return
+	}
+
+	if err := tplReg.PublishTemplate(id, version); err != nil {
+		templateError(w, err)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func previewTemplate(w http.ResponseWriter, r *http.Request) {
+	var smpl previewSample
+
+	id, version, ok := templateParams(w, r)
+	if !ok {
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&smpl); err != nil {
+		http.Error(w, "Ожидаю тестовые данные: {\"Vars\":{...},\"Recipient\":{\"Address\":\"...\",\"Name\":\"...\"}}\n"+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	t, err := tplReg.GetTemplate(id, version)
+	if err != nil {
+		templateError(w, err)
+
+		return
+	}
+
+	msg, err := mH.Preview(t, &letter.Letter{Vars: smpl.Vars, Locale: smpl.Locale}, smpl.Recipient)
+	if err != nil {
+		// ошибки рендеринга - ошибки шаблона или тестовых данных
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Write([]byte(msg))
+}
+
+func templateParams(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	version, err := strconv.Atoi(chi.URLParam(r, "version"))
+	if err != nil || version < 0 {
+		http.Error(w, "version must be a number", http.StatusBadRequest)
+
+		return "", 0, false
+	}
+
+	return chi.URLParam(r, "id"), version, true
+}
+
+func templateError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, tmpl.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, tmpl.ErrNotDraft):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, tmpl.ErrInvalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		zap.S().Errorf("templates error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zap.S().Errorf("json.Encode error: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"github.com/maris-cyber/mailsender/internal/event"
+)
+
+// хранилище событий по письмам
+type eventStore interface {
+	CreateEvent(*event.Event) error
+}
+
+// прозрачный gif 1x1
+var pixel = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// эндпойнты отслеживания, пути совпадают с track.OpenPath и track.ClickPath:
+// GET /t/o/{token} - открытие письма, отдаёт пиксель
+// GET /t/c/{token} - переход по ссылке, редирект на исходную ссылку
+func trackRouter(r chi.Router) {
+	r.Get("/o/{token}", trackOpen)
+	r.Get("/c/{token}", trackClick)
+}
+
+func trackOpen(w http.ResponseWriter, r *http.Request) {
+	// пиксель отдаётся всегда, чтобы письмо выглядело одинаково
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	w.Write(pixel)
+
+	c, err := tracker.Verify(chi.URLParam(r, "token"))
+	if err != nil {
+		zap.S().Debugf("trackOpen: %v", err)
+
+		return
+	}
+
+	e := event.New(event.Open, c.LetterID, c.Address)
+	e.UserAgent = r.UserAgent()
+
+	recordEvent(r.Context(), e)
+}
+
+func trackClick(w http.ResponseWriter, r *http.Request) {
+	c, err := tracker.Verify(chi.URLParam(r, "token"))
+	if err != nil || c.URL == "" {
+		// без подписи не редиректим, иначе получится открытый редирект
+		http.NotFound(w, r)
+
+		return
+	}
+
+	e := event.New(event.Click, c.LetterID, c.Address)
+	e.URL = c.URL
+	e.UserAgent = r.UserAgent()
+
+	recordEvent(r.Context(), e)
+
+	http.Redirect(w, r, c.URL, http.StatusFound)
+}
+
+// сохранить событие в базе и отправить в kafka
+func recordEvent(ctx context.Context, e *event.Event) {
+	if err := evtDB.CreateEvent(e); err != nil {
+		zap.S().Errorf("CreateEvent error: %v", err)
+	}
+
+	if err := kH.WriteEvent(ctx, e); err != nil {
+		zap.S().Errorf("kH.WriteEvent error: %v", err)
+	}
+}
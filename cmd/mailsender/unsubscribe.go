@@ -0,0 +1,84 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"github.com/maris-cyber/mailsender/internal/event"
+	"github.com/maris-cyber/mailsender/internal/suppress"
+)
+
+// страница подтверждения для перехода по ссылке из письма
+// GET ничего не меняет: ссылки в письмах открывают антивирусы и превью
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Отписка</title></head>
+<body>{{if .Done}}<p>Адрес {{.Address}} отписан от рассылки.</p>{{else}}
+<form method="post"><input type="hidden" name="List-Unsubscribe" value="One-Click">
+<p>Отписать {{.Address}} от рассылки?</p><button type="submit">Отписаться</button></form>{{end}}
+</body></html>
+`))
+
+// эндпойнты отписки, путь совпадает с track.UnsubscribePath:
+// GET  /unsubscribe/{token} - страница подтверждения
+// POST /unsubscribe/{token} - отписка в один клик (RFC 8058)
+func unsubscribeRouter(r chi.Router) {
+	r.Get("/{token}", unsubscribeForm)
+	r.Post("/{token}", unsubscribe)
+}
+
+func unsubscribeForm(w http.ResponseWriter, r *http.Request) {
+	c, err := tracker.Verify(chi.URLParam(r, "token"))
+	if err != nil || c.Address == "" {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err = unsubscribePage.Execute(w, map[string]interface{}{"Address": c.Address, "Done": false}); err != nil {
+		zap.S().Errorf("unsubscribePage error: %v", err)
+	}
+}
+
+func unsubscribe(w http.ResponseWriter, r *http.Request) {
+	c, err := tracker.Verify(chi.URLParam(r, "token"))
+	if err != nil || c.Address == "" {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	// отписка от категории, если её нет - от рассылок арендатора, если нет и его - от всех писем
+	e := suppress.Entry{Address: c.Address, Scope: suppress.Global, Reason: suppress.Unsubscribe}
+
+	switch {
+	case c.Category != "":
+		e.Scope, e.Value = suppress.Category, c.Category
+	case c.Tenant != "":
+		e.Scope, e.Value = suppress.Tenant, c.Tenant
+	}
+
+	if err = supDB.AddSuppression(&e); err != nil {
+		zap.S().Errorf("unsubscribe AddSuppression error: %v", err)
+		http.Error(w, "Не удалось отписаться, попробуйте позже", http.StatusInternalServerError)
+
+		return
+	}
+
+	evt := event.New(event.Unsubscribe, c.LetterID, c.Address)
+	evt.Category = c.Category
+	evt.Tenant = c.Tenant
+	evt.UserAgent = r.UserAgent()
+
+	recordEvent(r.Context(), evt)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err = unsubscribePage.Execute(w, map[string]interface{}{"Address": c.Address, "Done": true}); err != nil {
+		zap.S().Errorf("unsubscribePage error: %v", err)
+	}
+}
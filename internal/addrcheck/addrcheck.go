@@ -0,0 +1,454 @@
+/*
+addrcheck - пакет, проверяющий адреса получателей при поступлении писем,
+чтобы неправильные адреса не доходили до smtp и не тратили тикеты limiter'а:
+  - синтаксис адреса по RFC 5321 и ограничения длины;
+  - интернациональные домены (IDN) приводятся к punycode;
+  - при включённой проверке DNS у домена должна быть MX или A/AAAA запись;
+  - домены одноразовой почты из списка отклоняются.
+
+Синтаксис проверяется всегда, остальные проверки включаются переменными окружения.
+*/
+package addrcheck
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"go.uber.org/zap"
+	"golang.org/x/net/idna"
+)
+
+const (
+	ADDR_CHECK_DNS       = "ADDR_CHECK_DNS"       // проверять MX/A записи домена
+	ADDR_DNS_TIMEOUT     = "ADDR_DNS_TIMEOUT"     // таймаут запроса DNS, по умолчанию 5s
+	ADDR_DISPOSABLE_FILE = "ADDR_DISPOSABLE_FILE" // файл с доменами одноразовой почты, по домену в строке
+)
+
+// ограничения длины по RFC 5321 4.5.3.1
+const (
+	maxLocal   = 64
+	maxDomain  = 255
+	maxLabel   = 63
+	maxAddress = 254 // путь 256 октетов вместе с угловыми скобками
+)
+
+const defaultTimeout = 5 * time.Second
+
+// Resolver - поиск записей DNS, net.DefaultResolver подходит, в тестах подменяется
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type Validator struct {
+	resolver   Resolver // nil - DNS не проверяется
+	timeout    time.Duration
+	disposable map[string]bool
+}
+
+// конструктор, синтаксис проверяется всегда, поэтому возвращает валидатор и без настроек
+func New() (*Validator, error) {
+	v := Validator{timeout: defaultTimeout}
+
+	if err := v.GetConfig(); err != nil {
+		return nil, err
+	}
+
+	zap.S().Debugf("addrcheck config: dns %v disposable %d", v.resolver != nil, len(v.disposable))
+
+	return &v, nil
+}
+
+func (v *Validator) GetConfig() error {
+	if s, ok := os.LookupEnv(ADDR_CHECK_DNS); ok {
+		dns, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", ADDR_CHECK_DNS, err)
+		}
+
+		if dns {
+			v.resolver = net.DefaultResolver
+		}
+	}
+
+	if s, ok := os.LookupEnv(ADDR_DNS_TIMEOUT); ok && s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("bad %s %q", ADDR_DNS_TIMEOUT, s)
+		}
+
+		v.timeout = d
+	}
+
+	if s, ok := os.LookupEnv(ADDR_DISPOSABLE_FILE); ok && s != "" {
+		if err := v.LoadDisposable(s); err != nil {
+			return fmt.Errorf("%s: %v", ADDR_DISPOSABLE_FILE, err)
+		}
+	}
+
+	return nil
+}
+
+// SetResolver подключает проверку DNS через свой resolver, nil - выключает
+func (v *Validator) SetResolver(r Resolver) {
+	v.resolver = r
+}
+
+// LoadDisposable загружает список доменов одноразовой почты, пустые строки и # комментарии пропускаются
+func (v *Validator) LoadDisposable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	list := make(map[string]bool)
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+
+		d, err := idna.Lookup.ToASCII(strings.ToLower(s))
+		if err != nil {
+			return fmt.Errorf("bad domain %q: %v", s, err)
+		}
+
+		list[d] = true
+	}
+
+	if err = sc.Err(); err != nil {
+		return err
+	}
+
+	v.disposable = list
+
+	return nil
+}
+
+// Syntax проверяет синтаксис адреса и возвращает его в виде для smtp:
+// домен в нижнем регистре и в punycode, локальная часть без изменений
+func Syntax(address string) (string, error) {
+	if address == "" {
+		return "", fmt.Errorf("empty address")
+	}
+
+	i := strings.LastIndexByte(address, '@')
+	if i < 0 {
+		return "", fmt.Errorf("no @ in address")
+	}
+
+	local, domain := address[:i], address[i+1:]
+
+	if err := checkLocal(local); err != nil {
+		return "", err
+	}
+
+	domain, err := checkDomain(domain)
+	if err != nil {
+		return "", err
+	}
+
+	res := local + "@" + domain
+	if len(res) > maxAddress {
+		return "", fmt.Errorf("address longer than %d", maxAddress)
+	}
+
+	return res, nil
+}
+
+// локальная часть: dot-atom или quoted-string
+func checkLocal(local string) error {
+	if local == "" {
+		return fmt.Errorf("empty local part")
+	}
+
+	if len(local) > maxLocal {
+		return fmt.Errorf("local part longer than %d", maxLocal)
+	}
+
+	if local[0] == '"' {
+		return checkQuoted(local)
+	}
+
+	if local[0] == '.' || local[len(local)-1] == '.' || strings.Contains(local, "..") {
+		return fmt.Errorf("misplaced dot in local part")
+	}
+
+	for i := 0; i < len(local); i++ {
+		if c := local[i]; c != '.' && !isAtext(c) {
+			return fmt.Errorf("bad character %q in local part", c)
+		}
+	}
+
+	return nil
+}
+
+func checkQuoted(local string) error {
+	if len(local) < 2 || local[len(local)-1] != '"' {
+		return fmt.Errorf("unterminated quoted local part")
+	}
+
+	s := local[1 : len(local)-1]
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case c == '\\':
+			// quoted-pair: обратная косая и печатный символ или пробел
+			i++
+			if i == len(s) || s[i] < ' ' || s[i] > '~' {
+				return fmt.Errorf("bad quoted pair in local part")
+			}
+		case c == '"' || c < ' ' || c > '~':
+			return fmt.Errorf("bad character %q in quoted local part", c)
+		}
+	}
+
+	return nil
+}
+
+// atext из RFC 5322, символы не ASCII (SMTPUTF8) не поддерживаются
+func isAtext(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+
+	return strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+}
+
+// домен: имя из меток LDH, IDN переводится в punycode, адресные литералы не принимаются
+func checkDomain(domain string) (string, error) {
+	if domain == "" {
+		return "", fmt.Errorf("empty domain")
+	}
+
+	if domain[0] == '[' {
+		return "", fmt.Errorf("address literals not allowed")
+	}
+
+	d, err := idna.Lookup.ToASCII(strings.ToLower(domain))
+	if err != nil {
+		return "", fmt.Errorf("bad domain: %v", err)
+	}
+
+	if len(d) > maxDomain {
+		return "", fmt.Errorf("domain longer than %d", maxDomain)
+	}
+
+	labels := strings.Split(d, ".")
+	if len(labels) < 2 {
+		return "", fmt.Errorf("domain without dot")
+	}
+
+	for _, l := range labels {
+		if err = checkLabel(l); err != nil {
+			return "", err
+		}
+	}
+
+	// домен верхнего уровня не бывает числовым, иначе это IP адрес
+	if _, err = strconv.Atoi(labels[len(labels)-1]); err == nil {
+		return "", fmt.Errorf("numeric top level domain")
+	}
+
+	return d, nil
+}
+
+func checkLabel(l string) error {
+	if l == "" {
+		return fmt.Errorf("empty domain label")
+	}
+
+	if len(l) > maxLabel {
+		return fmt.Errorf("domain label longer than %d", maxLabel)
+	}
+
+	if l[0] == '-' || l[len(l)-1] == '-' {
+		return fmt.Errorf("domain label starts or ends with hyphen")
+	}
+
+	for i := 0; i < len(l); i++ {
+		c := l[i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-') {
+			return fmt.Errorf("bad character %q in domain", c)
+		}
+	}
+
+	return nil
+}
+
+// Check - полная проверка адреса: синтаксис, одноразовые домены, DNS
+// возвращает адрес в виде для smtp
+func (v *Validator) Check(ctx context.Context, address string) (string, error) {
+	return v.check(ctx, address, nil)
+}
+
+// check с кешем результатов проверки доменов, письмо часто идёт на один домен
+func (v *Validator) check(ctx context.Context, address string, cache map[string]error) (string, error) {
+	a, err := Syntax(address)
+	if err != nil {
+		return "", err
+	}
+
+	domain := a[strings.LastIndexByte(a, '@')+1:]
+
+	if v.isDisposable(domain) {
+		return "", fmt.Errorf("disposable domain %s", domain)
+	}
+
+	if v.resolver == nil {
+		return a, nil
+	}
+
+	err, ok := cache[domain]
+	if !ok {
+		err = v.lookup(ctx, domain)
+
+		if cache != nil {
+			cache[domain] = err
+		}
+	}
+
+	return a, err
+}
+
+// домен или его родитель в списке одноразовой почты
+func (v *Validator) isDisposable(domain string) bool {
+	for d := domain; d != ""; {
+		if v.disposable[d] {
+			return true
+		}
+
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+
+		d = d[i+1:]
+	}
+
+	return false
+}
+
+// lookup ищет MX, а если их нет - A/AAAA (RFC 5321 5.1)
+// временные ошибки DNS адрес не отклоняют, чтобы не терять письма из-за сбоя resolver'а
+func (v *Validator) lookup(ctx context.Context, domain string) error {
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+
+	mx, err := v.resolver.LookupMX(ctx, domain)
+	if err == nil && len(mx) > 0 {
+		// null MX (RFC 7505) - домен не принимает почту
+		if len(mx) == 1 && (mx[0].Host == "." || mx[0].Host == "") {
+			return fmt.Errorf("domain %s does not accept mail", domain)
+		}
+
+		return nil
+	}
+
+	if err != nil && !notFound(err) {
+		zap.S().Debugf("addrcheck LookupMX %s: %v", domain, err)
+
+		return nil
+	}
+
+	hosts, err := v.resolver.LookupHost(ctx, domain)
+	if err == nil && len(hosts) > 0 {
+		return nil
+	}
+
+	if err != nil && !notFound(err) {
+		zap.S().Debugf("addrcheck LookupHost %s: %v", domain, err)
+
+		return nil
+	}
+
+	return fmt.Errorf("domain %s has no MX or A records", domain)
+}
+
+func notFound(err error) bool {
+	e, ok := err.(*net.DNSError)
+
+	return ok && e.IsNotFound
+}
+
+// Filter проверяет адресатов письма и приводит их адреса к виду для smtp
+// неправильные адреса попадают в Invalid: в режиме personalize адресат получает статус invalid,
+// иначе адрес убирается из Addresses
+// если правильных адресов нет, письмо получает статус failed
+func (v *Validator) Filter(ctx context.Context, ltr *letter.Letter) {
+	cache := make(map[string]error)
+
+	var reasons []string
+
+	invalid := func(address string, err error) {
+		ltr.Invalid = append(ltr.Invalid, address)
+		reasons = append(reasons, address+": "+err.Error())
+
+		zap.S().Debugf("addrcheck %q: %v", address, err)
+	}
+
+	valid := 0
+
+	if len(ltr.Recipients) > 0 {
+		for i := range ltr.Recipients {
+			r := &ltr.Recipients[i]
+
+			a, err := v.check(ctx, r.Address, cache)
+			if err != nil {
+				r.Status = "invalid"
+				invalid(r.Address, err)
+
+				continue
+			}
+
+			r.Address = a
+			valid++
+		}
+
+		// неперсональное письмо уходит по Addresses, неправильных адресов там быть не должно
+		ltr.Addresses = ltr.Addresses[:0:0]
+		for i := range ltr.Recipients {
+			if ltr.Recipients[i].Status != "invalid" {
+				ltr.Addresses = append(ltr.Addresses, ltr.Recipients[i].Address)
+			}
+		}
+	} else {
+		keep := ltr.Addresses[:0:0]
+
+		for _, address := range ltr.Addresses {
+			a, err := v.check(ctx, address, cache)
+			if err != nil {
+				invalid(address, err)
+
+				continue
+			}
+
+			keep = append(keep, a)
+		}
+
+		ltr.Addresses = keep
+		valid = len(keep)
+	}
+
+	if valid == 0 {
+		ltr.Status = "failed"
+		ltr.Error = "no valid recipients"
+
+		if len(reasons) > 0 {
+			ltr.Error += ": " + strings.Join(reasons, "; ")
+		}
+	}
+}
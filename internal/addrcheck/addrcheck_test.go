@@ -0,0 +1,218 @@
+package addrcheck
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"go.uber.org/zap"
+)
+
+// resolver для тестов: записи по доменам, lookups - сколько было запросов
+type fakeResolver struct {
+	mx      map[string][]*net.MX
+	hosts   map[string][]string
+	fail    map[string]bool // временная ошибка DNS
+	lookups int
+}
+
+func (fr *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	fr.lookups++
+
+	if fr.fail[name] {
+		return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+	}
+
+	if mx, ok := fr.mx[name]; ok {
+		return mx, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (fr *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if h, ok := fr.hosts[host]; ok {
+		return h, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestMain(m *testing.M) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+
+	os.Exit(m.Run())
+}
+
+func Test_Syntax(t *testing.T) {
+	long := strings.Repeat("a", 63)
+
+	tests := []struct {
+		in, want string
+	}{
+		{"suocq@mailto.plus", "suocq@mailto.plus"},
+		{"Suocq@MailTo.Plus", "Suocq@mailto.plus"},
+		{"first.last+tag@sub.mailto.plus", "first.last+tag@sub.mailto.plus"},
+		{"o'brien!#$%&*/=?^_`{|}~-@mailto.plus", "o'brien!#$%&*/=?^_`{|}~-@mailto.plus"},
+		{`"john doe"@mailto.plus`, `"john doe"@mailto.plus`},
+		{`"a\"b"@mailto.plus`, `"a\"b"@mailto.plus`},
+		{"ivan@почта.рф", "ivan@xn--80a1acny.xn--p1ai"},
+		{"ivan@xn--80a1acny.xn--p1ai", "ivan@xn--80a1acny.xn--p1ai"},
+		{long + "x@mailto.plus", long + "x@mailto.plus"},
+		{long + "xy@mailto.plus", ""},
+		{long + "@" + long + "." + long + "." + long + "." + long + ".plus", ""},
+		{"a@" + long + "b.plus", ""},
+		{"", ""},
+		{"suocq", ""},
+		{"@mailto.plus", ""},
+		{"suocq@", ""},
+		{".suocq@mailto.plus", ""},
+		{"suocq.@mailto.plus", ""},
+		{"su..ocq@mailto.plus", ""},
+		{"su ocq@mailto.plus", ""},
+		{"Suocq <suocq@mailto.plus>", ""},
+		{"suocq@mailto", ""},
+		{"suocq@mailto..plus", ""},
+		{"suocq@-mailto.plus", ""},
+		{"suocq@mail_to.plus", ""},
+		{"suocq@[10.0.0.1]", ""},
+		{"suocq@10.0.0.1", ""},
+		{"иван@mailto.plus", ""},
+		{`"unterminated@mailto.plus`, ""},
+	}
+
+	for _, tt := range tests {
+		got, err := Syntax(tt.in)
+		if tt.want == "" && err == nil {
+			t.Errorf("Syntax(%q) = %q, want error", tt.in, got)
+		}
+
+		if tt.want != "" && (err != nil || got != tt.want) {
+			t.Errorf("Syntax(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func Test_Check(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "disposable.txt")
+
+	if err := os.WriteFile(list, []byte("# одноразовая почта\nmailinator.com\n\nTempMail.example\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile error: %v", err)
+	}
+
+	t.Setenv(ADDR_DISPOSABLE_FILE, list)
+
+	v, err := New()
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	fr := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"mailto.plus":           {{Host: "mx.mailto.plus.", Pref: 10}},
+			"nullmx.example":        {{Host: ".", Pref: 0}},
+			"mailinator.com":        {{Host: "mx.mailinator.com.", Pref: 10}},
+			"xn--80a1acny.xn--p1ai": {{Host: "mx.xn--80a1acny.xn--p1ai.", Pref: 10}},
+		},
+		hosts: map[string][]string{"a-only.example": {"10.0.0.1"}},
+		fail:  map[string]bool{"flaky.example": true},
+	}
+
+	// без resolver'а DNS не проверяется
+	if _, err = v.Check(context.Background(), "a@nowhere.example"); err != nil {
+		t.Errorf("Check without resolver: %v", err)
+	}
+
+	v.SetResolver(fr)
+
+	ctx := context.Background()
+
+	for _, a := range []string{"a@mailto.plus", "a@a-only.example", "a@flaky.example", "a@почта.рф"} {
+		if _, err = v.Check(ctx, a); err != nil {
+			t.Errorf("Check(%q): %v", a, err)
+		}
+	}
+
+	for _, a := range []string{"a@nowhere.example", "a@nullmx.example", "a@mailinator.com", "a@eu.mailinator.com", "a@tempmail.example", "a@@mailto.plus"} {
+		if _, err = v.Check(ctx, a); err == nil {
+			t.Errorf("Check(%q): want error", a)
+		}
+	}
+}
+
+func Test_Filter(t *testing.T) {
+	v, _ := New()
+	fr := &fakeResolver{mx: map[string][]*net.MX{"mailto.plus": {{Host: "mx.mailto.plus.", Pref: 10}}}}
+	v.SetResolver(fr)
+
+	ltr := letter.Letter{
+		Addresses: []string{"tcuboa@mailto.plus", "not an address", "suocq@MAILTO.plus", "a@nowhere.example"},
+		Status:    "awaiting",
+	}
+
+	v.Filter(context.Background(), &ltr)
+
+	if strings.Join(ltr.Addresses, ",") != "tcuboa@mailto.plus,suocq@mailto.plus" {
+		t.Errorf("Filter bulk addresses %v", ltr.Addresses)
+	}
+
+	if strings.Join(ltr.Invalid, ",") != "not an address,a@nowhere.example" || ltr.Status != "awaiting" {
+		t.Errorf("Filter bulk invalid %v status %s", ltr.Invalid, ltr.Status)
+	}
+
+	// один домен проверяется один раз на письмо
+	if fr.lookups != 2 {
+		t.Errorf("Filter DNS lookups %d, want 2", fr.lookups)
+	}
+
+	ltr = letter.Letter{
+		Addresses:   []string{"tcuboa@mailto.plus", "tcuboa@mailto"},
+		Status:      "awaiting",
+		Personalize: true,
+	}
+	ltr.Expand()
+
+	v.Filter(context.Background(), &ltr)
+
+	if ltr.Recipients[0].Status != "" || ltr.Recipients[1].Status != "invalid" || len(ltr.Invalid) != 1 {
+		t.Errorf("Filter personal recipients %+v invalid %v", ltr.Recipients, ltr.Invalid)
+	}
+
+	if strings.Join(ltr.Addresses, ",") != "tcuboa@mailto.plus" {
+		t.Errorf("Filter personal addresses %v", ltr.Addresses)
+	}
+
+	ltr.Recipients[0].Status = "sent"
+	ltr.SetStatusFromRecipients()
+
+	if ltr.Status != "partial" {
+		t.Errorf("Filter personal status %s, want partial", ltr.Status)
+	}
+
+	// адресаты со своими переменными без personalize: письмо одно, уходит по Addresses
+	ltr = letter.Letter{
+		Recipients: []letter.Recipient{{Address: "tcuboa@mailto"}, {Address: "Suocq@MAILTO.plus"}},
+		Status:     "awaiting",
+	}
+
+	v.Filter(context.Background(), &ltr)
+
+	if strings.Join(ltr.Addresses, ",") != "Suocq@mailto.plus" || ltr.Recipients[0].Status != "invalid" || ltr.Status != "awaiting" {
+		t.Errorf("Filter recipients addresses %v recipients %+v status %s", ltr.Addresses, ltr.Recipients, ltr.Status)
+	}
+
+	ltr = letter.Letter{Addresses: []string{"tcuboa@", "@mailto.plus"}, Status: "awaiting"}
+
+	v.Filter(context.Background(), &ltr)
+
+	if ltr.Status != "failed" || len(ltr.Addresses) != 0 || !strings.HasPrefix(ltr.Error, "no valid recipients: tcuboa@: ") {
+		t.Errorf("Filter all invalid: status %s addresses %v error %q", ltr.Status, ltr.Addresses, ltr.Error)
+	}
+}
@@ -0,0 +1,107 @@
+package bounce
+
+import (
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+)
+
+// ARF - жалоба получателя (Abuse Reporting Format, RFC 5965),
+// которую почтовый провайдер присылает по feedback loop
+type ARF struct {
+	FeedbackType string // abuse / fraud / virus / other / not-spam
+	UserAgent    string // кто сформировал отчёт
+	MailFrom     string // Original-Mail-From - отправитель конверта исходного письма, VERP
+	RcptTo       string // Original-Rcpt-To - получатель, провайдер может его скрыть
+	MessageID    string // Message-ID исходного письма
+	ReturnPath   string // Return-Path исходного письма
+	To           string // To исходного письма, если адресат один
+}
+
+// ParseARF разбирает письмо multipart/report; report-type=feedback-report
+func ParseARF(r io.Reader) (*ARF, error) {
+	rep, err := readReport(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return rep.arf()
+}
+
+func (rep *report) arf() (*ARF, error) {
+	if rep.typ != feedbackReport {
+		return nil, fmt.Errorf("not a feedback report: %s", rep.typ)
+	}
+
+	var (
+		a     ARF
+		found bool
+	)
+
+	err := walkParts(rep.msg.Body, rep.boundary, func(mt string, body io.Reader) error {
+		switch mt {
+		case "message/feedback-report":
+			found = true
+
+			return a.parseFields(body)
+		case "message/rfc822", "text/rfc822-headers", "message/rfc822-headers":
+			a.parseOriginal(body)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, fmt.Errorf("no feedback report part")
+	}
+
+	return &a, nil
+}
+
+func (a *ARF) parseFields(r io.Reader) error {
+	blocks, err := readFields(r)
+	if err != nil {
+		return err
+	}
+
+	if len(blocks) == 0 {
+		return fmt.Errorf("empty feedback report")
+	}
+
+	h := blocks[0]
+	a.FeedbackType = strings.ToLower(strings.TrimSpace(h.Get("Feedback-Type")))
+	a.UserAgent = strings.TrimSpace(h.Get("User-Agent"))
+	a.MailFrom = value(h.Get("Original-Mail-From"))
+	a.RcptTo = value(h.Get("Original-Rcpt-To"))
+
+	return nil
+}
+
+// parseOriginal - заголовки исходного письма, тело не нужно
+func (a *ARF) parseOriginal(r io.Reader) {
+	blocks, _ := readFields(r)
+	if len(blocks) == 0 {
+		return
+	}
+
+	h := blocks[0]
+	a.MessageID = strings.TrimSpace(h.Get("Message-Id"))
+	a.ReturnPath = value(h.Get("Return-Path"))
+
+	if list, err := mail.ParseAddressList(h.Get("To")); err == nil && len(list) == 1 {
+		a.To = list[0].Address
+	}
+}
+
+// Address - адрес пожаловавшегося получателя, если он известен
+func (a *ARF) Address() string {
+	if a.RcptTo != "" {
+		return a.RcptTo
+	}
+
+	return a.To
+}
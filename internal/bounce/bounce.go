@@ -0,0 +1,233 @@
+/*
+bounce - пакет, обрабатывающий отказы доставки и жалобы получателей.
+Письма уходят с адресом отправителя конверта VERP, поэтому уведомление
+о недоставке (DSN, RFC 3464) возвращается на адрес, по которому понятно, к какому
+письму и адресату оно относится. Та же метка стоит в Message-ID, по нему
+находится письмо из жалобы (ARF, RFC 5965), которую присылает почтовый провайдер.
+Уведомления и жалобы забираются из maildir, куда их складывает почтовый сервер домена отказов.
+Постоянный отказ меняет статус адресата на bounced, жалоба - на complained,
+в обоих случаях адрес добавляется в список подавления.
+*/
+package bounce
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/event"
+	"github.com/maris-cyber/mailsender/internal/suppress"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+const (
+	BOUNCE_ADDRESS = "BOUNCE_ADDRESS" // адрес для отказов, например bounces@bounces.example.com
+	BOUNCE_SECRET  = "BOUNCE_SECRET"  // ключ подписи VERP
+	BOUNCE_MAILDIR = "BOUNCE_MAILDIR" // maildir, куда почтовый сервер складывает отказы и жалобы
+	BOUNCE_PERIOD  = "BOUNCE_PERIOD"  // период просмотра maildir, по умолчанию 30s
+)
+
+const defaultPeriod = 30 * time.Second
+
+// Store - хранилище писем, в котором отмечаются отказы и жалобы
+// адресат определяется по адресу, а если он пустой - по номеру idx; возвращается адрес адресата
+type Store interface {
+	AddBounce(id primitive.ObjectID, idx int, address string) (string, error)
+	AddComplaint(id primitive.ObjectID, idx int, address string) (string, error)
+}
+
+// Notify - куда отправить событие об отказе или жалобе (база событий, kafka)
+type Notify func(context.Context, *event.Event)
+
+type Processor struct {
+	verp   *VERP
+	db     Store
+	sup    suppress.Store
+	notify Notify
+}
+
+// NewVERPFromEnv возвращает nil, если адрес для отказов не задан
+func NewVERPFromEnv() (*VERP, error) {
+	address, ok := os.LookupEnv(BOUNCE_ADDRESS)
+	if !ok || address == "" {
+		return nil, nil
+	}
+
+	secret, ok := os.LookupEnv(BOUNCE_SECRET)
+	if !ok || secret == "" {
+		return nil, fmt.Errorf("%s not defined", BOUNCE_SECRET)
+	}
+
+	return NewVERP(address, []byte(secret))
+}
+
+func NewProcessor(v *VERP, db Store, sup suppress.Store, notify Notify) *Processor {
+	return &Processor{verp: v, db: db, sup: sup, notify: notify}
+}
+
+// Process обрабатывает одно письмо из ящика отказов: уведомление о доставке или жалобу
+func (p *Processor) Process(ctx context.Context, r io.Reader) error {
+	rep, err := readReport(r)
+	if err != nil {
+		return err
+	}
+
+	switch rep.typ {
+	case deliveryStatus:
+		d, err := rep.dsn()
+		if err != nil {
+			return err
+		}
+
+		return p.bounce(ctx, d)
+	case feedbackReport:
+		a, err := rep.arf()
+		if err != nil {
+			return err
+		}
+
+		return p.complaint(ctx, a)
+	}
+
+	return fmt.Errorf("unknown report type %q", rep.typ)
+}
+
+func (p *Processor) bounce(ctx context.Context, d *DSN) error {
+	id, idx, err := p.letter(d.To, nil)
+	if err != nil {
+		return err
+	}
+
+	for i := range d.Recipients {
+		p.status(ctx, id, idx, &d.Recipients[i])
+	}
+
+	return nil
+}
+
+func (p *Processor) status(ctx context.Context, id primitive.ObjectID, idx int, s *Status) {
+	address := suppress.Normalize(s.Address)
+
+	var typ string
+
+	switch {
+	case s.Hard():
+		typ = event.Bounce
+
+		a, err := p.db.AddBounce(id, idx, address)
+		if err != nil {
+			zap.S().Errorf("AddBounce error: %v", err)
+		} else {
+			address = suppress.Normalize(a)
+		}
+
+		p.suppress(address, suppress.Bounce)
+	case s.Soft():
+		typ = event.Delay
+	default:
+		// delivered / relayed / expanded - не отказ
+		return
+	}
+
+	zap.S().Debugf("bounce %s letter %v address %s status %s", typ, id, address, s.Status)
+
+	if p.notify == nil {
+		return
+	}
+
+	e := event.New(typ, id.Hex(), address)
+	e.Status = s.Status
+	e.Diagnostic = s.Diagnostic
+
+	p.notify(ctx, e)
+}
+
+func (p *Processor) complaint(ctx context.Context, a *ARF) error {
+	// not-spam - получатель наоборот вынул письмо из спама
+	if a.FeedbackType == "not-spam" {
+		zap.S().Debugf("feedback not-spam for %s", a.MessageID)
+
+		return nil
+	}
+
+	id, idx, err := p.letter([]string{a.MailFrom, a.ReturnPath}, []string{a.MessageID})
+	if err != nil {
+		return err
+	}
+
+	address, err := p.db.AddComplaint(id, idx, suppress.Normalize(a.Address()))
+	if err != nil {
+		return fmt.Errorf("AddComplaint error: %v", err)
+	}
+
+	address = suppress.Normalize(address)
+	p.suppress(address, suppress.Complaint)
+
+	zap.S().Debugf("complaint %s letter %v address %s", a.FeedbackType, id, address)
+
+	if p.notify == nil {
+		return nil
+	}
+
+	e := event.New(event.Complaint, id.Hex(), address)
+	e.Status = a.FeedbackType
+	e.UserAgent = a.UserAgent
+
+	p.notify(ctx, e)
+
+	return nil
+}
+
+// letter находит письмо и номер адресата по Message-ID или по адресу VERP
+func (p *Processor) letter(addresses, messageIDs []string) (primitive.ObjectID, int, error) {
+	var (
+		letterID string
+		idx      int
+		err      error
+	)
+
+	for _, m := range messageIDs {
+		if letterID, idx, err = p.verp.ParseMessageID(m); err == nil {
+			break
+		}
+	}
+
+	if letterID == "" {
+		for _, a := range addresses {
+			if letterID, idx, err = p.verp.Decode(a); err == nil {
+				break
+			}
+		}
+	}
+
+	if letterID == "" {
+		return primitive.NilObjectID, 0, fmt.Errorf("no VERP address in %v %v", messageIDs, addresses)
+	}
+
+	id, err := primitive.ObjectIDFromHex(letterID)
+	if err != nil {
+		return primitive.NilObjectID, 0, fmt.Errorf("bad letter id %q: %v", letterID, err)
+	}
+
+	return id, idx, nil
+}
+
+// suppress добавляет адрес в список подавления для всех писем
+func (p *Processor) suppress(address, reason string) {
+	if address == "" || p.sup == nil {
+		return
+	}
+
+	err := p.sup.AddSuppression(&suppress.Entry{
+		Address: address,
+		Scope:   suppress.Global,
+		Reason:  reason,
+		Created: time.Now(),
+	})
+	if err != nil {
+		zap.S().Errorf("AddSuppression error: %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+package bounce
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maris-cyber/mailsender/internal/db/mem"
+	"github.com/maris-cyber/mailsender/internal/event"
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"github.com/maris-cyber/mailsender/internal/suppress"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// список подавления для тестов
+type fakeStore []suppress.Entry
+
+func (fs *fakeStore) AddSuppression(e *suppress.Entry) error {
+	*fs = append(*fs, *e)
+
+	return nil
+}
+
+func (fs *fakeStore) FindSuppressions(addresses []string) ([]suppress.Entry, error) {
+	return nil, nil
+}
+
+func (fs *fakeStore) RemoveSuppression(address, scope, value string) error {
+	return nil
+}
+
+func TestMain(m *testing.M) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+
+	os.Exit(m.Run())
+}
+
+func newTestVERP(t *testing.T) *VERP {
+	v, err := NewVERP("bounces@bounces.example.com", []byte("секрет"))
+	if err != nil {
+		t.Fatalf("NewVERP error: %v", err)
+	}
+
+	return v
+}
+
+// письмо из testdata с подставленным адресом VERP
+func readDSN(t *testing.T, name, verp string) string {
+	return readTestdata(t, name, "{{verp}}", verp)
+}
+
+// письмо из testdata с подстановками old, new, ...
+func readTestdata(t *testing.T, name string, oldnew ...string) string {
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("can't read %s: %v", name, err)
+	}
+
+	return strings.NewReplacer(oldnew...).Replace(string(b))
+}
+
+func Test_VERP(t *testing.T) {
+	v := newTestVERP(t)
+	id := primitive.NewObjectID().Hex()
+
+	for _, idx := range []int{-1, 0, 12} {
+		a := v.Encode(id, idx)
+
+		if local := a[:strings.IndexByte(a, '@')]; len(local) > 64 {
+			t.Errorf("VERP local part too long: %s", a)
+		}
+
+		gotID, gotIdx, err := v.Decode("<" + strings.ToUpper(a) + ">")
+		if err != nil {
+			t.Fatalf("Decode %s error: %v", a, err)
+		}
+
+		if gotID != id || gotIdx != idx {
+			t.Errorf("Decode %s = %s %d, want %s %d", a, gotID, gotIdx, id, idx)
+		}
+	}
+
+	a := v.Encode(id, 1)
+
+	for _, bad := range []string{
+		strings.Replace(a, "-1-", "-2-", 1),
+		strings.Replace(a, "example.com", "example.org", 1),
+		"bounces@bounces.example.com",
+		"someone+" + id + "-1-00000000@bounces.example.com",
+	} {
+		if _, _, err := v.Decode(bad); err == nil {
+			t.Errorf("Decode %s: want error", bad)
+		}
+	}
+}
+
+func Test_ParseDSN(t *testing.T) {
+	d, err := ParseDSN(strings.NewReader(readDSN(t, "hard.eml", "bounces+x@bounces.example.com")))
+	if err != nil {
+		t.Fatalf("ParseDSN error: %v", err)
+	}
+
+	if d.Reporting != "mx.mailto.plus" || len(d.To) == 0 || d.To[0] != "bounces+x@bounces.example.com" {
+		t.Errorf("ParseDSN message fields: %+v", d)
+	}
+
+	if len(d.Recipients) != 2 {
+		t.Fatalf("ParseDSN recipients: %+v", d.Recipients)
+	}
+
+	r := d.Recipients[0]
+	if r.Address != "Nobody@mailto.plus" || r.Status != "5.1.1" || !r.Hard() || r.Soft() {
+		t.Errorf("ParseDSN hard recipient: %+v", r)
+	}
+
+	if !strings.Contains(r.Diagnostic, "User unknown") {
+		t.Errorf("ParseDSN diagnostic: %q", r.Diagnostic)
+	}
+
+	r = d.Recipients[1]
+	if r.Address != "busy@mailto.plus" || r.Status != "4.2.2" || r.Hard() || !r.Soft() {
+		t.Errorf("ParseDSN soft recipient: %+v", r)
+	}
+
+	if _, err = ParseDSN(strings.NewReader("Subject: hello\r\n\r\nhello\r\n")); err == nil {
+		t.Errorf("ParseDSN plain message: want error")
+	}
+}
+
+func Test_ParseARF(t *testing.T) {
+	a, err := ParseARF(strings.NewReader(readTestdata(t, "complaint.eml",
+		"{{verp}}", "bounces+x@bounces.example.com",
+		"{{rcpt}}", "Suocq@mailto.plus",
+		"{{to}}", "Suocq <suocq@mailto.plus>",
+		"{{msgid}}", "<id@bounces.example.com>")))
+	if err != nil {
+		t.Fatalf("ParseARF error: %v", err)
+	}
+
+	want := ARF{
+		FeedbackType: "abuse",
+		UserAgent:    "SomeGenerator/1.0",
+		MailFrom:     "bounces+x@bounces.example.com",
+		RcptTo:       "Suocq@mailto.plus",
+		MessageID:    "<id@bounces.example.com>",
+		ReturnPath:   "bounces+x@bounces.example.com",
+		To:           "suocq@mailto.plus",
+	}
+
+	if *a != want {
+		t.Errorf("ParseARF = %+v, want %+v", *a, want)
+	}
+
+	// отчёт о доставке - не жалоба
+	if _, err = ParseARF(strings.NewReader(readDSN(t, "hard.eml", "x@y"))); err == nil {
+		t.Errorf("ParseARF for DSN: want error")
+	}
+}
+
+func Test_Complaint(t *testing.T) {
+	v := newTestVERP(t)
+
+	db, _ := mem.New(context.Background())
+
+	ltr := letter.Letter{
+		ID:          primitive.NewObjectID(),
+		Addresses:   []string{"tcuboa@mailto.plus", "suocq@mailto.plus"},
+		Status:      "sent",
+		Personalize: true,
+	}
+	ltr.Expand()
+
+	if err := db.Create(&ltr); err != nil {
+		t.Fatalf("Create error: %v", err)
+	}
+
+	sup := &fakeStore{}
+
+	var events []*event.Event
+
+	p := NewProcessor(v, db, sup, func(_ context.Context, e *event.Event) {
+		events = append(events, e)
+	})
+
+	// провайдер скрыл адрес получателя и переписал отправителя конверта,
+	// письмо и адресат находятся по Message-ID
+	arf := readTestdata(t, "complaint.eml",
+		"{{verp}}", "bounces@bounces.example.com",
+		"{{rcpt}}", "redacted@mailto.plus",
+		"{{to}}", "undisclosed-recipients:;",
+		"{{msgid}}", v.MessageID(ltr.ID.Hex(), 1))
+	arf = strings.Replace(arf, "Original-Rcpt-To: <redacted@mailto.plus>\n", "", 1)
+
+	if err := p.Process(context.Background(), strings.NewReader(arf)); err != nil {
+		t.Fatalf("Process error: %v", err)
+	}
+
+	got := db.Data[0]
+	if got.Recipients[1].Status != "complained" || got.Recipients[0].Status == "complained" {
+		t.Errorf("complaint recipients: %+v", got.Recipients)
+	}
+
+	if len(got.Complained) != 1 || got.Complained[0] != "suocq@mailto.plus" {
+		t.Errorf("complaint complained: %v", got.Complained)
+	}
+
+	if len(*sup) != 1 || (*sup)[0].Address != "suocq@mailto.plus" || (*sup)[0].Reason != suppress.Complaint {
+		t.Errorf("complaint suppressions: %+v", *sup)
+	}
+
+	if len(events) != 1 || events[0].Type != event.Complaint || events[0].Address != "suocq@mailto.plus" || events[0].Status != "abuse" {
+		t.Errorf("complaint events: %+v", events)
+	}
+
+	// без Message-ID письмо находится по VERP из Original-Mail-From
+	arf = readTestdata(t, "complaint.eml",
+		"{{verp}}", v.Encode(ltr.ID.Hex(), -1),
+		"{{rcpt}}", "TCUBOA@mailto.plus",
+		"{{to}}", "tcuboa@mailto.plus",
+		"{{msgid}}", "<20261019@mx.gmail.com>")
+
+	if err := p.Process(context.Background(), strings.NewReader(arf)); err != nil {
+		t.Fatalf("Process error: %v", err)
+	}
+
+	if got = db.Data[0]; got.Recipients[0].Status != "complained" || len(got.Complained) != 2 {
+		t.Errorf("complaint by VERP: %+v", got)
+	}
+}
+
+func Test_Process(t *testing.T) {
+	v := newTestVERP(t)
+
+	db, _ := mem.New(context.Background())
+
+	ltr := letter.Letter{
+		ID:          primitive.NewObjectID(),
+		Addresses:   []string{"nobody@mailto.plus", "busy@mailto.plus"},
+		Status:      "sent",
+		Personalize: true,
+	}
+	ltr.Expand()
+
+	if err := db.Create(&ltr); err != nil {
+		t.Fatalf("Create error: %v", err)
+	}
+
+	sup := &fakeStore{}
+
+	var events []*event.Event
+
+	p := NewProcessor(v, db, sup, func(_ context.Context, e *event.Event) {
+		events = append(events, e)
+	})
+
+	dsn := readDSN(t, "hard.eml", v.Encode(ltr.ID.Hex(), 0))
+	if err := p.Process(context.Background(), strings.NewReader(dsn)); err != nil {
+		t.Fatalf("Process error: %v", err)
+	}
+
+	got := db.Data[0]
+	if got.Recipients[0].Status != "bounced" || got.Recipients[1].Status == "bounced" {
+		t.Errorf("Process recipients: %+v", got.Recipients)
+	}
+
+	if len(got.Bounced) != 1 || got.Bounced[0] != "nobody@mailto.plus" {
+		t.Errorf("Process bounced: %v", got.Bounced)
+	}
+
+	if len(*sup) != 1 || (*sup)[0].Address != "nobody@mailto.plus" || (*sup)[0].Reason != suppress.Bounce || (*sup)[0].Scope != suppress.Global {
+		t.Errorf("Process suppressions: %+v", *sup)
+	}
+
+	if len(events) != 2 || events[0].Type != event.Bounce || events[1].Type != event.Delay || events[0].Status != "5.1.1" {
+		t.Errorf("Process events: %+v", events)
+	}
+
+	// подпись от другого ключа не принимается
+	other, _ := NewVERP("bounces@bounces.example.com", []byte("другой"))
+	dsn = readDSN(t, "hard.eml", other.Encode(ltr.ID.Hex(), 0))
+
+	if err := p.Process(context.Background(), strings.NewReader(dsn)); err == nil {
+		t.Errorf("Process with foreign signature: want error")
+	}
+}
+
+func Test_Maildir(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(BOUNCE_MAILDIR, dir)
+
+	v := newTestVERP(t)
+	db, _ := mem.New(context.Background())
+
+	ltr := letter.Letter{ID: primitive.NewObjectID(), Addresses: []string{"nobody@mailto.plus"}, Status: "sent"}
+	if err := db.Create(&ltr); err != nil {
+		t.Fatalf("Create error: %v", err)
+	}
+
+	md, err := NewMaildir(NewProcessor(v, db, nil, nil))
+	if err != nil || md == nil {
+		t.Fatalf("NewMaildir: %v %v", md, err)
+	}
+
+	dsn := readDSN(t, "hard.eml", v.Encode(ltr.ID.Hex(), -1))
+	if err = os.WriteFile(filepath.Join(dir, "new", "1760858102.M1P1.mx"), []byte(dsn), 0o600); err != nil {
+		t.Fatalf("WriteFile error: %v", err)
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, "new", "1760858103.M2P1.mx"), []byte("garbage"), 0o600); err != nil {
+		t.Fatalf("WriteFile error: %v", err)
+	}
+
+	md.Scan(context.Background())
+
+	if files, _ := os.ReadDir(filepath.Join(dir, "new")); len(files) != 0 {
+		t.Errorf("Maildir new not empty: %v", files)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "cur", "1760858102.M1P1.mx:2,S")); err != nil {
+		t.Errorf("Maildir message not moved to cur: %v", err)
+	}
+
+	if got := db.Data[0].Bounced; len(got) != 1 || got[0] != "nobody@mailto.plus" {
+		t.Errorf("Maildir bounced: %v", got)
+	}
+}
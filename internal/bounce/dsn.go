@@ -0,0 +1,112 @@
+package bounce
+
+import (
+	"fmt"
+	"io"
+	"net/textproto"
+	"strings"
+)
+
+// DSN - уведомление о статусе доставки (RFC 3464)
+type DSN struct {
+	To         []string // адреса, на которые пришло уведомление, среди них должен быть VERP
+	Reporting  string   // Reporting-MTA
+	Recipients []Status
+}
+
+// Status - статус доставки одному адресату
+type Status struct {
+	Address    string // Final-Recipient
+	Original   string // Original-Recipient, если есть
+	Action     string // failed / delayed / delivered / relayed / expanded
+	Status     string // код статуса, например 5.1.1
+	Diagnostic string // Diagnostic-Code - ответ сервера получателя
+}
+
+// Hard - постоянный отказ, на адрес больше отправлять нельзя
+func (s *Status) Hard() bool {
+	return s.Action == "failed" && strings.HasPrefix(s.Status, "5")
+}
+
+// Soft - временный отказ, сервер ещё пытается доставить или можно повторить позже
+func (s *Status) Soft() bool {
+	return s.Action == "delayed" || s.Action == "failed" && strings.HasPrefix(s.Status, "4")
+}
+
+// ParseDSN разбирает письмо multipart/report; report-type=delivery-status
+func ParseDSN(r io.Reader) (*DSN, error) {
+	rep, err := readReport(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return rep.dsn()
+}
+
+func (rep *report) dsn() (*DSN, error) {
+	if rep.typ != deliveryStatus {
+		return nil, fmt.Errorf("not a delivery status notification: %s", rep.typ)
+	}
+
+	d := DSN{To: envelope(rep.msg.Header)}
+	found := false
+
+	err := walkParts(rep.msg.Body, rep.boundary, func(mt string, body io.Reader) error {
+		if found || mt != "message/delivery-status" && mt != "message/global-delivery-status" {
+			return nil
+		}
+
+		found = true
+
+		return d.parseFields(body)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, fmt.Errorf("no status part")
+	}
+
+	return &d, nil
+}
+
+// parseFields разбирает поля: сначала блок о сообщении, затем по блоку на адресата
+func (d *DSN) parseFields(r io.Reader) error {
+	blocks, err := readFields(r)
+	if err != nil {
+		return err
+	}
+
+	if len(blocks) == 0 {
+		return fmt.Errorf("empty delivery status")
+	}
+
+	d.Reporting = value(blocks[0].Get("Reporting-Mta"))
+
+	for _, h := range blocks[1:] {
+		d.addRecipient(h)
+	}
+
+	return nil
+}
+
+func (d *DSN) addRecipient(h textproto.MIMEHeader) {
+	s := Status{
+		Address:    value(h.Get("Final-Recipient")),
+		Original:   value(h.Get("Original-Recipient")),
+		Action:     strings.ToLower(strings.TrimSpace(h.Get("Action"))),
+		Diagnostic: value(h.Get("Diagnostic-Code")),
+	}
+
+	// в статусе может быть комментарий: 5.1.1 (user unknown)
+	if f := strings.Fields(h.Get("Status")); len(f) > 0 {
+		s.Status = f[0]
+	}
+
+	if s.Address == "" {
+		s.Address = s.Original
+	}
+
+	d.Recipients = append(d.Recipients, s)
+}
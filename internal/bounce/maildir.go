@@ -0,0 +1,108 @@
+package bounce
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Maildir - просмотр каталога new в maildir: каждое новое письмо обрабатывается
+// и переносится в cur с флагом S, чтобы не обработать его повторно
+type Maildir struct {
+	dir    string
+	period time.Duration
+	p      *Processor
+}
+
+// NewMaildir возвращает nil, если maildir не задан
+func NewMaildir(p *Processor) (*Maildir, error) {
+	dir, ok := os.LookupEnv(BOUNCE_MAILDIR)
+	if !ok || dir == "" {
+		return nil, nil
+	}
+
+	md := Maildir{dir: dir, period: defaultPeriod, p: p}
+
+	if s, ok := os.LookupEnv(BOUNCE_PERIOD); ok && s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("bad %s %q", BOUNCE_PERIOD, s)
+		}
+
+		md.period = d
+	}
+
+	for _, sub := range []string{"new", "cur", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return nil, fmt.Errorf("maildir: %v", err)
+		}
+	}
+
+	return &md, nil
+}
+
+// Run просматривает maildir до отмены контекста
+func (md *Maildir) Run(ctx context.Context) {
+	t := time.NewTicker(md.period)
+	defer t.Stop()
+
+	for {
+		md.Scan(ctx)
+
+		select {
+		case <-ctx.Done():
+			zap.S().Debug("bounce maildir stopped")
+
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Scan обрабатывает все письма из new
+func (md *Maildir) Scan(ctx context.Context) {
+	files, err := os.ReadDir(filepath.Join(md.dir, "new"))
+	if err != nil {
+		zap.S().Errorf("bounce maildir read error: %v", err)
+
+		return
+	}
+
+	// имена в maildir начинаются со времени доставки
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	for _, f := range files {
+		if f.IsDir() || ctx.Err() != nil {
+			continue
+		}
+
+		md.file(ctx, f.Name())
+	}
+}
+
+func (md *Maildir) file(ctx context.Context, name string) {
+	path := filepath.Join(md.dir, "new", name)
+
+	f, err := os.Open(path)
+	if err != nil {
+		zap.S().Errorf("bounce open error: %v", err)
+
+		return
+	}
+
+	// письмо, которое не удалось разобрать, тоже переносится: повтор ничего не даст
+	if err = md.p.Process(ctx, f); err != nil {
+		zap.S().Errorf("bounce %s: %v", name, err)
+	}
+
+	f.Close()
+
+	if err = os.Rename(path, filepath.Join(md.dir, "cur", name+":2,S")); err != nil {
+		zap.S().Errorf("bounce rename error: %v", err)
+	}
+}
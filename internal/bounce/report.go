@@ -0,0 +1,152 @@
+package bounce
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// типы отчётов multipart/report
+const (
+	deliveryStatus = "delivery-status" // RFC 3464
+	feedbackReport = "feedback-report" // RFC 5965
+)
+
+// заголовки, в которые агенты доставки пишут адрес получателя конверта
+var envelopeHeaders = []string{"Delivered-To", "X-Original-To", "Envelope-To", "X-Envelope-To", "To"}
+
+// report - прочитанное письмо multipart/report
+type report struct {
+	msg      *mail.Message
+	typ      string // report-type
+	boundary string
+}
+
+// readReport читает письмо и проверяет, что это multipart/report
+func readReport(r io.Reader) (*report, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("read message: %v", err)
+	}
+
+	mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("content-type: %v", err)
+	}
+
+	if mt != "multipart/report" {
+		return nil, fmt.Errorf("not a report: %s", mt)
+	}
+
+	return &report{
+		msg:      msg,
+		typ:      strings.ToLower(params["report-type"]),
+		boundary: params["boundary"],
+	}, nil
+}
+
+// envelope - адреса получателя из заголовков, которые добавил агент доставки
+func envelope(h mail.Header) []string {
+	var res []string
+
+	for _, k := range envelopeHeaders {
+		for _, v := range h[textproto.CanonicalMIMEHeaderKey(k)] {
+			list, err := mail.ParseAddressList(v)
+			if err != nil {
+				res = append(res, strings.TrimSpace(v))
+
+				continue
+			}
+
+			for _, a := range list {
+				res = append(res, a.Address)
+			}
+		}
+	}
+
+	return res
+}
+
+// walkParts обходит части письма, в том числе вложенные multipart,
+// fn получает тип части и её раскодированное содержимое
+func walkParts(r io.Reader, boundary string, fn func(mt string, body io.Reader) error) error {
+	if boundary == "" {
+		return fmt.Errorf("multipart without boundary")
+	}
+
+	mr := multipart.NewReader(r, boundary)
+
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("read part: %v", err)
+		}
+
+		mt, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if err != nil {
+			continue
+		}
+
+		if strings.HasPrefix(mt, "multipart/") {
+			if err = walkParts(p, params["boundary"], fn); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		var body io.Reader = p
+
+		// quoted-printable multipart снимает сам
+		if strings.EqualFold(p.Header.Get("Content-Transfer-Encoding"), "base64") {
+			body = base64.NewDecoder(base64.StdEncoding, p)
+		}
+
+		if err = fn(mt, body); err != nil {
+			return err
+		}
+	}
+}
+
+// readFields читает блоки полей, разделённые пустой строкой
+// (так устроены message/delivery-status и message/feedback-report)
+func readFields(r io.Reader) ([]textproto.MIMEHeader, error) {
+	var res []textproto.MIMEHeader
+
+	tp := textproto.NewReader(bufio.NewReader(r))
+
+	for {
+		h, err := tp.ReadMIMEHeader()
+
+		if len(h) > 0 {
+			res = append(res, h)
+		}
+
+		if err == io.EOF {
+			return res, nil
+		}
+
+		if err != nil {
+			return res, fmt.Errorf("read fields: %v", err)
+		}
+	}
+}
+
+// value - значение поля вида "rfc822; user@example.com" без типа
+func value(s string) string {
+	if i := strings.IndexByte(s, ';'); i >= 0 {
+		s = s[i+1:]
+	}
+
+	return strings.Trim(strings.TrimSpace(s), "<>")
+}
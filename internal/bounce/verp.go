@@ -0,0 +1,121 @@
+package bounce
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VERP - адрес отправителя конверта, по которому отказ сопоставляется с письмом:
+// bounces+<ID письма>-<номер адресата>-<подпись>@example.com
+// номер адресата "x" - письмо одно на всех адресатов
+// подпись не даёт подделать отказ для чужого письма
+// та же метка используется в Message-ID, по нему находятся письма из жалоб (ARF)
+type VERP struct {
+	local  string
+	domain string
+	key    []byte
+}
+
+const sigHexLen = 8
+
+func NewVERP(address string, key []byte) (*VERP, error) {
+	i := strings.LastIndexByte(address, '@')
+	if i <= 0 || i == len(address)-1 {
+		return nil, fmt.Errorf("bad bounce address %q", address)
+	}
+
+	return &VERP{local: address[:i], domain: address[i+1:], key: key}, nil
+}
+
+// Encode - адрес для письма, idx < 0 - письмо одно на всех адресатов
+func (v *VERP) Encode(letterID string, idx int) string {
+	return v.local + "+" + v.tag(letterID, idx) + "@" + v.domain
+}
+
+// MessageID - Message-ID письма с той же меткой, что и в VERP
+func (v *VERP) MessageID(letterID string, idx int) string {
+	return "<" + v.tag(letterID, idx) + "@" + v.domain + ">"
+}
+
+// Decode - ID письма и номер адресата (-1, если письмо одно на всех) из адреса
+func (v *VERP) Decode(address string) (string, int, error) {
+	local, err := v.local4domain(address)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if !strings.HasPrefix(strings.ToLower(local), strings.ToLower(v.local)+"+") {
+		return "", 0, fmt.Errorf("not a VERP address %q", address)
+	}
+
+	return v.untag(local[len(v.local)+1:])
+}
+
+// ParseMessageID - ID письма и номер адресата из Message-ID
+func (v *VERP) ParseMessageID(id string) (string, int, error) {
+	local, err := v.local4domain(id)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return v.untag(local)
+}
+
+// local4domain - локальная часть адреса, если домен совпадает с доменом отказов
+func (v *VERP) local4domain(address string) (string, error) {
+	address = strings.Trim(strings.TrimSpace(address), "<>")
+
+	i := strings.LastIndexByte(address, '@')
+	if i < 0 || !strings.EqualFold(address[i+1:], v.domain) {
+		return "", fmt.Errorf("not a VERP address %q", address)
+	}
+
+	return address[:i], nil
+}
+
+func (v *VERP) tag(letterID string, idx int) string {
+	n := "x"
+	if idx >= 0 {
+		n = strconv.Itoa(idx)
+	}
+
+	tag := letterID + "-" + n
+
+	return tag + "-" + v.sign(tag)
+}
+
+func (v *VERP) untag(s string) (string, int, error) {
+	// адрес мог пройти через систему, меняющую регистр, в метке только строчные
+	parts := strings.Split(strings.ToLower(s), "-")
+	if len(parts) != 3 {
+		return "", 0, fmt.Errorf("bad VERP tag %q", s)
+	}
+
+	tag := parts[0] + "-" + parts[1]
+
+	if !hmac.Equal([]byte(parts[2]), []byte(v.sign(tag))) {
+		return "", 0, fmt.Errorf("bad VERP signature %q", s)
+	}
+
+	if parts[1] == "x" {
+		return parts[0], -1, nil
+	}
+
+	idx, err := strconv.Atoi(parts[1])
+	if err != nil || idx < 0 {
+		return "", 0, fmt.Errorf("bad VERP recipient %q", s)
+	}
+
+	return parts[0], idx, nil
+}
+
+func (v *VERP) sign(tag string) string {
+	m := hmac.New(sha256.New, v.key)
+	m.Write([]byte(tag))
+
+	return hex.EncodeToString(m.Sum(nil))[:sigHexLen]
+}
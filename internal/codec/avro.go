@@ -0,0 +1,272 @@
+package codec
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/maris-cyber/mailsender/api"
+	"github.com/maris-cyber/mailsender/internal/envelope"
+)
+
+// схемы Avro из api/avro, встроены в бинарник
+var (
+	sendRequestAvro  = mustAvro(api.AvroSendRequest)
+	letterStatusAvro = mustAvro(api.AvroLetterStatus)
+)
+
+func mustAvro(name string) *goavro.Codec {
+	s, err := api.Schemas.ReadFile(name)
+	if err != nil {
+		panic(fmt.Sprintf("avro schema %s: %v", name, err))
+	}
+
+	c, err := goavro.NewCodec(string(s))
+	if err != nil {
+		panic(fmt.Sprintf("avro schema %s: %v", name, err))
+	}
+
+	return c
+}
+
+func marshalAvro(c *goavro.Codec, m *message) ([]byte, error) {
+	var data map[string]interface{}
+
+	if m.request != nil {
+		letters := make([]interface{}, len(m.request.Letters))
+		for i := range m.request.Letters {
+			letters[i] = avroLetter(&m.request.Letters[i])
+		}
+
+		data = map[string]interface{}{"letters": letters}
+	} else if m.status != nil {
+		data = avroStatus(m.status)
+	}
+
+	return c.BinaryFromNative(nil, map[string]interface{}{
+		"schemaVersion": int32(m.version),
+		"type":          m.typ,
+		"producer":      m.producer,
+		"createdAt":     m.createdAt,
+		"correlationId": m.correlationID,
+		"data":          data,
+	})
+}
+
+func avroLetter(l *envelope.Letter) map[string]interface{} {
+	recipients := make([]interface{}, len(l.Recipients))
+	for i, r := range l.Recipients {
+		recipients[i] = map[string]interface{}{
+			"address":     r.Address,
+			"name":        r.Name,
+			"unsubscribe": r.Unsubscribe,
+			"vars":        avroMap(r.Vars),
+			"locale":      r.Locale,
+		}
+	}
+
+	return map[string]interface{}{
+		"addresses":       avroStrings(l.Addresses),
+		"recipients":      recipients,
+		"subject":         l.Subject,
+		"body":            l.Body,
+		"token":           l.Token,
+		"personalize":     l.Personalize,
+		"templateId":      l.TemplateID,
+		"templateVersion": int32(l.TemplateVersion),
+		"vars":            avroMap(l.Vars),
+		"locale":          l.Locale,
+		"track":           l.Track,
+		"category":        l.Category,
+		"bulk":            l.Bulk,
+		"idempotencyKey":  l.IdempotencyKey,
+	}
+}
+
+func avroStatus(s *envelope.LetterStatus) map[string]interface{} {
+	recipients := make([]interface{}, len(s.Recipients))
+	for i, r := range s.Recipients {
+		recipients[i] = map[string]interface{}{"address": r.Address, "status": r.Status}
+	}
+
+	return map[string]interface{}{
+		"letterId":        s.LetterID,
+		"kafkaKey":        s.KafkaKey,
+		"idempotencyKey":  s.IdempotencyKey,
+		"token":           s.Token,
+		"status":          s.Status,
+		"error":           s.Error,
+		"templateId":      s.TemplateID,
+		"templateVersion": int32(s.TemplateVersion),
+		"category":        s.Category,
+		"addresses":       avroStrings(s.Addresses),
+		"recipients":      recipients,
+		"suppressed":      avroStrings(s.Suppressed),
+		"invalid":         avroStrings(s.Invalid),
+	}
+}
+
+func avroStrings(ss []string) []interface{} {
+	a := make([]interface{}, len(ss))
+	for i, s := range ss {
+		a[i] = s
+	}
+
+	return a
+}
+
+func avroMap(m map[string]string) map[string]interface{} {
+	a := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		a[k] = v
+	}
+
+	return a
+}
+
+func unmarshalAvro(c *goavro.Codec, b []byte) (*message, error) {
+	// в формате Confluent Schema Registry перед данными нулевой байт и 4 байта номера схемы;
+	// обычное сообщение с нулевого байта начаться не может - это была бы версия схемы 0
+	if len(b) > 5 && b[0] == 0 {
+		b = b[5:]
+	}
+
+	native, _, err := c.NativeFromBinary(b)
+	if err != nil {
+		return nil, err
+	}
+
+	r := toRecord(native)
+	m := &message{
+		version:       int(r.int("schemaVersion")),
+		typ:           r.str("type"),
+		producer:      r.str("producer"),
+		correlationID: r.str("correlationId"),
+	}
+
+	if t, ok := r["createdAt"].(time.Time); ok {
+		m.createdAt = t.UTC()
+	}
+
+	data := toRecord(r["data"])
+
+	if c == sendRequestAvro {
+		m.request = &envelope.SendRequest{}
+		for _, v := range data.list("letters") {
+			m.request.Letters = append(m.request.Letters, unavroLetter(toRecord(v)))
+		}
+	} else {
+		m.status = unavroStatus(data)
+	}
+
+	return m, nil
+}
+
+func unavroLetter(r record) envelope.Letter {
+	l := envelope.Letter{
+		Addresses:       r.strings("addresses"),
+		Subject:         r.str("subject"),
+		Body:            r.str("body"),
+		Token:           r.str("token"),
+		Personalize:     r.bool("personalize"),
+		TemplateID:      r.str("templateId"),
+		TemplateVersion: int(r.int("templateVersion")),
+		Vars:            r.strmap("vars"),
+		Locale:          r.str("locale"),
+		Track:           r.bool("track"),
+		Category:        r.str("category"),
+		Bulk:            r.bool("bulk"),
+		IdempotencyKey:  r.str("idempotencyKey"),
+	}
+
+	for _, v := range r.list("recipients") {
+		rc := toRecord(v)
+		l.Recipients = append(l.Recipients, envelope.Recipient{
+			Address:     rc.str("address"),
+			Name:        rc.str("name"),
+			Unsubscribe: rc.str("unsubscribe"),
+			Vars:        rc.strmap("vars"),
+			Locale:      rc.str("locale"),
+		})
+	}
+
+	return l
+}
+
+func unavroStatus(r record) *envelope.LetterStatus {
+	s := &envelope.LetterStatus{
+		LetterID:        r.str("letterId"),
+		KafkaKey:        r.str("kafkaKey"),
+		IdempotencyKey:  r.str("idempotencyKey"),
+		Token:           r.str("token"),
+		Status:          r.str("status"),
+		Error:           r.str("error"),
+		TemplateID:      r.str("templateId"),
+		TemplateVersion: int(r.int("templateVersion")),
+		Category:        r.str("category"),
+		Addresses:       r.strings("addresses"),
+		Suppressed:      r.strings("suppressed"),
+		Invalid:         r.strings("invalid"),
+	}
+
+	for _, v := range r.list("recipients") {
+		rc := toRecord(v)
+		s.Recipients = append(s.Recipients, envelope.RecipientStatus{Address: rc.str("address"), Status: rc.str("status")})
+	}
+
+	return s
+}
+
+// record - запись Avro в виде, который отдаёт goavro
+type record map[string]interface{}
+
+func toRecord(v interface{}) record {
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+func (r record) str(k string) string {
+	s, _ := r[k].(string)
+	return s
+}
+
+func (r record) int(k string) int32 {
+	i, _ := r[k].(int32)
+	return i
+}
+
+func (r record) bool(k string) bool {
+	b, _ := r[k].(bool)
+	return b
+}
+
+func (r record) list(k string) []interface{} {
+	l, _ := r[k].([]interface{})
+	return l
+}
+
+// пустые массивы и словари возвращаются как nil, как в JSON с omitempty
+func (r record) strings(k string) []string {
+	var ss []string
+
+	for _, v := range r.list(k) {
+		s, _ := v.(string)
+		ss = append(ss, s)
+	}
+
+	return ss
+}
+
+func (r record) strmap(k string) map[string]string {
+	m, _ := r[k].(map[string]interface{})
+	if len(m) == 0 {
+		return nil
+	}
+
+	sm := make(map[string]string, len(m))
+	for k, v := range m {
+		sm[k], _ = v.(string)
+	}
+
+	return sm
+}
@@ -0,0 +1,231 @@
+/*
+codec - пакет, кодирующий сообщения kafka (запрос на отправку и статус письма)
+в JSON, Protobuf или Avro. Конверт и поля одни и те же во всех кодировках (см. пакет envelope),
+схемы лежат в api: JSON Schema в api/schema, Protobuf в api/proto, Avro в api/avro.
+
+Кодировка выбирается для топика настройкой, а у входящего сообщения - заголовком content-type,
+если он есть. Старый формат запроса (массив писем) бывает только в JSON.
+*/
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/envelope"
+	"github.com/maris-cyber/mailsender/internal/letter"
+)
+
+type Format string
+
+const (
+	JSON     Format = "json"
+	Protobuf Format = "protobuf"
+	Avro     Format = "avro"
+)
+
+// HeaderContentType - заголовок сообщения kafka с кодировкой
+const HeaderContentType = "content-type"
+
+// ParseFormat - кодировка по имени из настроек, пустое имя - JSON
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "json":
+		return JSON, nil
+	case "protobuf", "proto":
+		return Protobuf, nil
+	case "avro":
+		return Avro, nil
+	}
+
+	return "", fmt.Errorf("unknown format %q", s)
+}
+
+// FromContentType - кодировка по значению content-type, false - если тип незнакомый
+func FromContentType(ct string) (Format, bool) {
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = strings.TrimSpace(ct[:i])
+	}
+
+	switch ct {
+	case "application/json":
+		return JSON, true
+	case "application/x-protobuf", "application/protobuf", "application/vnd.google.protobuf":
+		return Protobuf, true
+	case "avro/binary", "application/avro", "application/vnd.apache.avro+binary":
+		return Avro, true
+	}
+
+	return "", false
+}
+
+// ContentType - значение заголовка content-type для исходящих сообщений
+func (f Format) ContentType() string {
+	switch f {
+	case Protobuf:
+		return "application/x-protobuf"
+	case Avro:
+		return "avro/binary"
+	}
+
+	return "application/json"
+}
+
+// message - конверт с данными, общий для Protobuf и Avro
+type message struct {
+	version       int
+	typ           string
+	producer      string
+	createdAt     time.Time
+	correlationID string
+	request       *envelope.SendRequest
+	status        *envelope.LetterStatus
+}
+
+// DecodeRequest разбирает запрос на отправку в кодировке f
+// в письмах проставляется CorrelationID из конверта
+func DecodeRequest(f Format, b []byte) ([]letter.Letter, envelope.Meta, error) {
+	var (
+		m   *message
+		err error
+	)
+
+	switch f {
+	case JSON, "":
+		return envelope.DecodeRequest(b)
+	case Protobuf:
+		m, err = unmarshalProto(b)
+	case Avro:
+		m, err = unmarshalAvro(sendRequestAvro, b)
+	default:
+		return nil, envelope.Meta{}, fmt.Errorf("unknown format %q", f)
+	}
+
+	if err != nil {
+		return nil, envelope.Meta{}, fmt.Errorf("%s: %v", f, err)
+	}
+
+	meta := envelope.Meta{Producer: m.producer, CreatedAt: m.createdAt, CorrelationID: m.correlationID}
+
+	if err = envelope.Check(m.version, m.typ, envelope.TypeSendRequest); err != nil {
+		return nil, meta, err
+	}
+
+	if m.request == nil {
+		return nil, meta, fmt.Errorf("%s: no send request", f)
+	}
+
+	return m.request.Queue(m.correlationID), meta, nil
+}
+
+// EncodeRequest - запрос на отправку в кодировке f, для тестов и других сервисов
+func EncodeRequest(f Format, letters []envelope.Letter, producer, correlationID string) ([]byte, error) {
+	if f == JSON || f == "" {
+		return envelope.EncodeRequest(letters, producer, correlationID)
+	}
+
+	m := newMessage(envelope.TypeSendRequest, producer, correlationID)
+	m.request = &envelope.SendRequest{Letters: letters}
+
+	return m.encode(f)
+}
+
+// EncodeStatus - статус письма в кодировке f
+func EncodeStatus(f Format, l *letter.Letter, producer string) ([]byte, error) {
+	if f == JSON || f == "" {
+		return envelope.EncodeStatus(l, producer)
+	}
+
+	s := envelope.StatusOf(l)
+	m := newMessage(envelope.TypeLetterStatus, producer, l.CorrelationID)
+	m.status = &s
+
+	return m.encode(f)
+}
+
+// DecodeStatus разбирает статус письма, для тех, кто читает топик статусов
+func DecodeStatus(f Format, b []byte) (*envelope.LetterStatus, envelope.Meta, error) {
+	var (
+		m   *message
+		err error
+	)
+
+	switch f {
+	case JSON, "":
+		m, err = unmarshalJSONStatus(b)
+	case Protobuf:
+		m, err = unmarshalProto(b)
+	case Avro:
+		m, err = unmarshalAvro(letterStatusAvro, b)
+	default:
+		return nil, envelope.Meta{}, fmt.Errorf("unknown format %q", f)
+	}
+
+	if err != nil {
+		return nil, envelope.Meta{}, fmt.Errorf("%s: %v", f, err)
+	}
+
+	meta := envelope.Meta{Producer: m.producer, CreatedAt: m.createdAt, CorrelationID: m.correlationID}
+
+	if err = envelope.Check(m.version, m.typ, envelope.TypeLetterStatus); err != nil {
+		return nil, meta, err
+	}
+
+	if m.status == nil {
+		return nil, meta, fmt.Errorf("%s: no letter status", f)
+	}
+
+	return m.status, meta, nil
+}
+
+func newMessage(typ, producer, correlationID string) *message {
+	return &message{
+		version:       envelope.Version,
+		typ:           typ,
+		producer:      producer,
+		createdAt:     time.Now().UTC(),
+		correlationID: correlationID,
+	}
+}
+
+func (m *message) encode(f Format) ([]byte, error) {
+	switch f {
+	case Protobuf:
+		return marshalProto(m), nil
+	case Avro:
+		if m.request != nil {
+			return marshalAvro(sendRequestAvro, m)
+		}
+
+		return marshalAvro(letterStatusAvro, m)
+	}
+
+	return nil, fmt.Errorf("unknown format %q", f)
+}
+
+func unmarshalJSONStatus(b []byte) (*message, error) {
+	var (
+		e envelope.Envelope
+		s envelope.LetterStatus
+	)
+
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(e.Data, &s); err != nil {
+		return nil, fmt.Errorf("letter status: %v", err)
+	}
+
+	return &message{
+		version:       e.SchemaVersion,
+		typ:           e.Type,
+		producer:      e.Producer,
+		createdAt:     e.CreatedAt,
+		correlationID: e.CorrelationID,
+		status:        &s,
+	}, nil
+}
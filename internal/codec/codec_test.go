@@ -0,0 +1,235 @@
+package codec
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/maris-cyber/mailsender/api"
+	"github.com/maris-cyber/mailsender/internal/envelope"
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+var formats = []Format{JSON, Protobuf, Avro}
+
+func TestMain(m *testing.M) {
+	logger, _ := zap.NewDevelopment()
+	zap.ReplaceGlobals(logger)
+
+	m.Run()
+}
+
+func testLetters() []envelope.Letter {
+	return []envelope.Letter{
+		{
+			Recipients: []envelope.Recipient{
+				{Address: "uuunet@mailto.plus", Name: "Иван", Vars: map[string]string{"order": "42", "sum": "100"}, Locale: "ru"},
+				{Address: "yhuzfu@mailto.plus", Unsubscribe: "https://example.com/u/1"},
+			},
+			TemplateID:      "welcome",
+			TemplateVersion: 3,
+			Personalize:     true,
+			Track:           true,
+			Category:        "orders",
+			IdempotencyKey:  "order-42",
+		},
+		{
+			Addresses: []string{"a@mailto.plus", "b@mailto.plus"},
+			Subject:   "тема",
+			Body:      "сообщение\n",
+			Token:     "t-1",
+			Vars:      map[string]string{"x": ""},
+			Bulk:      true,
+		},
+	}
+}
+
+func Test_RequestRoundTrip(t *testing.T) {
+	want := testLetters()
+
+	for _, f := range formats {
+		b, err := EncodeRequest(f, want, "bodyshop", "corr-1")
+		if err != nil {
+			t.Fatalf("%s EncodeRequest error: %v", f, err)
+		}
+
+		tL, meta, err := DecodeRequest(f, b)
+		if err != nil {
+			t.Fatalf("%s DecodeRequest error: %v", f, err)
+		}
+
+		if meta.Legacy || meta.Producer != "bodyshop" || meta.CorrelationID != "corr-1" || meta.CreatedAt.IsZero() {
+			t.Errorf("%s DecodeRequest meta %+v", f, meta)
+		}
+
+		if len(tL) != len(want) {
+			t.Fatalf("%s DecodeRequest letters %+v", f, tL)
+		}
+
+		for i := range want {
+			var l letter.Letter
+			want[i].To(&l)
+			l.CorrelationID = "corr-1"
+
+			if !reflect.DeepEqual(tL[i], l) {
+				t.Errorf("%s letter %d\n got %+v\nwant %+v", f, i, tL[i], l)
+			}
+		}
+	}
+}
+
+func Test_StatusRoundTrip(t *testing.T) {
+	l := &letter.Letter{
+		ID:              primitive.NewObjectID(),
+		KafkaKey:        "k-1",
+		IdempotencyKey:  "order-42",
+		CorrelationID:   "corr-2",
+		Status:          "partial",
+		Error:           "smtp: 550",
+		TemplateID:      "welcome",
+		TemplateVersion: 2,
+		Recipients: []letter.Recipient{
+			{Address: "uuunet@mailto.plus", Status: "sent"},
+			{Address: "yhuzfu@mailto.plus", Status: "error"},
+		},
+		Suppressed: []string{"s@mailto.plus"},
+		Invalid:    []string{"bad@"},
+	}
+	want := envelope.StatusOf(l)
+
+	for _, f := range formats {
+		b, err := EncodeStatus(f, l, "mailsender")
+		if err != nil {
+			t.Fatalf("%s EncodeStatus error: %v", f, err)
+		}
+
+		s, meta, err := DecodeStatus(f, b)
+		if err != nil {
+			t.Fatalf("%s DecodeStatus error: %v", f, err)
+		}
+
+		if meta.Producer != "mailsender" || meta.CorrelationID != "corr-2" {
+			t.Errorf("%s DecodeStatus meta %+v", f, meta)
+		}
+
+		if !reflect.DeepEqual(*s, want) {
+			t.Errorf("%s status\n got %+v\nwant %+v", f, *s, want)
+		}
+
+		// статус не принимается как запрос на отправку
+		if _, _, err = DecodeRequest(f, b); err == nil {
+			t.Errorf("%s DecodeRequest accepted letter status", f)
+		}
+	}
+}
+
+func Test_AvroConfluent(t *testing.T) {
+	b, err := EncodeRequest(Avro, testLetters(), "bodyshop", "")
+	if err != nil {
+		t.Fatalf("EncodeRequest error: %v", err)
+	}
+
+	// нулевой байт и номер схемы из Schema Registry
+	framed := append([]byte{0, 0, 0, 0, 7}, b...)
+
+	tL, _, err := DecodeRequest(Avro, framed)
+	if err != nil || len(tL) != 2 {
+		t.Errorf("DecodeRequest framed = %+v, %v", tL, err)
+	}
+}
+
+func Test_DecodeBad(t *testing.T) {
+	for _, f := range formats {
+		for _, b := range [][]byte{nil, []byte("\xff\xff\xff"), []byte(`{"schemaVersion":1}`)} {
+			if _, _, err := DecodeRequest(f, b); err == nil {
+				t.Errorf("%s DecodeRequest(%q) no error", f, b)
+			}
+		}
+	}
+
+	// версия схемы больше поддерживаемой
+	m := newMessage(envelope.TypeSendRequest, "", "")
+	m.version = envelope.Version + 1
+	m.request = &envelope.SendRequest{}
+
+	for _, f := range []Format{Protobuf, Avro} {
+		b, err := m.encode(f)
+		if err != nil {
+			t.Fatalf("%s encode error: %v", f, err)
+		}
+
+		if _, _, err = DecodeRequest(f, b); err == nil {
+			t.Errorf("%s DecodeRequest accepted version %d", f, m.version)
+		}
+	}
+}
+
+func Test_Format(t *testing.T) {
+	for s, want := range map[string]Format{"": JSON, "JSON": JSON, "proto": Protobuf, "protobuf": Protobuf, "avro": Avro} {
+		if f, err := ParseFormat(s); err != nil || f != want {
+			t.Errorf("ParseFormat(%q) = %q, %v", s, f, err)
+		}
+	}
+
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Errorf("ParseFormat(xml) no error")
+	}
+
+	for _, f := range formats {
+		if got, ok := FromContentType(f.ContentType() + "; charset=utf-8"); !ok || got != f {
+			t.Errorf("FromContentType(%q) = %q, %v", f.ContentType(), got, ok)
+		}
+	}
+
+	if _, ok := FromContentType("text/plain"); ok {
+		t.Errorf("FromContentType(text/plain) ok")
+	}
+}
+
+// поля Avro совпадают с полями JSON-схемы
+func Test_AvroSchema(t *testing.T) {
+	for avsc, schema := range map[string]string{
+		api.AvroSendRequest:  "schema/send-request.v1.json",
+		api.AvroLetterStatus: "schema/letter-status.v1.json",
+	} {
+		var a struct {
+			Fields []struct {
+				Name string `json:"name"`
+			} `json:"fields"`
+		}
+
+		var j struct {
+			Properties map[string]interface{} `json:"properties"`
+		}
+
+		for name, v := range map[string]interface{}{avsc: &a, schema: &j} {
+			b, err := api.Schemas.ReadFile(name)
+			if err != nil {
+				t.Fatalf("ReadFile error: %v", err)
+			}
+
+			if err = json.Unmarshal(b, v); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+
+		var got, want []string
+		for _, f := range a.Fields {
+			got = append(got, f.Name)
+		}
+
+		for p := range j.Properties {
+			want = append(want, p)
+		}
+
+		sort.Strings(got)
+		sort.Strings(want)
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s fields %v, %s properties %v", avsc, got, schema, want)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package codec
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/envelope"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Protobuf кодируется вручную по api/proto/mailsender.proto, без сгенерированного кода:
+// номера полей ниже должны совпадать с номерами в схеме
+
+var errProtoWireType = errors.New("unexpected wire type")
+
+func marshalProto(m *message) []byte {
+	var b []byte
+
+	b = appendVarint(b, 1, uint64(m.version))
+	b = appendString(b, 2, m.typ)
+	b = appendString(b, 3, m.producer)
+
+	if !m.createdAt.IsZero() {
+		b = appendVarint(b, 4, uint64(m.createdAt.UnixMilli()))
+	}
+
+	b = appendString(b, 5, m.correlationID)
+
+	switch {
+	case m.request != nil:
+		var r []byte
+		for i := range m.request.Letters {
+			r = appendMessage(r, 1, protoLetter(&m.request.Letters[i]))
+		}
+
+		b = appendMessage(b, 10, r)
+	case m.status != nil:
+		b = appendMessage(b, 11, protoStatus(m.status))
+	}
+
+	return b
+}
+
+func protoLetter(l *envelope.Letter) []byte {
+	var b []byte
+
+	b = appendStrings(b, 1, l.Addresses)
+
+	for _, r := range l.Recipients {
+		var rb []byte
+		rb = appendString(rb, 1, r.Address)
+		rb = appendString(rb, 2, r.Name)
+		rb = appendString(rb, 3, r.Unsubscribe)
+		rb = appendMap(rb, 4, r.Vars)
+		rb = appendString(rb, 5, r.Locale)
+		b = appendMessage(b, 2, rb)
+	}
+
+	b = appendString(b, 3, l.Subject)
+	b = appendString(b, 4, l.Body)
+	b = appendString(b, 5, l.Token)
+	b = appendBool(b, 6, l.Personalize)
+	b = appendString(b, 7, l.TemplateID)
+	b = appendVarint(b, 8, uint64(int64(l.TemplateVersion)))
+	b = appendMap(b, 9, l.Vars)
+	b = appendString(b, 10, l.Locale)
+	b = appendBool(b, 11, l.Track)
+	b = appendString(b, 12, l.Category)
+	b = appendBool(b, 13, l.Bulk)
+	b = appendString(b, 14, l.IdempotencyKey)
+
+	return b
+}
+
+func protoStatus(s *envelope.LetterStatus) []byte {
+	var b []byte
+
+	b = appendString(b, 1, s.LetterID)
+	b = appendString(b, 2, s.KafkaKey)
+	b = appendString(b, 3, s.IdempotencyKey)
+	b = appendString(b, 4, s.Token)
+	b = appendString(b, 5, s.Status)
+	b = appendString(b, 6, s.Error)
+	b = appendString(b, 7, s.TemplateID)
+	b = appendVarint(b, 8, uint64(int64(s.TemplateVersion)))
+	b = appendString(b, 9, s.Category)
+	b = appendStrings(b, 10, s.Addresses)
+
+	for _, r := range s.Recipients {
+		var rb []byte
+		rb = appendString(rb, 1, r.Address)
+		rb = appendString(rb, 2, r.Status)
+		b = appendMessage(b, 11, rb)
+	}
+
+	b = appendStrings(b, 12, s.Suppressed)
+	b = appendStrings(b, 13, s.Invalid)
+
+	return b
+}
+
+// значения по умолчанию (пустые строки, нули, false) в proto3 не пишутся
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+
+	return protowire.AppendString(b, s)
+}
+
+// элементы repeated пишутся все, даже пустые
+func appendStrings(b []byte, num protowire.Number, ss []string) []byte {
+	for _, s := range ss {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendString(b, s)
+	}
+
+	return b
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+
+	return appendVarint(b, num, 1)
+}
+
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+
+	return protowire.AppendBytes(b, m)
+}
+
+// map<string, string> - повторяющиеся записи с ключом 1 и значением 2, ключи по порядку
+func appendMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var e []byte
+		e = protowire.AppendTag(e, 1, protowire.BytesType)
+		e = protowire.AppendString(e, k)
+		e = protowire.AppendTag(e, 2, protowire.BytesType)
+		e = protowire.AppendString(e, m[k])
+		b = appendMessage(b, num, e)
+	}
+
+	return b
+}
+
+// field - одно поле сообщения: для varint значение в x, для строк и вложенных сообщений - в v
+type field struct {
+	num protowire.Number
+	typ protowire.Type
+	x   uint64
+	v   []byte
+}
+
+func (f *field) str() string {
+	return string(f.v)
+}
+
+// fields перебирает поля сообщения, незнакомые поля пропускает вызывающий
+func fields(b []byte, fn func(f *field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+
+		b = b[n:]
+		f := field{num: num, typ: typ}
+
+		switch typ {
+		case protowire.VarintType:
+			f.x, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			f.v, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+
+		b = b[n:]
+
+		if err := fn(&f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// want проверяет тип поля, чтобы строка не читалась как число и наоборот
+func want(f *field, typ protowire.Type) error {
+	if f.typ != typ {
+		return errProtoWireType
+	}
+
+	return nil
+}
+
+func unmarshalProto(b []byte) (*message, error) {
+	m := &message{}
+
+	err := fields(b, func(f *field) error {
+		switch f.num {
+		case 1:
+			m.version = int(int32(f.x))
+			return want(f, protowire.VarintType)
+		case 2:
+			m.typ = f.str()
+			return want(f, protowire.BytesType)
+		case 3:
+			m.producer = f.str()
+			return want(f, protowire.BytesType)
+		case 4:
+			m.createdAt = time.UnixMilli(int64(f.x)).UTC()
+			return want(f, protowire.VarintType)
+		case 5:
+			m.correlationID = f.str()
+			return want(f, protowire.BytesType)
+		case 10:
+			if err := want(f, protowire.BytesType); err != nil {
+				return err
+			}
+
+			m.request = &envelope.SendRequest{}
+
+			return fields(f.v, func(f *field) error {
+				if f.num != 1 {
+					return nil
+				}
+
+				if err := want(f, protowire.BytesType); err != nil {
+					return err
+				}
+
+				var l envelope.Letter
+				if err := unprotoLetter(f.v, &l); err != nil {
+					return err
+				}
+
+				m.request.Letters = append(m.request.Letters, l)
+
+				return nil
+			})
+		case 11:
+			if err := want(f, protowire.BytesType); err != nil {
+				return err
+			}
+
+			m.status = &envelope.LetterStatus{}
+
+			return unprotoStatus(f.v, m.status)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func unprotoLetter(b []byte, l *envelope.Letter) error {
+	return fields(b, func(f *field) error {
+		switch f.num {
+		case 1:
+			l.Addresses = append(l.Addresses, f.str())
+		case 2:
+			var r envelope.Recipient
+			if err := unprotoRecipient(f.v, &r); err != nil {
+				return err
+			}
+
+			l.Recipients = append(l.Recipients, r)
+		case 3:
+			l.Subject = f.str()
+		case 4:
+			l.Body = f.str()
+		case 5:
+			l.Token = f.str()
+		case 6:
+			l.Personalize = f.x != 0
+			return want(f, protowire.VarintType)
+		case 7:
+			l.TemplateID = f.str()
+		case 8:
+			l.TemplateVersion = int(int32(f.x))
+			return want(f, protowire.VarintType)
+		case 9:
+			if l.Vars == nil {
+				l.Vars = map[string]string{}
+			}
+
+			return unprotoMapEntry(f.v, l.Vars)
+		case 10:
+			l.Locale = f.str()
+		case 11:
+			l.Track = f.x != 0
+			return want(f, protowire.VarintType)
+		case 12:
+			l.Category = f.str()
+		case 13:
+			l.Bulk = f.x != 0
+			return want(f, protowire.VarintType)
+		case 14:
+			l.IdempotencyKey = f.str()
+		default:
+			return nil
+		}
+
+		return want(f, protowire.BytesType)
+	})
+}
+
+func unprotoRecipient(b []byte, r *envelope.Recipient) error {
+	return fields(b, func(f *field) error {
+		switch f.num {
+		case 1:
+			r.Address = f.str()
+		case 2:
+			r.Name = f.str()
+		case 3:
+			r.Unsubscribe = f.str()
+		case 4:
+			if r.Vars == nil {
+				r.Vars = map[string]string{}
+			}
+
+			return unprotoMapEntry(f.v, r.Vars)
+		case 5:
+			r.Locale = f.str()
+		default:
+			return nil
+		}
+
+		return want(f, protowire.BytesType)
+	})
+}
+
+func unprotoStatus(b []byte, s *envelope.LetterStatus) error {
+	return fields(b, func(f *field) error {
+		switch f.num {
+		case 1:
+			s.LetterID = f.str()
+		case 2:
+			s.KafkaKey = f.str()
+		case 3:
+			s.IdempotencyKey = f.str()
+		case 4:
+			s.Token = f.str()
+		case 5:
+			s.Status = f.str()
+		case 6:
+			s.Error = f.str()
+		case 7:
+			s.TemplateID = f.str()
+		case 8:
+			s.TemplateVersion = int(int32(f.x))
+			return want(f, protowire.VarintType)
+		case 9:
+			s.Category = f.str()
+		case 10:
+			s.Addresses = append(s.Addresses, f.str())
+		case 11:
+			var r envelope.RecipientStatus
+
+			err := fields(f.v, func(f *field) error {
+				switch f.num {
+				case 1:
+					r.Address = f.str()
+				case 2:
+					r.Status = f.str()
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			s.Recipients = append(s.Recipients, r)
+		case 12:
+			s.Suppressed = append(s.Suppressed, f.str())
+		case 13:
+			s.Invalid = append(s.Invalid, f.str())
+		default:
+			return nil
+		}
+
+		return want(f, protowire.BytesType)
+	})
+}
+
+func unprotoMapEntry(b []byte, m map[string]string) error {
+	var k, v string
+
+	err := fields(b, func(f *field) error {
+		switch f.num {
+		case 1:
+			k = f.str()
+		case 2:
+			v = f.str()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m[k] = v
+
+	return nil
+}
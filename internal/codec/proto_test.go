@@ -0,0 +1,462 @@
+package codec
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/maris-cyber/mailsender/api"
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const protoFile = "proto/mailsender.proto"
+
+// protoTokens разбивает .proto на слова и знаки, без комментариев
+func protoTokens(src string) []string {
+	var (
+		res []string
+		cur strings.Builder
+	)
+
+	flush := func() {
+		if cur.Len() > 0 {
+			res = append(res, cur.String())
+			cur.Reset()
+		}
+	}
+
+	for _, line := range strings.Split(src, "\n") {
+		// в контракте "//" бывает только в комментариях
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+
+		quoted := false
+
+		for _, r := range line {
+			switch {
+			case r == '"':
+				// строка - одно слово вместе с кавычками, внутри неё знаки не разделяют
+				cur.WriteRune(r)
+
+				if quoted = !quoted; !quoted {
+					flush()
+				}
+			case quoted || unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.':
+				cur.WriteRune(r)
+			case unicode.IsSpace(r):
+				flush()
+			default:
+				flush()
+				res = append(res, string(r))
+			}
+		}
+
+		flush()
+	}
+
+	return res
+}
+
+// скалярные типы, которые есть в mailsender.proto
+var protoScalars = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	"int32":  descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+}
+
+// parseProto строит описание файла из .proto: только то подмножество proto3, которое используется в контракте
+// (сообщения, repeated, map<string, string>, oneof); остальное - ошибка, чтобы тест не проверял меньше, чем написано
+func parseProto(src string) (*descriptorpb.FileDescriptorProto, error) {
+	toks := protoTokens(src)
+	pos := 0
+
+	next := func() string {
+		if pos >= len(toks) {
+			return ""
+		}
+
+		pos++
+
+		return toks[pos-1]
+	}
+
+	expect := func(want string) error {
+		if got := next(); got != want {
+			return fmt.Errorf("token %d: %q, want %q", pos, got, want)
+		}
+
+		return nil
+	}
+
+	fd := &descriptorpb.FileDescriptorProto{Name: proto.String(protoFile), Syntax: proto.String("proto3")}
+
+	typeName := func(t string) string {
+		return "." + fd.GetPackage() + "." + t
+	}
+
+	scalarOrMessage := func(f *descriptorpb.FieldDescriptorProto, t string) {
+		if st, ok := protoScalars[t]; ok {
+			f.Type = st.Enum()
+
+			return
+		}
+
+		f.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+		f.TypeName = proto.String(typeName(t))
+	}
+
+	// поле до ";": [repeated] тип имя = номер или map<K, V> имя = номер
+	field := func(m *descriptorpb.DescriptorProto, first string, oneof *int32) error {
+		f := &descriptorpb.FieldDescriptorProto{Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), OneofIndex: oneof}
+
+		t := first
+		if t == "repeated" {
+			f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			t = next()
+		}
+
+		if t == "map" {
+			var kv [2]string
+
+			for i, sep := range []string{"<", ",", ">"} {
+				if err := expect(sep); err != nil {
+					return err
+				}
+
+				if i < 2 {
+					kv[i] = next()
+				}
+			}
+
+			f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			t = ""
+
+			defer func() {
+				// map - повторяющееся вложенное сообщение {Name}Entry с полями key = 1 и value = 2
+				entry := &descriptorpb.DescriptorProto{
+					Name:    proto.String(strings.Title(f.GetName()) + "Entry"),
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				}
+
+				for i, st := range kv {
+					ef := &descriptorpb.FieldDescriptorProto{
+						Name:   proto.String([]string{"key", "value"}[i]),
+						Number: proto.Int32(int32(i + 1)),
+						Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					}
+					scalarOrMessage(ef, st)
+					entry.Field = append(entry.Field, ef)
+				}
+
+				m.NestedType = append(m.NestedType, entry)
+				f.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				f.TypeName = proto.String(typeName(m.GetName() + "." + entry.GetName()))
+			}()
+		}
+
+		f.Name = proto.String(next())
+
+		if err := expect("="); err != nil {
+			return err
+		}
+
+		n, err := strconv.Atoi(next())
+		if err != nil {
+			return fmt.Errorf("field %s number: %v", f.GetName(), err)
+		}
+
+		f.Number = proto.Int32(int32(n))
+
+		if t != "" {
+			scalarOrMessage(f, t)
+		}
+
+		m.Field = append(m.Field, f)
+
+		return expect(";")
+	}
+
+	for pos < len(toks) {
+		switch tok := next(); tok {
+		case "syntax", "option":
+			for next() != ";" {
+			}
+		case "package":
+			fd.Package = proto.String(next())
+
+			if err := expect(";"); err != nil {
+				return nil, err
+			}
+		case "message":
+			m := &descriptorpb.DescriptorProto{Name: proto.String(next())}
+
+			if err := expect("{"); err != nil {
+				return nil, err
+			}
+
+			for t := next(); t != "}"; t = next() {
+				if t == "" {
+					return nil, fmt.Errorf("message %s not closed", m.GetName())
+				}
+
+				if t != "oneof" {
+					if err := field(m, t, nil); err != nil {
+						return nil, err
+					}
+
+					continue
+				}
+
+				idx := int32(len(m.OneofDecl))
+				m.OneofDecl = append(m.OneofDecl, &descriptorpb.OneofDescriptorProto{Name: proto.String(next())})
+
+				if err := expect("{"); err != nil {
+					return nil, err
+				}
+
+				for ot := next(); ot != "}"; ot = next() {
+					if err := field(m, ot, &idx); err != nil {
+						return nil, err
+					}
+				}
+			}
+
+			fd.MessageType = append(fd.MessageType, m)
+		default:
+			return nil, fmt.Errorf("unsupported %q at token %d", tok, pos)
+		}
+	}
+
+	return fd, nil
+}
+
+// protoEnvelope - описание Envelope из api/proto/mailsender.proto
+func protoEnvelope(t *testing.T) protoreflect.MessageDescriptor {
+	src, err := api.Schemas.ReadFile(protoFile)
+	if err != nil {
+		t.Fatalf("ReadFile error: %v", err)
+	}
+
+	fdp, err := parseProto(string(src))
+	if err != nil {
+		t.Fatalf("parse %s: %v", protoFile, err)
+	}
+
+	fd, err := protodesc.NewFile(fdp, nil)
+	if err != nil {
+		t.Fatalf("protodesc.NewFile error: %v", err)
+	}
+
+	md := fd.Messages().ByName("Envelope")
+	if md == nil {
+		t.Fatalf("no Envelope in %s", protoFile)
+	}
+
+	return md
+}
+
+// unknownFields - пути полей, которых нет в .proto или которые пришли не того типа
+func unknownFields(m protoreflect.Message, path string) []string {
+	var res []string
+
+	if len(m.GetUnknown()) > 0 {
+		res = append(res, path)
+	}
+
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		p := path + "." + string(fd.Name())
+
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil {
+				v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+					res = append(res, unknownFields(mv.Message(), p+"["+k.String()+"]")...)
+
+					return true
+				})
+			}
+		case fd.IsList() && fd.Message() != nil:
+			for i := 0; i < v.List().Len(); i++ {
+				res = append(res, unknownFields(v.List().Get(i).Message(), p+"["+strconv.Itoa(i)+"]")...)
+			}
+		case fd.Message() != nil:
+			res = append(res, unknownFields(v.Message(), p)...)
+		}
+
+		return true
+	})
+
+	return res
+}
+
+// get - значение по пути из имён полей и номеров элементов: "send_request.letters.0.template_id"
+func get(m protoreflect.Message, path string) interface{} {
+	var v protoreflect.Value
+
+	parts := strings.Split(path, ".")
+
+	for i := 0; i < len(parts); i++ {
+		fd := m.Descriptor().Fields().ByName(protoreflect.Name(parts[i]))
+		if fd == nil {
+			return nil
+		}
+
+		v = m.Get(fd)
+
+		switch {
+		case fd.IsMap():
+			i++
+
+			return v.Map().Get(protoreflect.ValueOfString(parts[i]).MapKey()).Interface()
+		case fd.IsList():
+			i++
+
+			n, _ := strconv.Atoi(parts[i])
+			if n >= v.List().Len() {
+				return nil
+			}
+
+			v = v.List().Get(n)
+		}
+
+		if fd.Message() != nil && i < len(parts)-1 {
+			m = v.Message()
+		}
+	}
+
+	return v.Interface()
+}
+
+// кодировка Protobuf совпадает с api/proto/mailsender.proto: сообщение разбирается по описанию из .proto
+// без неизвестных полей и с теми же значениями, а сообщение, закодированное по .proto, - нашим кодом
+func Test_ProtoContract(t *testing.T) {
+	md := protoEnvelope(t)
+
+	req, err := EncodeRequest(Protobuf, testLetters(), "bodyshop", "corr-1")
+	if err != nil {
+		t.Fatalf("EncodeRequest error: %v", err)
+	}
+
+	l := &letter.Letter{
+		ID:              primitive.NewObjectID(),
+		KafkaKey:        "k-1",
+		IdempotencyKey:  "order-42",
+		Token:           "t-1",
+		Status:          "partial",
+		Error:           "smtp: 550",
+		TemplateID:      "welcome",
+		TemplateVersion: 2,
+		Category:        "orders",
+		Addresses:       []string{"uuunet@mailto.plus"},
+		Recipients:      []letter.Recipient{{Address: "uuunet@mailto.plus", Status: "sent"}},
+		Suppressed:      []string{"s@mailto.plus"},
+		Invalid:         []string{"bad@"},
+	}
+
+	st, err := EncodeStatus(Protobuf, l, "mailsender")
+	if err != nil {
+		t.Fatalf("EncodeStatus error: %v", err)
+	}
+
+	for name, c := range map[string]struct {
+		b    []byte
+		want map[string]interface{}
+	}{
+		"request": {req, map[string]interface{}{
+			"schema_version":                     int32(1),
+			"type":                               "mailsender.send-request",
+			"producer":                           "bodyshop",
+			"correlation_id":                     "corr-1",
+			"send_request.letters.0.template_id": "welcome",
+			"send_request.letters.0.template_version":         int32(3),
+			"send_request.letters.0.personalize":              true,
+			"send_request.letters.0.track":                    true,
+			"send_request.letters.0.category":                 "orders",
+			"send_request.letters.0.idempotency_key":          "order-42",
+			"send_request.letters.0.recipients.0.address":     "uuunet@mailto.plus",
+			"send_request.letters.0.recipients.0.name":        "Иван",
+			"send_request.letters.0.recipients.0.vars.order":  "42",
+			"send_request.letters.0.recipients.0.locale":      "ru",
+			"send_request.letters.0.recipients.1.unsubscribe": "https://example.com/u/1",
+			"send_request.letters.1.addresses.1":              "b@mailto.plus",
+			"send_request.letters.1.subject":                  "тема",
+			"send_request.letters.1.body":                     "сообщение\n",
+			"send_request.letters.1.token":                    "t-1",
+			"send_request.letters.1.vars.x":                   "",
+			"send_request.letters.1.bulk":                     true,
+		}},
+		"status": {st, map[string]interface{}{
+			"type":                               "mailsender.letter-status",
+			"producer":                           "mailsender",
+			"letter_status.letter_id":            l.ID.Hex(),
+			"letter_status.kafka_key":            "k-1",
+			"letter_status.idempotency_key":      "order-42",
+			"letter_status.token":                "t-1",
+			"letter_status.status":               "partial",
+			"letter_status.error":                "smtp: 550",
+			"letter_status.template_id":          "welcome",
+			"letter_status.template_version":     int32(2),
+			"letter_status.category":             "orders",
+			"letter_status.addresses.0":          "uuunet@mailto.plus",
+			"letter_status.recipients.0.address": "uuunet@mailto.plus",
+			"letter_status.recipients.0.status":  "sent",
+			"letter_status.suppressed.0":         "s@mailto.plus",
+			"letter_status.invalid.0":            "bad@",
+		}},
+	} {
+		m := dynamicpb.NewMessage(md)
+
+		if err := proto.Unmarshal(c.b, m); err != nil {
+			t.Fatalf("%s: proto.Unmarshal error: %v", name, err)
+		}
+
+		if u := unknownFields(m, "Envelope"); len(u) > 0 {
+			t.Errorf("%s: fields not in %s: %v", name, protoFile, u)
+		}
+
+		for path, want := range c.want {
+			if got := get(m, path); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %s = %#v, want %#v", name, path, got, want)
+			}
+		}
+
+		if created, _ := get(m, "created_at").(int64); created <= 0 {
+			t.Errorf("%s: created_at %v", name, get(m, "created_at"))
+		}
+
+		// закодированное по .proto разбирается нашим кодом так же
+		b, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+		if err != nil {
+			t.Fatalf("%s: proto.Marshal error: %v", name, err)
+		}
+
+		if name == "request" {
+			got, _, err1 := DecodeRequest(Protobuf, b)
+			want, _, err2 := DecodeRequest(Protobuf, c.b)
+
+			if err1 != nil || err2 != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("request from .proto\n got %+v, %v\nwant %+v, %v", got, err1, want, err2)
+			}
+
+			continue
+		}
+
+		got, _, err1 := DecodeStatus(Protobuf, b)
+		want, _, err2 := DecodeStatus(Protobuf, c.b)
+
+		if err1 != nil || err2 != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("status from .proto\n got %+v, %v\nwant %+v, %v", got, err1, want, err2)
+		}
+	}
+}
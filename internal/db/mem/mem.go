@@ -11,22 +11,33 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/maris-cyber/mailsender/internal/event"
 	"github.com/maris-cyber/mailsender/internal/letter"
+	"github.com/maris-cyber/mailsender/internal/outbox"
+	"github.com/maris-cyber/mailsender/internal/suppress"
+	"github.com/maris-cyber/mailsender/internal/tmpl"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.uber.org/zap"
 )
 
 type DB struct {
-	Data []letter.Letter
-	mu   *sync.Mutex
-	ctx  context.Context
+	Data         []letter.Letter
+	Templates    []tmpl.Template
+	Events       []event.Event
+	Suppressions []suppress.Entry
+	Outbox       []outbox.Record
+	keys         map[string]bool // ключи идемпотентности писем
+	mu           *sync.Mutex
+	ctx          context.Context
 }
 
 func New(ctx context.Context) (*DB, error) {
 	qH := DB{}
 	qH.ctx = ctx
 	qH.mu = &sync.Mutex{}
+	qH.keys = make(map[string]bool)
 
 	return &qH, nil
 }
@@ -39,7 +50,26 @@ func (qH *DB) Create(t *letter.Letter) error {
 	zap.S().Debugf("Create %v\n", t)
 	qH.mu.Lock()
 	defer qH.mu.Unlock()
+
+	return qH.create(t)
+}
+
+func (qH *DB) create(t *letter.Letter) error {
+	if t.IdempotencyKey != "" {
+		if qH.keys[t.IdempotencyKey] {
+			return fmt.Errorf("%w: %s", letter.ErrDuplicate, t.IdempotencyKey)
+		}
+
+		qH.keys[t.IdempotencyKey] = true
+	}
+
+	// как и в mongo, у каждого письма свой ID: по нему меняется статус, строятся VERP и ссылки отслеживания
+	if t.ID.IsZero() {
+		t.ID = primitive.NewObjectID()
+	}
+
 	qH.Data = append(qH.Data, *t)
+	qH.Data[len(qH.Data)-1].Ack = nil // как и в mongo, подтверждение не сохраняется
 
 	return nil
 }
@@ -81,6 +111,180 @@ func (qH *DB) UpdateSttById(id primitive.ObjectID, stts string) error {
 	return fmt.Errorf("can't find id %v: ", id)
 }
 
+// сохранить результат обработки письма:
+// статус, статусы адресатов, адресатов, подавленных адресатов и причину ошибки
+func (qH *DB) UpdateResult(t *letter.Letter) error {
+	zap.S().Debugf("UpdateResult ID %v\n", t.ID)
+
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	return qH.updateResult(t)
+}
+
+func (qH *DB) updateResult(t *letter.Letter) error {
+	for i := range qH.Data {
+		if qH.Data[i].ID == t.ID {
+			qH.Data[i].Status = t.Status
+			qH.Data[i].Addresses = t.Addresses
+			qH.Data[i].Recipients = append([]letter.Recipient(nil), t.Recipients...)
+			qH.Data[i].Suppressed = t.Suppressed
+			qH.Data[i].Error = t.Error
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("can't find id %v: ", t.ID)
+}
+
+// сохранить письмо и запись outbox с его статусом, под одной блокировкой
+func (qH *DB) CreateWithOutbox(t *letter.Letter) error {
+	zap.S().Debugf("CreateWithOutbox %v\n", t)
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	if err := qH.create(t); err != nil {
+		return err
+	}
+
+	qH.Outbox = append(qH.Outbox, *outbox.New(t))
+
+	return nil
+}
+
+// сохранить результат обработки письма и запись outbox с его статусом, под одной блокировкой
+func (qH *DB) UpdateResultWithOutbox(t *letter.Letter) error {
+	zap.S().Debugf("UpdateResultWithOutbox ID %v\n", t.ID)
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	if err := qH.updateResult(t); err != nil {
+		return err
+	}
+
+	qH.Outbox = append(qH.Outbox, *outbox.New(t))
+
+	return nil
+}
+
+// недоставленные записи outbox по порядку
+func (qH *DB) PendingOutbox(limit int) ([]outbox.Record, error) {
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	var rs []outbox.Record
+
+	for _, r := range qH.Outbox {
+		if len(rs) == limit {
+			break
+		}
+
+		if !r.Delivered && !r.Failed {
+			rs = append(rs, r)
+		}
+	}
+
+	return rs, nil
+}
+
+// отметить записи outbox доставленными
+func (qH *DB) MarkDelivered(ids []primitive.ObjectID) error {
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	now := time.Now()
+
+	for _, id := range ids {
+		for i := range qH.Outbox {
+			if qH.Outbox[i].ID == id {
+				qH.Outbox[i].Delivered = true
+				qH.Outbox[i].DeliveredAt = now
+			}
+		}
+	}
+
+	return nil
+}
+
+// отметить запись outbox неудавшейся
+func (qH *DB) MarkFailed(id primitive.ObjectID, reason string) error {
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	for i := range qH.Outbox {
+		if qH.Outbox[i].ID == id {
+			qH.Outbox[i].Failed = true
+			qH.Outbox[i].Error = reason
+		}
+	}
+
+	return nil
+}
+
+// отметить постоянный отказ доставки адресату письма id,
+// возвращает адрес адресата (см. markRecipient)
+func (qH *DB) AddBounce(id primitive.ObjectID, idx int, address string) (string, error) {
+	zap.S().Debugf("AddBounce ID %v address %s\n", id, address)
+
+	return qH.markRecipient(id, idx, address, "bounced", func(l *letter.Letter) *[]string { return &l.Bounced })
+}
+
+// отметить жалобу адресата письма id,
+// возвращает адрес адресата (см. markRecipient)
+func (qH *DB) AddComplaint(id primitive.ObjectID, idx int, address string) (string, error) {
+	zap.S().Debugf("AddComplaint ID %v address %s\n", id, address)
+
+	return qH.markRecipient(id, idx, address, "complained", func(l *letter.Letter) *[]string { return &l.Complained })
+}
+
+// markRecipient добавляет адрес в список list письма id, а адресату персонального письма ставит статус stts;
+// если адрес неизвестен, адресат ищется по номеру idx и возвращается его адрес
+func (qH *DB) markRecipient(id primitive.ObjectID, idx int, address, stts string, list func(*letter.Letter) *[]string) (string, error) {
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	for i := range qH.Data {
+		if qH.Data[i].ID != id {
+			continue
+		}
+
+		l := &qH.Data[i]
+
+		if address == "" {
+			if idx < 0 || idx >= len(l.Recipients) {
+				return "", fmt.Errorf("no recipient %d in %v", idx, id)
+			}
+
+			address = l.Recipients[idx].Address
+		}
+
+		found := false
+
+		for _, a := range *list(l) {
+			if strings.EqualFold(a, address) {
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			*list(l) = append(*list(l), address)
+		}
+
+		for j := range l.Recipients {
+			if strings.EqualFold(l.Recipients[j].Address, address) {
+				l.Recipients[j].Status = stts
+			}
+		}
+
+		return address, nil
+	}
+
+	return "", fmt.Errorf("can't find id %v: ", id)
+}
+
 // изменить все статусы oldstts на newstts
 func (qH *DB) UpdateSttsAll(oldstts string, newstts string) error {
 	zap.S().Debugf("UpdateSttsAll oldstatus %s newstatus %s\n", oldstts, newstts)
@@ -149,6 +353,21 @@ func (qH *DB) List(stts string) ([]*letter.Letter, error) {
 	return rslt, nil
 }
 
+// записать событие по письму
+func (qH *DB) CreateEvent(e *event.Event) error {
+	zap.S().Debugf("CreateEvent %v\n", e)
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	if e.ID.IsZero() {
+		e.ID = primitive.NewObjectID()
+	}
+
+	qH.Events = append(qH.Events, *e)
+
+	return nil
+}
+
 func (qH *DB) SetContext(ctx context.Context) {
 	qH.ctx = ctx
 }
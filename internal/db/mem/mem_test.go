@@ -2,11 +2,13 @@ package mem
 
 import (
 	"context"
+	"errors"
 	"os"
 	"strconv"
 	"testing"
 
 	"github.com/maris-cyber/mailsender/internal/letter"
+	"github.com/maris-cyber/mailsender/internal/tmpl"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.uber.org/zap"
 )
@@ -110,3 +112,178 @@ func Test_CRUDl(t *testing.T) {
 		zap.S().Debugf("list %d:\n%v\n", i, l)
 	}
 }
+
+func Test_UpdateResult(t *testing.T) {
+	var tL letter.Letter
+
+	tL.Addresses = []string{"uuunet@mailto.plus", "yhuzfu@mailto.plus"}
+	tL.Body = "Здравствуйте, {{name}}"
+	tL.Subject = "персональное письмо"
+	tL.Status = "Personal"
+	tL.Personalize = true
+	tL.ID = primitive.NewObjectID()
+	tL.Expand()
+
+	if err := tdb.Create(&tL); err != nil {
+		t.Fatalf("Test MemDB can't create error:%v\n", err)
+	}
+
+	tL.Recipients[0].Status = "sent"
+	tL.Recipients[1].Status = "error"
+
+	if err := tdb.UpdateResult(&tL); err != nil {
+		t.Errorf("Test MemDB can't UpdateResult error: %v\n", err)
+	}
+
+	var tR letter.Letter
+
+	if err := tdb.Read(&tR, "Personal"); err != nil {
+		t.Fatalf("Test MemDB can't read error: %v\n", err)
+	}
+
+	if len(tR.Recipients) != 2 || tR.Recipients[0].Status != "sent" || tR.Recipients[1].Status != "error" {
+		t.Errorf("Test MemDB recipients not updated: %v\n", tR.Recipients)
+	}
+
+	tR.SetStatusFromRecipients()
+
+	if tR.Status != "partial" {
+		t.Errorf("Test MemDB letter status %s, want partial\n", tR.Status)
+	}
+}
+
+func Test_Templates(t *testing.T) {
+	// шаблон с ошибкой синтаксиса не сохраняется
+	bad := tmpl.Template{ID: "welcome", Subject: "Привет, {{.Name", Text: "версия 0"}
+	if err := tdb.CreateTemplate(&bad); !errors.Is(err, tmpl.ErrInvalid) {
+		t.Errorf("Test MemDB invalid template must not be created: %v\n", err)
+	}
+
+	v1 := tmpl.Template{ID: "welcome", Subject: "Привет, {{.Name}}", Text: "версия 1"}
+
+	if err := tdb.CreateTemplate(&v1); err != nil {
+		t.Fatalf("Test MemDB can't CreateTemplate: %v\n", err)
+	}
+
+	if v1.Version != 1 || v1.State != tmpl.Draft {
+		t.Errorf("Test MemDB new template must be draft version 1: %v\n", v1)
+	}
+
+	// черновик не виден как опубликованная версия
+	if _, err := tdb.GetTemplate("welcome", 0); !errors.Is(err, tmpl.ErrNotFound) {
+		t.Errorf("Test MemDB draft must not be published: %v\n", err)
+	}
+
+	if err := tdb.PublishTemplate("welcome", 1); err != nil {
+		t.Fatalf("Test MemDB can't PublishTemplate: %v\n", err)
+	}
+
+	// опубликованную версию менять нельзя
+	v1.Text = "изменено"
+	if err := tdb.UpdateTemplate(&v1); !errors.Is(err, tmpl.ErrNotDraft) {
+		t.Errorf("Test MemDB published template must not be updated: %v\n", err)
+	}
+
+	// письмо запоминает опубликованную версию
+	ltr := letter.Letter{TemplateID: "welcome"}
+	if err := tmpl.Pin(tdb, &ltr); err != nil || ltr.TemplateVersion != 1 {
+		t.Errorf("Test MemDB Pin: version %d error %v\n", ltr.TemplateVersion, err)
+	}
+
+	v2 := tmpl.Template{ID: "welcome", Subject: "Привет", Text: "версия 2"}
+	if err := tdb.CreateTemplate(&v2); err != nil || v2.Version != 2 {
+		t.Fatalf("Test MemDB can't CreateTemplate version 2: %v %v\n", v2, err)
+	}
+
+	// черновик нельзя изменить на шаблон с ошибкой и нельзя указать в письме
+	v2.Text = "{{end}}"
+	if err := tdb.UpdateTemplate(&v2); !errors.Is(err, tmpl.ErrInvalid) {
+		t.Errorf("Test MemDB invalid template must not be updated: %v\n", err)
+	}
+
+	draft := letter.Letter{TemplateID: "welcome", TemplateVersion: 2}
+	if err := tmpl.Pin(tdb, &draft); !errors.Is(err, tmpl.ErrNotPublished) {
+		t.Errorf("Test MemDB Pin draft: %v\n", err)
+	}
+
+	// черновик, сохранённый в обход проверки, не публикуется
+	tdb.mu.Lock()
+	tdb.Templates[len(tdb.Templates)-1].HTML = "{{if .x}}"
+	tdb.mu.Unlock()
+
+	if err := tdb.PublishTemplate("welcome", 2); !errors.Is(err, tmpl.ErrInvalid) {
+		t.Errorf("Test MemDB invalid template must not be published: %v\n", err)
+	}
+
+	tdb.mu.Lock()
+	tdb.Templates[len(tdb.Templates)-1].HTML = ""
+	tdb.mu.Unlock()
+
+	if err := tdb.PublishTemplate("welcome", 2); err != nil {
+		t.Fatalf("Test MemDB can't PublishTemplate: %v\n", err)
+	}
+
+	// письмо, поставленное в очередь раньше, получает свою версию
+	got, err := tdb.GetTemplate(ltr.TemplateID, ltr.TemplateVersion)
+	if err != nil || got.Text != "версия 1" {
+		t.Errorf("Test MemDB pinned template changed: %v %v\n", got, err)
+	}
+
+	v3 := tmpl.Template{ID: "welcome", Text: "версия 3"}
+	if err = tdb.CreateTemplate(&v3); err != nil {
+		t.Fatalf("Test MemDB can't CreateTemplate version 3: %v\n", err)
+	}
+
+	if err = tdb.DeleteTemplate("welcome", 3); err != nil {
+		t.Errorf("Test MemDB can't DeleteTemplate draft: %v\n", err)
+	}
+
+	if err = tdb.DeleteTemplate("welcome", 2); !errors.Is(err, tmpl.ErrNotDraft) {
+		t.Errorf("Test MemDB published template must not be deleted: %v\n", err)
+	}
+
+	lst, err := tdb.ListTemplates("welcome")
+	if err != nil || len(lst) != 2 {
+		t.Errorf("Test MemDB ListTemplates: %v %v\n", lst, err)
+	}
+}
+
+func Test_Duplicate(t *testing.T) {
+	tL := letter.Letter{
+		Addresses: []string{"uuunet@mailto.plus"},
+		Status:    "Duplicate",
+		KafkaKey:  "key",
+	}
+	tL.DefaultKey("topic/0/7", 1)
+
+	if tL.IdempotencyKey != "key:1" {
+		t.Errorf("Test MemDB IdempotencyKey %q, want key:1\n", tL.IdempotencyKey)
+	}
+
+	tL.ID = primitive.NewObjectID()
+	if err := tdb.Create(&tL); err != nil {
+		t.Fatalf("Test MemDB can't create error: %v\n", err)
+	}
+
+	// повторное чтение того же сообщения kafka
+	tL.ID = primitive.NewObjectID()
+	if err := tdb.Create(&tL); !errors.Is(err, letter.ErrDuplicate) {
+		t.Errorf("Test MemDB duplicate create error %v, want ErrDuplicate\n", err)
+	}
+
+	// без ключа kafka ключ получается из топика, партиции и смещения
+	tN := letter.Letter{Addresses: []string{"uuunet@mailto.plus"}, Status: "Duplicate"}
+	tN.DefaultKey("topic/0/7", 0)
+
+	if tN.IdempotencyKey != "topic/0/7:0" {
+		t.Errorf("Test MemDB IdempotencyKey %q, want topic/0/7:0\n", tN.IdempotencyKey)
+	}
+
+	// письма без ключа не проверяются
+	for i := 0; i < 2; i++ {
+		tE := letter.Letter{ID: primitive.NewObjectID(), Status: "Duplicate"}
+		if err := tdb.Create(&tE); err != nil {
+			t.Errorf("Test MemDB can't create letter without key: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package mem
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/suppress"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// список подавления в памяти
+
+func (qH *DB) AddSuppression(e *suppress.Entry) error {
+	zap.S().Debugf("AddSuppression %v\n", e)
+
+	if !e.Valid() {
+		return fmt.Errorf("bad suppression scope %q value %q", e.Scope, e.Value)
+	}
+
+	e.Address = suppress.Normalize(e.Address)
+	e.Created = time.Now()
+
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	for i := range qH.Suppressions {
+		s := &qH.Suppressions[i]
+		if s.Address == e.Address && s.Scope == e.Scope && s.Value == e.Value {
+			s.Reason = e.Reason
+			s.Created = e.Created
+			e.ID = s.ID
+
+			return nil
+		}
+	}
+
+	e.ID = primitive.NewObjectID()
+	qH.Suppressions = append(qH.Suppressions, *e)
+
+	return nil
+}
+
+func (qH *DB) FindSuppressions(addresses []string) ([]suppress.Entry, error) {
+	want := make(map[string]bool, len(addresses))
+	for _, a := range addresses {
+		want[suppress.Normalize(a)] = true
+	}
+
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	res := []suppress.Entry{}
+
+	for i := range qH.Suppressions {
+		if want[qH.Suppressions[i].Address] {
+			res = append(res, qH.Suppressions[i])
+		}
+	}
+
+	return res, nil
+}
+
+func (qH *DB) RemoveSuppression(address, scope, value string) error {
+	zap.S().Debugf("RemoveSuppression %s %s %s\n", address, scope, value)
+
+	address = suppress.Normalize(address)
+
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	for i := range qH.Suppressions {
+		s := &qH.Suppressions[i]
+		if s.Address == address && s.Scope == scope && s.Value == value {
+			qH.Suppressions = append(qH.Suppressions[:i], qH.Suppressions[i+1:]...)
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("suppression %s %s %s not found", address, scope, value)
+}
@@ -0,0 +1,186 @@
+package mem
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/tmpl"
+	"go.uber.org/zap"
+)
+
+// реестр шаблонов в памяти
+
+func (qH *DB) GetTemplate(id string, version int) (*tmpl.Template, error) {
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	var found *tmpl.Template
+
+	for i := range qH.Templates {
+		t := &qH.Templates[i]
+		if t.ID != id {
+			continue
+		}
+
+		if version != 0 && t.Version == version {
+			res := *t
+
+			return &res, nil
+		}
+
+		// последняя опубликованная
+		if version == 0 && t.State == tmpl.Published && (found == nil || t.Version > found.Version) {
+			found = t
+		}
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("template %s version %d: %w", id, version, tmpl.ErrNotFound)
+	}
+
+	res := *found
+
+	return &res, nil
+}
+
+func (qH *DB) CreateTemplate(t *tmpl.Template) error {
+	zap.S().Debugf("CreateTemplate %s\n", t.ID)
+
+	if t.ID == "" {
+		return fmt.Errorf("template id is empty")
+	}
+
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	t.Version = 0
+
+	for i := range qH.Templates {
+		if qH.Templates[i].ID == t.ID && qH.Templates[i].Version > t.Version {
+			t.Version = qH.Templates[i].Version
+		}
+	}
+
+	t.Version++
+	t.State = tmpl.Draft
+	t.Created = time.Now()
+	t.Updated = t.Created
+
+	qH.Templates = append(qH.Templates, *t)
+
+	return nil
+}
+
+func (qH *DB) UpdateTemplate(t *tmpl.Template) error {
+	zap.S().Debugf("UpdateTemplate %s version %d\n", t.ID, t.Version)
+
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	d, err := qH.draft(t.ID, t.Version)
+	if err != nil {
+		return err
+	}
+
+	d.Subject = t.Subject
+	d.HTML = t.HTML
+	d.Text = t.Text
+	d.Locales = t.Locales
+	d.Updated = time.Now()
+	*t = *d
+
+	return nil
+}
+
+func (qH *DB) PublishTemplate(id string, version int) error {
+	zap.S().Debugf("PublishTemplate %s version %d\n", id, version)
+
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	d, err := qH.draft(id, version)
+	if err != nil {
+		return err
+	}
+
+	// черновик мог быть сохранён до проверки шаблонов
+	if err = d.Validate(); err != nil {
+		return err
+	}
+
+	d.State = tmpl.Published
+	d.Updated = time.Now()
+
+	return nil
+}
+
+func (qH *DB) DeleteTemplate(id string, version int) error {
+	zap.S().Debugf("DeleteTemplate %s version %d\n", id, version)
+
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	if _, err := qH.draft(id, version); err != nil {
+		return err
+	}
+
+	for i := range qH.Templates {
+		if qH.Templates[i].ID == id && qH.Templates[i].Version == version {
+			qH.Templates = append(qH.Templates[:i], qH.Templates[i+1:]...)
+
+			break
+		}
+	}
+
+	return nil
+}
+
+func (qH *DB) ListTemplates(id string) ([]tmpl.Template, error) {
+	qH.mu.Lock()
+	defer qH.mu.Unlock()
+
+	res := make([]tmpl.Template, 0, len(qH.Templates))
+
+	for i := range qH.Templates {
+		if id == "" || qH.Templates[i].ID == id {
+			res = append(res, qH.Templates[i])
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].ID != res[j].ID {
+			return res[i].ID < res[j].ID
+		}
+
+		return res[i].Version < res[j].Version
+	})
+
+	return res, nil
+}
+
+// найти черновик, вызывается под блокировкой
+func (qH *DB) draft(id string, version int) (*tmpl.Template, error) {
+	for i := range qH.Templates {
+		t := &qH.Templates[i]
+		if t.ID != id || t.Version != version {
+			continue
+		}
+
+		if t.State != tmpl.Draft {
+			return nil, fmt.Errorf("template %s version %d: %w", id, version, tmpl.ErrNotDraft)
+		}
+
+		return t, nil
+	}
+
+	return nil, fmt.Errorf("template %s version %d: %w", id, version, tmpl.ErrNotFound)
+}
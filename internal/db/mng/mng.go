@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"sync"
 
+	"github.com/maris-cyber/mailsender/internal/event"
 	"github.com/maris-cyber/mailsender/internal/letter"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -17,6 +18,11 @@ import (
 
 type DB struct {
 	mCollection *mongo.Collection
+	tCollection *mongo.Collection // шаблоны писем
+	eCollection *mongo.Collection // события по письмам
+	sCollection *mongo.Collection // список подавления
+	oCollection *mongo.Collection // outbox статусов для kafka
+	noTxn       bool              // mongo без реплики, транзакции не поддерживаются
 	mClient     *mongo.Client
 	CfgMongo    MongoConfig
 	mu          *sync.Mutex
@@ -65,6 +71,41 @@ func (qH *DB) connectToDB() error {
 	}
 
 	qH.mCollection = qH.mClient.Database(qH.CfgMongo.dbName).Collection(qH.CfgMongo.dbCollection)
+	qH.tCollection = qH.mClient.Database(qH.CfgMongo.dbName).Collection(qH.CfgMongo.tplCollection)
+	qH.eCollection = qH.mClient.Database(qH.CfgMongo.dbName).Collection(qH.CfgMongo.evtCollection)
+	qH.sCollection = qH.mClient.Database(qH.CfgMongo.dbName).Collection(qH.CfgMongo.supCollection)
+	qH.oCollection = qH.mClient.Database(qH.CfgMongo.dbName).Collection(qH.CfgMongo.outCollection)
+
+	if err = qH.lettersIndex(); err != nil {
+		zap.S().Errorf("mongo lettersIndex error: %v", err)
+	}
+
+	if err = qH.templatesIndex(); err != nil {
+		zap.S().Errorf("mongo templatesIndex error: %v", err)
+	}
+
+	if err = qH.suppressionsIndex(); err != nil {
+		zap.S().Errorf("mongo suppressionsIndex error: %v", err)
+	}
+
+	if err = qH.outboxIndex(); err != nil {
+		zap.S().Errorf("mongo outboxIndex error: %v", err)
+	}
+
+	qH.detectTransactions()
+
+	return nil
+}
+
+// уникальный индекс по ключу идемпотентности, письма без ключа в индекс не попадают
+func (qH *DB) lettersIndex() error {
+	_, err := qH.mCollection.Indexes().CreateOne(qH.ctx, mongo.IndexModel{
+		Keys:    bson.D{primitive.E{Key: "idempotencykey", Value: 1}},
+		Options: options.Index().SetUnique(true).SetSparse(true),
+	})
+	if err != nil {
+		return fmt.Errorf("mongo letters index error: %v", err)
+	}
 
 	return nil
 }
@@ -83,8 +124,16 @@ func (qH *DB) Create(e *letter.Letter) error {
 		zap.S().Debug("mongo Create connectToDB pass")
 	}
 
-	res, err := qH.mCollection.InsertOne(qH.ctx, e)
+	return qH.insert(qH.ctx, e)
+}
+
+func (qH *DB) insert(ctx context.Context, e *letter.Letter) error {
+	res, err := qH.mCollection.InsertOne(ctx, e)
 	if err != nil {
+		if e.IdempotencyKey != "" && mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: %s", letter.ErrDuplicate, e.IdempotencyKey)
+		}
+
 		return fmt.Errorf("mongo Create error: %v", err)
 	}
 
@@ -108,7 +157,7 @@ func (qH *DB) Read(target *letter.Letter, stts string) error {
 	// работает, письма выбираются сначала самые ранние
 
 	options := options.FindOne()
-	options.SetSort(bson.D{{"datefield", 1}})
+	options.SetSort(bson.D{{Key: "datefield", Value: 1}})
 
 	filter := bson.D{primitive.E{Key: "status", Value: stts}}
 	result := qH.mCollection.FindOne(qH.ctx, filter, options)
@@ -140,6 +189,94 @@ func (qH *DB) UpdateSttById(id primitive.ObjectID, stts string) error {
 	return nil
 }
 
+// сохранить результат обработки письма:
+// статус, статусы адресатов, адресатов, подавленных адресатов и причину ошибки
+func (qH *DB) UpdateResult(e *letter.Letter) error {
+	return qH.updateResult(qH.ctx, e)
+}
+
+func (qH *DB) updateResult(ctx context.Context, e *letter.Letter) error {
+	update := bson.D{primitive.E{Key: "$set", Value: bson.D{
+		primitive.E{Key: "status", Value: e.Status},
+		primitive.E{Key: "addresses", Value: e.Addresses},
+		primitive.E{Key: "recipients", Value: e.Recipients},
+		primitive.E{Key: "suppressed", Value: e.Suppressed},
+		primitive.E{Key: "error", Value: e.Error},
+	}}}
+
+	res, err := qH.mCollection.UpdateByID(ctx, e.ID, update)
+	if err != nil {
+		zap.S().Debugf("Error updating result after processing QuElement: %v\n", err)
+
+		return fmt.Errorf("error updating result after processing QuElement: %v", err)
+	}
+
+	zap.S().Debugf("mongodb modified result: %v status: %s count: %d", e.ID, e.Status, res.ModifiedCount)
+
+	return nil
+}
+
+// отметить постоянный отказ доставки адресату письма id,
+// возвращает адрес адресата (см. markRecipient)
+func (qH *DB) AddBounce(id primitive.ObjectID, idx int, address string) (string, error) {
+	return qH.markRecipient(id, idx, address, "bounced", "bounced")
+}
+
+// отметить жалобу адресата письма id,
+// возвращает адрес адресата (см. markRecipient)
+func (qH *DB) AddComplaint(id primitive.ObjectID, idx int, address string) (string, error) {
+	return qH.markRecipient(id, idx, address, "complained", "complained")
+}
+
+// markRecipient добавляет адрес в поле field письма id, а адресату персонального письма ставит статус stts;
+// если адрес неизвестен, адресат ищется по номеру idx и возвращается его адрес
+func (qH *DB) markRecipient(id primitive.ObjectID, idx int, address, stts, field string) (string, error) {
+	if address == "" {
+		if idx < 0 {
+			return "", fmt.Errorf("mongo markRecipient: no recipient for %v", id)
+		}
+
+		var l letter.Letter
+
+		opts := options.FindOne().SetProjection(bson.D{primitive.E{Key: "recipients", Value: 1}})
+		if err := qH.mCollection.FindOne(qH.ctx, bson.D{primitive.E{Key: "_id", Value: id}}, opts).Decode(&l); err != nil {
+			return "", fmt.Errorf("mongo markRecipient error: %v", err)
+		}
+
+		if idx >= len(l.Recipients) {
+			return "", fmt.Errorf("mongo markRecipient: no recipient %d in %v", idx, id)
+		}
+
+		address = l.Recipients[idx].Address
+	}
+
+	update := bson.D{primitive.E{Key: "$addToSet", Value: bson.D{primitive.E{Key: field, Value: address}}}}
+
+	res, err := qH.mCollection.UpdateByID(qH.ctx, id, update)
+	if err != nil {
+		return "", fmt.Errorf("mongo markRecipient error: %v", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return "", fmt.Errorf("mongo markRecipient: can't find id %v", id)
+	}
+
+	// у письма одного на всех адресатов recipients нет, тогда ничего не изменится
+	filter := bson.D{
+		primitive.E{Key: "_id", Value: id},
+		primitive.E{Key: "recipients.address", Value: address},
+	}
+	update = bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "recipients.$.status", Value: stts}}}}
+
+	if _, err = qH.mCollection.UpdateOne(qH.ctx, filter, update); err != nil {
+		return "", fmt.Errorf("mongo markRecipient error: %v", err)
+	}
+
+	zap.S().Debugf("mongodb %s: %v address: %s", stts, id, address)
+
+	return address, nil
+}
+
 // // изменить все статусы oldstts на newstts
 func (qH *DB) UpdateSttsAll(oldstts string, newstts string) error {
 	update := bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "status", Value: newstts}}}}
@@ -174,6 +311,18 @@ func (qH *DB) Delete(id primitive.ObjectID) error {
 	return nil
 }
 
+// записать событие по письму
+func (qH *DB) CreateEvent(e *event.Event) error {
+	res, err := qH.eCollection.InsertOne(qH.ctx, e)
+	if err != nil {
+		return fmt.Errorf("mongo CreateEvent error: %v", err)
+	}
+
+	zap.S().Debugf("in mongo event inserted: %v\n", res)
+
+	return nil
+}
+
 func (qH *DB) Stop() error {
 	if err := qH.mClient.Disconnect(qH.ctx); err != nil {
 		return fmt.Errorf("mongo.Client.Diconnect error: %v", err)
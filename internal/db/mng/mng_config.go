@@ -17,12 +17,24 @@ const (
 	MONGODB_BASE       = "MONGODB_BASE_NAME"
 	Q_Collection       = "letters"
 	MONGODB_COLLECTION = "MONGODB_COLLECTION"
+	T_Collection       = "templates"
+	MONGODB_TEMPLATES  = "MONGODB_TEMPLATES_COLLECTION"
+	E_Collection       = "events"
+	MONGODB_EVENTS     = "MONGODB_EVENTS_COLLECTION"
+	S_Collection       = "suppressions"
+	MONGODB_SUPPRESS   = "MONGODB_SUPPRESSIONS_COLLECTION"
+	O_Collection       = "outbox"
+	MONGODB_OUTBOX     = "MONGODB_OUTBOX_COLLECTION"
 )
 
 type MongoConfig struct {
 	MongoDBConnectionString string
 	dbName                  string
 	dbCollection            string
+	tplCollection           string
+	evtCollection           string
+	supCollection           string
+	outCollection           string
 }
 
 func (c *MongoConfig) GetConfig() error {
@@ -54,6 +66,22 @@ func (c *MongoConfig) GetConfig() error {
 		c.dbCollection = Q_Collection
 	}
 
+	if c.tplCollection, ok = os.LookupEnv(MONGODB_TEMPLATES); !ok {
+		c.tplCollection = T_Collection
+	}
+
+	if c.evtCollection, ok = os.LookupEnv(MONGODB_EVENTS); !ok {
+		c.evtCollection = E_Collection
+	}
+
+	if c.supCollection, ok = os.LookupEnv(MONGODB_SUPPRESS); !ok {
+		c.supCollection = S_Collection
+	}
+
+	if c.outCollection, ok = os.LookupEnv(MONGODB_OUTBOX); !ok {
+		c.outCollection = O_Collection
+	}
+
 	if mongodb, ok := os.LookupEnv(HOME_DB); ok {
 		c.MongoDBConnectionString = mongodb
 	} else {
@@ -33,6 +33,18 @@ func TestMain(m *testing.M) {
 		if tdb.CfgMongo.dbCollection, ok = os.LookupEnv(MONGODB_COLLECTION); !ok {
 			tdb.CfgMongo.dbCollection = Q_Collection
 		}
+
+		if tdb.CfgMongo.tplCollection, ok = os.LookupEnv(MONGODB_TEMPLATES); !ok {
+			tdb.CfgMongo.tplCollection = T_Collection
+		}
+
+		if tdb.CfgMongo.evtCollection, ok = os.LookupEnv(MONGODB_EVENTS); !ok {
+			tdb.CfgMongo.evtCollection = E_Collection
+		}
+
+		if tdb.CfgMongo.supCollection, ok = os.LookupEnv(MONGODB_SUPPRESS); !ok {
+			tdb.CfgMongo.supCollection = S_Collection
+		}
 	}
 
 	zap.S().Debugf("Test mongo config: %v\n", tdb.CfgMongo)
@@ -0,0 +1,164 @@
+package mng
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"github.com/maris-cyber/mailsender/internal/outbox"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// доставленные записи outbox хранятся неделю
+const outboxTTL = 7 * 24 * time.Hour
+
+// индекс для выборки недоставленных по порядку и удаление старых доставленных
+func (qH *DB) outboxIndex() error {
+	_, err := qH.oCollection.Indexes().CreateMany(qH.ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{primitive.E{Key: "delivered", Value: 1}, primitive.E{Key: "_id", Value: 1}},
+		},
+		{
+			// у недоставленных deliveredat нет, TTL их не трогает
+			Keys:    bson.D{primitive.E{Key: "deliveredat", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(outboxTTL.Seconds())),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("mongo outbox index error: %v", err)
+	}
+
+	return nil
+}
+
+// detectTransactions выясняет, поддерживает ли сервер транзакции: их нет у mongo без реплики
+func (qH *DB) detectTransactions() {
+	var res struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+
+	if err := qH.mClient.Database("admin").RunCommand(qH.ctx, bson.D{primitive.E{Key: "isMaster", Value: 1}}).Decode(&res); err != nil {
+		zap.S().Errorf("mongo isMaster error: %v", err)
+
+		return
+	}
+
+	// реплика или mongos
+	qH.noTxn = res.SetName == "" && res.Msg != "isdbgrid"
+
+	if qH.noTxn {
+		zap.S().Info("mongo without replica set, outbox without transactions")
+	}
+}
+
+// withTransaction выполняет fn в транзакции
+// mongo без реплики транзакций не поддерживает, тогда fn выполняется без транзакции,
+// поэтому порядок записей в fn выбран так, чтобы и без неё статус не терялся и не появлялся лишний
+func (qH *DB) withTransaction(fn func(ctx context.Context) error) error {
+	if qH.noTxn {
+		return fn(qH.ctx)
+	}
+
+	return qH.mClient.UseSession(qH.ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, fn(sc)
+		})
+
+		return err
+	})
+}
+
+// сохранить письмо и запись outbox с его статусом в одной транзакции
+func (qH *DB) CreateWithOutbox(e *letter.Letter) error {
+	if e.ID.IsZero() {
+		e.ID = primitive.NewObjectID()
+	}
+
+	// сначала письмо: повтор (ErrDuplicate) не должен оставить запись outbox без письма
+	return qH.withTransaction(func(ctx context.Context) error {
+		if err := qH.insert(ctx, e); err != nil {
+			return err
+		}
+
+		if _, err := qH.oCollection.InsertOne(ctx, outbox.New(e)); err != nil {
+			return fmt.Errorf("mongo outbox insert error: %v", err)
+		}
+
+		return nil
+	})
+}
+
+// сохранить результат обработки письма и запись outbox с его статусом в одной транзакции
+func (qH *DB) UpdateResultWithOutbox(e *letter.Letter) error {
+	// сначала запись outbox: без транзакции статус может уйти в kafka дважды, но не потеряется
+	return qH.withTransaction(func(ctx context.Context) error {
+		if _, err := qH.oCollection.InsertOne(ctx, outbox.New(e)); err != nil {
+			return fmt.Errorf("mongo outbox insert error: %v", err)
+		}
+
+		return qH.updateResult(ctx, e)
+	})
+}
+
+// недоставленные записи outbox по порядку
+func (qH *DB) PendingOutbox(limit int) ([]outbox.Record, error) {
+	opts := options.Find().SetSort(bson.D{primitive.E{Key: "_id", Value: 1}}).SetLimit(int64(limit))
+
+	filter := bson.D{
+		primitive.E{Key: "delivered", Value: false},
+		primitive.E{Key: "failed", Value: bson.D{primitive.E{Key: "$ne", Value: true}}},
+	}
+
+	cur, err := qH.oCollection.Find(qH.ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("mongo PendingOutbox error: %v", err)
+	}
+
+	var rs []outbox.Record
+
+	if err = cur.All(qH.ctx, &rs); err != nil {
+		return nil, fmt.Errorf("mongo PendingOutbox error: %v", err)
+	}
+
+	return rs, nil
+}
+
+// отметить записи outbox доставленными
+func (qH *DB) MarkDelivered(ids []primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	filter := bson.D{primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: "$in", Value: ids}}}}
+	update := bson.D{primitive.E{Key: "$set", Value: bson.D{
+		primitive.E{Key: "delivered", Value: true},
+		primitive.E{Key: "deliveredat", Value: time.Now()},
+	}}}
+
+	if _, err := qH.oCollection.UpdateMany(qH.ctx, filter, update); err != nil {
+		return fmt.Errorf("mongo MarkDelivered error: %v", err)
+	}
+
+	return nil
+}
+
+// отметить запись outbox неудавшейся: она остаётся недоставленной, найти - {failed: true}
+func (qH *DB) MarkFailed(id primitive.ObjectID, reason string) error {
+	filter := bson.D{primitive.E{Key: "_id", Value: id}}
+	update := bson.D{primitive.E{Key: "$set", Value: bson.D{
+		primitive.E{Key: "failed", Value: true},
+		primitive.E{Key: "error", Value: reason},
+	}}}
+
+	if _, err := qH.oCollection.UpdateOne(qH.ctx, filter, update); err != nil {
+		return fmt.Errorf("mongo MarkFailed error: %v", err)
+	}
+
+	return nil
+}
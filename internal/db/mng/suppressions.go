@@ -0,0 +1,104 @@
+package mng
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/suppress"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// список подавления в отдельной коллекции
+// запись уникальна по адресу, области и значению, это обеспечивает индекс
+
+func (qH *DB) suppressionsIndex() error {
+	_, err := qH.sCollection.Indexes().CreateOne(qH.ctx, mongo.IndexModel{
+		Keys: bson.D{
+			primitive.E{Key: "address", Value: 1},
+			primitive.E{Key: "scope", Value: 1},
+			primitive.E{Key: "value", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("mongo suppressions index error: %v", err)
+	}
+
+	return nil
+}
+
+func suppressionFilter(address, scope, value string) bson.D {
+	return bson.D{
+		primitive.E{Key: "address", Value: suppress.Normalize(address)},
+		primitive.E{Key: "scope", Value: scope},
+		primitive.E{Key: "value", Value: value},
+	}
+}
+
+func (qH *DB) AddSuppression(e *suppress.Entry) error {
+	if !e.Valid() {
+		return fmt.Errorf("bad suppression scope %q value %q", e.Scope, e.Value)
+	}
+
+	e.Address = suppress.Normalize(e.Address)
+	e.Created = time.Now()
+
+	update := bson.D{
+		primitive.E{Key: "$set", Value: bson.D{
+			primitive.E{Key: "reason", Value: e.Reason},
+			primitive.E{Key: "created", Value: e.Created},
+		}},
+	}
+
+	res, err := qH.sCollection.UpdateOne(qH.ctx, suppressionFilter(e.Address, e.Scope, e.Value), update, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("mongo AddSuppression error: %v", err)
+	}
+
+	if id, ok := res.UpsertedID.(primitive.ObjectID); ok {
+		e.ID = id
+	}
+
+	zap.S().Debugf("mongo suppression %s %s %s added", e.Address, e.Scope, e.Value)
+
+	return nil
+}
+
+func (qH *DB) FindSuppressions(addresses []string) ([]suppress.Entry, error) {
+	norm := make([]string, len(addresses))
+	for i, a := range addresses {
+		norm[i] = suppress.Normalize(a)
+	}
+
+	filter := bson.D{primitive.E{Key: "address", Value: bson.D{primitive.E{Key: "$in", Value: norm}}}}
+
+	cur, err := qH.sCollection.Find(qH.ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("mongo FindSuppressions error: %v", err)
+	}
+
+	res := []suppress.Entry{}
+
+	if err = cur.All(qH.ctx, &res); err != nil {
+		return nil, fmt.Errorf("mongo FindSuppressions decode error: %v", err)
+	}
+
+	return res, nil
+}
+
+func (qH *DB) RemoveSuppression(address, scope, value string) error {
+	res, err := qH.sCollection.DeleteOne(qH.ctx, suppressionFilter(address, scope, value))
+	if err != nil {
+		return fmt.Errorf("mongo RemoveSuppression error: %v", err)
+	}
+
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("suppression %s %s %s not found", address, scope, value)
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package mng
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/tmpl"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// реестр шаблонов в отдельной коллекции
+// версия шаблона уникальна в пределах ID, это обеспечивает индекс
+
+func (qH *DB) templatesIndex() error {
+	_, err := qH.tCollection.Indexes().CreateOne(qH.ctx, mongo.IndexModel{
+		Keys:    bson.D{primitive.E{Key: "id", Value: 1}, primitive.E{Key: "version", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("mongo templates index error: %v", err)
+	}
+
+	return nil
+}
+
+func (qH *DB) GetTemplate(id string, version int) (*tmpl.Template, error) {
+	var t tmpl.Template
+
+	filter := bson.D{primitive.E{Key: "id", Value: id}}
+	opts := options.FindOne()
+
+	if version == 0 {
+		// последняя опубликованная версия
+		filter = append(filter, primitive.E{Key: "state", Value: tmpl.Published})
+		opts.SetSort(bson.D{primitive.E{Key: "version", Value: -1}})
+	} else {
+		filter = append(filter, primitive.E{Key: "version", Value: version})
+	}
+
+	err := qH.tCollection.FindOne(qH.ctx, filter, opts).Decode(&t)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("template %s version %d: %w", id, version, tmpl.ErrNotFound)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("mongo GetTemplate error: %v", err)
+	}
+
+	return &t, nil
+}
+
+func (qH *DB) CreateTemplate(t *tmpl.Template) error {
+	if t.ID == "" {
+		return fmt.Errorf("template id is empty")
+	}
+
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
+	// при одновременном создании версий индекс отклонит дубликат, пробуем ещё раз
+	for try := 0; try < 3; try++ {
+		var last tmpl.Template
+
+		opts := options.FindOne().SetSort(bson.D{primitive.E{Key: "version", Value: -1}})
+
+		err := qH.tCollection.FindOne(qH.ctx, bson.D{primitive.E{Key: "id", Value: t.ID}}, opts).Decode(&last)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return fmt.Errorf("mongo CreateTemplate error: %v", err)
+		}
+
+		t.Version = last.Version + 1
+		t.State = tmpl.Draft
+		t.Created = time.Now()
+		t.Updated = t.Created
+
+		_, err = qH.tCollection.InsertOne(qH.ctx, t)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("mongo CreateTemplate error: %v", err)
+		}
+
+		zap.S().Debugf("mongo template %s version %d created", t.ID, t.Version)
+
+		return nil
+	}
+
+	return fmt.Errorf("mongo CreateTemplate: too many concurrent versions of %s", t.ID)
+}
+
+func (qH *DB) UpdateTemplate(t *tmpl.Template) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
+	update := bson.D{primitive.E{Key: "$set", Value: bson.D{
+		primitive.E{Key: "subject", Value: t.Subject},
+		primitive.E{Key: "html", Value: t.HTML},
+		primitive.E{Key: "text", Value: t.Text},
+		primitive.E{Key: "locales", Value: t.Locales},
+		primitive.E{Key: "updated", Value: time.Now()},
+	}}}
+
+	if err := qH.updateDraft(t.ID, t.Version, update); err != nil {
+		return err
+	}
+
+	res, err := qH.GetTemplate(t.ID, t.Version)
+	if err != nil {
+		return err
+	}
+
+	*t = *res
+
+	return nil
+}
+
+func (qH *DB) PublishTemplate(id string, version int) error {
+	// черновик мог быть сохранён до проверки шаблонов
+	t, err := qH.GetTemplate(id, version)
+	if err != nil {
+		return err
+	}
+
+	if t.State == tmpl.Draft {
+		if err = t.Validate(); err != nil {
+			return err
+		}
+	}
+
+	update := bson.D{primitive.E{Key: "$set", Value: bson.D{
+		primitive.E{Key: "state", Value: tmpl.Published},
+		primitive.E{Key: "updated", Value: time.Now()},
+	}}}
+
+	return qH.updateDraft(id, version, update)
+}
+
+func (qH *DB) DeleteTemplate(id string, version int) error {
+	res, err := qH.tCollection.DeleteOne(qH.ctx, draftFilter(id, version))
+	if err != nil {
+		return fmt.Errorf("mongo DeleteTemplate error: %v", err)
+	}
+
+	if res.DeletedCount == 0 {
+		return qH.notDraft(id, version)
+	}
+
+	return nil
+}
+
+func (qH *DB) ListTemplates(id string) ([]tmpl.Template, error) {
+	filter := bson.D{}
+	if id != "" {
+		filter = bson.D{primitive.E{Key: "id", Value: id}}
+	}
+
+	opts := options.Find().SetSort(bson.D{primitive.E{Key: "id", Value: 1}, primitive.E{Key: "version", Value: 1}})
+
+	cur, err := qH.tCollection.Find(qH.ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("mongo ListTemplates error: %v", err)
+	}
+
+	res := []tmpl.Template{}
+
+	if err = cur.All(qH.ctx, &res); err != nil {
+		return nil, fmt.Errorf("mongo ListTemplates decode error: %v", err)
+	}
+
+	return res, nil
+}
+
+func draftFilter(id string, version int) bson.D {
+	return bson.D{
+		primitive.E{Key: "id", Value: id},
+		primitive.E{Key: "version", Value: version},
+		primitive.E{Key: "state", Value: tmpl.Draft},
+	}
+}
+
+func (qH *DB) updateDraft(id string, version int, update bson.D) error {
+	res, err := qH.tCollection.UpdateOne(qH.ctx, draftFilter(id, version), update)
+	if err != nil {
+		return fmt.Errorf("mongo update template error: %v", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return qH.notDraft(id, version)
+	}
+
+	return nil
+}
+
+// объяснить, почему черновик не найден: версии нет или она уже опубликована
+func (qH *DB) notDraft(id string, version int) error {
+	if _, err := qH.GetTemplate(id, version); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("template %s version %d: %w", id, version, tmpl.ErrNotDraft)
+}
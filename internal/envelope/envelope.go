@@ -0,0 +1,248 @@
+/*
+envelope - пакет, описывающий контракт сообщений kafka:
+конверт с версией схемы, типом сообщения, отправителем, временем и сквозным ID,
+внутри которого запрос на отправку писем, статус письма или событие по письму.
+Схемы JSON лежат в api/schema, по ним другие команды могут проверять свои сообщения.
+
+Старый формат запроса - голый массив писем с полями в именах Go - по-прежнему принимается.
+*/
+package envelope
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/event"
+	"github.com/maris-cyber/mailsender/internal/letter"
+)
+
+// текущая версия схемы, сообщения с большей версией не принимаются
+const Version = 1
+
+// типы сообщений
+const (
+	TypeSendRequest  = "mailsender.send-request"  // запрос на отправку писем
+	TypeLetterStatus = "mailsender.letter-status" // статус обработки письма
+	TypeLetterEvent  = "mailsender.letter-event"  // событие по письму: открытие, переход, отписка, отказ, жалоба
+)
+
+// Envelope - конверт сообщения, Data зависит от Type
+type Envelope struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Type          string          `json:"type"`
+	Producer      string          `json:"producer,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	CorrelationID string          `json:"correlationId,omitempty"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// SendRequest - данные запроса на отправку
+type SendRequest struct {
+	Letters []Letter `json:"letters"`
+}
+
+// Letter - письмо в запросе
+type Letter struct {
+	Addresses       []string          `json:"addresses,omitempty"`
+	Recipients      []Recipient       `json:"recipients,omitempty"`
+	Subject         string            `json:"subject,omitempty"`
+	Body            string            `json:"body,omitempty"`
+	Token           string            `json:"token,omitempty"`
+	Personalize     bool              `json:"personalize,omitempty"`
+	TemplateID      string            `json:"templateId,omitempty"`
+	TemplateVersion int               `json:"templateVersion,omitempty"`
+	Vars            map[string]string `json:"vars,omitempty"`
+	Locale          string            `json:"locale,omitempty"`
+	Track           bool              `json:"track,omitempty"`
+	Category        string            `json:"category,omitempty"`
+	Bulk            bool              `json:"bulk,omitempty"`
+	IdempotencyKey  string            `json:"idempotencyKey,omitempty"`
+}
+
+type Recipient struct {
+	Address     string            `json:"address"`
+	Name        string            `json:"name,omitempty"`
+	Unsubscribe string            `json:"unsubscribe,omitempty"`
+	Vars        map[string]string `json:"vars,omitempty"`
+	Locale      string            `json:"locale,omitempty"`
+}
+
+// LetterStatus - статус письма для profile, без темы и тела
+type LetterStatus struct {
+	LetterID        string            `json:"letterId,omitempty"`
+	KafkaKey        string            `json:"kafkaKey,omitempty"`
+	IdempotencyKey  string            `json:"idempotencyKey,omitempty"`
+	Token           string            `json:"token,omitempty"`
+	Status          string            `json:"status"`
+	Error           string            `json:"error,omitempty"`
+	TemplateID      string            `json:"templateId,omitempty"`
+	TemplateVersion int               `json:"templateVersion,omitempty"`
+	Category        string            `json:"category,omitempty"`
+	Addresses       []string          `json:"addresses,omitempty"`
+	Recipients      []RecipientStatus `json:"recipients,omitempty"`
+	Suppressed      []string          `json:"suppressed,omitempty"`
+	Invalid         []string          `json:"invalid,omitempty"`
+}
+
+type RecipientStatus struct {
+	Address string `json:"address"`
+	Status  string `json:"status,omitempty"`
+}
+
+// Meta - поля конверта запроса, нужные дальше
+type Meta struct {
+	Legacy        bool // старый формат - массив писем
+	Producer      string
+	CreatedAt     time.Time
+	CorrelationID string
+}
+
+// DecodeRequest разбирает запрос на отправку в новом или старом формате
+// в письмах проставляется CorrelationID из конверта
+func DecodeRequest(b []byte) ([]letter.Letter, Meta, error) {
+	b = bytes.TrimSpace(b)
+
+	if len(b) > 0 && b[0] == '[' {
+		var tL []letter.Letter
+
+		if err := json.Unmarshal(b, &tL); err != nil {
+			return nil, Meta{Legacy: true}, fmt.Errorf("legacy request: %v", err)
+		}
+
+		return tL, Meta{Legacy: true}, nil
+	}
+
+	var e Envelope
+
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, Meta{}, fmt.Errorf("envelope: %v", err)
+	}
+
+	meta := Meta{Producer: e.Producer, CreatedAt: e.CreatedAt, CorrelationID: e.CorrelationID}
+
+	if err := Check(e.SchemaVersion, e.Type, TypeSendRequest); err != nil {
+		return nil, meta, err
+	}
+
+	var req SendRequest
+
+	if err := json.Unmarshal(e.Data, &req); err != nil {
+		return nil, meta, fmt.Errorf("send request: %v", err)
+	}
+
+	return req.Queue(e.CorrelationID), meta, nil
+}
+
+// Check проверяет версию схемы и тип сообщения, общая для всех кодировок
+func Check(version int, typ, want string) error {
+	if version < 1 || version > Version {
+		return fmt.Errorf("unsupported schema version %d", version)
+	}
+
+	if typ != want {
+		return fmt.Errorf("unexpected message type %q", typ)
+	}
+
+	return nil
+}
+
+// Queue - письма очереди из запроса, с CorrelationID из конверта
+func (req *SendRequest) Queue(correlationID string) []letter.Letter {
+	tL := make([]letter.Letter, len(req.Letters))
+	for i := range req.Letters {
+		req.Letters[i].To(&tL[i])
+		tL[i].CorrelationID = correlationID
+	}
+
+	return tL
+}
+
+// EncodeRequest - запрос на отправку в конверте, для тестов и http
+func EncodeRequest(letters []Letter, producer, correlationID string) ([]byte, error) {
+	return encode(TypeSendRequest, producer, correlationID, SendRequest{Letters: letters})
+}
+
+// EncodeStatus - статус письма в конверте
+func EncodeStatus(l *letter.Letter, producer string) ([]byte, error) {
+	return encode(TypeLetterStatus, producer, l.CorrelationID, StatusOf(l))
+}
+
+// EncodeEvent - событие по письму в конверте
+func EncodeEvent(e *event.Event, producer string) ([]byte, error) {
+	return encode(TypeLetterEvent, producer, "", e)
+}
+
+func encode(typ, producer, correlationID string, data interface{}) ([]byte, error) {
+	d, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(Envelope{
+		SchemaVersion: Version,
+		Type:          typ,
+		Producer:      producer,
+		CreatedAt:     time.Now().UTC(),
+		CorrelationID: correlationID,
+		Data:          d,
+	})
+}
+
+// To переносит письмо из запроса в письмо очереди
+func (r *Letter) To(l *letter.Letter) {
+	l.Addresses = r.Addresses
+	l.Subject = r.Subject
+	l.Body = r.Body
+	l.Token = r.Token
+	l.Personalize = r.Personalize
+	l.TemplateID = r.TemplateID
+	l.TemplateVersion = r.TemplateVersion
+	l.Vars = r.Vars
+	l.Locale = r.Locale
+	l.Track = r.Track
+	l.Category = r.Category
+	l.Bulk = r.Bulk
+	l.IdempotencyKey = r.IdempotencyKey
+
+	if len(r.Recipients) > 0 {
+		l.Recipients = make([]letter.Recipient, len(r.Recipients))
+		for i, rc := range r.Recipients {
+			l.Recipients[i] = letter.Recipient{
+				Address:     rc.Address,
+				Name:        rc.Name,
+				Unsubscribe: rc.Unsubscribe,
+				Vars:        rc.Vars,
+				Locale:      rc.Locale,
+			}
+		}
+	}
+}
+
+// StatusOf - статус письма очереди
+func StatusOf(l *letter.Letter) LetterStatus {
+	s := LetterStatus{
+		KafkaKey:        l.KafkaKey,
+		IdempotencyKey:  l.IdempotencyKey,
+		Token:           l.Token,
+		Status:          l.Status,
+		Error:           l.Error,
+		TemplateID:      l.TemplateID,
+		TemplateVersion: l.TemplateVersion,
+		Category:        l.Category,
+		Addresses:       l.Addresses,
+		Suppressed:      l.Suppressed,
+		Invalid:         l.Invalid,
+	}
+
+	if !l.ID.IsZero() {
+		s.LetterID = l.ID.Hex()
+	}
+
+	for _, r := range l.Recipients {
+		s.Recipients = append(s.Recipients, RecipientStatus{Address: r.Address, Status: r.Status})
+	}
+
+	return s
+}
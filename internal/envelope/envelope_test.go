@@ -0,0 +1,268 @@
+package envelope
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/maris-cyber/mailsender/internal/event"
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const schemaDir = "../../api/schema"
+
+func Test_DecodeLegacy(t *testing.T) {
+	tL, meta, err := DecodeRequest([]byte(` [{"Subject":"тема","Body":"сообщение","Addresses":["uuunet@mailto.plus"]}]`))
+	if err != nil {
+		t.Fatalf("DecodeRequest legacy error: %v", err)
+	}
+
+	if !meta.Legacy || len(tL) != 1 || tL[0].Subject != "тема" || tL[0].Addresses[0] != "uuunet@mailto.plus" {
+		t.Errorf("DecodeRequest legacy = %+v, %+v", tL, meta)
+	}
+
+	// исходное MIME сообщение принимается только по smtp и от sendmail, не из json
+	tL, _, err = DecodeRequest([]byte(`[{"Subject":"тема","Addresses":["uuunet@mailto.plus"],"Raw":"From: boss@example.com\r\n\r\nhi"}]`))
+	if err != nil || len(tL) != 1 || tL[0].Raw != "" {
+		t.Errorf("DecodeRequest legacy with Raw = %+v, %v", tL, err)
+	}
+}
+
+func Test_DecodeEnvelope(t *testing.T) {
+	b, err := EncodeRequest([]Letter{{
+		Recipients:     []Recipient{{Address: "uuunet@mailto.plus", Name: "Иван", Vars: map[string]string{"order": "42"}}},
+		TemplateID:     "welcome",
+		Personalize:    true,
+		IdempotencyKey: "order-42",
+	}}, "bodyshop", "corr-1")
+	if err != nil {
+		t.Fatalf("EncodeRequest error: %v", err)
+	}
+
+	tL, meta, err := DecodeRequest(b)
+	if err != nil {
+		t.Fatalf("DecodeRequest error: %v", err)
+	}
+
+	if meta.Legacy || meta.Producer != "bodyshop" || meta.CorrelationID != "corr-1" || meta.CreatedAt.IsZero() {
+		t.Errorf("DecodeRequest meta %+v", meta)
+	}
+
+	if len(tL) != 1 {
+		t.Fatalf("DecodeRequest letters %+v", tL)
+	}
+
+	l := tL[0]
+	if l.TemplateID != "welcome" || !l.Personalize || l.IdempotencyKey != "order-42" || l.CorrelationID != "corr-1" ||
+		len(l.Recipients) != 1 || l.Recipients[0].Name != "Иван" || l.Recipients[0].Vars["order"] != "42" {
+		t.Errorf("DecodeRequest letter %+v", l)
+	}
+
+	for _, bad := range []string{
+		`{"schemaVersion":2,"type":"mailsender.send-request","data":{"letters":[]}}`,
+		`{"schemaVersion":1,"type":"mailsender.letter-status","data":{}}`,
+		`{"schemaVersion":1,"type":"mailsender.send-request","data":{"letters":{}}}`,
+		`{"schemaVersion":1`,
+		`[{"Addresses":"uuunet@mailto.plus"}]`,
+	} {
+		if _, _, err = DecodeRequest([]byte(bad)); err == nil {
+			t.Errorf("DecodeRequest(%s): want error", bad)
+		}
+	}
+}
+
+func Test_EncodeStatus(t *testing.T) {
+	l := letter.Letter{
+		ID:            primitive.NewObjectID(),
+		Subject:       "тема",
+		Body:          "тело не уходит в profile",
+		Status:        "partial",
+		KafkaKey:      "key",
+		CorrelationID: "corr-1",
+		Recipients:    []letter.Recipient{{Address: "uuunet@mailto.plus", Status: "sent"}, {Address: "bad@", Status: "invalid"}},
+		Invalid:       []string{"bad@"},
+	}
+
+	b, err := EncodeStatus(&l, "mailsender")
+	if err != nil {
+		t.Fatalf("EncodeStatus error: %v", err)
+	}
+
+	if strings.Contains(string(b), "тело") {
+		t.Errorf("EncodeStatus contains body: %s", b)
+	}
+
+	var e Envelope
+	if err = json.Unmarshal(b, &e); err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+
+	var s LetterStatus
+	if err = json.Unmarshal(e.Data, &s); err != nil {
+		t.Fatalf("Unmarshal data error: %v", err)
+	}
+
+	if e.Type != TypeLetterStatus || e.SchemaVersion != Version || e.CorrelationID != "corr-1" ||
+		s.LetterID != l.ID.Hex() || s.Status != "partial" || len(s.Recipients) != 2 || s.Recipients[1].Status != "invalid" {
+		t.Errorf("EncodeStatus = %s", b)
+	}
+
+	// статус соответствует схеме
+	checkSchema(t, loadSchema(t, "letter-status.v1.json"), decode(t, b), "")
+
+	// статусы адресатов после отказа и жалобы тоже
+	l.Recipients = append(l.Recipients, letter.Recipient{Address: "yhuzfu@mailto.plus", Status: "bounced"}, letter.Recipient{Address: "suocq@mailto.plus", Status: "complained"})
+
+	if b, err = EncodeStatus(&l, "mailsender"); err != nil {
+		t.Fatalf("EncodeStatus error: %v", err)
+	}
+
+	checkSchema(t, loadSchema(t, "letter-status.v1.json"), decode(t, b), "")
+}
+
+func Test_EncodeEvent(t *testing.T) {
+	schema := loadSchema(t, "letter-event.v1.json")
+	props := schema["properties"].(map[string]interface{})
+
+	checkFields(t, reflect.TypeOf(event.Event{}), props["data"].(map[string]interface{}))
+
+	e := event.New(event.Click, primitive.NewObjectID().Hex(), "uuunet@mailto.plus")
+	e.URL = "https://example.com/"
+	e.UserAgent = "test"
+
+	b, err := EncodeEvent(e, "mailsender")
+	if err != nil {
+		t.Fatalf("EncodeEvent error: %v", err)
+	}
+
+	m := decode(t, b)
+	data := m["data"].(map[string]interface{})
+
+	if m["type"] != TypeLetterEvent || data["letterId"] != e.LetterID || data["userAgent"] != "test" {
+		t.Errorf("EncodeEvent = %s", b)
+	}
+
+	checkSchema(t, schema, m, "")
+}
+
+// поля DTO совпадают со свойствами схемы запроса
+func Test_RequestSchema(t *testing.T) {
+	schema := loadSchema(t, "send-request.v1.json")
+	defs := schema["$defs"].(map[string]interface{})
+
+	checkFields(t, reflect.TypeOf(Letter{}), defs["letter"].(map[string]interface{}))
+	checkFields(t, reflect.TypeOf(Recipient{}), defs["recipient"].(map[string]interface{}))
+
+	b, err := EncodeRequest([]Letter{{Addresses: []string{"uuunet@mailto.plus"}, Subject: "тема"}}, "test", "")
+	if err != nil {
+		t.Fatalf("EncodeRequest error: %v", err)
+	}
+
+	req := decode(t, b)
+	data := req["data"].(map[string]interface{})
+	letters := data["letters"].([]interface{})
+
+	checkSchema(t, schema, req, "")
+	checkSchema(t, defs["letter"].(map[string]interface{}), letters[0].(map[string]interface{}), "letters[0]")
+}
+
+func loadSchema(t *testing.T, name string) map[string]interface{} {
+	b, err := os.ReadFile(filepath.Join(schemaDir, name))
+	if err != nil {
+		t.Fatalf("can't read schema %s: %v", name, err)
+	}
+
+	return decode(t, b)
+}
+
+func decode(t *testing.T, b []byte) map[string]interface{} {
+	var m map[string]interface{}
+
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("Unmarshal %s error: %v", b, err)
+	}
+
+	return m
+}
+
+// checkSchema - упрощённая проверка объекта: обязательные свойства есть, лишних нет,
+// вложенные объекты и массивы объектов проверяются так же, ссылки $ref проверяются отдельно
+func checkSchema(t *testing.T, schema, obj map[string]interface{}, path string) {
+	if _, ok := schema["$ref"]; ok {
+		return
+	}
+
+	props, _ := schema["properties"].(map[string]interface{})
+
+	if req, ok := schema["required"].([]interface{}); ok {
+		for _, r := range req {
+			if _, ok := obj[r.(string)]; !ok {
+				t.Errorf("%s: required property %s missing", path, r)
+			}
+		}
+	}
+
+	for k, v := range obj {
+		p, ok := props[k].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: property %s not in schema", path, k)
+
+			continue
+		}
+
+		switch v := v.(type) {
+		case map[string]interface{}:
+			checkSchema(t, p, v, path+"."+k)
+		case []interface{}:
+			items, _ := p["items"].(map[string]interface{})
+			for _, it := range v {
+				if o, ok := it.(map[string]interface{}); ok && items != nil {
+					checkSchema(t, items, o, path+"."+k+"[]")
+				}
+			}
+		}
+
+		if enum, ok := p["enum"].([]interface{}); ok {
+			found := false
+
+			for _, e := range enum {
+				if e == v {
+					found = true
+				}
+			}
+
+			if !found {
+				t.Errorf("%s.%s: %v not in %v", path, k, v, enum)
+			}
+		}
+	}
+}
+
+// checkFields - у каждого json поля структуры есть свойство в схеме и наоборот
+func checkFields(t *testing.T, typ reflect.Type, schema map[string]interface{}) {
+	props := schema["properties"].(map[string]interface{})
+	fields := make(map[string]bool)
+
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+
+		fields[name] = true
+
+		if _, ok := props[name]; !ok {
+			t.Errorf("%s.%s: field not in schema", typ.Name(), name)
+		}
+	}
+
+	for k := range props {
+		if !fields[k] {
+			t.Errorf("%s: schema property %s has no field", typ.Name(), k)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// event - определение сущности событие по письму (открытие, переход по ссылке, отписка и т.п.)
+package event
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	Open        = "open"
+	Click       = "click"
+	Unsubscribe = "unsubscribe"
+	Bounce      = "bounce"    // постоянный отказ доставки
+	Delay       = "delay"     // временный отказ, сервер получателя ещё пытается доставить
+	Complaint   = "complaint" // жалоба получателя по feedback loop (ARF)
+)
+
+// json - данные события в конверте (api/schema/letter-event.v1.json)
+type Event struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Type       string             `bson:"type" json:"type"`
+	LetterID   string             `bson:"letterid" json:"letterId"`
+	Address    string             `bson:"address,omitempty" json:"address,omitempty"`       // адресат
+	URL        string             `bson:"url,omitempty" json:"url,omitempty"`               // для click - куда перешли
+	Category   string             `bson:"category,omitempty" json:"category,omitempty"`     // для unsubscribe - от какой категории отписались
+	Tenant     string             `bson:"tenant,omitempty" json:"tenant,omitempty"`         // для unsubscribe - токен письма
+	UserAgent  string             `bson:"useragent,omitempty" json:"userAgent,omitempty"`   // для open и click - браузер, для complaint - кто сформировал отчёт
+	Status     string             `bson:"status,omitempty" json:"status,omitempty"`         // для bounce и delay - код статуса доставки, например 5.1.1, для complaint - Feedback-Type
+	Diagnostic string             `bson:"diagnostic,omitempty" json:"diagnostic,omitempty"` // для bounce и delay - ответ сервера получателя
+	Time       time.Time          `bson:"time" json:"time"`
+}
+
+func New(typ, letterID, address string) *Event {
+	return &Event{
+		Type:     typ,
+		LetterID: letterID,
+		Address:  address,
+		Time:     time.Now(),
+	}
+}
@@ -0,0 +1,417 @@
+package htmlproc
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// встраивание CSS
+// поддерживаются простые селекторы: tag, .class, #id, *, их сочетания (p.note#x)
+// и потомки через пробел (table td.cell), а также группы через запятую;
+// правила с другими селекторами (:hover, >, [attr]) и @-правила (@media)
+// встроить нельзя, они остаются в блоке <style>
+
+type decl struct {
+	prop      string
+	val       string
+	important bool
+}
+
+// compound - простой селектор без комбинаторов
+type compound struct {
+	tag     string // "" или "*" - любой
+	id      string
+	classes []string
+}
+
+type selector struct {
+	parts []compound // слева направо, между ними - потомок
+	spec  int
+}
+
+type rule struct {
+	sels  []selector
+	decls []decl
+}
+
+// применённое к элементу объявление
+type applied struct {
+	decl
+	spec  int
+	order int
+}
+
+var compoundRE = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9-]*|\*)?((?:[.#][a-zA-Z_-][a-zA-Z0-9_-]*)*)$`)
+var partRE = regexp.MustCompile(`[.#][^.#]+`)
+var commentRE = regexp.MustCompile(`(?s)/\*.*?\*/`)
+
+func inlineCSS(doc *html.Node) {
+	var (
+		styles []*html.Node
+		css    strings.Builder
+	)
+
+	collectStyles(doc, &styles)
+
+	if len(styles) == 0 {
+		return
+	}
+
+	for _, s := range styles {
+		for c := s.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.TextNode {
+				css.WriteString(c.Data)
+				css.WriteString("\n")
+			}
+		}
+	}
+
+	rules, residual := parseCSS(css.String())
+
+	order := 0
+	applyRules(doc, rules, &order)
+
+	// то, что не встроилось, остаётся в первом блоке <style>
+	for i, s := range styles {
+		if i == 0 && residual != "" {
+			for c := s.FirstChild; c != nil; c = s.FirstChild {
+				s.RemoveChild(c)
+			}
+
+			s.AppendChild(&html.Node{Type: html.TextNode, Data: residual})
+
+			continue
+		}
+
+		s.Parent.RemoveChild(s)
+	}
+}
+
+func collectStyles(n *html.Node, styles *[]*html.Node) {
+	if n.Type == html.ElementNode && n.DataAtom == atom.Style {
+		*styles = append(*styles, n)
+
+		return
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		collectStyles(c, styles)
+	}
+}
+
+// разобрать таблицу стилей на встраиваемые правила и остаток
+func parseCSS(css string) ([]rule, string) {
+	var (
+		rules    []rule
+		residual strings.Builder
+	)
+
+	css = commentRE.ReplaceAllString(css, "")
+
+	for {
+		css = strings.TrimSpace(css)
+		if css == "" {
+			break
+		}
+
+		if css[0] == '@' {
+			end := atRuleEnd(css)
+			residual.WriteString(strings.TrimSpace(css[:end]))
+			residual.WriteString("\n")
+			css = css[end:]
+
+			continue
+		}
+
+		open := strings.IndexByte(css, '{')
+		if open < 0 {
+			break
+		}
+
+		closing := strings.IndexByte(css[open:], '}')
+		if closing < 0 {
+			closing = len(css) - open - 1
+		}
+
+		selText := strings.TrimSpace(css[:open])
+		body := css[open+1 : open+closing]
+		text := css[:open+closing+1]
+		css = css[open+closing+1:]
+
+		sels, ok := parseSelectors(selText)
+		if !ok {
+			residual.WriteString(strings.TrimSpace(text))
+			residual.WriteString("\n")
+
+			continue
+		}
+
+		rules = append(rules, rule{sels: sels, decls: parseDecls(body)})
+	}
+
+	return rules, strings.TrimSpace(residual.String())
+}
+
+// конец @-правила: до ; или до парной }
+func atRuleEnd(css string) int {
+	depth := 0
+
+	for i := 0; i < len(css); i++ {
+		switch css[i] {
+		case ';':
+			if depth == 0 {
+				return i + 1
+			}
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+
+	return len(css)
+}
+
+func parseSelectors(s string) ([]selector, bool) {
+	var sels []selector
+
+	for _, group := range strings.Split(s, ",") {
+		fields := strings.Fields(group)
+		if len(fields) == 0 {
+			return nil, false
+		}
+
+		sel := selector{}
+
+		for _, f := range fields {
+			m := compoundRE.FindStringSubmatch(f)
+			if m == nil {
+				return nil, false
+			}
+
+			c := compound{tag: strings.ToLower(m[1])}
+			if c.tag != "" && c.tag != "*" {
+				sel.spec++
+			}
+
+			for _, part := range partRE.FindAllString(m[2], -1) {
+				if part[0] == '#' {
+					c.id = part[1:]
+					sel.spec += 10000
+				} else {
+					c.classes = append(c.classes, part[1:])
+					sel.spec += 100
+				}
+			}
+
+			sel.parts = append(sel.parts, c)
+		}
+
+		sels = append(sels, sel)
+	}
+
+	return sels, true
+}
+
+func parseDecls(body string) []decl {
+	var res []decl
+
+	for _, d := range strings.Split(body, ";") {
+		i := strings.IndexByte(d, ':')
+		if i < 0 {
+			continue
+		}
+
+		prop := strings.ToLower(strings.TrimSpace(d[:i]))
+		val := strings.TrimSpace(d[i+1:])
+
+		if prop == "" || val == "" {
+			continue
+		}
+
+		important := false
+
+		if j := strings.Index(strings.ToLower(val), "!important"); j >= 0 {
+			important = true
+			val = strings.TrimSpace(val[:j])
+		}
+
+		res = append(res, decl{prop: prop, val: val, important: important})
+	}
+
+	return res
+}
+
+func applyRules(n *html.Node, rules []rule, order *int) {
+	if n.Type == html.ElementNode {
+		switch n.DataAtom {
+		case atom.Style, atom.Head, atom.Title, atom.Script:
+			return
+		}
+
+		applyToElement(n, rules, order)
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		applyRules(c, rules, order)
+	}
+}
+
+func applyToElement(n *html.Node, rules []rule, order *int) {
+	var matched []applied
+
+	for _, r := range rules {
+		spec := -1
+
+		for _, s := range r.sels {
+			if s.spec > spec && s.match(n) {
+				spec = s.spec
+			}
+		}
+
+		if spec < 0 {
+			continue
+		}
+
+		for _, d := range r.decls {
+			*order++
+			matched = append(matched, applied{decl: d, spec: spec, order: *order})
+		}
+	}
+
+	if len(matched) == 0 {
+		return
+	}
+
+	// каскад: обычные правила по специфичности и порядку,
+	// затем собственный style элемента, затем !important
+	sort.SliceStable(matched, func(i, j int) bool {
+		if matched[i].important != matched[j].important {
+			return !matched[i].important
+		}
+
+		if matched[i].spec != matched[j].spec {
+			return matched[i].spec < matched[j].spec
+		}
+
+		return matched[i].order < matched[j].order
+	})
+
+	var (
+		props []string
+		vals  = map[string]string{}
+	)
+
+	set := func(d decl) {
+		if _, ok := vals[d.prop]; !ok {
+			props = append(props, d.prop)
+		}
+
+		vals[d.prop] = d.val
+	}
+
+	idx := -1
+
+	for i, a := range n.Attr {
+		if strings.EqualFold(a.Key, "style") {
+			idx = i
+		}
+	}
+
+	for _, m := range matched {
+		if !m.important {
+			set(m.decl)
+		}
+	}
+
+	if idx >= 0 {
+		for _, d := range parseDecls(n.Attr[idx].Val) {
+			set(d)
+		}
+	}
+
+	for _, m := range matched {
+		if m.important {
+			set(m.decl)
+		}
+	}
+
+	parts := make([]string, len(props))
+	for i, p := range props {
+		parts[i] = p + ": " + vals[p]
+	}
+
+	style := strings.Join(parts, "; ")
+
+	if idx >= 0 {
+		n.Attr[idx].Val = style
+	} else {
+		n.Attr = append(n.Attr, html.Attribute{Key: "style", Val: style})
+	}
+}
+
+func (s *selector) match(n *html.Node) bool {
+	last := len(s.parts) - 1
+	if !s.parts[last].match(n) {
+		return false
+	}
+
+	// предки справа налево, жадно
+	i := last - 1
+
+	for p := n.Parent; p != nil && i >= 0; p = p.Parent {
+		if p.Type == html.ElementNode && s.parts[i].match(p) {
+			i--
+		}
+	}
+
+	return i < 0
+}
+
+func (c *compound) match(n *html.Node) bool {
+	if c.tag != "" && c.tag != "*" && c.tag != n.Data {
+		return false
+	}
+
+	var id, class string
+
+	for _, a := range n.Attr {
+		switch strings.ToLower(a.Key) {
+		case "id":
+			id = a.Val
+		case "class":
+			class = a.Val
+		}
+	}
+
+	if c.id != "" && c.id != id {
+		return false
+	}
+
+	have := strings.Fields(class)
+
+	for _, want := range c.classes {
+		found := false
+
+		for _, h := range have {
+			if h == want {
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
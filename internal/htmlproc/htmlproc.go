@@ -0,0 +1,246 @@
+/*
+htmlproc - пакет, обеспечивающий обработку html письма перед отправкой:
+  - встраивание CSS правил из блоков <style> в атрибуты style элементов,
+    потому что многие почтовые клиенты вырезают <style>;
+  - удаление скриптов и опасных атрибутов из html, пришедшего от пользователей;
+  - замена относительных ссылок на абсолютные от заданного базового URL.
+
+Каждый шаг включается переменной окружения, по умолчанию обработка выключена.
+*/
+package htmlproc
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	HTML_INLINE_CSS = "HTML_INLINE_CSS"
+	HTML_SANITIZE   = "HTML_SANITIZE"
+	HTML_BASE_URL   = "HTML_BASE_URL"
+)
+
+type Processor struct {
+	inline   bool
+	sanitize bool
+	base     *url.URL // nil - относительные ссылки не меняются
+}
+
+// конструктор, если ни один шаг не включён, возвращает nil
+func New() (*Processor, error) {
+	p := Processor{}
+
+	if err := p.GetConfig(); err != nil {
+		return nil, err
+	}
+
+	if !p.inline && !p.sanitize && p.base == nil {
+		return nil, nil
+	}
+
+	zap.S().Debugf("htmlproc config: %+v", p)
+
+	return &p, nil
+}
+
+func (p *Processor) GetConfig() error {
+	var err error
+
+	if s, ok := os.LookupEnv(HTML_INLINE_CSS); ok {
+		if p.inline, err = strconv.ParseBool(s); err != nil {
+			return fmt.Errorf("%s: %v", HTML_INLINE_CSS, err)
+		}
+	}
+
+	if s, ok := os.LookupEnv(HTML_SANITIZE); ok {
+		if p.sanitize, err = strconv.ParseBool(s); err != nil {
+			return fmt.Errorf("%s: %v", HTML_SANITIZE, err)
+		}
+	}
+
+	if s, ok := os.LookupEnv(HTML_BASE_URL); ok && s != "" {
+		if p.base, err = url.Parse(s); err != nil {
+			return fmt.Errorf("%s: %v", HTML_BASE_URL, err)
+		}
+
+		if !p.base.IsAbs() {
+			return fmt.Errorf("%s must be absolute: %s", HTML_BASE_URL, s)
+		}
+	}
+
+	return nil
+}
+
+// обработать html письма
+func (p *Processor) Process(src string) (string, error) {
+	if src == "" {
+		return src, nil
+	}
+
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return "", fmt.Errorf("html.Parse error: %v", err)
+	}
+
+	// сначала чистка, чтобы не встраивать стили в удаляемые элементы
+	if p.sanitize {
+		sanitize(doc)
+	}
+
+	if p.inline {
+		inlineCSS(doc)
+	}
+
+	if p.base != nil {
+		p.rewriteURLs(doc)
+	}
+
+	var b bytes.Buffer
+
+	if err = html.Render(&b, doc); err != nil {
+		return "", fmt.Errorf("html.Render error: %v", err)
+	}
+
+	return b.String(), nil
+}
+
+// элементы, которые удаляются вместе с содержимым
+var dangerous = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Iframe:   true,
+	atom.Frame:    true,
+	atom.Frameset: true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Applet:   true,
+	atom.Base:     true,
+	atom.Link:     true,
+	atom.Meta:     true,
+	atom.Form:     true,
+}
+
+// атрибуты со ссылками
+var urlAttrs = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"background": true,
+	"poster":     true,
+	"cite":       true,
+	"xlink:href": true,
+}
+
+func sanitize(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+
+		if c.Type == html.ElementNode && dangerous[c.DataAtom] {
+			n.RemoveChild(c)
+		} else {
+			if c.Type == html.ElementNode {
+				c.Attr = safeAttrs(c.Attr)
+			}
+
+			// @import в <style> тянет внешние стили
+			if c.Type == html.TextNode && n.DataAtom == atom.Style && strings.Contains(strings.ToLower(c.Data), "@import") {
+				c.Data = ""
+			}
+
+			sanitize(c)
+		}
+
+		c = next
+	}
+}
+
+func safeAttrs(attrs []html.Attribute) []html.Attribute {
+	res := attrs[:0]
+
+	for _, a := range attrs {
+		key := strings.ToLower(a.Key)
+
+		switch {
+		case strings.HasPrefix(key, "on"), key == "srcdoc", key == "formaction":
+			continue
+		case urlAttrs[key] && !safeURL(key, a.Val):
+			continue
+		case key == "style" && !safeStyle(a.Val):
+			continue
+		}
+
+		res = append(res, a)
+	}
+
+	return res
+}
+
+func safeURL(key, val string) bool {
+	// браузеры игнорируют пробелы и управляющие символы в схеме: "java\tscript:"
+	v := strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+
+		return r
+	}, val))
+
+	switch {
+	case strings.HasPrefix(v, "javascript:"), strings.HasPrefix(v, "vbscript:"):
+		return false
+	case strings.HasPrefix(v, "data:"):
+		// картинки в письмах встречаются, остальное - нет
+		return key == "src" && strings.HasPrefix(v, "data:image/") && !strings.HasPrefix(v, "data:image/svg")
+	}
+
+	return true
+}
+
+func safeStyle(val string) bool {
+	v := strings.ToLower(strings.Join(strings.Fields(val), ""))
+
+	return !strings.Contains(v, "expression(") && !strings.Contains(v, "javascript:") &&
+		!strings.Contains(v, "vbscript:") && !strings.Contains(v, "-moz-binding") && !strings.Contains(v, "behavior:")
+}
+
+// заменить относительные ссылки на абсолютные
+func (p *Processor) rewriteURLs(n *html.Node) {
+	if n.Type == html.ElementNode {
+		for i := range n.Attr {
+			a := &n.Attr[i]
+			if !urlAttrs[strings.ToLower(a.Key)] {
+				continue
+			}
+
+			a.Val = p.absolute(a.Val)
+		}
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		p.rewriteURLs(c)
+	}
+}
+
+func (p *Processor) absolute(val string) string {
+	v := strings.TrimSpace(val)
+
+	// якоря и пустые ссылки не трогаем
+	if v == "" || strings.HasPrefix(v, "#") {
+		return val
+	}
+
+	u, err := url.Parse(v)
+	if err != nil || u.IsAbs() {
+		return val
+	}
+
+	return p.base.ResolveReference(u).String()
+}
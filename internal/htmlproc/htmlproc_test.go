@@ -0,0 +1,114 @@
+package htmlproc
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+
+	os.Exit(m.Run())
+}
+
+func process(t *testing.T, p *Processor, src string) string {
+	t.Helper()
+
+	res, err := p.Process(src)
+	if err != nil {
+		t.Fatalf("Process error: %v", err)
+	}
+
+	return res
+}
+
+func Test_InlineCSS(t *testing.T) {
+	p := &Processor{inline: true}
+
+	src := `<html><head><style>
+/* комментарий */
+p { color: red; margin: 0 }
+.note { color: blue }
+#main p.note { font-weight: bold }
+td, th { padding: 4px !important }
+a:hover { color: green }
+@media (max-width: 600px) { p { font-size: 12px } }
+</style></head><body><div id="main">
+<p>обычный</p>
+<p class="note" style="margin: 2px">заметка</p>
+<table><tr><td style="padding: 0">ячейка</td></tr></table>
+</div></body></html>`
+
+	res := process(t, p, src)
+
+	wants := []string{
+		`<p style="color: red; margin: 0">обычный</p>`,
+		// специфичность: #main p.note > .note > p, собственный style элемента важнее правил
+		`<p class="note" style="color: blue; margin: 2px; font-weight: bold">заметка</p>`,
+		// !important важнее собственного style
+		`<td style="padding: 4px">ячейка</td>`,
+		// невстраиваемое остаётся в <style>
+		`<style>a:hover { color: green }
+@media (max-width: 600px) { p { font-size: 12px } }</style>`,
+	}
+
+	for _, want := range wants {
+		if !strings.Contains(res, want) {
+			t.Errorf("inline result must contain\n%s\ngot:\n%s", want, res)
+		}
+	}
+}
+
+func Test_Sanitize(t *testing.T) {
+	p := &Processor{sanitize: true}
+
+	src := `<p onclick="steal()" style="width: expression(alert(1))">текст</p>
+<script>alert(1)</script><iframe src="https://evil.example"></iframe>
+<a href="java	script:alert(1)">плохая</a><a href="https://example.com/x">хорошая</a>
+<img src="data:image/png;base64,AAAA"><img src="data:text/html;base64,AAAA">`
+
+	res := process(t, p, src)
+
+	for _, bad := range []string{"onclick", "expression", "<script", "alert(1)</script>", "<iframe", "javascript", "data:text/html"} {
+		if strings.Contains(strings.ToLower(res), strings.ToLower(bad)) {
+			t.Errorf("sanitized result must not contain %q:\n%s", bad, res)
+		}
+	}
+
+	for _, good := range []string{`<p>текст</p>`, `href="https://example.com/x"`, `src="data:image/png;base64,AAAA"`} {
+		if !strings.Contains(res, good) {
+			t.Errorf("sanitized result must contain %q:\n%s", good, res)
+		}
+	}
+}
+
+func Test_RewriteURLs(t *testing.T) {
+	base, _ := url.Parse("https://mail.example.com/static/")
+	p := &Processor{base: base}
+
+	src := `<a href="/unsubscribe?id=1">1</a><a href="logo.png">2</a><a href="#top">3</a>` +
+		`<a href="mailto:a@example.com">4</a><img src="https://cdn.example.com/x.png"><a href="//cdn.example.com/y">5</a>`
+
+	res := process(t, p, src)
+
+	wants := []string{
+		`href="https://mail.example.com/unsubscribe?id=1"`,
+		`href="https://mail.example.com/static/logo.png"`,
+		`href="#top"`,
+		`href="mailto:a@example.com"`,
+		`src="https://cdn.example.com/x.png"`,
+		`href="https://cdn.example.com/y"`,
+	}
+
+	for _, want := range wants {
+		if !strings.Contains(res, want) {
+			t.Errorf("rewrite result must contain %s:\n%s", want, res)
+		}
+	}
+}
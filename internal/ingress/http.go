@@ -0,0 +1,107 @@
+package ingress
+
+import (
+	"context"
+	"errors"
+
+	"github.com/maris-cyber/mailsender/internal/addrcheck"
+	"github.com/maris-cyber/mailsender/internal/envelope"
+	"github.com/maris-cyber/mailsender/internal/letter"
+)
+
+// ErrStopped - источник остановлен, запрос не принят
+var ErrStopped = errors.New("ingress stopped")
+
+// HTTPSource ставит в очередь запросы, пришедшие в http, сразу, без kafka
+// запросы принимает http сервер mailsender'а (/post) через Accept, сообщения RFC 5322 (/post/message) - через AcceptMessage
+type HTTPSource struct {
+	ch   *chan *letter.Letter
+	val  *addrcheck.Validator
+	done chan struct{}
+}
+
+func NewHTTP(ch *chan *letter.Letter, val *addrcheck.Validator) *HTTPSource {
+	return &HTTPSource{ch: ch, val: val, done: make(chan struct{})}
+}
+
+func (h *HTTPSource) Name() string {
+	return HTTP
+}
+
+// Run принимает запросы до отмены ctx
+func (h *HTTPSource) Run(ctx context.Context) error {
+	<-ctx.Done()
+	close(h.done)
+
+	return nil
+}
+
+// Accept ставит письма запроса b в очередь и возвращает их число, когда очередь их сохранила
+// key - ключ запроса для ключей идемпотентности писем, без него повтор запроса создаст письма заново
+func (h *HTTPSource) Accept(ctx context.Context, b []byte, key, correlationID string) (int, error) {
+	if h.stopped() {
+		return 0, ErrStopped
+	}
+
+	tL, _, err := envelope.DecodeRequest(b)
+	if err != nil {
+		return 0, err
+	}
+
+	correlate(tL, correlationID)
+	Prepare(ctx, tL, key, "", h.val)
+
+	if err = h.enqueue(ctx, tL); err != nil {
+		return 0, err
+	}
+
+	return len(tL), nil
+}
+
+// AcceptMessage ставит в очередь сообщение RFC 5322 b для адресатов rcpts, как принятое по smtp (см. ParseMessage),
+// и возвращается, когда очередь его сохранила; без key ключ запроса - из Message-ID и адресатов
+func (h *HTTPSource) AcceptMessage(ctx context.Context, b []byte, rcpts []string, key, correlationID string) error {
+	if h.stopped() {
+		return ErrStopped
+	}
+
+	ltr, msgKey, err := ParseMessage(b, rcpts)
+	if err != nil {
+		return err
+	}
+
+	if key == "" {
+		key = msgKey
+	}
+
+	tL := []letter.Letter{ltr}
+	correlate(tL, correlationID)
+	Prepare(ctx, tL, key, "", h.val)
+
+	return h.enqueue(ctx, tL)
+}
+
+func (h *HTTPSource) stopped() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueue ставит письма в очередь, запрос отменится и при остановке источника
+func (h *HTTPSource) enqueue(ctx context.Context, tL []letter.Letter) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-h.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return Enqueue(ctx, *h.ch, tL)
+}
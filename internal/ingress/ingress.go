@@ -0,0 +1,116 @@
+// ingress - источники писем для очереди: kafka, http, каталог с файлами запросов, поток redis, smtp
+// все источники, кроме smtp, принимают то же, что и kafka: запрос в конверте (api/schema/send-request.v1.json)
+// или массив писем, и отмечают запрос обработанным только после того, как очередь сохранила письма
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/maris-cyber/mailsender/internal/addrcheck"
+	"github.com/maris-cyber/mailsender/internal/letter"
+)
+
+const INGRESS_SOURCES = "INGRESS_SOURCES" // источники через запятую: kafka (по умолчанию), http, spool, redis, smtp
+
+// имена источников
+const (
+	Kafka = "kafka"
+	HTTP  = "http"
+	Spool = "spool"
+	Redis = "redis"
+	SMTP  = "smtp"
+)
+
+// Source - источник писем, Run ставит письма в очередь до отмены ctx
+type Source interface {
+	Name() string
+	Run(ctx context.Context) error
+}
+
+// Enabled - включённые источники из INGRESS_SOURCES
+func Enabled() (map[string]bool, error) {
+	s := os.Getenv(INGRESS_SOURCES)
+	if strings.TrimSpace(s) == "" {
+		return map[string]bool{Kafka: true}, nil
+	}
+
+	res := map[string]bool{}
+
+	for _, name := range strings.Split(s, ",") {
+		switch name = strings.ToLower(strings.TrimSpace(name)); name {
+		case "":
+		case Kafka, HTTP, Spool, Redis, SMTP:
+			res[name] = true
+		default:
+			return nil, fmt.Errorf("%s: unknown source %q", INGRESS_SOURCES, name)
+		}
+	}
+
+	if len(res) == 0 {
+		return nil, fmt.Errorf("%s: no sources", INGRESS_SOURCES)
+	}
+
+	return res, nil
+}
+
+// Prepare готовит письма запроса к очереди: статус, ключ идемпотентности из key запроса
+// (или source, если ключа нет), адресаты, сквозной ID и проверка адресов, если val задан
+// key возвращается отправителю в статусе в поле kafkaKey, откуда бы ни пришёл запрос
+func Prepare(ctx context.Context, tL []letter.Letter, key, source string, val *addrcheck.Validator) {
+	for i := range tL {
+		tL[i].Status = "awaiting"
+		tL[i].KafkaKey = key
+		tL[i].DefaultKey(source, i)
+		tL[i].Expand()
+		tL[i].CorrelationID = letter.CleanCorrelationID(tL[i].CorrelationID)
+
+		// неправильные адреса отмечаются до очереди, письмо без правильных адресов получает статус failed
+		if val != nil {
+			val.Filter(ctx, &tL[i])
+		}
+	}
+}
+
+// Enqueue отправляет письма в канал очереди и ждёт подтверждения сохранения каждого
+func Enqueue(ctx context.Context, ch chan *letter.Letter, tL []letter.Letter) error {
+	ack := make(chan error, len(tL))
+
+	for i := range tL {
+		tL[i].Ack = ack
+		// отправить в канал для обработчика событий очереди
+		tL[i].Log().Debugf("Ingress send to Queue chan %v\n", tL[i])
+
+		select {
+		case ch <- &tL[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var firstErr error
+
+	for range tL {
+		select {
+		case err := <-ack:
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return firstErr
+}
+
+// сквозной ID из запроса проставляется письмам, у которых его нет
+func correlate(tL []letter.Letter, correlationID string) {
+	for i := range tL {
+		if tL[i].CorrelationID == "" {
+			tL[i].CorrelationID = correlationID
+		}
+	}
+}
@@ -0,0 +1,667 @@
+package ingress
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"go.uber.org/zap"
+)
+
+const request = `[{"Subject":"тема","Body":"сообщение","Addresses":["uuunet@mailto.plus"]},{"Subject":"тема 2","Addresses":["yhuzfu@mailto.plus"]}]`
+
+func TestMain(m *testing.M) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+
+	os.Exit(m.Run())
+}
+
+// очередь для тестов: подтверждает письма с ошибкой err и запоминает сохранённые
+type fakeQueue struct {
+	mu    sync.Mutex
+	ch    chan *letter.Letter
+	saved []*letter.Letter
+	err   error
+}
+
+func newFakeQueue(ctx context.Context) *fakeQueue {
+	q := &fakeQueue{ch: make(chan *letter.Letter)}
+
+	go func() {
+		for {
+			select {
+			case ltr := <-q.ch:
+				q.mu.Lock()
+				err := q.err
+				if err == nil {
+					q.saved = append(q.saved, ltr)
+				}
+				q.mu.Unlock()
+
+				ltr.Acknowledge(err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return q
+}
+
+func (q *fakeQueue) letters() []*letter.Letter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return append([]*letter.Letter(nil), q.saved...)
+}
+
+func (q *fakeQueue) fail(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.err = err
+}
+
+func Test_Enabled(t *testing.T) {
+	if s, err := Enabled(); err != nil || len(s) != 1 || !s[Kafka] {
+		t.Errorf("Enabled default = %v, %v", s, err)
+	}
+
+	t.Setenv(INGRESS_SOURCES, " HTTP, spool,redis ")
+
+	if s, err := Enabled(); err != nil || len(s) != 3 || s[Kafka] || !s[HTTP] || !s[Spool] || !s[Redis] {
+		t.Errorf("Enabled = %v, %v", s, err)
+	}
+
+	for _, bad := range []string{"kafka,nats", " , "} {
+		t.Setenv(INGRESS_SOURCES, bad)
+
+		if _, err := Enabled(); err == nil {
+			t.Errorf("Enabled %q no error", bad)
+		}
+	}
+}
+
+func Test_HTTP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q := newFakeQueue(ctx)
+	h := NewHTTP(&q.ch, nil)
+
+	runCtx, stop := context.WithCancel(ctx)
+	go h.Run(runCtx)
+
+	n, err := h.Accept(ctx, []byte(request), "req-1", "corr\r\n-1")
+	if err != nil || n != 2 {
+		t.Fatalf("Accept = %d, %v", n, err)
+	}
+
+	saved := q.letters()
+	if len(saved) != 2 {
+		t.Fatalf("saved %d letters", len(saved))
+	}
+
+	for i, ltr := range saved {
+		if ltr.Status != "awaiting" || ltr.KafkaKey != "req-1" || ltr.IdempotencyKey != "req-1:"+strconv.Itoa(i) || ltr.CorrelationID != "corr-1" {
+			t.Errorf("letter %d %+v", i, ltr)
+		}
+	}
+
+	if _, err = h.Accept(ctx, []byte("{"), "", ""); err == nil {
+		t.Errorf("Accept broken request no error")
+	}
+
+	// сообщение RFC 5322: ключ - из Message-ID и адресатов, сквозной ID из сообщения важнее заголовка
+	if err = h.AcceptMessage(ctx, []byte(smtpMessage), []string{"a@example.com"}, "", "corr-2"); err != nil {
+		t.Fatalf("AcceptMessage error: %v", err)
+	}
+
+	if err = h.AcceptMessage(ctx, []byte(smtpMessage), []string{"a@example.com"}, "req-2", ""); err != nil {
+		t.Fatalf("AcceptMessage with key error: %v", err)
+	}
+
+	saved = q.letters()
+	if len(saved) != 4 {
+		t.Fatalf("saved %d letters", len(saved))
+	}
+
+	if ltr := saved[2]; ltr.Raw == "" || !strings.HasPrefix(ltr.KafkaKey, "1@example.com:") || ltr.CorrelationID != "corr-1" {
+		t.Errorf("message letter %+v", ltr)
+	}
+
+	if ltr := saved[3]; ltr.KafkaKey != "req-2" || ltr.IdempotencyKey != "req-2:0" {
+		t.Errorf("message letter with key %+v", ltr)
+	}
+
+	if err = h.AcceptMessage(ctx, []byte("no headers"), []string{"a@example.com"}, "", ""); err == nil {
+		t.Errorf("AcceptMessage broken message no error")
+	}
+
+	// ошибка очереди возвращается отправителю
+	q.fail(errors.New("db down"))
+
+	if _, err = h.Accept(ctx, []byte(request), "", ""); err == nil || err.Error() != "db down" {
+		t.Errorf("Accept with queue error = %v", err)
+	}
+
+	stop()
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err = h.Accept(ctx, []byte(request), "", ""); err != ErrStopped {
+		t.Errorf("Accept after stop = %v", err)
+	}
+}
+
+func Test_Spool(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(INGRESS_SPOOL_DIR, dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q := newFakeQueue(ctx)
+
+	sp, err := NewSpool(&q.ch, nil)
+	if err != nil {
+		t.Fatalf("NewSpool error: %v", err)
+	}
+
+	for name, content := range map[string]string{
+		"b.json":      request,
+		"a.json":      `{"schemaVersion":1,"type":"mailsender.send-request","createdAt":"2021-11-01T10:00:00Z","correlationId":"c-1","data":{"letters":[{"subject":"конверт","addresses":["uuunet@mailto.plus"]}]}}`,
+		"broken.json": "{",
+		"c.json.tmp":  request,
+	} {
+		if err = os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sp.Scan(ctx)
+
+	saved := q.letters()
+	if len(saved) != 3 {
+		t.Fatalf("saved %d letters", len(saved))
+	}
+
+	// файлы по порядку имён, имя файла - ключ запроса
+	if saved[0].Subject != "конверт" || saved[0].IdempotencyKey != "a:0" || saved[0].CorrelationID != "c-1" || saved[2].IdempotencyKey != "b:1" {
+		t.Errorf("saved %+v %+v", saved[0], saved[2])
+	}
+
+	for _, path := range []string{"done/a.json", "done/b.json", "failed/broken.json", "failed/broken.json.error", "c.json.tmp"} {
+		if _, err = os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+
+	// пока очередь не сохранила письма, файл остаётся на месте
+	q.fail(errors.New("db down"))
+
+	if err = os.Rename(filepath.Join(dir, "c.json.tmp"), filepath.Join(dir, "c.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	sp.Scan(ctx)
+
+	if _, err = os.Stat(filepath.Join(dir, "c.json")); err != nil {
+		t.Errorf("file moved after queue error: %v", err)
+	}
+}
+
+func Test_ReadReply(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("+OK\r\n-ERR wrong\r\n:42\r\n$5\r\nhe\r\no\r\n$-1\r\n*2\r\n$1\r\na\r\n*-1\r\n"))
+
+	want := []interface{}{"OK", respError("ERR wrong"), int64(42), "he\r\no", nil}
+
+	for _, w := range want {
+		if got, err := readReply(r); err != nil || got != w {
+			t.Errorf("readReply = %#v, %v, want %#v", got, err, w)
+		}
+	}
+
+	got, err := readReply(r)
+	if arr, ok := got.([]interface{}); err != nil || !ok || len(arr) != 2 || arr[0] != "a" || arr[1] != nil {
+		t.Errorf("readReply array = %#v, %v", got, err)
+	}
+}
+
+// fakeRedis - сервер redis с одним потоком: XGROUP, XREADGROUP и XACK, чего хватает RedisSource
+type fakeRedis struct {
+	mu      sync.Mutex
+	entries [][]string // id и поля
+	next    int        // следующая запись для ">"
+	pending map[string]bool
+	acked   []string
+}
+
+func (fr *fakeRedis) serve(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go fr.conn(c)
+	}
+}
+
+func (fr *fakeRedis) conn(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+
+	for {
+		req, err := readReply(r)
+		if err != nil {
+			return
+		}
+
+		args, _ := req.([]interface{})
+		if len(args) == 0 {
+			return
+		}
+
+		cmd, _ := args[0].(string)
+
+		fr.mu.Lock()
+
+		switch strings.ToUpper(cmd) {
+		case "XGROUP":
+			c.Write([]byte("+OK\r\n"))
+		case "XACK":
+			id, _ := args[3].(string)
+			fr.acked = append(fr.acked, id)
+			delete(fr.pending, id)
+			c.Write([]byte(":1\r\n"))
+		case "XREADGROUP":
+			id, _ := args[len(args)-1].(string)
+
+			var items [][]string
+
+			if id == "0" {
+				for _, e := range fr.entries[:fr.next] {
+					if fr.pending[e[0]] {
+						items = append(items, e)
+					}
+				}
+			} else if fr.next < len(fr.entries) {
+				items = fr.entries[fr.next:]
+				fr.next = len(fr.entries)
+
+				for _, e := range items {
+					fr.pending[e[0]] = true
+				}
+			}
+
+			if len(items) == 0 && id != "0" {
+				c.Write([]byte("*-1\r\n"))
+
+				break
+			}
+
+			b := &strings.Builder{}
+			b.WriteString("*1\r\n*2\r\n$6\r\nstream\r\n")
+			b.WriteString("*" + strconv.Itoa(len(items)) + "\r\n")
+
+			for _, e := range items {
+				b.WriteString("*2\r\n" + bulk(e[0]) + "*" + strconv.Itoa(len(e)-1) + "\r\n")
+
+				for _, f := range e[1:] {
+					b.WriteString(bulk(f))
+				}
+			}
+
+			c.Write([]byte(b.String()))
+		default:
+			c.Write([]byte("-ERR unknown command\r\n"))
+		}
+
+		fr.mu.Unlock()
+	}
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func Test_Redis(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	fr := &fakeRedis{
+		pending: map[string]bool{},
+		entries: [][]string{
+			{"1-0", RedisFieldPayload, request, RedisFieldKey, "req-1", RedisFieldCorrelationID, "c-1"},
+			{"2-0", RedisFieldPayload, "{"},
+			{"3-0", RedisFieldPayload, request},
+		},
+	}
+
+	go fr.serve(l)
+
+	t.Setenv(INGRESS_REDIS_ADDR, l.Addr().String())
+	t.Setenv(INGRESS_REDIS_STREAM, "stream")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q := newFakeQueue(ctx)
+
+	rs, err := NewRedis(&q.ch, nil)
+	if err != nil {
+		t.Fatalf("NewRedis error: %v", err)
+	}
+
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		rs.Run(runCtx)
+	}()
+
+	for ctx.Err() == nil {
+		fr.mu.Lock()
+		n := len(fr.acked)
+		fr.mu.Unlock()
+
+		if n == 3 {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stop()
+	<-done
+
+	// неразобранная запись подтверждается, чтобы не читать её вечно
+	if strings.Join(fr.acked, ",") != "1-0,2-0,3-0" {
+		t.Errorf("acked %v", fr.acked)
+	}
+
+	saved := q.letters()
+	if len(saved) != 4 {
+		t.Fatalf("saved %d letters", len(saved))
+	}
+
+	// без ключа ключ запроса - поток и ID записи
+	if saved[0].IdempotencyKey != "req-1:0" || saved[0].CorrelationID != "c-1" || saved[3].IdempotencyKey != "stream/3-0:1" {
+		t.Errorf("saved %+v %+v", saved[0], saved[3])
+	}
+}
+
+// самоподписанный сертификат для STARTTLS, возвращает пути к сертификату и ключу
+func writeTestCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey error: %v", err)
+	}
+
+	tpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, &tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate error: %v", err)
+	}
+
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey error: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write cert error: %v", err)
+	}
+
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0o600); err != nil {
+		t.Fatalf("write key error: %v", err)
+	}
+
+	return certFile, keyFile
+}
+
+// запустить smtp источник на свободном порту, возвращает адрес
+func startSMTP(ctx context.Context, t *testing.T, q *fakeQueue) string {
+	s, err := NewSMTP(&q.ch, nil)
+	if err != nil {
+		t.Fatalf("NewSMTP error: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+
+	go s.serve(ctx, l)
+
+	return l.Addr().String()
+}
+
+const smtpMessage = "From: app@example.com\r\n" +
+	"To: a@example.com\r\n" +
+	"Bcc: hidden@example.com,\r\n" +
+	"\tother@example.com\r\n" +
+	"Subject: =?UTF-8?B?0YLQtdC80LA=?=\r\n" +
+	"Message-ID: <1@example.com>\r\n" +
+	"X-Correlation-ID: corr-1\r\n" +
+	"\r\n" +
+	"Body\r\n"
+
+func Test_SMTP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := NewSMTP(nil, nil); err == nil {
+		t.Errorf("NewSMTP without users no error")
+	}
+
+	t.Setenv(INGRESS_SMTP_USERS, "app:secret")
+
+	if _, err := NewSMTP(nil, nil); err == nil {
+		t.Errorf("NewSMTP without TLS no error")
+	}
+
+	t.Setenv(INGRESS_SMTP_INSECURE_AUTH, "true")
+	t.Setenv(INGRESS_SMTP_HOSTNAME, "mx.example.com")
+
+	q := newFakeQueue(ctx)
+
+	addr := startSMTP(ctx, t, q)
+
+	// после неудачного AUTH net/smtp закрывает соединение, поэтому оно отдельное
+	bad, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial error: %v", err)
+	}
+	defer bad.Close()
+
+	if err = bad.Auth(smtp.PlainAuth("", "app", "wrong", "127.0.0.1")); err == nil {
+		t.Errorf("AUTH with wrong password no error")
+	}
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial error: %v", err)
+	}
+	defer c.Close()
+
+	if err = c.Mail("app@example.com"); err == nil {
+		t.Errorf("MAIL without AUTH no error")
+	}
+
+	if err = c.Auth(smtp.PlainAuth("", "app", "secret", "127.0.0.1")); err != nil {
+		t.Fatalf("AUTH error: %v", err)
+	}
+
+	send := func(rcpts ...string) error {
+		if err := c.Mail("app@example.com"); err != nil {
+			return err
+		}
+
+		for _, rcpt := range rcpts {
+			if err := c.Rcpt(rcpt); err != nil {
+				return err
+			}
+		}
+
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+
+		if _, err = w.Write([]byte(smtpMessage)); err != nil {
+			return err
+		}
+
+		return w.Close()
+	}
+
+	if err = send("a@example.com", "hidden@example.com"); err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+
+	// то же сообщение другому адресату - другое письмо, тем же адресатам в другом порядке - повтор
+	if err = send("c@example.com"); err != nil {
+		t.Fatalf("send to other recipient error: %v", err)
+	}
+
+	if err = send("Hidden@example.com", "a@example.com"); err != nil {
+		t.Fatalf("send again error: %v", err)
+	}
+
+	saved := q.letters()
+	if len(saved) != 3 {
+		t.Fatalf("saved %d letters", len(saved))
+	}
+
+	ltr := saved[0]
+	if ltr.Subject != "тема" || strings.Join(ltr.Addresses, ",") != "a@example.com,hidden@example.com" ||
+		!strings.HasPrefix(ltr.KafkaKey, "1@example.com:") || ltr.IdempotencyKey != ltr.KafkaKey+":0" || ltr.CorrelationID != "corr-1" {
+		t.Errorf("letter %+v", ltr)
+	}
+
+	if saved[1].IdempotencyKey == ltr.IdempotencyKey {
+		t.Errorf("other recipient same key %s", ltr.IdempotencyKey)
+	}
+
+	if saved[2].IdempotencyKey != ltr.IdempotencyKey {
+		t.Errorf("same recipients key %s, want %s", saved[2].IdempotencyKey, ltr.IdempotencyKey)
+	}
+
+	// Bcc не уходит получателям, строки через CRLF
+	if strings.Contains(ltr.Raw, "hidden") || strings.Contains(ltr.Raw, "other") ||
+		!strings.HasPrefix(ltr.Raw, "From: app@example.com\r\nTo: a@example.com\r\nSubject:") || !strings.HasSuffix(ltr.Raw, "\r\n\r\nBody\r\n") {
+		t.Errorf("raw %q", ltr.Raw)
+	}
+
+	// ошибка очереди - временная, клиент повторит
+	q.fail(errors.New("db down"))
+
+	var tpe *textproto.Error
+	if err = send("a@example.com"); !errors.As(err, &tpe) || tpe.Code != 451 {
+		t.Errorf("send with queue error = %v", err)
+	}
+
+	if err = c.Quit(); err != nil {
+		t.Errorf("QUIT error: %v", err)
+	}
+}
+
+func Test_SMTPStartTLS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	certFile, keyFile := writeTestCert(t)
+
+	t.Setenv(INGRESS_SMTP_USERS, "app:secret")
+	t.Setenv(INGRESS_SMTP_TLS_CERT_FILE, certFile)
+	t.Setenv(INGRESS_SMTP_TLS_KEY_FILE, keyFile)
+
+	q := newFakeQueue(ctx)
+
+	c, err := smtp.Dial(startSMTP(ctx, t, q))
+	if err != nil {
+		t.Fatalf("Dial error: %v", err)
+	}
+	defer c.Close()
+
+	if err = c.Hello("client.example.com"); err != nil {
+		t.Fatalf("EHLO error: %v", err)
+	}
+
+	// до STARTTLS AUTH не предлагается
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Errorf("AUTH offered without TLS")
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		t.Fatalf("STARTTLS not offered")
+	}
+
+	if err = c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("STARTTLS error: %v", err)
+	}
+
+	if err = c.Auth(smtp.PlainAuth("", "app", "secret", "127.0.0.1")); err != nil {
+		t.Fatalf("AUTH after STARTTLS error: %v", err)
+	}
+
+	if err = c.Mail("app@example.com"); err != nil {
+		t.Fatalf("MAIL error: %v", err)
+	}
+
+	if err = c.Rcpt("a@example.com"); err != nil {
+		t.Fatalf("RCPT error: %v", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA error: %v", err)
+	}
+
+	if _, err = w.Write([]byte(smtpMessage)); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatalf("DATA close error: %v", err)
+	}
+
+	if saved := q.letters(); len(saved) != 1 {
+		t.Errorf("saved %d letters", len(saved))
+	}
+}
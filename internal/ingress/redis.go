@@ -0,0 +1,255 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/addrcheck"
+	"github.com/maris-cyber/mailsender/internal/envelope"
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"go.uber.org/zap"
+)
+
+const (
+	INGRESS_REDIS_ADDR     = "INGRESS_REDIS_ADDR"     // host:port
+	INGRESS_REDIS_PASSWORD = "INGRESS_REDIS_PASSWORD" // пароль для AUTH, если нужен
+	INGRESS_REDIS_STREAM   = "INGRESS_REDIS_STREAM"   // поток с запросами, по умолчанию mailsender
+	INGRESS_REDIS_GROUP    = "INGRESS_REDIS_GROUP"    // группа читателей, по умолчанию mailsender
+	INGRESS_REDIS_CONSUMER = "INGRESS_REDIS_CONSUMER" // имя читателя в группе, по умолчанию имя хоста
+	INGRESS_REDIS_BATCH    = "INGRESS_REDIS_BATCH"    // сколько записей читать за раз, по умолчанию 10
+)
+
+// поля записи потока
+const (
+	RedisFieldPayload       = "payload"        // запрос: конверт или массив писем в JSON
+	RedisFieldKey           = "key"            // ключ запроса, если нет - ID записи
+	RedisFieldCorrelationID = "correlation-id" // сквозной ID
+)
+
+const (
+	defaultRedisName  = "mailsender"
+	defaultRedisBatch = 10
+	redisBlock        = time.Second     // сколько XREADGROUP ждёт новых записей
+	redisTimeout      = 5 * time.Second // сколько ждать ответа сверх redisBlock
+	redisRetryDelay   = time.Second     // пауза перед переподключением
+)
+
+// RedisSource читает запросы из потока redis группой читателей (XREADGROUP)
+// запись подтверждается (XACK) после того, как очередь сохранила письма; после перезапуска
+// сначала перечитываются выданные читателю, но не подтверждённые записи
+type RedisSource struct {
+	addr     string
+	password string
+	stream   string
+	group    string
+	consumer string
+	batch    int
+	ch       *chan *letter.Letter
+	val      *addrcheck.Validator
+}
+
+func NewRedis(ch *chan *letter.Letter, val *addrcheck.Validator) (*RedisSource, error) {
+	rs := RedisSource{
+		addr:     os.Getenv(INGRESS_REDIS_ADDR),
+		password: os.Getenv(INGRESS_REDIS_PASSWORD),
+		stream:   defaultRedisName,
+		group:    defaultRedisName,
+		batch:    defaultRedisBatch,
+		ch:       ch,
+		val:      val,
+	}
+
+	if rs.addr == "" {
+		return nil, fmt.Errorf("%s not defined", INGRESS_REDIS_ADDR)
+	}
+
+	if s := os.Getenv(INGRESS_REDIS_STREAM); s != "" {
+		rs.stream = s
+	}
+
+	if s := os.Getenv(INGRESS_REDIS_GROUP); s != "" {
+		rs.group = s
+	}
+
+	if rs.consumer = os.Getenv(INGRESS_REDIS_CONSUMER); rs.consumer == "" {
+		rs.consumer, _ = os.Hostname()
+	}
+
+	if rs.consumer == "" {
+		rs.consumer = defaultRedisName
+	}
+
+	if s := os.Getenv(INGRESS_REDIS_BATCH); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("bad %s %q", INGRESS_REDIS_BATCH, s)
+		}
+
+		rs.batch = n
+	}
+
+	return &rs, nil
+}
+
+func (rs *RedisSource) Name() string {
+	return Redis
+}
+
+// Run читает поток до отмены ctx, при ошибках соединения переподключается
+func (rs *RedisSource) Run(ctx context.Context) error {
+	for {
+		err := rs.consume(ctx)
+		if ctx.Err() != nil {
+			zap.S().Debug("ingress redis stopped")
+
+			return nil
+		}
+
+		zap.S().Errorf("ingress redis error: %v, reconnect in %v", err, redisRetryDelay)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(redisRetryDelay):
+		}
+	}
+}
+
+// consume - одно соединение: создать группу, дочитать неподтверждённое, читать новое
+func (rs *RedisSource) consume(ctx context.Context) error {
+	d := net.Dialer{Timeout: redisTimeout}
+
+	c, err := d.DialContext(ctx, "tcp", rs.addr)
+	if err != nil {
+		return err
+	}
+
+	rc := newRespConn(c)
+	defer rc.Close()
+
+	if rs.password != "" {
+		if _, err = rc.do(redisTimeout, "AUTH", rs.password); err != nil {
+			return err
+		}
+	}
+
+	// группа начинает с новых записей; если она уже есть, продолжает с сохранённого места
+	_, err = rc.do(redisTimeout, "XGROUP", "CREATE", rs.stream, rs.group, "$", "MKSTREAM")
+	if e, ok := err.(respError); err != nil && !(ok && strings.HasPrefix(string(e), "BUSYGROUP")) {
+		return err
+	}
+
+	// "0" - выданные этому читателю, но не подтверждённые записи, ">" - новые
+	id := "0"
+
+	for ctx.Err() == nil {
+		res, err := rc.do(redisBlock+redisTimeout, "XREADGROUP", "GROUP", rs.group, rs.consumer,
+			"COUNT", strconv.Itoa(rs.batch), "BLOCK", strconv.Itoa(int(redisBlock/time.Millisecond)),
+			"STREAMS", rs.stream, id)
+		if err != nil {
+			return err
+		}
+
+		entries, err := streamEntries(res)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 0 && id == "0" {
+			id = ">"
+		}
+
+		for _, e := range entries {
+			if err = rs.entry(ctx, e); err != nil {
+				return err
+			}
+
+			if _, err = rc.do(redisTimeout, "XACK", rs.stream, rs.group, e.id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return ctx.Err()
+}
+
+// entry ставит в очередь письма записи; запись, которую не удалось разобрать, пишется в лог и подтверждается
+func (rs *RedisSource) entry(ctx context.Context, e streamEntry) error {
+	tL, _, err := envelope.DecodeRequest([]byte(e.fields[RedisFieldPayload]))
+	if err != nil {
+		zap.S().Errorf("ingress redis %s/%s: %v", rs.stream, e.id, err)
+
+		return nil
+	}
+
+	key := e.fields[RedisFieldKey]
+	if key == "" {
+		key = rs.stream + "/" + e.id
+	}
+
+	correlate(tL, e.fields[RedisFieldCorrelationID])
+	Prepare(ctx, tL, key, "", rs.val)
+
+	return Enqueue(ctx, *rs.ch, tL)
+}
+
+type streamEntry struct {
+	id     string
+	fields map[string]string
+}
+
+// streamEntries разбирает ответ XREADGROUP одного потока: [[поток, [[id, [поле, значение, ...]], ...]]]
+// nil - новых записей нет
+func streamEntries(res interface{}) ([]streamEntry, error) {
+	if res == nil {
+		return nil, nil
+	}
+
+	streams, ok := res.([]interface{})
+	if !ok || len(streams) != 1 {
+		return nil, errRespType
+	}
+
+	stream, ok := streams[0].([]interface{})
+	if !ok || len(stream) != 2 {
+		return nil, errRespType
+	}
+
+	items, ok := stream[1].([]interface{})
+	if !ok {
+		return nil, errRespType
+	}
+
+	entries := make([]streamEntry, 0, len(items))
+
+	for _, item := range items {
+		kv, ok := item.([]interface{})
+		if !ok || len(kv) != 2 {
+			return nil, errRespType
+		}
+
+		id, ok := kv[0].(string)
+		if !ok {
+			return nil, errRespType
+		}
+
+		e := streamEntry{id: id, fields: map[string]string{}}
+
+		// у удалённой, но не подтверждённой записи полей нет
+		fields, _ := kv[1].([]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			k, _ := fields[i].(string)
+			v, _ := fields[i+1].(string)
+			e.fields[k] = v
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
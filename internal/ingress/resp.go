@@ -0,0 +1,125 @@
+package ingress
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// минимальный клиент redis (протокол RESP2): команда - массив строк,
+// ответ - string, int64, []interface{}, nil или respError
+
+// respError - ответ redis с ошибкой ("-ERR ...")
+type respError string
+
+func (e respError) Error() string {
+	return "redis: " + string(e)
+}
+
+type respConn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newRespConn(c net.Conn) *respConn {
+	return &respConn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+}
+
+// do отправляет команду и ждёт ответ не дольше timeout
+func (rc *respConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := rc.c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(rc.w, "*%d\r\n", len(args))
+
+	for _, a := range args {
+		fmt.Fprintf(rc.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+
+	if err := rc.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	res, err := readReply(rc.r)
+	if err != nil {
+		return nil, err
+	}
+
+	if e, ok := res.(respError); ok {
+		return nil, e
+	}
+
+	return res, nil
+}
+
+func (rc *respConn) Close() error {
+	return rc.c.Close()
+}
+
+// readReply читает один ответ; ошибка redis возвращается значением respError,
+// чтобы вложенные в массив ошибки не обрывали разбор
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: bad reply line %q", line)
+	}
+
+	kind, rest := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return respError(rest), nil
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", rest)
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad array length %q", rest)
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		res := make([]interface{}, n)
+		for i := range res {
+			if res[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+
+		return res, nil
+	}
+
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+var errRespType = errors.New("redis: unexpected reply")
@@ -0,0 +1,638 @@
+package ingress
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/addrcheck"
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"go.uber.org/zap"
+)
+
+const (
+	INGRESS_SMTP_ADDR          = "INGRESS_SMTP_ADDR"          // адрес для приёма, по умолчанию :587
+	INGRESS_SMTP_HOSTNAME      = "INGRESS_SMTP_HOSTNAME"      // имя сервера в приветствии, по умолчанию имя хоста
+	INGRESS_SMTP_USERS         = "INGRESS_SMTP_USERS"         // логины и пароли через запятую: app:secret,cron:secret2
+	INGRESS_SMTP_TLS_CERT_FILE = "INGRESS_SMTP_TLS_CERT_FILE" // сертификат для STARTTLS в PEM
+	INGRESS_SMTP_TLS_KEY_FILE  = "INGRESS_SMTP_TLS_KEY_FILE"  // ключ сертификата в PEM
+	INGRESS_SMTP_INSECURE_AUTH = "INGRESS_SMTP_INSECURE_AUTH" // true - AUTH без STARTTLS, только для приёма с localhost
+	INGRESS_SMTP_MAX_SIZE      = "INGRESS_SMTP_MAX_SIZE"      // размер сообщения в байтах, по умолчанию 10485760
+)
+
+const (
+	defaultSMTPAddr    = ":587"
+	defaultSMTPMaxSize = 10 << 20
+	smtpMaxRcpts       = 100
+	smtpTimeout        = 5 * time.Minute // сколько ждать команду клиента
+)
+
+// SMTPSource - сервер отправки почты (submission) для программ, которые умеют только smtp
+// принимает письма только после AUTH (PLAIN или LOGIN), AUTH - только после STARTTLS,
+// если не разрешено иное; письмо ставится в очередь с исходным MIME в Raw, и только после
+// того, как очередь его сохранила, клиент получает 250
+type SMTPSource struct {
+	addr         string
+	hostname     string
+	users        map[string]string
+	tls          *tls.Config // nil - без STARTTLS
+	insecureAuth bool
+	maxSize      int
+	ch           *chan *letter.Letter
+	val          *addrcheck.Validator
+}
+
+func NewSMTP(ch *chan *letter.Letter, val *addrcheck.Validator) (*SMTPSource, error) {
+	s := SMTPSource{
+		addr:         defaultSMTPAddr,
+		hostname:     os.Getenv(INGRESS_SMTP_HOSTNAME),
+		users:        map[string]string{},
+		insecureAuth: strings.EqualFold(os.Getenv(INGRESS_SMTP_INSECURE_AUTH), "true"),
+		maxSize:      defaultSMTPMaxSize,
+		ch:           ch,
+		val:          val,
+	}
+
+	if a := os.Getenv(INGRESS_SMTP_ADDR); a != "" {
+		s.addr = a
+	}
+
+	if s.hostname == "" {
+		s.hostname, _ = os.Hostname()
+	}
+
+	for _, up := range strings.Split(os.Getenv(INGRESS_SMTP_USERS), ",") {
+		if up = strings.TrimSpace(up); up == "" {
+			continue
+		}
+
+		i := strings.Index(up, ":")
+		if i <= 0 || i == len(up)-1 {
+			return nil, fmt.Errorf("bad %s: user:password expected", INGRESS_SMTP_USERS)
+		}
+
+		s.users[up[:i]] = up[i+1:]
+	}
+
+	if len(s.users) == 0 {
+		return nil, fmt.Errorf("%s not defined", INGRESS_SMTP_USERS)
+	}
+
+	certFile, keyFile := os.Getenv(INGRESS_SMTP_TLS_CERT_FILE), os.Getenv(INGRESS_SMTP_TLS_KEY_FILE)
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("smtp certificate: %v", err)
+		}
+
+		s.tls = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	if s.tls == nil && !s.insecureAuth {
+		return nil, fmt.Errorf("%s and %s needed for STARTTLS, or %s=true", INGRESS_SMTP_TLS_CERT_FILE, INGRESS_SMTP_TLS_KEY_FILE, INGRESS_SMTP_INSECURE_AUTH)
+	}
+
+	if v := os.Getenv(INGRESS_SMTP_MAX_SIZE); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("bad %s %q", INGRESS_SMTP_MAX_SIZE, v)
+		}
+
+		s.maxSize = n
+	}
+
+	return &s, nil
+}
+
+func (s *SMTPSource) Name() string {
+	return SMTP
+}
+
+// Run принимает соединения до отмены ctx
+func (s *SMTPSource) Run(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("smtp listen: %v", err)
+	}
+
+	s.serve(ctx, l)
+
+	return nil
+}
+
+func (s *SMTPSource) serve(ctx context.Context, l net.Listener) {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				zap.S().Errorf("ingress smtp accept error: %v", err)
+			}
+
+			return
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			sess := &smtpSession{s: s}
+			sess.run(ctx, c)
+		}()
+	}
+}
+
+// smtpSession - одно соединение с клиентом
+type smtpSession struct {
+	s     *SMTPSource
+	conn  net.Conn
+	tp    *textproto.Conn
+	tls   bool
+	helo  bool
+	user  string
+	from  string
+	rcpts []string
+}
+
+func (ss *smtpSession) run(ctx context.Context, c net.Conn) {
+	ss.setConn(c)
+
+	// при остановке соединение закрывается, ReadLine вернёт ошибку
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+
+		ss.conn.Close()
+	}()
+
+	ss.reply(220, ss.s.hostname+" ESMTP mailsender")
+
+	for {
+		ss.conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+		line, err := ss.tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			ss.ehlo()
+		case "HELO":
+			ss.helo = true
+			ss.reply(250, ss.s.hostname)
+		case "STARTTLS":
+			if !ss.startTLS() {
+				return
+			}
+		case "AUTH":
+			ss.auth(arg)
+		case "MAIL":
+			ss.mail(arg)
+		case "RCPT":
+			ss.rcpt(arg)
+		case "DATA":
+			if !ss.data(ctx) {
+				return
+			}
+		case "RSET":
+			ss.reset()
+			ss.reply(250, "2.0.0 OK")
+		case "NOOP":
+			ss.reply(250, "2.0.0 OK")
+		case "VRFY":
+			ss.reply(252, "2.5.0 Cannot VRFY user")
+		case "QUIT":
+			ss.reply(221, "2.0.0 Bye")
+
+			return
+		default:
+			ss.reply(500, "5.5.2 Unknown command")
+		}
+	}
+}
+
+func (ss *smtpSession) setConn(c net.Conn) {
+	ss.conn = c
+	ss.tp = textproto.NewConn(c)
+}
+
+func (ss *smtpSession) reply(code int, lines ...string) {
+	for i, l := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+
+		ss.tp.PrintfLine("%d%s%s", code, sep, l)
+	}
+}
+
+func (ss *smtpSession) reset() {
+	ss.from = ""
+	ss.rcpts = nil
+}
+
+// AUTH без шифрования разрешён, только если так настроено
+func (ss *smtpSession) canAuth() bool {
+	return ss.tls || ss.s.insecureAuth
+}
+
+func (ss *smtpSession) ehlo() {
+	ss.helo = true
+	ss.reset()
+
+	ext := []string{ss.s.hostname, "8BITMIME", "ENHANCEDSTATUSCODES", "SIZE " + strconv.Itoa(ss.s.maxSize)}
+
+	if ss.s.tls != nil && !ss.tls {
+		ext = append(ext, "STARTTLS")
+	}
+
+	if ss.canAuth() {
+		ext = append(ext, "AUTH PLAIN LOGIN")
+	}
+
+	ss.reply(250, ext...)
+}
+
+// startTLS возвращает false, если соединение дальше не годится
+func (ss *smtpSession) startTLS() bool {
+	if ss.s.tls == nil || ss.tls {
+		ss.reply(503, "5.5.1 TLS not available")
+
+		return true
+	}
+
+	ss.reply(220, "2.0.0 Ready to start TLS")
+
+	tc := tls.Server(ss.conn, ss.s.tls)
+	if err := tc.Handshake(); err != nil {
+		zap.S().Debugf("ingress smtp TLS handshake error: %v", err)
+
+		return false
+	}
+
+	// после STARTTLS клиент начинает заново (RFC 3207)
+	ss.setConn(tc)
+	ss.tls = true
+	ss.helo = false
+	ss.user = ""
+	ss.reset()
+
+	return true
+}
+
+func (ss *smtpSession) auth(arg string) {
+	switch {
+	case !ss.helo:
+		ss.reply(503, "5.5.1 EHLO first")
+
+		return
+	case ss.user != "":
+		ss.reply(503, "5.5.1 Already authenticated")
+
+		return
+	case !ss.canAuth():
+		ss.reply(538, "5.7.11 Encryption required, use STARTTLS")
+
+		return
+	}
+
+	mechanism, initial := arg, ""
+	if i := strings.IndexByte(arg, ' '); i >= 0 {
+		mechanism, initial = arg[:i], arg[i+1:]
+	}
+
+	var user, password string
+
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		resp, ok := ss.challenge(initial, "")
+		if !ok {
+			return
+		}
+
+		// authzid \0 authcid \0 passwd
+		parts := strings.Split(resp, "\x00")
+		if len(parts) != 3 {
+			ss.reply(501, "5.5.2 Bad AUTH PLAIN response")
+
+			return
+		}
+
+		user, password = parts[1], parts[2]
+	case "LOGIN":
+		var ok bool
+
+		if user, ok = ss.challenge(initial, "Username:"); !ok {
+			return
+		}
+
+		if password, ok = ss.challenge("", "Password:"); !ok {
+			return
+		}
+	default:
+		ss.reply(504, "5.5.4 Unrecognized authentication type")
+
+		return
+	}
+
+	want, ok := ss.s.users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(want), []byte(password)) != 1 {
+		zap.S().Debugf("ingress smtp AUTH failed for %q from %s", user, ss.conn.RemoteAddr())
+		ss.reply(535, "5.7.8 Authentication credentials invalid")
+
+		return
+	}
+
+	ss.user = user
+	ss.reply(235, "2.7.0 Authentication successful")
+}
+
+// challenge возвращает ответ клиента из initial или на запрос prompt, декодированный из base64
+func (ss *smtpSession) challenge(initial, prompt string) (string, bool) {
+	resp := initial
+
+	if resp == "" {
+		ss.reply(334, base64.StdEncoding.EncodeToString([]byte(prompt)))
+
+		line, err := ss.tp.ReadLine()
+		if err != nil {
+			return "", false
+		}
+
+		resp = line
+	}
+
+	if resp == "*" {
+		ss.reply(501, "5.0.0 Authentication cancelled")
+
+		return "", false
+	}
+
+	if resp == "=" {
+		return "", true
+	}
+
+	b, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		ss.reply(501, "5.5.2 Bad base64")
+
+		return "", false
+	}
+
+	return string(b), true
+}
+
+// адрес из "FROM:<a@b.c> SIZE=100" или "TO:<a@b.c>" и параметры после него
+func smtpPath(arg, prefix string) (string, string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", "", false
+	}
+
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", "", false
+	}
+
+	return arg[1:end], strings.TrimSpace(arg[end+1:]), true
+}
+
+func (ss *smtpSession) mail(arg string) {
+	if ss.user == "" {
+		ss.reply(530, "5.7.0 Authentication required")
+
+		return
+	}
+
+	if ss.from != "" {
+		ss.reply(503, "5.5.1 Nested MAIL command")
+
+		return
+	}
+
+	from, params, ok := smtpPath(arg, "FROM:")
+	if !ok {
+		ss.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+
+		return
+	}
+
+	for _, p := range strings.Fields(params) {
+		if strings.HasPrefix(strings.ToUpper(p), "SIZE=") {
+			if n, err := strconv.Atoi(p[5:]); err == nil && n > ss.s.maxSize {
+				ss.reply(552, "5.3.4 Message size exceeds fixed limit")
+
+				return
+			}
+		}
+	}
+
+	// пустой обратный путь (<>) - тоже отправитель
+	if from == "" {
+		from = "<>"
+	}
+
+	ss.from = from
+	ss.reply(250, "2.1.0 OK")
+}
+
+func (ss *smtpSession) rcpt(arg string) {
+	if ss.from == "" {
+		ss.reply(503, "5.5.1 MAIL first")
+
+		return
+	}
+
+	to, _, ok := smtpPath(arg, "TO:")
+	if !ok || !strings.Contains(to, "@") {
+		ss.reply(501, "5.1.3 Syntax: RCPT TO:<address>")
+
+		return
+	}
+
+	if len(ss.rcpts) >= smtpMaxRcpts {
+		ss.reply(452, "4.5.3 Too many recipients")
+
+		return
+	}
+
+	ss.rcpts = append(ss.rcpts, to)
+	ss.reply(250, "2.1.5 OK")
+}
+
+// data возвращает false, если соединение дальше не годится
+func (ss *smtpSession) data(ctx context.Context) bool {
+	if len(ss.rcpts) == 0 {
+		ss.reply(503, "5.5.1 RCPT first")
+
+		return true
+	}
+
+	ss.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+
+	dr := ss.tp.DotReader()
+
+	b, err := ioutil.ReadAll(io.LimitReader(dr, int64(ss.s.maxSize)+1))
+	if err != nil {
+		return false
+	}
+
+	if len(b) > ss.s.maxSize {
+		// дочитать до точки, чтобы продолжить разговор
+		if _, err = io.Copy(ioutil.Discard, dr); err != nil {
+			return false
+		}
+
+		ss.reset()
+		ss.reply(552, "5.3.4 Message size exceeds fixed limit")
+
+		return true
+	}
+
+	code, text := ss.s.accept(ctx, ss.user, ss.rcpts, b)
+	ss.reset()
+	ss.reply(code, text)
+
+	return true
+}
+
+// accept ставит принятое сообщение в очередь и возвращает ответ клиенту
+func (s *SMTPSource) accept(ctx context.Context, user string, rcpts []string, b []byte) (int, string) {
+	ltr, key, err := ParseMessage(b, rcpts)
+	if err != nil {
+		return 554, "5.6.0 Malformed message: " + err.Error()
+	}
+
+	tL := []letter.Letter{ltr}
+	Prepare(ctx, tL, key, "", s.val)
+
+	if err = Enqueue(ctx, *s.ch, tL); err != nil {
+		zap.S().Errorf("ingress smtp from %s enqueue error: %v", user, err)
+
+		return 451, "4.3.0 Temporary failure, try again later"
+	}
+
+	tL[0].Log().Debugf("ingress smtp from %s queued %d recipients", user, len(rcpts))
+
+	return 250, "2.0.0 OK queued"
+}
+
+// ParseMessage делает письмо из сообщения RFC 5322 для адресатов rcpts:
+// тема - из Subject, сквозной ID - из X-Correlation-ID, исходное сообщение - в Raw;
+// возвращает и ключ запроса (см. messageKey), чтобы повторная отправка того же сообщения не создала письмо заново
+func ParseMessage(b []byte, rcpts []string) (letter.Letter, string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return letter.Letter{}, "", err
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+
+	ltr := letter.Letter{
+		Addresses:     append([]string(nil), rcpts...),
+		Subject:       subject,
+		Raw:           RawMessage(b),
+		CorrelationID: msg.Header.Get("X-Correlation-Id"),
+	}
+
+	return ltr, messageKey(strings.Trim(msg.Header.Get("Message-Id"), "<> "), rcpts), nil
+}
+
+// messageKey - ключ запроса из Message-ID и набора адресатов:
+// то же сообщение другим адресатам (досылка, пересылка) - другое письмо, а не повтор;
+// без Message-ID ключа нет
+func messageKey(id string, rcpts []string) string {
+	if id == "" {
+		return ""
+	}
+
+	as := make([]string, len(rcpts))
+	for i, a := range rcpts {
+		as[i] = strings.ToLower(a)
+	}
+
+	sort.Strings(as)
+
+	h := sha256.Sum256([]byte(strings.Join(as, "\n")))
+
+	return id + ":" + hex.EncodeToString(h[:8])
+}
+
+// RawMessage - исходное сообщение для Raw: строки через CRLF, без заголовков Bcc,
+// которые не должны дойти до получателей (RFC 6409, 8.1)
+func RawMessage(b []byte) string {
+	s := strings.ReplaceAll(string(b), "\r\n", "\n")
+
+	end := strings.Index(s, "\n\n")
+	if end < 0 {
+		end = len(s)
+	}
+
+	var (
+		head []string
+		bcc  bool
+	)
+
+	for _, l := range strings.Split(s[:end], "\n") {
+		// строка продолжения относится к предыдущему заголовку
+		if strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t") {
+			if !bcc {
+				head = append(head, l)
+			}
+
+			continue
+		}
+
+		bcc = len(l) >= 4 && strings.EqualFold(l[:4], "bcc:")
+		if !bcc {
+			head = append(head, l)
+		}
+	}
+
+	return strings.ReplaceAll(strings.Join(head, "\n")+s[end:], "\n", "\r\n")
+}
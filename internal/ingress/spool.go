@@ -0,0 +1,154 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/addrcheck"
+	"github.com/maris-cyber/mailsender/internal/envelope"
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"go.uber.org/zap"
+)
+
+const (
+	INGRESS_SPOOL_DIR    = "INGRESS_SPOOL_DIR"    // каталог с файлами запросов *.json
+	INGRESS_SPOOL_PERIOD = "INGRESS_SPOOL_PERIOD" // как часто просматривать каталог, по умолчанию 1s
+)
+
+const (
+	defaultSpoolPeriod = time.Second
+	spoolExt           = ".json"
+	spoolDone          = "done"   // сюда переносятся файлы, письма из которых в очереди
+	spoolFailed        = "failed" // сюда переносятся файлы, которые не удалось разобрать, с причиной в .error
+)
+
+// SpoolSource просматривает каталог и ставит в очередь запросы из файлов *.json
+// файл нужно писать под другим именем (например, .json.tmp) и переименовывать, когда он дописан
+// имя файла без .json - ключ запроса, поэтому повторно положенный файл с тем же именем не создаст писем
+type SpoolSource struct {
+	dir    string
+	period time.Duration
+	ch     *chan *letter.Letter
+	val    *addrcheck.Validator
+}
+
+func NewSpool(ch *chan *letter.Letter, val *addrcheck.Validator) (*SpoolSource, error) {
+	dir := os.Getenv(INGRESS_SPOOL_DIR)
+	if dir == "" {
+		return nil, fmt.Errorf("%s not defined", INGRESS_SPOOL_DIR)
+	}
+
+	sp := SpoolSource{dir: dir, period: defaultSpoolPeriod, ch: ch, val: val}
+
+	if s, ok := os.LookupEnv(INGRESS_SPOOL_PERIOD); ok && s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("bad %s %q", INGRESS_SPOOL_PERIOD, s)
+		}
+
+		sp.period = d
+	}
+
+	for _, sub := range []string{spoolDone, spoolFailed} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return nil, fmt.Errorf("spool: %v", err)
+		}
+	}
+
+	return &sp, nil
+}
+
+func (sp *SpoolSource) Name() string {
+	return Spool
+}
+
+// Run просматривает каталог до отмены контекста
+func (sp *SpoolSource) Run(ctx context.Context) error {
+	t := time.NewTicker(sp.period)
+	defer t.Stop()
+
+	for {
+		sp.Scan(ctx)
+
+		select {
+		case <-ctx.Done():
+			zap.S().Debug("ingress spool stopped")
+
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// Scan ставит в очередь запросы из всех файлов каталога по порядку имён
+func (sp *SpoolSource) Scan(ctx context.Context) {
+	files, err := os.ReadDir(sp.dir)
+	if err != nil {
+		zap.S().Errorf("ingress spool read error: %v", err)
+
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, spoolExt) || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		sp.file(ctx, name)
+	}
+}
+
+func (sp *SpoolSource) file(ctx context.Context, name string) {
+	path := filepath.Join(sp.dir, name)
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		zap.S().Errorf("ingress spool open error: %v", err)
+
+		return
+	}
+
+	tL, _, err := envelope.DecodeRequest(b)
+	if err != nil {
+		// повторное чтение файл не исправит
+		zap.S().Errorf("ingress spool %s: %v", name, err)
+
+		if err = os.WriteFile(filepath.Join(sp.dir, spoolFailed, name+".error"), []byte(err.Error()+"\n"), 0o600); err != nil {
+			zap.S().Errorf("ingress spool write error: %v", err)
+		}
+
+		sp.move(name, spoolFailed)
+
+		return
+	}
+
+	key := strings.TrimSuffix(name, spoolExt)
+	Prepare(ctx, tL, key, "", sp.val)
+
+	// пока очередь не сохранит письма, файл остаётся на месте и будет прочитан снова
+	if err = Enqueue(ctx, *sp.ch, tL); err != nil {
+		zap.S().Errorf("ingress spool %s enqueue: %v", name, err)
+
+		return
+	}
+
+	sp.move(name, spoolDone)
+}
+
+func (sp *SpoolSource) move(name, sub string) {
+	if err := os.Rename(filepath.Join(sp.dir, name), filepath.Join(sp.dir, sub, name)); err != nil {
+		zap.S().Errorf("ingress spool rename error: %v", err)
+	}
+}
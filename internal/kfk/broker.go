@@ -0,0 +1,48 @@
+package kfk
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// MessageReader - то, что DB нужно от kafka.Reader
+type MessageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	ReadMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// MessageWriter - то, что DB нужно от kafka.Writer
+type MessageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Broker создаёт читателей и писателей топиков: настоящей kafka или MemBroker в памяти
+type Broker interface {
+	Reader(topic, groupID string, cfg ConsumerConfig) MessageReader
+	Writer(topic string) MessageWriter
+}
+
+// kafkaBroker - подключение к kafka из Config, одно на всех писателей
+type kafkaBroker struct {
+	cfg       Config
+	transport *kafka.Transport
+}
+
+func newKafkaBroker(cfg Config) *kafkaBroker {
+	return &kafkaBroker{cfg: cfg, transport: cfg.transport()}
+}
+
+func (b *kafkaBroker) Reader(topic, groupID string, cfg ConsumerConfig) MessageReader {
+	c := b.cfg
+	c.consumer = cfg
+
+	return c.reader(topic, groupID)
+}
+
+func (b *kafkaBroker) Writer(topic string) MessageWriter {
+	return b.cfg.writer(topic, b.transport)
+}
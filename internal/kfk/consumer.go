@@ -0,0 +1,222 @@
+package kfk
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+// значения по умолчанию для чтения запросов
+const (
+	defaultMinBytes = 10
+	defaultMaxBytes = 10e6
+	defaultMaxWait  = 10 * time.Second
+	defaultWorkers  = 1
+	workerBuffer    = 16 // сколько сообщений ждёт своего обработчика, дальше чтение ждёт места
+)
+
+// ConsumerConfig - откуда и как читать топик для mailsender
+type ConsumerConfig struct {
+	StartOffset    int64         // kafka.FirstOffset или kafka.LastOffset для группы без сохранённых смещений
+	StartTime      time.Time     // если задано, группа без сохранённых смещений начинает с первого сообщения не раньше
+	MinBytes       int           // сколько байт брокер набирает для ответа на fetch
+	MaxBytes       int           // больше скольких байт брокер не отдаёт за fetch
+	MaxWait        time.Duration // сколько брокер ждёт MinBytes
+	CommitInterval time.Duration // 0 - смещение сохраняется сразу после обработки, иначе пачками с этим периодом
+	Workers        int           // сколько партиций обрабатывается параллельно
+}
+
+// messageFetcher - то, что нужно от kafka.Reader
+type messageFetcher interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// reader читает topic группой groupID с настройками ConsumerConfig
+func (cfgKfk *Config) reader(topic, groupID string) *kafka.Reader {
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:        cfgKfk.brokers,
+		Dialer:         cfgKfk.dialer(),
+		Topic:          topic,
+		GroupID:        groupID,
+		StartOffset:    cfgKfk.consumer.StartOffset,
+		MinBytes:       cfgKfk.consumer.MinBytes,
+		MaxBytes:       cfgKfk.consumer.MaxBytes,
+		MaxWait:        cfgKfk.consumer.MaxWait,
+		CommitInterval: cfgKfk.consumer.CommitInterval,
+	})
+}
+
+// seekTime сохраняет группе смещения первых сообщений не раньше StartTime в партициях,
+// по которым у группы ещё нет смещений; остальные партиции читаются с сохранённого места,
+// а партиции без таких сообщений - со StartOffset
+// kafka.Reader с группой не умеет начинать с момента времени, поэтому смещения сохраняются до его запуска
+func (cfgKfk *Config) seekTime(ctx context.Context, transport *kafka.Transport) error {
+	if cfgKfk.consumer.StartTime.IsZero() {
+		return nil
+	}
+
+	client := &kafka.Client{Addr: kafka.TCP(cfgKfk.brokers...), Transport: transport}
+
+	meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{cfgKfk.topicMS}})
+	if err != nil {
+		return fmt.Errorf("kafka metadata: %v", err)
+	}
+
+	if len(meta.Topics) != 1 || meta.Topics[0].Error != nil {
+		return fmt.Errorf("kafka metadata %s: %v", cfgKfk.topicMS, meta.Topics)
+	}
+
+	partitions := make([]int, 0, len(meta.Topics[0].Partitions))
+	for _, p := range meta.Topics[0].Partitions {
+		partitions = append(partitions, p.ID)
+	}
+
+	committed, err := client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{
+		GroupID: cfgKfk.groupId,
+		Topics:  map[string][]int{cfgKfk.topicMS: partitions},
+	})
+	if err != nil {
+		return fmt.Errorf("kafka offset fetch: %v", err)
+	}
+
+	if committed.Error != nil {
+		return fmt.Errorf("kafka offset fetch: %v", committed.Error)
+	}
+
+	var requests []kafka.OffsetRequest
+
+	for _, p := range committed.Topics[cfgKfk.topicMS] {
+		if p.Error == nil && p.CommittedOffset < 0 {
+			requests = append(requests, kafka.TimeOffsetOf(p.Partition, cfgKfk.consumer.StartTime))
+		}
+	}
+
+	if len(requests) == 0 {
+		return nil
+	}
+
+	listed, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: map[string][]kafka.OffsetRequest{cfgKfk.topicMS: requests}})
+	if err != nil {
+		return fmt.Errorf("kafka list offsets: %v", err)
+	}
+
+	var commits []kafka.OffsetCommit
+
+	for _, p := range listed.Topics[cfgKfk.topicMS] {
+		if p.Error != nil {
+			return fmt.Errorf("kafka list offsets partition %d: %v", p.Partition, p.Error)
+		}
+
+		for offset := range p.Offsets {
+			if offset >= 0 {
+				commits = append(commits, kafka.OffsetCommit{Partition: p.Partition, Offset: offset})
+			}
+		}
+	}
+
+	if len(commits) == 0 {
+		return nil
+	}
+
+	// смещения сохраняются вне поколения группы, пока в ней нет участников
+	res, err := client.OffsetCommit(ctx, &kafka.OffsetCommitRequest{
+		GroupID:      cfgKfk.groupId,
+		GenerationID: -1,
+		Topics:       map[string][]kafka.OffsetCommit{cfgKfk.topicMS: commits},
+	})
+	if err != nil {
+		return fmt.Errorf("kafka offset commit: %v", err)
+	}
+
+	for _, p := range res.Topics[cfgKfk.topicMS] {
+		if p.Error != nil {
+			return fmt.Errorf("kafka offset commit partition %d: %v", p.Partition, p.Error)
+		}
+	}
+
+	zap.S().Debugf("Kfk group %s starts from %v: %v\n", cfgKfk.groupId, cfgKfk.consumer.StartTime, commits)
+
+	return nil
+}
+
+// consume читает сообщения и раздаёт их workers обработчикам по номеру партиции:
+// партиции обрабатываются параллельно, сообщения одной партиции - по порядку одним обработчиком
+// смещение сохраняется, только если handle обработал сообщение без ошибки
+func consume(ctx context.Context, r messageFetcher, workers int, handle func(context.Context, kafka.Message) error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	wg := &sync.WaitGroup{}
+	in := make([]chan kafka.Message, workers)
+
+	for i := range in {
+		in[i] = make(chan kafka.Message, workerBuffer)
+
+		wg.Add(1)
+
+		go func(in chan kafka.Message) {
+			defer wg.Done()
+
+			for msg := range in {
+				if err := handle(ctx, msg); err != nil {
+					zap.S().Infof("kH.handle %s error: %v\n", source(msg), err)
+
+					continue
+				}
+
+				if err := r.CommitMessages(context.Background(), msg); err != nil {
+					zap.S().Errorf("Kfk commit %s error: %v\n", source(msg), err)
+				}
+			}
+		}(in[i])
+	}
+
+	defer wg.Wait()
+
+	// пока kafka недоступна, FetchMessage сразу возвращает ошибку: ждём вдвое дольше после каждой, но не больше retryDelay
+	backoff := minBackoff
+
+Fetching:
+	for {
+		msg, err := r.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				zap.S().Debug("Kafka consume ctx.Done()")
+
+				break
+			}
+
+			zap.S().Errorf("Kfk fetch error: %v, retry in %v\n", err, backoff)
+
+			select {
+			case <-ctx.Done():
+				break Fetching
+			case <-time.After(backoff):
+			}
+
+			if backoff *= 2; backoff > retryDelay {
+				backoff = retryDelay
+			}
+
+			continue
+		}
+
+		backoff = minBackoff
+
+		select {
+		case in[msg.Partition%workers] <- msg:
+		case <-ctx.Done():
+			break Fetching
+		}
+	}
+
+	for i := range in {
+		close(in[i])
+	}
+}
@@ -0,0 +1,146 @@
+package kfk
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+// заголовки сообщения в топике недоставленных сообщений (DLQ)
+const (
+	HeaderError     = "dlq-error"     // почему сообщение не обработано
+	HeaderTopic     = "dlq-topic"     // исходный топик
+	HeaderPartition = "dlq-partition" // исходная партиция
+	HeaderOffset    = "dlq-offset"    // исходное смещение
+	HeaderTime      = "dlq-time"      // когда сообщение попало в DLQ, RFC 3339
+)
+
+const dlqPrefix = "dlq-"
+
+// HeaderOrigin - откуда сообщение прочитано в первый раз (топик/партиция/смещение)
+// не удаляется при возврате из DLQ: по нему строятся ключи идемпотентности писем сообщения без ключа,
+// поэтому после возврата уже поставленные в очередь письма не отправляются снова
+const HeaderOrigin = "mailsender-origin"
+
+// WriteDLQ отправляет исходное сообщение в DLQ с тем же ключом, значением и заголовками,
+// добавляя заголовки с причиной и местом, откуда оно прочитано
+// если DLQ не настроен, сообщение только пишется в лог
+func (kH *DB) WriteDLQ(ctx context.Context, msg kafka.Message, reason string) error {
+	zap.S().Errorf("kafka message %s dead: %s\n", source(msg), reason)
+
+	if kH.Writer4DLQ == nil {
+		return nil
+	}
+
+	headers := withoutDLQ(msg.Headers)
+	if header(headers, HeaderOrigin) == "" {
+		headers = append(headers, kafka.Header{Key: HeaderOrigin, Value: []byte(source(msg))})
+	}
+
+	headers = append(headers,
+		kafka.Header{Key: HeaderError, Value: []byte(reason)},
+		kafka.Header{Key: HeaderTopic, Value: []byte(msg.Topic)},
+		kafka.Header{Key: HeaderPartition, Value: []byte(strconv.Itoa(msg.Partition))},
+		kafka.Header{Key: HeaderOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		kafka.Header{Key: HeaderTime, Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+	)
+
+	return kH.Writer4DLQ.WriteMessages(ctx, kafka.Message{
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	})
+}
+
+// ReplayDLQ возвращает сообщения из DLQ в топик для mailsender без заголовков dlq-
+// читает, пока не вернёт max сообщений (0 - без ограничения) или пока idle не будет новых сообщений
+// прочитанное в DLQ отмечается своей группой, поэтому повторный запуск продолжит с того же места
+// письма, которые уже были поставлены в очередь, отсечёт ключ идемпотентности:
+// он строится из ключа сообщения, а без ключа - из заголовка HeaderOrigin, который сохраняется
+func (kH *DB) ReplayDLQ(ctx context.Context, max int, idle time.Duration) (int, error) {
+	if kH.CfgKfk.topicDLQ == "" {
+		return 0, fmt.Errorf("%s not defined", KAFKA_TOPIC_DLQ)
+	}
+
+	// DLQ всегда читается с начала, прочитанное отмечается сразу
+	cfg := kH.CfgKfk.consumer
+	cfg.StartOffset = kafka.FirstOffset
+	cfg.CommitInterval = 0
+
+	r := kH.broker.Reader(kH.CfgKfk.topicDLQ, kH.CfgKfk.groupId+"-dlq-replay", cfg)
+	defer r.Close()
+
+	n := 0
+
+	for max == 0 || n < max {
+		fctx, cancel := context.WithTimeout(ctx, idle)
+		msg, err := r.FetchMessage(fctx)
+		cancel()
+
+		if err != nil {
+			if ctx.Err() == nil && fctx.Err() != nil {
+				// новых сообщений нет
+				return n, nil
+			}
+
+			return n, fmt.Errorf("DLQ fetch: %v", err)
+		}
+
+		err = kH.Writer4MS.WriteMessages(ctx, kafka.Message{
+			Key:     msg.Key,
+			Value:   msg.Value,
+			Headers: withoutDLQ(msg.Headers),
+		})
+		if err != nil {
+			return n, fmt.Errorf("DLQ replay write: %v", err)
+		}
+
+		if err = r.CommitMessages(ctx, msg); err != nil {
+			return n, fmt.Errorf("DLQ commit: %v", err)
+		}
+
+		zap.S().Debugf("DLQ replayed %s/%d/%d: %s", msg.Topic, msg.Partition, msg.Offset, header(msg.Headers, HeaderError))
+
+		n++
+	}
+
+	return n, nil
+}
+
+// заголовки без служебных dlq-, чтобы при повторном попадании в DLQ они не копились
+func withoutDLQ(hs []kafka.Header) []kafka.Header {
+	res := make([]kafka.Header, 0, len(hs)+6)
+
+	for _, h := range hs {
+		if !strings.HasPrefix(h.Key, dlqPrefix) {
+			res = append(res, h)
+		}
+	}
+
+	return res
+}
+
+// origin - откуда сообщение прочитано в первый раз, до DLQ
+func origin(msg kafka.Message) string {
+	if o := header(msg.Headers, HeaderOrigin); o != "" {
+		return o
+	}
+
+	return source(msg)
+}
+
+// значение заголовка key, пустое, если его нет
+func header(hs []kafka.Header, key string) string {
+	for _, h := range hs {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+
+	return ""
+}
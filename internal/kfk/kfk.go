@@ -5,21 +5,38 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"runtime"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/maris-cyber/mailsender/internal/addrcheck"
+	"github.com/maris-cyber/mailsender/internal/codec"
+	"github.com/maris-cyber/mailsender/internal/envelope"
+	"github.com/maris-cyber/mailsender/internal/event"
+	"github.com/maris-cyber/mailsender/internal/ingress"
 	"github.com/maris-cyber/mailsender/internal/letter"
 	"github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
 )
 
+// имя сервиса в конвертах исходящих сообщений
+const Producer = "mailsender"
+
+// пауза перед повторной отправкой писем в очередь или в DLQ
+const retryDelay = time.Second
+
 type DB struct {
 	CfgKfk     Config
-	Reader     *kafka.Reader // читать сообщения для mailsender
-	Writer4MS  *kafka.Writer // для тестов писать сообщения для mailsender
-	Writer4Prf *kafka.Writer // писать сообщения для profile
+	Reader     MessageReader // читать сообщения для mailsender
+	Writer4MS  MessageWriter // для тестов писать сообщения для mailsender
+	Writer4Prf MessageWriter // писать сообщения для profile
+	Writer4Evt MessageWriter // писать события по письмам, может отсутствовать
+	Writer4DLQ MessageWriter // писать сообщения, которые не удалось обработать, может отсутствовать
+	broker     Broker        // kafka или MemBroker в локальном режиме
+	prf        *Publisher    // статусы для profile пачками, без него пишутся по одному
 	fQtK       *chan *letter.Letter
 	fKtQ       *chan *letter.Letter
+	val        *addrcheck.Validator // проверка адресов при получении, может отсутствовать
 }
 
 // инициализация
@@ -33,39 +50,67 @@ func New(ctx context.Context, fQtK *chan *letter.Letter, fKtQ *chan *letter.Lett
 
 	zap.S().Debugf("Kafka.GetConfig: %v\n", kH.CfgKfk)
 
-	kH.Reader = kafka.NewReader(kafka.ReaderConfig{
-		Brokers:  kH.CfgKfk.brokers,
-		Topic:    kH.CfgKfk.topicMS,
-		GroupID:  kH.CfgKfk.groupId,
-		MinBytes: 10e0,
-		MaxBytes: 10e6,
-	})
+	var b Broker
 
-	kH.Writer4MS = &kafka.Writer{
-		Addr:     kafka.TCP(kH.CfgKfk.brokers[0]),
-		Topic:    kH.CfgKfk.topicMS,
-		Balancer: &kafka.LeastBytes{},
-	}
+	if kH.CfgKfk.local {
+		// без внешней kafka: топики в памяти, живут, пока работает сервис
+		zap.S().Debug("Kafka local mode")
+
+		b = NewMemBroker(localPartitions)
+	} else {
+		kb := newKafkaBroker(kH.CfgKfk)
 
-	kH.Writer4Prf = &kafka.Writer{
-		Addr:     kafka.TCP(kH.CfgKfk.brokers[0]),
-		Topic:    kH.CfgKfk.topicPrf,
-		Balancer: &kafka.LeastBytes{},
+		// если kafka недоступна, группа без сохранённых смещений начнёт со StartOffset
+		if err := kH.CfgKfk.seekTime(ctx, kb.transport); err != nil {
+			zap.S().Errorf("Kafka start time error: %v\n", err)
+		}
+
+		b = kb
 	}
 
+	kH.open(b)
+
 	kH.fKtQ = fKtQ
 	kH.fQtK = fQtK
 
 	return &kH, nil
 }
 
-// обработка событий для kafka
+// open создаёт читателя и писателей топиков из конфигурации
+func (kH *DB) open(b Broker) {
+	kH.broker = b
+	kH.Reader = b.Reader(kH.CfgKfk.topicMS, kH.CfgKfk.groupId, kH.CfgKfk.consumer)
+	kH.Writer4MS = b.Writer(kH.CfgKfk.topicMS)
+	kH.Writer4Prf = b.Writer(kH.CfgKfk.topicPrf)
+
+	kH.prf = NewPublisher(kH.Writer4Prf, kH.CfgKfk.prf)
+
+	if kH.CfgKfk.topicEvt != "" {
+		kH.Writer4Evt = b.Writer(kH.CfgKfk.topicEvt)
+	}
+
+	if kH.CfgKfk.topicDLQ != "" {
+		kH.Writer4DLQ = b.Writer(kH.CfgKfk.topicDLQ)
+	}
+}
+
+// подключить проверку адресов получателей
+func (kH *DB) SetValidator(v *addrcheck.Validator) {
+	kH.val = v
+}
+
+// обработка событий для kafka, запускает горутины и сразу возвращается
 func (kH *DB) Run(ctx context.Context) {
 	wg := &sync.WaitGroup{}
-	wg.Add(2)
+	wg.Add(1)
 
 	defer wg.Wait()
 
+	// публикация статусов пачками, после отмены ctx дописывает накопленное
+	if kH.prf != nil {
+		kH.prf.Start(ctx)
+	}
+
 	// обработка при поступлении сообщения от очереди для передачи через kafka в profile
 
 	go func(ctx context.Context) {
@@ -73,12 +118,42 @@ func (kH *DB) Run(ctx context.Context) {
 		go kH.RunFromQueue(ctx)
 	}(ctx)
 
-	// чтение из kafka сообщений в топике для mailsender и передача в канал для очереди
+	// чтение из kafka сообщений в топике для mailsender запускается как источник писем, см. Source
+}
 
-	go func(ctx context.Context) {
-		defer wg.Done()
-		go kH.RunFromKafka(ctx)
-	}(ctx)
+// Outbox - статусы сохраняются в outbox и уходят в kafka через Relay (KAFKA_OUTBOX=true)
+func (kH *DB) Outbox() bool {
+	return kH.CfgKfk.useOutbox
+}
+
+// Local - локальный режим (KAFKA_MODE=local): топики в памяти
+func (kH *DB) Local() bool {
+	return kH.CfgKfk.local
+}
+
+// Events - задан ли топик событий KAFKA_TOPIC_EVENTS
+func (kH *DB) Events() bool {
+	return kH.Writer4Evt != nil
+}
+
+// Source - kafka как источник писем для очереди (ingress)
+func (kH *DB) Source() ingress.Source {
+	return kafkaSource{kH}
+}
+
+type kafkaSource struct {
+	kH *DB
+}
+
+func (s kafkaSource) Name() string {
+	return ingress.Kafka
+}
+
+// чтение из kafka сообщений в топике для mailsender и передача в канал для очереди
+func (s kafkaSource) Run(ctx context.Context) error {
+	s.kH.RunFromKafka(ctx)
+
+	return nil
 }
 
 func (kH *DB) RunFromQueue(ctx context.Context) {
@@ -97,33 +172,22 @@ func (kH *DB) RunFromQueue(ctx context.Context) {
 	}
 }
 
+// партиции обрабатываются параллельно KAFKA_CONSUMER_WORKERS обработчиками, сообщения партиции - по порядку
 func (kH *DB) RunFromKafka(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			zap.S().Debug("Kafka RunFromKafka ctx.Done()")
-
-			return
-		default:
-			err := kH.FetchCommitMS(ctx)
-			if err != nil {
-				zap.S().Infof("kH.FetchCommitMS error: %v\n", err)
-			}
-
-			runtime.Gosched()
-		}
-	}
+	consume(ctx, kH.Reader, kH.CfgKfk.consumer.Workers, kH.handle)
 }
 
 // создавать сообщения в kafka для mailsender
-// погремушка для тестирования
-func (kH *DB) WriteToMS(ctx context.Context, k []byte, b []byte) error {
+// погремушка для тестирования, headers добавляются к заголовку content-type
+func (kH *DB) WriteToMS(ctx context.Context, k []byte, b []byte, headers ...kafka.Header) error {
 	var err error
 
+	// из http приходит JSON, заголовок нужен, если для топика задана другая кодировка
 	messages := []kafka.Message{
 		{
-			Key:   k,
-			Value: b,
+			Key:     k,
+			Value:   b,
+			Headers: append(contentType(codec.JSON), headers...),
 		},
 	}
 
@@ -134,9 +198,9 @@ func (kH *DB) WriteToMS(ctx context.Context, k []byte, b []byte) error {
 
 // читать сообщения из кафки,
 // отправлять их в DB очередь и отмечать как прочитанные
+// сообщение отмечается прочитанным только после того, как очередь сохранила все письма из него,
+// поэтому при падении сервиса письма не теряются, а повторно прочитанные отсекает ключ идемпотентности
 func (kH *DB) FetchCommitMS(ctx context.Context) error {
-	var tL []letter.Letter
-
 	zap.S().Debugf("Kfk Read waiting fetch\n")
 
 	msg, err := kH.Reader.FetchMessage(ctx)
@@ -144,33 +208,83 @@ func (kH *DB) FetchCommitMS(ctx context.Context) error {
 		return err
 	}
 
+	if err = kH.handle(ctx, msg); err != nil {
+		return err
+	}
+
+	return kH.Reader.CommitMessages(context.Background(), msg)
+}
+
+// handle разбирает сообщение и ставит письма в очередь; nil - сообщение можно отмечать прочитанным
+// ошибка бывает, только если отменён ctx
+func (kH *DB) handle(ctx context.Context, msg kafka.Message) error {
 	zap.S().Debugf("Kfk Read fetch %s\n", msg.Value)
 
-	err = json.Unmarshal(msg.Value, &tL)
+	tL, meta, err := kH.decode(msg)
 	if err != nil {
-		zap.S().Debugf("json.Unmarshal error: %v\n", err)
+		// повторное чтение сообщение не исправит, поэтому оно уходит в DLQ и отмечается прочитанным
+		reason := "unmarshal: " + err.Error()
+
+		return kH.retry(ctx, "DLQ", func() error { return kH.WriteDLQ(ctx, msg, reason) })
 	}
 
 	keyFromKfk := string(msg.Key)
 
-	zap.S().Debugf("Kfk Unmarshal %v\n", tL)
+	zap.S().Debugf("Kfk Unmarshal legacy %v producer %s: %v\n", meta.Legacy, meta.Producer, tL)
+
+	var reasons []string
+
+	valid := tL[:0:0]
 
 	for i := range tL {
-		tL[i].Status = "awaiting"
-		tL[i].KafkaKey = keyFromKfk
-		// отправить в канал для обработчика событий очереди
-		zap.S().Debugf("Kfk send to Queue chan %v\n", tL[i])
-		*kH.fKtQ <- &tL[i]
+		correlate(msg, &tL[i])
 	}
 
-	err = kH.Reader.CommitMessages(context.Background(), msg)
+	ingress.Prepare(ctx, tL, keyFromKfk, origin(msg), kH.val)
 
-	return err
+	for i := range tL {
+		// письмо, не прошедшее проверку, при настроенном DLQ не ставится в очередь,
+		// сообщение целиком уходит в DLQ, после повтора уже поставленные письма отсечёт ключ идемпотентности
+		if tL[i].Status == "failed" && kH.Writer4DLQ != nil {
+			reasons = append(reasons, fmt.Sprintf("letter %d: %s", i, tL[i].Error))
+
+			continue
+		}
+
+		valid = append(valid, tL[i])
+	}
+
+	if len(reasons) > 0 {
+		reason := "validation: " + strings.Join(reasons, "; ")
+		if err = kH.retry(ctx, "DLQ", func() error { return kH.WriteDLQ(ctx, msg, reason) }); err != nil {
+			return err
+		}
+	}
+
+	// пока очередь не сохранит письма, сообщение не отмечается прочитанным
+	// при повторе уже сохранённые письма очередь подтвердит как дубликаты
+	return kH.retry(ctx, "enqueue", func() error { return ingress.Enqueue(ctx, *kH.fKtQ, valid) })
 }
 
-func (kH *DB) ReadMS(ctx context.Context, fKtQ chan *letter.Letter) error {
-	var tL []letter.Letter
+// retry повторяет fn раз в retryDelay, пока она не выполнится или пока не отменён контекст
+func (kH *DB) retry(ctx context.Context, what string, fn func() error) error {
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
 
+		zap.S().Errorf("Kfk %s error: %v, retry in %v\n", what, err, retryDelay)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("kfk %s: %v", what, ctx.Err())
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+func (kH *DB) ReadMS(ctx context.Context, fKtQ chan *letter.Letter) error {
 	msg, err := kH.Reader.ReadMessage(ctx)
 	if err != nil {
 		return err
@@ -178,9 +292,9 @@ func (kH *DB) ReadMS(ctx context.Context, fKtQ chan *letter.Letter) error {
 
 	zap.S().Debugf("Kfk Read fetch %s\n", msg.Value)
 
-	err = json.Unmarshal(msg.Value, &tL)
+	tL, _, err := kH.decode(msg)
 	if err != nil {
-		zap.S().Debugf("json.Unmarshal error: %v\n", err)
+		zap.S().Debugf("kH.decode error: %v\n", err)
 	}
 
 	keyFromKfk := string(msg.Key)
@@ -188,8 +302,12 @@ func (kH *DB) ReadMS(ctx context.Context, fKtQ chan *letter.Letter) error {
 	zap.S().Debugf("Kfk Unmarshal %v\n", tL)
 
 	for i := range tL {
-		tL[i].Status = "awaiting"
-		tL[i].KafkaKey = keyFromKfk
+		correlate(msg, &tL[i])
+	}
+
+	ingress.Prepare(ctx, tL, keyFromKfk, origin(msg), kH.val)
+
+	for i := range tL {
 		// отправить в канал для обработчика событий очереди
 		fKtQ <- &tL[i]
 	}
@@ -197,33 +315,120 @@ func (kH *DB) ReadMS(ctx context.Context, fKtQ chan *letter.Letter) error {
 	return err
 }
 
+// decode разбирает запрос в кодировке из заголовка content-type,
+// а если заголовка нет или тип незнакомый - в кодировке, заданной для топика
+func (kH *DB) decode(msg kafka.Message) ([]letter.Letter, envelope.Meta, error) {
+	f := kH.CfgKfk.encMS
+
+	if ct := header(msg.Headers, codec.HeaderContentType); ct != "" {
+		if hf, ok := codec.FromContentType(ct); ok {
+			f = hf
+		} else {
+			zap.S().Debugf("Kfk unknown content-type %q, use %s\n", ct, f)
+		}
+	}
+
+	return codec.DecodeRequest(f, msg.Value)
+}
+
+func contentType(f codec.Format) []kafka.Header {
+	return []kafka.Header{{Key: codec.HeaderContentType, Value: []byte(f.ContentType())}}
+}
+
+// откуда письмо: топик/партиция/смещение, для ключа идемпотентности, если у сообщения нет ключа
+func source(msg kafka.Message) string {
+	return fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
+}
+
 // писать сообщения в кафку для prodile
-// пока пишется по одному сообщению
+// с Publisher статус только ставится в буфер, запись идёт пачками; ждать приходится, только если буфер полон
 func (kH *DB) WriteToPrf(ctx context.Context, t *letter.Letter) error {
+	msg, err := kH.prfMessage(t)
+	if err != nil {
+		return err
+	}
+
+	if kH.prf != nil {
+		return kH.prf.Publish(ctx, msg)
+	}
+
+	return kH.Writer4Prf.WriteMessages(ctx, msg)
+}
+
+// статус письма для profile в конверте (envelope) в кодировке KAFKA_ENCODING_PROFILE,
+// в старом формате - письмо целиком
+func (kH *DB) prfMessage(t *letter.Letter) (kafka.Message, error) {
 	var (
 		v   []byte
 		err error
 	)
 
-	if v, err = json.Marshal(t); err != nil {
-		return err
+	if kH.CfgKfk.legacy {
+		v, err = json.Marshal(t)
+	} else {
+		v, err = codec.EncodeStatus(kH.CfgKfk.encPrf, t, Producer)
 	}
 
-	zap.S().Debugf("kafka writeToPrf %s", v)
+	if err != nil {
+		return kafka.Message{}, err
+	}
 
-	messages := []kafka.Message{
-		{
-			Key:   []byte(t.KafkaKey),
-			Value: v,
-		},
+	zap.S().Debugf("kafka prfMessage %s %q", kH.CfgKfk.encPrf, v)
+
+	return kafka.Message{
+		Key:     []byte(t.KafkaKey),
+		Value:   v,
+		Headers: withCorrelationID(contentType(kH.CfgKfk.encPrf), t),
+	}, nil
+}
+
+// писать событие по письму в топик событий, в конверте (api/schema/letter-event.v1.json)
+// ключ - ID письма, чтобы события одного письма шли по порядку
+func (kH *DB) WriteEvent(ctx context.Context, e *event.Event) error {
+	if kH.Writer4Evt == nil {
+		return nil
+	}
+
+	v, err := envelope.EncodeEvent(e, Producer)
+	if err != nil {
+		return err
 	}
 
-	err = kH.Writer4Prf.WriteMessages(context.Background(), messages...)
+	zap.S().Debugf("kafka WriteEvent %s", v)
 
-	return err
+	return kH.Writer4Evt.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(e.LetterID),
+		Value:   v,
+		Headers: contentType(codec.JSON),
+	})
 }
 
-// пока нет ничего
+// Stop дожидается, пока Publisher допишет статусы (Run должен быть остановлен отменой контекста),
+// и закрывает читателя и писателей
 func (kH *DB) Stop(ctx context.Context) error {
-	return nil
+	var err error
+
+	if kH.prf != nil {
+		if err = kH.prf.Wait(ctx); err != nil {
+			err = fmt.Errorf("kafka publisher: %v", err)
+		}
+	}
+
+	if kH.Reader != nil {
+		if cErr := kH.Reader.Close(); cErr != nil {
+			err = fmt.Errorf("kafka reader close: %v", cErr)
+		}
+	}
+
+	for _, w := range []MessageWriter{kH.Writer4MS, kH.Writer4Prf, kH.Writer4Evt, kH.Writer4DLQ} {
+		if w == nil {
+			continue
+		}
+
+		if cErr := w.Close(); cErr != nil && err == nil {
+			err = fmt.Errorf("kafka writer close: %v", cErr)
+		}
+	}
+
+	return err
 }
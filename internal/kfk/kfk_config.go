@@ -1,33 +1,103 @@
 package kfk
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/maris-cyber/mailsender/internal/codec"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
 	"go.uber.org/zap"
 )
 
 const (
-	KAFKA_BROKERS   = "KAFKA_BROKERS"
+	KAFKA_MODE      = "KAFKA_MODE"    // kafka (по умолчанию) или local - топики в памяти, без брокеров
+	KAFKA_BROKERS   = "KAFKA_BROKERS" // брокеры через запятую
 	KAFKA_TOPIC_MS  = "KAFKA_TOPIC_MAILSENDER"
 	KAFKA_TOPIC_PRF = "KAFKA_TOPIC_PROFILE"
 	KAFKA_GROUPID   = "KAFKA_GROUPID"
+	KAFKA_TOPIC_EVT = "KAFKA_TOPIC_EVENTS"
+	KAFKA_TOPIC_DLQ = "KAFKA_TOPIC_DLQ"
+	KAFKA_PRF_FMT   = "KAFKA_PROFILE_FORMAT"      // envelope (по умолчанию) или legacy - письмо целиком, как раньше
+	KAFKA_ENC_MS    = "KAFKA_ENCODING_MAILSENDER" // кодировка запросов: json (по умолчанию), protobuf или avro
+	KAFKA_ENC_PRF   = "KAFKA_ENCODING_PROFILE"    // кодировка статусов: json (по умолчанию), protobuf или avro
 )
 
+// публикация статусов в profile пачками, см. PublisherConfig
+const (
+	KAFKA_PRF_BATCH   = "KAFKA_PROFILE_BATCH_SIZE"    // по умолчанию 100
+	KAFKA_PRF_LINGER  = "KAFKA_PROFILE_LINGER"        // по умолчанию 50ms
+	KAFKA_PRF_BUFFER  = "KAFKA_PROFILE_BUFFER"        // по умолчанию 1000
+	KAFKA_PRF_RETRIES = "KAFKA_PROFILE_RETRIES"       // по умолчанию 10
+	KAFKA_PRF_FLUSH   = "KAFKA_PROFILE_FLUSH_TIMEOUT" // по умолчанию 10s
+	KAFKA_OUTBOX      = "KAFKA_OUTBOX"                // true - статусы через outbox в базе (см. Relay), иначе сразу через Publisher
+	KAFKA_OUTBOX_PRD  = "KAFKA_OUTBOX_PERIOD"         // как часто relay просматривает outbox, по умолчанию 1s
+)
+
+// чтение запросов, см. ConsumerConfig
+const (
+	KAFKA_START_OFFSET     = "KAFKA_START_OFFSET"     // earliest (по умолчанию), latest или время в RFC 3339
+	KAFKA_FETCH_MIN_BYTES  = "KAFKA_FETCH_MIN_BYTES"  // по умолчанию 10
+	KAFKA_FETCH_MAX_BYTES  = "KAFKA_FETCH_MAX_BYTES"  // по умолчанию 10000000
+	KAFKA_FETCH_MAX_WAIT   = "KAFKA_FETCH_MAX_WAIT"   // по умолчанию 10s
+	KAFKA_COMMIT_INTERVAL  = "KAFKA_COMMIT_INTERVAL"  // по умолчанию 0 - сразу после обработки сообщения
+	KAFKA_CONSUMER_WORKERS = "KAFKA_CONSUMER_WORKERS" // по умолчанию 1
+)
+
+// аутентификация и шифрование, по умолчанию выключены
+const (
+	KAFKA_SASL_MECHANISM = "KAFKA_SASL_MECHANISM" // PLAIN, SCRAM-SHA-256 или SCRAM-SHA-512
+	KAFKA_SASL_USERNAME  = "KAFKA_SASL_USERNAME"
+	KAFKA_SASL_PASSWORD  = "KAFKA_SASL_PASSWORD"
+	KAFKA_TLS            = "KAFKA_TLS"           // true - подключаться по TLS с системными корневыми сертификатами
+	KAFKA_TLS_CA_FILE    = "KAFKA_TLS_CA_FILE"   // сертификат CA брокеров в PEM, включает TLS
+	KAFKA_TLS_CERT_FILE  = "KAFKA_TLS_CERT_FILE" // сертификат клиента в PEM, вместе с KAFKA_TLS_KEY_FILE включает TLS
+	KAFKA_TLS_KEY_FILE   = "KAFKA_TLS_KEY_FILE"  // ключ сертификата клиента в PEM
+)
+
+// сколько партиций у топиков в локальном режиме
+const localPartitions = 3
+
 type Config struct {
-	brokers  []string
-	topicMS  string
-	topicPrf string
-	groupId  string
+	local     bool // топики в памяти (MemBroker) вместо kafka
+	brokers   []string
+	topicMS   string
+	topicPrf  string
+	groupId   string
+	topicEvt  string         // события по письмам (открытия, переходы), если не задан - не публикуются
+	topicDLQ  string         // неразобранные и не прошедшие проверку сообщения, если не задан - только в лог
+	legacy    bool           // статусы в profile в старом формате
+	encMS     codec.Format   // кодировка запросов, если у сообщения нет заголовка content-type
+	encPrf    codec.Format   // кодировка статусов
+	sasl      sasl.Mechanism // nil - без аутентификации
+	tls       *tls.Config    // nil - без TLS
+	prf       PublisherConfig
+	useOutbox bool          // статусы через outbox и relay
+	outbox    time.Duration // период relay
+	consumer  ConsumerConfig
 }
 
 func (cfgKfk *Config) GetConfig() error {
 	var ok bool
 
-	brk, ok := os.LookupEnv(KAFKA_BROKERS)
-	cfgKfk.brokers = []string{brk}
+	switch m := os.Getenv(KAFKA_MODE); m {
+	case "", "kafka":
+	case "local":
+		cfgKfk.local = true
+	default:
+		return fmt.Errorf("%s: unknown mode %q", KAFKA_MODE, m)
+	}
+
+	cfgKfk.brokers = brokers(os.Getenv(KAFKA_BROKERS))
 
-	if !ok {
+	if len(cfgKfk.brokers) == 0 && !cfgKfk.local {
 		return fmt.Errorf("kafka broker not defined")
 	}
 
@@ -43,7 +113,276 @@ func (cfgKfk *Config) GetConfig() error {
 		return fmt.Errorf("KAFKA_GROUPID not defined")
 	}
 
+	cfgKfk.topicEvt = os.Getenv(KAFKA_TOPIC_EVT)
+	cfgKfk.topicDLQ = os.Getenv(KAFKA_TOPIC_DLQ)
+
+	switch f := os.Getenv(KAFKA_PRF_FMT); f {
+	case "", "envelope":
+	case "legacy":
+		cfgKfk.legacy = true
+	default:
+		return fmt.Errorf("%s: unknown format %q", KAFKA_PRF_FMT, f)
+	}
+
+	var err error
+
+	if cfgKfk.encMS, err = codec.ParseFormat(os.Getenv(KAFKA_ENC_MS)); err != nil {
+		return fmt.Errorf("%s: %v", KAFKA_ENC_MS, err)
+	}
+
+	if cfgKfk.encPrf, err = codec.ParseFormat(os.Getenv(KAFKA_ENC_PRF)); err != nil {
+		return fmt.Errorf("%s: %v", KAFKA_ENC_PRF, err)
+	}
+
+	// письмо целиком бывает только в JSON
+	if cfgKfk.legacy && cfgKfk.encPrf != codec.JSON {
+		return fmt.Errorf("%s=legacy needs %s=json", KAFKA_PRF_FMT, KAFKA_ENC_PRF)
+	}
+
+	if err = cfgKfk.publisherConfig(); err != nil {
+		return err
+	}
+
+	if err = cfgKfk.consumerConfig(); err != nil {
+		return err
+	}
+
+	if cfgKfk.sasl, err = saslMechanism(); err != nil {
+		return err
+	}
+
+	if cfgKfk.tls, err = tlsConfig(); err != nil {
+		return err
+	}
+
 	zap.S().Debugf("kafka Config %v\n", cfgKfk)
 
 	return nil
 }
+
+// для лога, без пароля SASL
+func (cfgKfk Config) String() string {
+	mechanism := "none"
+	if cfgKfk.sasl != nil {
+		mechanism = cfgKfk.sasl.Name()
+	}
+
+	return fmt.Sprintf("{local:%v brokers:%v topicMS:%s topicPrf:%s groupId:%s topicEvt:%s topicDLQ:%s legacy:%v encMS:%s encPrf:%s sasl:%s tls:%v outbox:%v consumer:%+v}",
+		cfgKfk.local, cfgKfk.brokers, cfgKfk.topicMS, cfgKfk.topicPrf, cfgKfk.groupId, cfgKfk.topicEvt, cfgKfk.topicDLQ,
+		cfgKfk.legacy, cfgKfk.encMS, cfgKfk.encPrf, mechanism, cfgKfk.tls != nil, cfgKfk.useOutbox, cfgKfk.consumer)
+}
+
+// dialer - подключение читателей с SASL и TLS, если они настроены
+func (cfgKfk *Config) dialer() *kafka.Dialer {
+	return &kafka.Dialer{
+		Timeout:       10 * time.Second,
+		DualStack:     true,
+		SASLMechanism: cfgKfk.sasl,
+		TLS:           cfgKfk.tls,
+	}
+}
+
+// transport - подключение писателей с SASL и TLS, если они настроены
+func (cfgKfk *Config) transport() *kafka.Transport {
+	return &kafka.Transport{
+		SASL: cfgKfk.sasl,
+		TLS:  cfgKfk.tls,
+	}
+}
+
+// writer пишет в topic через любой доступный брокер из списка
+func (cfgKfk *Config) writer(topic string, transport *kafka.Transport) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:      kafka.TCP(cfgKfk.brokers...),
+		Topic:     topic,
+		Balancer:  &kafka.LeastBytes{},
+		Transport: transport,
+		// пачки собирает Publisher, писатель не ждёт BatchTimeout (по умолчанию 1s) неполную пачку
+		BatchSize:    cfgKfk.prf.BatchSize,
+		BatchTimeout: time.Millisecond,
+	}
+}
+
+func (cfgKfk *Config) publisherConfig() error {
+	cfgKfk.prf = PublisherConfig{
+		BatchSize:    defaultBatchSize,
+		Linger:       defaultLinger,
+		Buffer:       defaultBuffer,
+		Retries:      defaultRetries,
+		FlushTimeout: defaultFlushTimeout,
+	}
+
+	for env, n := range map[string]*int{
+		KAFKA_PRF_BATCH:   &cfgKfk.prf.BatchSize,
+		KAFKA_PRF_BUFFER:  &cfgKfk.prf.Buffer,
+		KAFKA_PRF_RETRIES: &cfgKfk.prf.Retries,
+	} {
+		if s, ok := os.LookupEnv(env); ok && s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil || v < 0 || (v == 0 && env != KAFKA_PRF_RETRIES) {
+				return fmt.Errorf("bad %s %q", env, s)
+			}
+
+			*n = v
+		}
+	}
+
+	cfgKfk.useOutbox = strings.EqualFold(os.Getenv(KAFKA_OUTBOX), "true")
+	cfgKfk.outbox = defaultOutboxPeriod
+
+	for env, d := range map[string]*time.Duration{
+		KAFKA_PRF_LINGER: &cfgKfk.prf.Linger,
+		KAFKA_PRF_FLUSH:  &cfgKfk.prf.FlushTimeout,
+		KAFKA_OUTBOX_PRD: &cfgKfk.outbox,
+	} {
+		if s, ok := os.LookupEnv(env); ok && s != "" {
+			v, err := time.ParseDuration(s)
+			if err != nil || v <= 0 {
+				return fmt.Errorf("bad %s %q", env, s)
+			}
+
+			*d = v
+		}
+	}
+
+	return nil
+}
+
+func (cfgKfk *Config) consumerConfig() error {
+	cfgKfk.consumer = ConsumerConfig{
+		StartOffset: kafka.FirstOffset,
+		MinBytes:    defaultMinBytes,
+		MaxBytes:    defaultMaxBytes,
+		MaxWait:     defaultMaxWait,
+		Workers:     defaultWorkers,
+	}
+
+	switch s := strings.TrimSpace(os.Getenv(KAFKA_START_OFFSET)); strings.ToLower(s) {
+	case "", "earliest":
+	case "latest":
+		cfgKfk.consumer.StartOffset = kafka.LastOffset
+	default:
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return fmt.Errorf("bad %s %q: earliest, latest or RFC 3339 time expected", KAFKA_START_OFFSET, s)
+		}
+
+		// в партициях без сообщений после t читать только новые
+		cfgKfk.consumer.StartOffset = kafka.LastOffset
+		cfgKfk.consumer.StartTime = t
+	}
+
+	for env, n := range map[string]*int{
+		KAFKA_FETCH_MIN_BYTES:  &cfgKfk.consumer.MinBytes,
+		KAFKA_FETCH_MAX_BYTES:  &cfgKfk.consumer.MaxBytes,
+		KAFKA_CONSUMER_WORKERS: &cfgKfk.consumer.Workers,
+	} {
+		if s, ok := os.LookupEnv(env); ok && s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil || v <= 0 {
+				return fmt.Errorf("bad %s %q", env, s)
+			}
+
+			*n = v
+		}
+	}
+
+	if cfgKfk.consumer.MinBytes > cfgKfk.consumer.MaxBytes {
+		return fmt.Errorf("%s greater than %s", KAFKA_FETCH_MIN_BYTES, KAFKA_FETCH_MAX_BYTES)
+	}
+
+	for env, d := range map[string]*time.Duration{
+		KAFKA_FETCH_MAX_WAIT:  &cfgKfk.consumer.MaxWait,
+		KAFKA_COMMIT_INTERVAL: &cfgKfk.consumer.CommitInterval,
+	} {
+		if s, ok := os.LookupEnv(env); ok && s != "" {
+			v, err := time.ParseDuration(s)
+			if err != nil || v < 0 || (v == 0 && env != KAFKA_COMMIT_INTERVAL) {
+				return fmt.Errorf("bad %s %q", env, s)
+			}
+
+			*d = v
+		}
+	}
+
+	return nil
+}
+
+// список брокеров через запятую, пробелы и пустые элементы отбрасываются
+func brokers(s string) []string {
+	var bs []string
+
+	for _, b := range strings.Split(s, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			bs = append(bs, b)
+		}
+	}
+
+	return bs
+}
+
+func saslMechanism() (sasl.Mechanism, error) {
+	name := strings.ToUpper(strings.TrimSpace(os.Getenv(KAFKA_SASL_MECHANISM)))
+	if name == "" {
+		return nil, nil
+	}
+
+	user := os.Getenv(KAFKA_SASL_USERNAME)
+	password := os.Getenv(KAFKA_SASL_PASSWORD)
+
+	if user == "" {
+		return nil, fmt.Errorf("%s not defined", KAFKA_SASL_USERNAME)
+	}
+
+	switch name {
+	case "PLAIN":
+		return plain.Mechanism{Username: user, Password: password}, nil
+	case "SCRAM-SHA-256":
+		return scram.Mechanism(scram.SHA256, user, password)
+	case "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, user, password)
+	}
+
+	return nil, fmt.Errorf("%s: unknown mechanism %q", KAFKA_SASL_MECHANISM, name)
+}
+
+// tlsConfig включает TLS, если задан KAFKA_TLS=true, CA или сертификат клиента
+func tlsConfig() (*tls.Config, error) {
+	caFile := os.Getenv(KAFKA_TLS_CA_FILE)
+	certFile := os.Getenv(KAFKA_TLS_CERT_FILE)
+	keyFile := os.Getenv(KAFKA_TLS_KEY_FILE)
+
+	on := strings.EqualFold(os.Getenv(KAFKA_TLS), "true")
+	if !on && caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", KAFKA_TLS_CA_FILE, err)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates in %s", KAFKA_TLS_CA_FILE, caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("both %s and %s needed", KAFKA_TLS_CERT_FILE, KAFKA_TLS_KEY_FILE)
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("kafka client certificate: %v", err)
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
@@ -4,158 +4,1109 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"io"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/maris-cyber/mailsender/internal/addrcheck"
+	"github.com/maris-cyber/mailsender/internal/codec"
+	"github.com/maris-cyber/mailsender/internal/db/mem"
+	"github.com/maris-cyber/mailsender/internal/envelope"
 	"github.com/maris-cyber/mailsender/internal/letter"
 	"github.com/segmentio/kafka-go"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.uber.org/zap"
 )
 
-var ctx context.Context
-var kH *DB
-
 func TestMain(m *testing.M) {
-
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync()
 	zap.ReplaceGlobals(logger)
 
-	ctx = context.Background()
+	// Запуск тестов.
+	os.Exit(m.Run())
+}
+
+// newTestDB - DB на MemBroker, как в KAFKA_MODE=local, и канал, в который он отдаёт письма очереди
+func newTestDB() (*DB, *MemBroker, chan *letter.Letter) {
 	// канал для передачии из очереди в kafka
 	fQtK := make(chan *letter.Letter, 10)
 	// канал для передачии из kafka в очередь
 	fKtQ := make(chan *letter.Letter, 10)
 
-	kH = &DB{}
-
-	if err := kH.CfgKfk.GetConfig(); err != nil {
-		zap.S().Debugf("Can't config kafka: %v\nHardcoding config for test\n", err)
-		kH.CfgKfk.brokers = []string{"tb-kafka-0.tb-kafka.team15.svc.cluster.local:9092"}
+	k := &DB{
+		CfgKfk: Config{
+			local:    true,
+			groupId:  "TEST-mailsender",
+			topicMS:  "TEST-mts-to-mailsender",
+			topicPrf: "TEST-mts-to-profile",
+		},
+		fQtK: &fQtK,
+		fKtQ: &fKtQ,
 	}
 
-	kH.CfgKfk.groupId = "TEST-mailsender"
-	kH.CfgKfk.topicMS = "TEST-mts-to-mailsender"
-	kH.CfgKfk.topicPrf = "TEST-mts-to-profile"
+	b := NewMemBroker(3)
+	k.open(b)
 
-	kH.Reader = kafka.NewReader(kafka.ReaderConfig{
-		Brokers:  kH.CfgKfk.brokers,
-		Topic:    kH.CfgKfk.topicMS,
-		GroupID:  kH.CfgKfk.groupId,
-		MinBytes: 10e0,
-		MaxBytes: 10e6,
-	})
-
-	kH.Writer4MS = &kafka.Writer{
-		Addr:     kafka.TCP(kH.CfgKfk.brokers[0]),
-		Topic:    kH.CfgKfk.topicMS,
-		Balancer: &kafka.LeastBytes{},
-	}
+	return k, b, fKtQ
+}
 
-	kH.Writer4Prf = &kafka.Writer{
-		Addr:     kafka.TCP(kH.CfgKfk.brokers[0]),
-		Topic:    kH.CfgKfk.topicPrf,
-		Balancer: &kafka.LeastBytes{},
+// очередь, которая сохраняет все письма: подтверждает их и передаёт в saved
+func ackQueue(ctx context.Context, fKtQ chan *letter.Letter, saved chan *letter.Letter) {
+	for {
+		select {
+		case ltr := <-fKtQ:
+			ltr.Acknowledge(nil)
+			saved <- ltr
+		case <-ctx.Done():
+			return
+		}
 	}
-
-	kH.fKtQ = &fKtQ
-	kH.fQtK = &fQtK
-
-	zap.S().Debugf("Kafka test config %v\n", kH.CfgKfk)
-
-	ctx, _ = context.WithTimeout(ctx, 25*time.Second)
-
-	defer kH.Stop(ctx)
-	// Запуск тестов.
-	os.Exit(m.Run())
 }
 
-func Test_WriteToMS(t *testing.T) {
-	var err error
-	var tL [2]letter.Letter
+func testLetters(n int, subject string) []byte {
+	tL := make([]letter.Letter, n)
 	for i := range tL {
 		tL[i].Addresses = []string{"uuunet@mailto.plus", "yhuzfu@mailto.plus"}
-		tL[i].Body = "тест kafka WriteToMS" + strconv.Itoa(i)
-		tL[i].Subject = "тема kafka " + strconv.Itoa(i)
+		tL[i].Body = "тест kafka " + strconv.Itoa(i)
+		tL[i].Subject = subject + " " + strconv.Itoa(i)
 		tL[i].Status = "Testing"
 		tL[i].ID = primitive.NewObjectID()
 	}
-	msgs, _ := json.Marshal(&tL)
+
+	msgs, _ := json.Marshal(tL)
+
+	return msgs
+}
+
+func testKey() []byte {
 	key := make([]byte, 16)
-	_, err = rand.Read(key)
-	if err != nil {
+	if _, err := rand.Read(key); err != nil {
 		zap.S().Debugf("can't generate key for Kfk: %v\n", err)
 	}
 
-	zap.S().Debugf("Kafka test WriteToMS config %v\n", kH.CfgKfk)
-	err = kH.WriteToMS(ctx, key, msgs)
+	return key
+}
+
+func Test_WriteToMS(t *testing.T) {
+	k, b, _ := newTestDB()
+	key := testKey()
+
+	err := k.WriteToMS(context.Background(), key, testLetters(2, "тема kafka"), kafka.Header{Key: HeaderCorrelationID, Value: []byte("req-1")})
 	if err != nil {
-		t.Errorf("Test kafka can't create for MS\n")
+		t.Fatalf("WriteToMS error: %v", err)
+	}
+
+	msgs := b.Messages(k.CfgKfk.topicMS)
+	if len(msgs) != 1 || string(msgs[0].Key) != string(key) {
+		t.Fatalf("messages in %s: %v", k.CfgKfk.topicMS, msgs)
 	}
-	zap.S().Debugf("Test kafka create for MS %v\n", tL)
 
+	if ct, id := header(msgs[0].Headers, codec.HeaderContentType), header(msgs[0].Headers, HeaderCorrelationID); ct != codec.JSON.ContentType() || id != "req-1" {
+		t.Errorf("headers %v", msgs[0].Headers)
+	}
 }
 
 func Test_ReadCommit(t *testing.T) {
+	k, b, fKtQ := newTestDB()
 
-	zap.S().Debugf("Test kafka Read & Commit MS\n")
-	err := kH.FetchCommitMS(ctx)
-	if err != nil {
-		t.Errorf("Test kafka can't read\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	saved := make(chan *letter.Letter, 10)
+	go ackQueue(ctx, fKtQ, saved)
+
+	for i := 0; i < 2; i++ {
+		if err := k.WriteToMS(ctx, testKey(), testLetters(2, "тема kafka")); err != nil {
+			t.Fatalf("WriteToMS error: %v", err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := k.FetchCommitMS(ctx); err != nil {
+			t.Fatalf("FetchCommitMS error: %v", err)
+		}
+	}
+
+	if len(saved) != 4 {
+		t.Errorf("saved %d letters, want 4", len(saved))
+	}
+
+	var committed int64
+	for p := 0; p < 3; p++ {
+		committed += b.Committed(k.CfgKfk.topicMS, k.CfgKfk.groupId, p)
+	}
+
+	if committed != 2 {
+		t.Errorf("committed %d messages, want 2", committed)
+	}
+
+	// после перезапуска группа продолжает с сохранённого места
+	k.Reader.Close()
+	k.Reader = b.Reader(k.CfgKfk.topicMS, k.CfgKfk.groupId, k.CfgKfk.consumer)
+
+	fctx, fcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer fcancel()
+
+	if msg, err := k.Reader.FetchMessage(fctx); err == nil {
+		t.Errorf("committed message read again: %s", msg.Value)
 	}
-	zap.S().Debugf("Test kafka read\n")
 }
 
 func Test_Read(t *testing.T) {
-	var err error
+	k, _, _ := newTestDB()
 	fKtQ := make(chan *letter.Letter, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
 	// чтобы прочитать, надо написать
+	if err := k.WriteToMS(ctx, testKey(), testLetters(1, "тема kafka")); err != nil {
+		t.Fatalf("WriteToMS error: %v", err)
+	}
 
-	var tL [1]letter.Letter
-	for i := range tL {
-		tL[i].Addresses = []string{"uuunet@mailto.plus", "yhuzfu@mailto.plus"}
-		tL[i].Body = "тест kafka 4 ReadMS" + strconv.Itoa(i)
-		tL[i].Subject = "тема kafka" + strconv.Itoa(i)
-		tL[i].Status = "Testing"
-		tL[i].ID = primitive.NewObjectID()
+	if err := k.ReadMS(ctx, fKtQ); err != nil {
+		t.Fatalf("ReadMS error: %v", err)
 	}
-	msgs, _ := json.Marshal(&tL)
 
-	key := make([]byte, 16)
-	_, err = rand.Read(key)
-	if err != nil {
-		zap.S().Debugf("can't generate key for Kfk: %v\n", err)
+	if len(fKtQ) != 1 {
+		t.Fatalf("ReadMS sent %d letters", len(fKtQ))
+	}
+
+	if ltr := <-fKtQ; ltr.Status != "awaiting" || ltr.Subject != "тема kafka 0" {
+		t.Errorf("ReadMS letter %+v", ltr)
+	}
+}
+
+func Test_WriteToPrf(t *testing.T) {
+	k, b, _ := newTestDB()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		k.prf.Run(ctx)
+	}()
+
+	tL := letter.Letter{
+		Addresses: []string{"uuunet@mailto.plus", "yhuzfu@mailto.plus"},
+		Subject:   "тема письма из kafka_test",
+		Status:    "sent",
+		ID:        primitive.NewObjectID(),
+		KafkaKey:  "key-1",
+	}
+
+	if err := k.WriteToPrf(ctx, &tL); err != nil {
+		t.Fatalf("WriteToPrf error: %v", err)
+	}
+
+	// Publisher допишет буфер после отмены
+	cancel()
+	<-done
+
+	if err := k.Stop(context.Background()); err != nil {
+		t.Errorf("Stop error: %v", err)
+	}
+
+	// читатель тоже закрыт
+	if _, err := k.Reader.FetchMessage(context.Background()); err != io.EOF {
+		t.Errorf("FetchMessage after Stop = %v", err)
+	}
+
+	msgs := b.Messages(k.CfgKfk.topicPrf)
+	if len(msgs) != 1 {
+		t.Fatalf("messages in %s: %d", k.CfgKfk.topicPrf, len(msgs))
+	}
+
+	st, _, err := codec.DecodeStatus(codec.JSON, msgs[0].Value)
+	if err != nil || st.LetterID != tL.ID.Hex() || st.Status != "sent" || string(msgs[0].Key) != "key-1" {
+		t.Errorf("status %+v, %v", st, err)
+	}
+}
+
+// весь путь через kafka: запрос от отправителя - очередь - статус для profile
+func Test_Pipeline(t *testing.T) {
+	k, b, fKtQ := newTestDB()
+	k.CfgKfk.consumer.Workers = 2
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	k.Run(ctx)
+
+	go k.Source().Run(ctx)
+
+	// очередь "отправляет" сохранённые письма
+	saved := make(chan *letter.Letter, 10)
+	go ackQueue(ctx, fKtQ, saved)
+
+	go func() {
+		for {
+			select {
+			case ltr := <-saved:
+				ltr.Status = "sent"
+				*k.fQtK <- ltr
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		err := k.WriteToMS(ctx, testKey(), testLetters(2, "тема"), kafka.Header{Key: "X-Request-ID", Value: []byte("req-" + strconv.Itoa(i))})
+		if err != nil {
+			t.Fatalf("WriteToMS error: %v", err)
+		}
+	}
+
+	var msgs []kafka.Message
+
+	for len(msgs) < 6 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+		msgs = b.Messages(k.CfgKfk.topicPrf)
+	}
+
+	if len(msgs) != 6 {
+		t.Fatalf("statuses in %s: %d, want 6", k.CfgKfk.topicPrf, len(msgs))
+	}
+
+	for _, msg := range msgs {
+		st, meta, err := codec.DecodeStatus(codec.JSON, msg.Value)
+		if err != nil || st.Status != "sent" || !strings.HasPrefix(meta.CorrelationID, "req-") {
+			t.Errorf("status %+v %+v, %v", st, meta, err)
+		}
+
+		if header(msg.Headers, HeaderCorrelationID) != meta.CorrelationID {
+			t.Errorf("status headers %v", msg.Headers)
+		}
+	}
+}
+
+func Test_MemBroker(t *testing.T) {
+	b := NewMemBroker(2)
+	w := b.Writer("topic")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		if err := w.WriteMessages(ctx, kafka.Message{Key: []byte("same"), Value: []byte(strconv.Itoa(i))}); err != nil {
+			t.Fatalf("WriteMessages error: %v", err)
+		}
 	}
 
-	err = kH.WriteToMS(ctx, key, msgs)
+	// сообщения с одним ключом - в одной партиции по порядку
+	msgs := b.Messages("topic")
+	for i, msg := range msgs {
+		if msg.Partition != msgs[0].Partition || msg.Offset != int64(i) {
+			t.Errorf("message %d partition %d offset %d", i, msg.Partition, msg.Offset)
+		}
+	}
+
+	r := b.Reader("topic", "g", ConsumerConfig{})
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadMessage(ctx); err != nil {
+			t.Fatalf("ReadMessage error: %v", err)
+		}
+	}
+
+	// прочитанное, но не подтверждённое, после перезапуска читается снова
+	if msg, err := r.FetchMessage(ctx); err != nil || string(msg.Value) != "2" {
+		t.Fatalf("FetchMessage = %s, %v", msg.Value, err)
+	}
+
+	r.Close()
+
+	if _, err := r.FetchMessage(ctx); err != io.EOF {
+		t.Errorf("FetchMessage after Close = %v", err)
+	}
+
+	r = b.Reader("topic", "g", ConsumerConfig{})
+	if msg, err := r.FetchMessage(ctx); err != nil || string(msg.Value) != "2" {
+		t.Errorf("FetchMessage after restart = %s, %v", msg.Value, err)
+	}
+
+	// другая группа читает всё с начала, группа с LastOffset - только новое
+	if msg, err := b.Reader("topic", "other", ConsumerConfig{}).FetchMessage(ctx); err != nil || string(msg.Value) != "0" {
+		t.Errorf("other group FetchMessage = %s, %v", msg.Value, err)
+	}
+
+	latest := b.Reader("topic", "latest", ConsumerConfig{StartOffset: kafka.LastOffset})
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		w.WriteMessages(ctx, kafka.Message{Value: []byte("new")})
+	}()
+
+	if msg, err := latest.FetchMessage(ctx); err != nil || string(msg.Value) != "new" {
+		t.Errorf("latest group FetchMessage = %s, %v", msg.Value, err)
+	}
+
+	w.Close()
+
+	if err := w.WriteMessages(ctx, kafka.Message{}); err == nil {
+		t.Errorf("WriteMessages after Close no error")
+	}
+}
+
+func Test_WithoutDLQ(t *testing.T) {
+	hs := []kafka.Header{
+		{Key: "trace", Value: []byte("1")},
+		{Key: HeaderError, Value: []byte("unmarshal: EOF")},
+		{Key: HeaderOffset, Value: []byte("7")},
+	}
+
+	if got := header(hs, HeaderError); got != "unmarshal: EOF" {
+		t.Errorf("header %s = %q", HeaderError, got)
+	}
+
+	res := withoutDLQ(hs)
+	if len(res) != 1 || res[0].Key != "trace" {
+		t.Errorf("withoutDLQ = %v", res)
+	}
+
+	if header(res, HeaderTopic) != "" {
+		t.Errorf("header of missing key not empty")
+	}
+}
+
+// сообщение без ключа с неправильным письмом уходит в DLQ, а после возврата
+// правильное письмо получает тот же ключ идемпотентности и очередь отсечёт его как дубликат
+func Test_DLQ(t *testing.T) {
+	k, b, fKtQ := newTestDB()
+	k.CfgKfk.topicDLQ = "TEST-mts-dlq"
+	k.Writer4DLQ = b.Writer(k.CfgKfk.topicDLQ)
+
+	val, err := addrcheck.New()
 	if err != nil {
-		t.Errorf("Test kafka can't create for Read MS\n")
+		t.Fatalf("addrcheck.New error: %v", err)
 	}
 
-	zap.S().Debugf("Test kafka Read MS\n")
-	err = kH.ReadMS(ctx, fKtQ)
+	k.SetValidator(val)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	saved := make(chan *letter.Letter, 10)
+	go ackQueue(ctx, fKtQ, saved)
+
+	mixed, err := json.Marshal([]letter.Letter{
+		{Subject: "правильное", Addresses: []string{"uuunet@mailto.plus"}},
+		{Subject: "неправильное", Addresses: []string{"bad@"}},
+	})
 	if err != nil {
-		t.Errorf("Test kafka can't read\n")
+		t.Fatalf("Marshal error: %v", err)
+	}
+
+	for _, v := range [][]byte{mixed, []byte("{")} {
+		if err = k.WriteToMS(ctx, nil, v); err != nil {
+			t.Fatalf("WriteToMS error: %v", err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = k.FetchCommitMS(ctx); err != nil {
+			t.Fatalf("FetchCommitMS error: %v", err)
+		}
+	}
+
+	if len(saved) != 1 {
+		t.Fatalf("saved %d letters, want 1", len(saved))
+	}
+
+	first := <-saved
+
+	dead := b.Messages(k.CfgKfk.topicDLQ)
+	if len(dead) != 2 {
+		t.Fatalf("DLQ messages %d, want 2", len(dead))
+	}
+
+	for _, msg := range dead {
+		if header(msg.Headers, HeaderError) == "" || header(msg.Headers, HeaderOrigin) == "" {
+			t.Errorf("DLQ headers %v", msg.Headers)
+		}
+	}
+
+	n, err := k.ReplayDLQ(ctx, 0, 50*time.Millisecond)
+	if err != nil || n != 2 {
+		t.Fatalf("ReplayDLQ = %d, %v", n, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = k.FetchCommitMS(ctx); err != nil {
+			t.Fatalf("FetchCommitMS after replay error: %v", err)
+		}
+	}
+
+	if len(saved) != 1 {
+		t.Fatalf("saved %d letters after replay, want 1", len(saved))
+	}
+
+	if again := <-saved; again.IdempotencyKey != first.IdempotencyKey || first.IdempotencyKey == "" {
+		t.Errorf("idempotency key after replay %q, before %q", again.IdempotencyKey, first.IdempotencyKey)
+	}
+
+	// снова не прошедшие сообщения попадают в DLQ с прежним местом первого чтения
+	dead = b.Messages(k.CfgKfk.topicDLQ)
+	if len(dead) != 4 {
+		t.Fatalf("DLQ messages after replay %d, want 4", len(dead))
+	}
+
+	origins := map[string]int{}
+	for _, msg := range dead {
+		n := 0
+		for _, h := range msg.Headers {
+			if h.Key == HeaderOrigin {
+				n++
+			}
+		}
+
+		if n != 1 {
+			t.Errorf("%d %s headers", n, HeaderOrigin)
+		}
+
+		origins[header(msg.Headers, HeaderOrigin)]++
+	}
+
+	if len(origins) != 2 {
+		t.Errorf("origins %v", origins)
 	}
-	zap.S().Debugf("Test kafka read\n")
 }
 
-// ? todo сделать красиво
-func Test_WriteToPrf(t *testing.T) {
-	var tL letter.Letter
+func Test_Decode(t *testing.T) {
+	k := &DB{CfgKfk: Config{encMS: codec.Protobuf}}
+	letters := []envelope.Letter{{Addresses: []string{"uuunet@mailto.plus"}, Subject: "тема"}}
 
-	tL.Addresses = []string{"uuunet@mailto.plus", "yhuzfu@mailto.plus"}
-	tL.Body = "туловище письма из kafka_test"
-	tL.Subject = "тема письма из kafka_test"
-	tL.Status = "Sent"
-	tL.ID = primitive.NewObjectID()
+	pb, err := codec.EncodeRequest(codec.Protobuf, letters, "bodyshop", "")
+	if err != nil {
+		t.Fatalf("EncodeRequest error: %v", err)
+	}
 
-	err := kH.WriteToPrf(ctx, &tL)
+	av, err := codec.EncodeRequest(codec.Avro, letters, "bodyshop", "")
 	if err != nil {
-		t.Errorf("Test kafka can't create for Prf\n")
+		t.Fatalf("EncodeRequest error: %v", err)
+	}
+
+	for name, msg := range map[string]kafka.Message{
+		"topic":        {Value: pb},
+		"content-type": {Value: av, Headers: contentType(codec.Avro)},
+		"json":         {Value: []byte(`[{"Subject":"тема","Addresses":["uuunet@mailto.plus"]}]`), Headers: contentType(codec.JSON)},
+	} {
+		tL, _, err := k.decode(msg)
+		if err != nil || len(tL) != 1 || tL[0].Subject != "тема" {
+			t.Errorf("decode %s = %+v, %v", name, tL, err)
+		}
+	}
+}
+
+func Test_CorrelationID(t *testing.T) {
+	tests := []struct {
+		hs   []kafka.Header
+		want string
+	}{
+		{nil, ""},
+		{[]kafka.Header{{Key: "X-Request-ID", Value: []byte(" req-1 ")}}, "req-1"},
+		{[]kafka.Header{{Key: "x-correlation-id", Value: []byte("c-1")}, {Key: HeaderCorrelationID, Value: []byte("c-2")}}, "c-2"},
+		{[]kafka.Header{{Key: "traceparent", Value: []byte("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")}}, "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{[]kafka.Header{{Key: "traceparent", Value: []byte("broken")}}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := correlationID(tt.hs); got != tt.want {
+			t.Errorf("correlationID(%v) = %q, want %q", tt.hs, got, tt.want)
+		}
+	}
+
+	msg := kafka.Message{Headers: []kafka.Header{{Key: HeaderCorrelationID, Value: []byte("from\r\nheader")}}}
+
+	// ID из конверта важнее заголовка, переводы строк вырезаются
+	ltr := &letter.Letter{CorrelationID: "from envelope"}
+	if correlate(msg, ltr); ltr.CorrelationID != "fromenvelope" {
+		t.Errorf("correlate envelope = %q", ltr.CorrelationID)
+	}
+
+	ltr = &letter.Letter{}
+	if correlate(msg, ltr); ltr.CorrelationID != "fromheader" {
+		t.Errorf("correlate header = %q", ltr.CorrelationID)
+	}
+
+	// ID уходит в заголовок сообщения для profile
+	pm, err := (&DB{}).prfMessage(ltr)
+	if err != nil || header(pm.Headers, HeaderCorrelationID) != "fromheader" {
+		t.Errorf("prfMessage headers %v, error %v", pm.Headers, err)
+	}
+}
+
+func Test_Config(t *testing.T) {
+	t.Setenv(KAFKA_BROKERS, " kafka-0:9092, ,kafka-1:9092,kafka-2:9092 ")
+	t.Setenv(KAFKA_TOPIC_MS, "ms")
+	t.Setenv(KAFKA_TOPIC_PRF, "prf")
+	t.Setenv(KAFKA_GROUPID, "group")
+	t.Setenv(KAFKA_SASL_MECHANISM, "scram-sha-512")
+	t.Setenv(KAFKA_SASL_USERNAME, "mailsender")
+	t.Setenv(KAFKA_SASL_PASSWORD, "secret")
+	t.Setenv(KAFKA_TLS, "true")
+
+	var cfg Config
+
+	if err := cfg.GetConfig(); err != nil {
+		t.Fatalf("GetConfig error: %v", err)
+	}
+
+	if want := []string{"kafka-0:9092", "kafka-1:9092", "kafka-2:9092"}; strings.Join(cfg.brokers, ",") != strings.Join(want, ",") {
+		t.Errorf("brokers = %q, want %q", cfg.brokers, want)
+	}
+
+	if cfg.sasl == nil || cfg.sasl.Name() != "SCRAM-SHA-512" {
+		t.Errorf("sasl = %v", cfg.sasl)
+	}
+
+	if cfg.tls == nil || cfg.tls.RootCAs != nil {
+		t.Errorf("tls = %+v", cfg.tls)
+	}
+
+	if s := cfg.String(); strings.Contains(s, "secret") {
+		t.Errorf("password in config log: %s", s)
+	}
+
+	if w := cfg.writer("ms", cfg.transport()); w.Addr.String() != "kafka-0:9092,kafka-1:9092,kafka-2:9092" {
+		t.Errorf("writer addr = %s", w.Addr)
+	}
+
+	// outbox - только по настройке, иначе статусы идут через Publisher
+	if cfg.useOutbox {
+		t.Errorf("outbox on by default")
+	}
+
+	t.Setenv(KAFKA_OUTBOX, "TRUE")
+
+	if err := cfg.GetConfig(); err != nil || !cfg.useOutbox {
+		t.Errorf("GetConfig with %s: outbox %v, %v", KAFKA_OUTBOX, cfg.useOutbox, err)
+	}
+
+	t.Setenv(KAFKA_SASL_MECHANISM, "PLAIN")
+
+	if m, err := saslMechanism(); err != nil || m.Name() != "PLAIN" {
+		t.Errorf("saslMechanism PLAIN = %v, %v", m, err)
+	}
+
+	for env, val := range map[string]string{
+		KAFKA_SASL_MECHANISM:   "GSSAPI",
+		KAFKA_TLS_CA_FILE:      "testdata/nothing.pem",
+		KAFKA_TLS_CERT_FILE:    "testdata/nothing.pem",
+		KAFKA_BROKERS:          " , ",
+		KAFKA_START_OFFSET:     "yesterday",
+		KAFKA_FETCH_MIN_BYTES:  "20000000",
+		KAFKA_CONSUMER_WORKERS: "0",
+		KAFKA_COMMIT_INTERVAL:  "-1s",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, val)
+
+			if err := cfg.GetConfig(); err == nil {
+				t.Errorf("GetConfig with %s=%q no error", env, val)
+			}
+		})
+	}
+}
+
+func Test_ConsumerConfig(t *testing.T) {
+	var cfg Config
+
+	if err := cfg.consumerConfig(); err != nil || cfg.consumer.StartOffset != kafka.FirstOffset || cfg.consumer.Workers != 1 {
+		t.Errorf("consumerConfig defaults %+v, %v", cfg.consumer, err)
+	}
+
+	t.Setenv(KAFKA_START_OFFSET, "Latest")
+
+	if err := cfg.consumerConfig(); err != nil || cfg.consumer.StartOffset != kafka.LastOffset || !cfg.consumer.StartTime.IsZero() {
+		t.Errorf("consumerConfig latest %+v, %v", cfg.consumer, err)
+	}
+
+	t.Setenv(KAFKA_START_OFFSET, "2021-11-01T10:00:00+03:00")
+	t.Setenv(KAFKA_FETCH_MAX_WAIT, "500ms")
+	t.Setenv(KAFKA_COMMIT_INTERVAL, "0")
+	t.Setenv(KAFKA_CONSUMER_WORKERS, "4")
+
+	if err := cfg.consumerConfig(); err != nil {
+		t.Fatalf("consumerConfig error: %v", err)
+	}
+
+	// с момента времени - только для группы без смещений, в пустых партициях - с конца
+	if want := time.Date(2021, 11, 1, 7, 0, 0, 0, time.UTC); !cfg.consumer.StartTime.Equal(want) || cfg.consumer.StartOffset != kafka.LastOffset {
+		t.Errorf("consumerConfig start %v %d", cfg.consumer.StartTime, cfg.consumer.StartOffset)
+	}
+
+	if cfg.consumer.MaxWait != 500*time.Millisecond || cfg.consumer.CommitInterval != 0 || cfg.consumer.Workers != 4 {
+		t.Errorf("consumerConfig %+v", cfg.consumer)
+	}
+}
+
+// fakeFetcher сначала fails раз возвращает ошибку, затем отдаёт msgs, потом ждёт отмены ctx,
+// и запоминает время вызовов и сохранённые смещения
+type fakeFetcher struct {
+	mu        sync.Mutex
+	fails     int
+	fetched   []time.Time
+	msgs      []kafka.Message
+	committed []kafka.Message
+}
+
+func (r *fakeFetcher) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	r.mu.Lock()
+
+	r.fetched = append(r.fetched, time.Now())
+
+	if r.fails > 0 {
+		r.fails--
+		r.mu.Unlock()
+
+		return kafka.Message{}, errors.New("kafka unavailable")
+	}
+
+	if len(r.msgs) == 0 {
+		r.mu.Unlock()
+		<-ctx.Done()
+
+		return kafka.Message{}, ctx.Err()
+	}
+
+	msg := r.msgs[0]
+	r.msgs = r.msgs[1:]
+	r.mu.Unlock()
+
+	return msg, nil
+}
+
+func (r *fakeFetcher) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.committed = append(r.committed, msgs...)
+
+	return nil
+}
+
+func Test_Consume(t *testing.T) {
+	const partitions, perPartition = 5, 20
+
+	r := &fakeFetcher{}
+
+	for i := 0; i < perPartition; i++ {
+		for p := 0; p < partitions; p++ {
+			r.msgs = append(r.msgs, kafka.Message{Partition: p, Offset: int64(i)})
+		}
+	}
+
+	var (
+		mu     sync.Mutex
+		seen   = map[int][]int64{}
+		active int32
+		peak   int32
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		consume(ctx, r, 3, func(ctx context.Context, msg kafka.Message) error {
+			mu.Lock()
+			seen[msg.Partition] = append(seen[msg.Partition], msg.Offset)
+			if active++; active > peak {
+				peak = active
+			}
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			active--
+			mu.Unlock()
+
+			// сообщение с ошибкой не отмечается прочитанным
+			if msg.Partition == 0 && msg.Offset == perPartition-1 {
+				return context.Canceled
+			}
+
+			return nil
+		})
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		r.mu.Lock()
+		n := len(r.committed)
+		r.mu.Unlock()
+
+		if n == partitions*perPartition-1 || time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+
+	if len(r.committed) != partitions*perPartition-1 {
+		t.Errorf("committed %d messages, want %d", len(r.committed), partitions*perPartition-1)
+	}
+
+	// сообщения партиции обрабатываются по порядку
+	for p := 0; p < partitions; p++ {
+		if len(seen[p]) != perPartition {
+			t.Errorf("partition %d handled %d messages", p, len(seen[p]))
+		}
+
+		for i, off := range seen[p] {
+			if off != int64(i) {
+				t.Errorf("partition %d order %v", p, seen[p])
+
+				break
+			}
+		}
+	}
+
+	if peak < 2 {
+		t.Errorf("partitions handled one by one, peak %d", peak)
+	}
+}
+
+// fakeWriter запоминает пачки, первые ошибки из errs возвращаются по очереди
+type fakeWriter struct {
+	mu      sync.Mutex
+	batches [][]kafka.Message
+	errs    []error
+	calls   int
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.calls++
+
+	if len(w.errs) > 0 {
+		err := w.errs[0]
+		w.errs = w.errs[1:]
+
+		return err
+	}
+
+	w.batches = append(w.batches, append([]kafka.Message(nil), msgs...))
+
+	return nil
+}
+
+func (w *fakeWriter) sizes() []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var n []int
+	for _, b := range w.batches {
+		n = append(n, len(b))
+	}
+
+	return n
+}
+
+// Stop сразу после запуска всё равно дожидается записи накопленного
+// пока чтение возвращает ошибки, consume ждёт между попытками всё дольше
+func Test_ConsumeFetchError(t *testing.T) {
+	r := &fakeFetcher{fails: 3, msgs: []kafka.Message{{Offset: 1}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		consume(ctx, r, 1, func(ctx context.Context, msg kafka.Message) error { return nil })
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		r.mu.Lock()
+		n := len(r.committed)
+		r.mu.Unlock()
+
+		if n == 1 || time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+
+	if len(r.committed) != 1 || len(r.fetched) < 4 {
+		t.Fatalf("committed %d, fetched %d", len(r.committed), len(r.fetched))
+	}
+
+	for i, want := range []time.Duration{minBackoff, 2 * minBackoff, 4 * minBackoff} {
+		if got := r.fetched[i+1].Sub(r.fetched[i]); got < want {
+			t.Errorf("fetch %d after %v, want at least %v", i+1, got, want)
+		}
+	}
+
+	// отмена во время ожидания не ждёт его конца
+	r = &fakeFetcher{fails: 1 << 30}
+	ctx, cancel = context.WithCancel(context.Background())
+	done = make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		consume(ctx, r, 1, func(ctx context.Context, msg kafka.Message) error { return nil })
+	}()
+
+	time.Sleep(2 * minBackoff)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(minBackoff):
+		t.Errorf("consume did not stop while waiting to retry")
+	}
+}
+
+func Test_PublisherStart(t *testing.T) {
+	w := &fakeWriter{}
+	p := NewPublisher(w, PublisherConfig{BatchSize: 100, Linger: time.Hour})
+
+	publish(t, p, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p.Start(ctx)
+
+	if err := p.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait error: %v", err)
+	}
+
+	if n := w.sizes(); len(n) == 0 || n[0] != 3 {
+		t.Errorf("batches %v, want [3]", n)
+	}
+}
+
+func publish(t *testing.T, p *Publisher, n int) {
+	for i := 0; i < n; i++ {
+		if err := p.Publish(context.Background(), kafka.Message{Key: []byte(strconv.Itoa(i))}); err != nil {
+			t.Fatalf("Publish error: %v", err)
+		}
+	}
+}
+
+func Test_PublisherBatch(t *testing.T) {
+	w := &fakeWriter{}
+	p := NewPublisher(w, PublisherConfig{BatchSize: 3, Linger: time.Hour, Buffer: 10})
+
+	pctx, cancel := context.WithCancel(context.Background())
+	go p.Run(pctx)
+
+	publish(t, p, 7)
+
+	// две полные пачки пишутся сразу, седьмое сообщение ждёт Linger
+	deadline := time.Now().Add(time.Second)
+	for len(w.sizes()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if got := w.sizes(); len(got) != 2 || got[0] != 3 || got[1] != 3 {
+		t.Errorf("batches before shutdown %v", got)
+	}
+
+	// после отмены контекста остаток дописывается
+	cancel()
+
+	if err := p.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait error: %v", err)
+	}
+
+	if got := w.sizes(); len(got) != 3 || got[2] != 1 {
+		t.Errorf("batches after shutdown %v", got)
+	}
+
+	if err := p.Publish(context.Background(), kafka.Message{}); err != errPublisherStopped {
+		t.Errorf("Publish after stop = %v", err)
+	}
+}
+
+func Test_PublisherLinger(t *testing.T) {
+	w := &fakeWriter{}
+	p := NewPublisher(w, PublisherConfig{BatchSize: 100, Linger: 10 * time.Millisecond})
+
+	pctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go p.Run(pctx)
+
+	publish(t, p, 2)
+
+	deadline := time.Now().Add(time.Second)
+	for len(w.sizes()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if got := w.sizes(); len(got) != 1 || got[0] != 2 {
+		t.Errorf("batches %v", got)
+	}
+}
+
+func Test_PublisherRetry(t *testing.T) {
+	w := &fakeWriter{errs: []error{
+		kafka.LeaderNotAvailable,
+		kafka.WriteErrors{nil, kafka.NotEnoughReplicas, kafka.MessageSizeTooLarge},
+	}}
+	p := NewPublisher(w, PublisherConfig{Retries: 3})
+
+	// временная ошибка - повтор всей пачки, затем повтор только сообщения с временной ошибкой,
+	// сообщение с постоянной ошибкой пропускается
+	if rest := p.write(context.Background(), []kafka.Message{{Key: []byte("0")}, {Key: []byte("1")}, {Key: []byte("2")}}); rest != nil {
+		t.Errorf("write rest %v", rest)
+	}
+
+	if w.calls != 3 || len(w.batches) != 1 || len(w.batches[0]) != 1 || string(w.batches[0][0].Key) != "1" {
+		t.Errorf("write calls %d batches %v", w.calls, w.batches)
+	}
+
+	// повторы кончились
+	w = &fakeWriter{errs: []error{kafka.LeaderNotAvailable, kafka.LeaderNotAvailable}}
+	p = NewPublisher(w, PublisherConfig{Retries: 1})
+
+	if rest := p.write(context.Background(), []kafka.Message{{}}); rest != nil || w.calls != 2 || len(w.batches) != 0 {
+		t.Errorf("write after retries rest %v calls %d", rest, w.calls)
+	}
+
+	// отменённый контекст - сообщения возвращаются, чтобы их дописал flush
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w = &fakeWriter{errs: []error{context.Canceled}}
+	p = NewPublisher(w, PublisherConfig{})
+
+	if rest := p.write(cctx, []kafka.Message{{}}); len(rest) != 1 {
+		t.Errorf("write with canceled ctx rest %v", rest)
+	}
+}
+
+func Test_Relay(t *testing.T) {
+	db, _ := mem.New(context.Background())
+
+	for i := 0; i < 5; i++ {
+		if err := db.CreateWithOutbox(&letter.Letter{KafkaKey: strconv.Itoa(i), Status: "failed"}); err != nil {
+			t.Fatalf("CreateWithOutbox error: %v", err)
+		}
+	}
+
+	w := &fakeWriter{errs: []error{kafka.LeaderNotAvailable}}
+	k := &DB{}
+	r := &Relay{store: db, w: w, msg: k.prfMessage, batch: 2, period: time.Hour}
+
+	// kafka недоступна - ничего не отмечено доставленным
+	if n, err := r.Flush(context.Background()); err == nil || n != 0 {
+		t.Errorf("Flush with broker error = %d, %v", n, err)
+	}
+
+	if rs, _ := db.PendingOutbox(10); len(rs) != 5 {
+		t.Errorf("pending after error %d", len(rs))
+	}
+
+	n, err := r.Flush(context.Background())
+	if err != nil || n != 5 {
+		t.Errorf("Flush = %d, %v", n, err)
+	}
+
+	var keys []string
+	for _, b := range w.batches {
+		for _, m := range b {
+			keys = append(keys, string(m.Key))
+		}
+	}
+
+	if got := strings.Join(keys, ","); got != "0,1,2,3,4" || len(w.batches) != 3 {
+		t.Errorf("relay order %s in %v batches", got, w.sizes())
+	}
+
+	if rs, _ := db.PendingOutbox(10); len(rs) != 0 {
+		t.Errorf("pending after flush %d", len(rs))
+	}
+}
+
+func Test_RelayBackoff(t *testing.T) {
+	r := &Relay{period: time.Second}
+
+	tests := []struct {
+		wait, want time.Duration
+	}{
+		{time.Second, 2 * time.Second},
+		{8 * time.Second, 16 * time.Second},
+		{20 * time.Second, maxOutboxBackoff},
+		{maxOutboxBackoff, maxOutboxBackoff},
+		{0, time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := r.backoff(tt.wait); got != tt.want {
+			t.Errorf("backoff(%v) = %v, want %v", tt.wait, got, tt.want)
+		}
+	}
+
+	// период больше предела - ожидание не короче периода
+	r.period = time.Minute
+
+	if got := r.backoff(time.Minute); got != time.Minute {
+		t.Errorf("backoff with long period = %v", got)
+	}
+}
+
+// статус, который нельзя закодировать, не теряется: запись остаётся в outbox неудавшейся
+func Test_RelayFailed(t *testing.T) {
+	db, _ := mem.New(context.Background())
+
+	for i := 0; i < 3; i++ {
+		if err := db.CreateWithOutbox(&letter.Letter{KafkaKey: strconv.Itoa(i), Status: "failed"}); err != nil {
+			t.Fatalf("CreateWithOutbox error: %v", err)
+		}
+	}
+
+	w := &fakeWriter{}
+	k := &DB{}
+	msg := func(l *letter.Letter) (kafka.Message, error) {
+		if l.KafkaKey == "1" {
+			return kafka.Message{}, io.ErrUnexpectedEOF
+		}
+
+		return k.prfMessage(l)
+	}
+	r := &Relay{store: db, w: w, msg: msg, batch: 10, period: time.Hour}
+
+	n, err := r.Flush(context.Background())
+	if err != nil || n != 2 {
+		t.Errorf("Flush = %d, %v", n, err)
+	}
+
+	if rs, _ := db.PendingOutbox(10); len(rs) != 0 {
+		t.Errorf("pending after flush %d", len(rs))
+	}
+
+	for _, rec := range db.Outbox {
+		failed := rec.Letter.KafkaKey == "1"
+		if rec.Failed != failed || rec.Delivered == failed || (failed && rec.Error == "") {
+			t.Errorf("record %s failed %v delivered %v error %q", rec.Letter.KafkaKey, rec.Failed, rec.Delivered, rec.Error)
+		}
 	}
-	zap.S().Debugf("Test kafka create for Prf %v\n", tL)
 }
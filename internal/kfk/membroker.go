@@ -0,0 +1,283 @@
+package kfk
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// MemBroker - kafka в памяти для тестов и локального запуска (KAFKA_MODE=local)
+// топики создаются при первом обращении, у каждого partitions партиций;
+// сообщение попадает в партицию по хешу ключа, без ключа - по кругу
+// группа читает все партиции топика, сохранённые смещения хранятся, пока жив MemBroker
+// читатели одной группы делят сообщения между собой, а когда закрыт последний из них,
+// следующий начнёт с сохранённых смещений - как после перебалансировки в kafka
+type MemBroker struct {
+	mu         sync.Mutex
+	partitions int
+	topics     map[string]*memTopic
+	groups     map[memGroupKey]*memGroup
+	changed    chan struct{} // закрывается и заменяется при каждой записи, будит ждущих читателей
+}
+
+type memTopic struct {
+	partitions [][]kafka.Message
+	next       int // партиция для следующего сообщения без ключа
+}
+
+type memGroupKey struct {
+	topic string
+	group string
+}
+
+type memGroup struct {
+	committed []int64 // смещение следующего сообщения после подтверждённых, по партициям
+	position  []int64 // смещение следующего сообщения для выдачи, по партициям
+	members   int
+	next      int // партиция, с которой начать поиск сообщения
+}
+
+func NewMemBroker(partitions int) *MemBroker {
+	if partitions < 1 {
+		partitions = 1
+	}
+
+	return &MemBroker{
+		partitions: partitions,
+		topics:     map[string]*memTopic{},
+		groups:     map[memGroupKey]*memGroup{},
+		changed:    make(chan struct{}),
+	}
+}
+
+// Messages - все сообщения топика по партициям, для проверок в тестах
+func (b *MemBroker) Messages(topic string) []kafka.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var msgs []kafka.Message
+
+	for _, p := range b.topic(topic).partitions {
+		msgs = append(msgs, p...)
+	}
+
+	return msgs
+}
+
+// Committed - сколько сообщений партиции подтвердила группа
+func (b *MemBroker) Committed(topic, groupID string, partition int) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if g, ok := b.groups[memGroupKey{topic, groupID}]; ok {
+		return g.committed[partition]
+	}
+
+	return 0
+}
+
+func (b *MemBroker) Writer(topic string) MessageWriter {
+	return &memWriter{b: b, topic: topic}
+}
+
+func (b *MemBroker) Reader(topic, groupID string, cfg ConsumerConfig) MessageReader {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := b.topic(topic)
+	key := memGroupKey{topic, groupID}
+
+	g, ok := b.groups[key]
+	if !ok {
+		g = &memGroup{committed: make([]int64, len(t.partitions))}
+
+		// новая группа начинает с начала или, как и в kafka, только с новых сообщений
+		if cfg.StartOffset == kafka.LastOffset {
+			for i, p := range t.partitions {
+				g.committed[i] = int64(len(p))
+			}
+		}
+
+		b.groups[key] = g
+	}
+
+	if g.members == 0 {
+		g.position = append([]int64(nil), g.committed...)
+	}
+
+	g.members++
+
+	return &memReader{b: b, topic: topic, group: g}
+}
+
+// topic вызывается под b.mu
+func (b *MemBroker) topic(name string) *memTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &memTopic{partitions: make([][]kafka.Message, b.partitions)}
+		b.topics[name] = t
+	}
+
+	return t
+}
+
+func (b *MemBroker) write(topic string, msgs []kafka.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := b.topic(topic)
+	now := time.Now()
+
+	for _, msg := range msgs {
+		p := t.next
+		if len(msg.Key) > 0 {
+			h := fnv.New32a()
+			h.Write(msg.Key)
+			p = int(h.Sum32() % uint32(len(t.partitions)))
+		} else {
+			t.next = (t.next + 1) % len(t.partitions)
+		}
+
+		msg.Topic = topic
+		msg.Partition = p
+		msg.Offset = int64(len(t.partitions[p]))
+		msg.Time = now
+		t.partitions[p] = append(t.partitions[p], msg)
+	}
+
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+type memWriter struct {
+	b      *MemBroker
+	topic  string
+	mu     sync.Mutex
+	closed bool
+}
+
+func (w *memWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return io.ErrClosedPipe
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	w.b.write(w.topic, msgs)
+
+	return nil
+}
+
+func (w *memWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+
+	return nil
+}
+
+type memReader struct {
+	b      *MemBroker
+	topic  string
+	group  *memGroup
+	closed bool
+}
+
+// FetchMessage отдаёт следующее сообщение группы, если его нет - ждёт записи или отмены ctx
+func (r *memReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	for {
+		r.b.mu.Lock()
+
+		if r.closed {
+			r.b.mu.Unlock()
+
+			return kafka.Message{}, io.EOF
+		}
+
+		msg, ok := r.next()
+		changed := r.b.changed
+		r.b.mu.Unlock()
+
+		if ok {
+			return msg, nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		}
+	}
+}
+
+// next вызывается под b.mu
+func (r *memReader) next() (kafka.Message, bool) {
+	t := r.b.topics[r.topic]
+	g := r.group
+
+	for i := range t.partitions {
+		p := (g.next + i) % len(t.partitions)
+
+		if g.position[p] < int64(len(t.partitions[p])) {
+			msg := t.partitions[p][g.position[p]]
+			g.position[p]++
+			g.next = (p + 1) % len(t.partitions)
+
+			return msg, true
+		}
+	}
+
+	return kafka.Message{}, false
+}
+
+func (r *memReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	msg, err := r.FetchMessage(ctx)
+	if err != nil {
+		return msg, err
+	}
+
+	return msg, r.CommitMessages(ctx, msg)
+}
+
+func (r *memReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.b.mu.Lock()
+	defer r.b.mu.Unlock()
+
+	if r.closed {
+		return io.ErrClosedPipe
+	}
+
+	for _, msg := range msgs {
+		if msg.Offset+1 > r.group.committed[msg.Partition] {
+			r.group.committed[msg.Partition] = msg.Offset + 1
+		}
+	}
+
+	return nil
+}
+
+func (r *memReader) Close() error {
+	r.b.mu.Lock()
+	defer r.b.mu.Unlock()
+
+	if !r.closed {
+		r.closed = true
+		r.group.members--
+
+		// разбудить FetchMessage этого читателя
+		close(r.b.changed)
+		r.b.changed = make(chan struct{})
+	}
+
+	return nil
+}
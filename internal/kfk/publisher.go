@@ -0,0 +1,272 @@
+package kfk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+// значения по умолчанию для публикации статусов
+const (
+	defaultBatchSize    = 100
+	defaultLinger       = 50 * time.Millisecond
+	defaultBuffer       = 1000
+	defaultRetries      = 10
+	defaultFlushTimeout = 10 * time.Second
+	minBackoff          = 100 * time.Millisecond
+)
+
+var errPublisherStopped = errors.New("publisher stopped")
+
+// PublisherConfig - настройки пачек и повторов
+type PublisherConfig struct {
+	BatchSize    int           // сколько сообщений пишется за раз
+	Linger       time.Duration // сколько ждать, пока наберётся пачка
+	Buffer       int           // сколько сообщений ждёт отправки, дальше Publish ждёт места
+	Retries      int           // сколько раз повторять пачку при временных ошибках брокера
+	FlushTimeout time.Duration // сколько дописывать накопленное после отмены контекста
+}
+
+// messageWriter - то, что нужно от kafka.Writer
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Publisher копит сообщения в буфере и пишет их пачками в отдельной горутине,
+// поэтому медленный брокер не останавливает того, кто публикует, пока буфер не заполнен
+type Publisher struct {
+	w       messageWriter
+	cfg     PublisherConfig
+	in      chan kafka.Message
+	done    chan struct{}
+	running int32 // Run запущен, иначе ждать нечего
+}
+
+func NewPublisher(w messageWriter, cfg PublisherConfig) *Publisher {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+
+	if cfg.Linger <= 0 {
+		cfg.Linger = defaultLinger
+	}
+
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = defaultBuffer
+	}
+
+	if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+
+	if cfg.FlushTimeout <= 0 {
+		cfg.FlushTimeout = defaultFlushTimeout
+	}
+
+	return &Publisher{
+		w:    w,
+		cfg:  cfg,
+		in:   make(chan kafka.Message, cfg.Buffer),
+		done: make(chan struct{}),
+	}
+}
+
+// Publish ставит сообщение в буфер; если буфер полон, ждёт, пока освободится место или отменят ctx
+func (p *Publisher) Publish(ctx context.Context, msg kafka.Message) error {
+	select {
+	case <-p.done:
+		return errPublisherStopped
+	default:
+	}
+
+	select {
+	case p.in <- msg:
+		return nil
+	case <-p.done:
+		return errPublisherStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Start запускает Run в отдельной горутине; Wait, вызванный после Start, дождётся записи накопленного,
+// даже если горутина ещё не успела начать работу
+func (p *Publisher) Start(ctx context.Context) {
+	atomic.StoreInt32(&p.running, 1)
+
+	go p.Run(ctx)
+}
+
+// Run пишет пачку, когда набралось BatchSize сообщений или прошло Linger с первого сообщения пачки
+// после отмены ctx дописывает всё, что накопилось, не дольше FlushTimeout
+func (p *Publisher) Run(ctx context.Context) {
+	atomic.StoreInt32(&p.running, 1)
+	defer close(p.done)
+
+	var (
+		batch     []kafka.Message
+		lingering <-chan time.Time
+	)
+
+	timer := time.NewTimer(p.cfg.Linger)
+	timer.Stop()
+
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg := <-p.in:
+			batch = append(batch, msg)
+
+			if len(batch) == 1 {
+				timer.Reset(p.cfg.Linger)
+				lingering = timer.C
+			}
+
+			if len(batch) < p.cfg.BatchSize {
+				continue
+			}
+
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-lingering:
+		case <-ctx.Done():
+			p.flush(batch)
+
+			return
+		}
+
+		lingering = nil
+		batch = p.write(ctx, batch)
+		// не записанное из-за отмены ctx допишет flush
+	}
+}
+
+// Wait ждёт, пока Run допишет накопленное
+func (p *Publisher) Wait(ctx context.Context) error {
+	if atomic.LoadInt32(&p.running) == 0 {
+		return nil
+	}
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush дописывает пачку и всё, что осталось в буфере
+func (p *Publisher) flush(batch []kafka.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.FlushTimeout)
+	defer cancel()
+
+drain:
+	for {
+		select {
+		case msg := <-p.in:
+			batch = append(batch, msg)
+		default:
+			break drain
+		}
+	}
+
+	zap.S().Debugf("Kfk publisher flush %d messages\n", len(batch))
+
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > p.cfg.BatchSize {
+			n = p.cfg.BatchSize
+		}
+
+		if rest := p.write(ctx, batch[:n]); len(rest) > 0 {
+			zap.S().Errorf("Kfk publisher lost %d messages on shutdown: %v\n", len(rest)+len(batch)-n, ctx.Err())
+
+			return
+		}
+
+		batch = batch[n:]
+	}
+}
+
+// write пишет пачку, при временных ошибках повторяет незаписанные сообщения до Retries раз
+// сообщения с постоянными ошибками и после исчерпания повторов пропускаются с записью в лог
+// возвращает то, что не записано из-за отмены ctx
+func (p *Publisher) write(ctx context.Context, batch []kafka.Message) []kafka.Message {
+	backoff := minBackoff
+
+	for attempt := 0; len(batch) > 0; attempt++ {
+		err := p.w.WriteMessages(ctx, batch...)
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return batch
+		}
+
+		var retry []kafka.Message
+
+		var wErrs kafka.WriteErrors
+		if errors.As(err, &wErrs) && len(wErrs) == len(batch) {
+			for i, e := range wErrs {
+				if e != nil && transient(e) {
+					retry = append(retry, batch[i])
+				} else if e != nil {
+					zap.S().Errorf("Kfk publisher drop message %s: %v\n", batch[i].Key, e)
+				}
+			}
+		} else if transient(err) {
+			retry = batch
+		} else {
+			zap.S().Errorf("Kfk publisher drop %d messages: %v\n", len(batch), err)
+		}
+
+		if len(retry) > 0 && attempt >= p.cfg.Retries {
+			zap.S().Errorf("Kfk publisher drop %d messages after %d retries: %v\n", len(retry), attempt, err)
+
+			return nil
+		}
+
+		batch = retry
+		if len(batch) == 0 {
+			return nil
+		}
+
+		zap.S().Errorf("Kfk publisher write error: %v, retry %d messages in %v\n", err, len(batch), backoff)
+
+		select {
+		case <-ctx.Done():
+			return batch
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > retryDelay {
+			backoff = retryDelay
+		}
+	}
+
+	return nil
+}
+
+// transient - ошибка, которую может исправить повтор: брокер недоступен, сменился лидер и т.п.
+func transient(err error) bool {
+	var kErr kafka.Error
+	if errors.As(err, &kErr) {
+		return kErr.Temporary()
+	}
+
+	var nErr net.Error
+	if errors.As(err, &nErr) {
+		return true
+	}
+
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,135 @@
+package kfk
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"github.com/maris-cyber/mailsender/internal/outbox"
+	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+const defaultOutboxPeriod = time.Second
+
+// дольше relay не ждёт между попытками, пока kafka или база недоступны
+const maxOutboxBackoff = 30 * time.Second
+
+// Relay отправляет статусы из outbox в топик для profile по порядку записей
+// запись отмечается доставленной только после того, как kafka подтвердила запись,
+// поэтому при падении статус будет отправлен повторно, но не потеряется
+type Relay struct {
+	store  outbox.Store
+	w      messageWriter
+	msg    func(*letter.Letter) (kafka.Message, error)
+	batch  int
+	period time.Duration
+}
+
+func (kH *DB) NewRelay(store outbox.Store) *Relay {
+	return &Relay{
+		store:  store,
+		w:      kH.Writer4Prf,
+		msg:    kH.prfMessage,
+		batch:  kH.CfgKfk.prf.BatchSize,
+		period: kH.CfgKfk.outbox,
+	}
+}
+
+// Run раз в period отправляет всё, что накопилось в outbox
+// после ошибки ждёт вдвое дольше, но не больше maxOutboxBackoff, после успешной отправки - снова period
+// при остановке неотправленное остаётся в outbox до следующего запуска
+func (r *Relay) Run(ctx context.Context) {
+	wait := r.period
+
+	for {
+		n, err := r.Flush(ctx)
+
+		if err != nil && ctx.Err() == nil {
+			wait = r.backoff(wait)
+			zap.S().Errorf("Kfk outbox relay error: %v, retry in %v\n", err, wait)
+		} else {
+			if n > 0 {
+				zap.S().Debugf("Kfk outbox relay sent %d\n", n)
+			}
+
+			wait = r.period
+		}
+
+		select {
+		case <-ctx.Done():
+			zap.S().Debug("Kafka outbox relay ctx.Done()")
+
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// backoff - следующее ожидание после ошибки
+func (r *Relay) backoff(wait time.Duration) time.Duration {
+	if wait *= 2; wait > maxOutboxBackoff {
+		wait = maxOutboxBackoff
+	}
+
+	if wait < r.period {
+		wait = r.period
+	}
+
+	return wait
+}
+
+// Flush отправляет недоставленные записи пачками и возвращает, сколько отправлено
+// на ошибке записи останавливается, следующая попытка начнёт с той же записи, чтобы не нарушить порядок
+func (r *Relay) Flush(ctx context.Context) (int, error) {
+	n := 0
+
+	for {
+		rs, err := r.store.PendingOutbox(r.batch)
+		if err != nil {
+			return n, err
+		}
+
+		if len(rs) == 0 {
+			return n, nil
+		}
+
+		msgs := make([]kafka.Message, 0, len(rs))
+		ids := make([]primitive.ObjectID, 0, len(rs))
+
+		for i := range rs {
+			msg, err := r.msg(&rs[i].Letter)
+			if err != nil {
+				// повтор не исправит: запись отмечается неудавшейся и остаётся в outbox, остальные идут дальше
+				zap.S().Errorf("Kfk outbox record %v letter %v failed: %v\n", rs[i].ID, rs[i].LetterID, err)
+
+				if err = r.store.MarkFailed(rs[i].ID, err.Error()); err != nil {
+					return n, err
+				}
+
+				continue
+			}
+
+			ids = append(ids, rs[i].ID)
+			msgs = append(msgs, msg)
+		}
+
+		if len(msgs) > 0 {
+			if err = r.w.WriteMessages(ctx, msgs...); err != nil {
+				return n, fmt.Errorf("outbox write: %v", err)
+			}
+		}
+
+		if err = r.store.MarkDelivered(ids); err != nil {
+			return n, err
+		}
+
+		n += len(msgs)
+
+		if len(rs) < r.batch {
+			return n, nil
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package kfk
+
+import (
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/maris-cyber/mailsender/internal/letter"
+)
+
+// HeaderCorrelationID - заголовок со сквозным ID запроса,
+// пишется в сообщения для profile, читается из сообщений для mailsender
+const HeaderCorrelationID = "correlation-id"
+
+// заголовки, из которых берётся сквозной ID, по порядку; регистр не важен
+var correlationHeaders = []string{HeaderCorrelationID, "x-correlation-id", "x-request-id"}
+
+// заголовок W3C Trace Context: версия-trace_id-parent_id-флаги
+const headerTraceparent = "traceparent"
+
+// сквозной ID из заголовков сообщения, если его нет - trace-id из traceparent
+func correlationID(hs []kafka.Header) string {
+	for _, key := range correlationHeaders {
+		if v := headerFold(hs, key); v != "" {
+			return v
+		}
+	}
+
+	if parts := strings.Split(headerFold(hs, headerTraceparent), "-"); len(parts) == 4 {
+		return parts[1]
+	}
+
+	return ""
+}
+
+// correlate проставляет письму сквозной ID из заголовков, если его не было в конверте
+func correlate(msg kafka.Message, ltr *letter.Letter) {
+	if ltr.CorrelationID == "" {
+		ltr.CorrelationID = correlationID(msg.Headers)
+	}
+
+	ltr.CorrelationID = letter.CleanCorrelationID(ltr.CorrelationID)
+}
+
+// заголовки сообщения со сквозным ID письма
+func withCorrelationID(hs []kafka.Header, ltr *letter.Letter) []kafka.Header {
+	if ltr.CorrelationID == "" {
+		return hs
+	}
+
+	return append(hs, kafka.Header{Key: HeaderCorrelationID, Value: []byte(ltr.CorrelationID)})
+}
+
+// значение заголовка key без учёта регистра, пустое, если его нет
+func headerFold(hs []kafka.Header, key string) string {
+	for _, h := range hs {
+		if strings.EqualFold(h.Key, key) {
+			return strings.TrimSpace(string(h.Value))
+		}
+	}
+
+	return ""
+}
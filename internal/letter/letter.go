@@ -2,17 +2,52 @@
 package letter
 
 import (
+	"errors"
+	"fmt"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
 )
 
+// ErrDuplicate - письмо с таким ключом идемпотентности уже есть в очереди
+var ErrDuplicate = errors.New("duplicate letter")
+
 type Letter struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty"` // для mongo
-	Addresses []string           `bson:"addresses"`
-	Subject   string             `bson:"subject"`
-	Body      string             `bson:"body"`
-	Token     string             `bson:"token"`
-	Status    string             `bson:"status"`   // sent / error / awaiting
-	KafkaKey  string             `bson:"kafkakey"` // ключ из кафки, записать при получении из кафки, отправлять в кафку с ним
+	ID              primitive.ObjectID `bson:"_id,omitempty"` // для mongo
+	Addresses       []string           `bson:"addresses"`
+	Subject         string             `bson:"subject"`
+	Body            string             `bson:"body"`
+	Token           string             `bson:"token"`
+	Status          string             `bson:"status"`   // sent / error / failed / partial / suppressed / awaiting
+	KafkaKey        string             `bson:"kafkakey"` // ключ из кафки, записать при получении из кафки, отправлять в кафку с ним
+	Personalize     bool               `bson:"personalize"`
+	Recipients      []Recipient        `bson:"recipients,omitempty"`      // адресаты в режиме personalize, каждому своё письмо
+	TemplateID      string             `bson:"templateid,omitempty"`      // если задан, тема и тело рендерятся из шаблона
+	TemplateVersion int                `bson:"templateversion,omitempty"` // версия шаблона, запоминается при постановке в очередь
+	Vars            map[string]string  `bson:"vars,omitempty"`            // переменные для шаблона
+	Locale          string             `bson:"locale,omitempty"`          // локаль для выбора варианта шаблона: ru-RU, en
+	Error           string             `bson:"error,omitempty"`           // причина, по которой письмо не отправлено
+	Track           bool               `bson:"track,omitempty"`           // отслеживать открытия и переходы по ссылкам
+	Category        string             `bson:"category,omitempty"`        // категория рассылки, для отписки и списка подавления
+	Suppressed      []string           `bson:"suppressed,omitempty"`      // адресаты, исключённые по списку подавления
+	Bulk            bool               `bson:"bulk,omitempty"`            // массовая рассылка, добавляется List-Unsubscribe
+	Bounced         []string           `bson:"bounced,omitempty"`         // адресаты, от которых пришёл постоянный отказ
+	Complained      []string           `bson:"complained,omitempty"`      // адресаты, пожаловавшиеся на письмо
+	Invalid         []string           `bson:"invalid,omitempty"`         // адресаты с неправильными адресами, не отправляются
+	IdempotencyKey  string             `bson:"idempotencykey,omitempty"`  // повторное письмо с тем же ключом в очередь не ставится
+	CorrelationID   string             `bson:"correlationid,omitempty"`   // сквозной ID запроса отправителя, возвращается в статусе
+	Raw             string             `bson:"raw,omitempty" json:"-"`    // исходное MIME сообщение (принятое по smtp), отправляется как есть; из json не читается
+	Ack             chan<- error       `bson:"-" json:"-"`                // куда очередь сообщит, что письмо сохранено, не сохраняется
+}
+
+// Recipient - адресат персонального письма со своими переменными и своим статусом
+type Recipient struct {
+	Address     string            `bson:"address"`
+	Name        string            `bson:"name,omitempty"`
+	Unsubscribe string            `bson:"unsubscribe,omitempty"` // ссылка для отписки
+	Vars        map[string]string `bson:"vars,omitempty"`
+	Locale      string            `bson:"locale,omitempty"` // если не задана, используется локаль письма
+	Status      string            `bson:"status,omitempty"` // sent / error / failed / invalid / suppressed / bounced / complained
 }
 
 func New() *Letter {
@@ -27,4 +62,136 @@ func (l *Letter) Copy(res *Letter) {
 	res.Token = l.Token
 	res.Status = l.Status
 	res.KafkaKey = l.KafkaKey
+	res.Personalize = l.Personalize
+	// статусы адресатов меняет mailer, поэтому слайс копируется
+	res.Recipients = append([]Recipient(nil), l.Recipients...)
+	res.TemplateID = l.TemplateID
+	res.TemplateVersion = l.TemplateVersion
+	res.Vars = l.Vars
+	res.Locale = l.Locale
+	res.Error = l.Error
+	res.Track = l.Track
+	res.Category = l.Category
+	res.Suppressed = l.Suppressed
+	res.Bulk = l.Bulk
+	res.Bounced = l.Bounced
+	res.Complained = l.Complained
+	res.Invalid = l.Invalid
+	res.IdempotencyKey = l.IdempotencyKey
+	res.CorrelationID = l.CorrelationID
+	res.Raw = l.Raw
+}
+
+// длина сквозного ID, длиннее обрезается
+const maxCorrelationID = 128
+
+// CleanCorrelationID оставляет от сквозного ID только видимые символы ASCII, не больше 128:
+// ID приходит от отправителя, а попадает в заголовки письма и сообщений kafka
+func CleanCorrelationID(s string) string {
+	b := make([]byte, 0, len(s))
+
+	for i := 0; i < len(s) && len(b) < maxCorrelationID; i++ {
+		if s[i] > ' ' && s[i] < 0x7f {
+			b = append(b, s[i])
+		}
+	}
+
+	return string(b)
+}
+
+// Log - логгер с полем correlationId, чтобы по нему найти в логах всё, что было с письмом
+func (l *Letter) Log() *zap.SugaredLogger {
+	if l.CorrelationID == "" {
+		return zap.S()
+	}
+
+	return zap.S().With("correlationId", l.CorrelationID)
+}
+
+// Acknowledge сообщает получателю письма (kafka), сохранила ли его очередь
+// канал буферизован отправителем, поэтому не блокирует; подтверждение отправляется один раз
+func (l *Letter) Acknowledge(err error) {
+	if l.Ack == nil {
+		return
+	}
+
+	l.Ack <- err
+	l.Ack = nil
+}
+
+// DefaultKey задаёт ключ идемпотентности, если отправитель его не передал:
+// ключ сообщения kafka и номер письма в сообщении, а если ключа нет - source (топик, партиция, смещение)
+// так повторная публикация и повторное чтение сообщения не создают писем заново
+func (l *Letter) DefaultKey(source string, idx int) {
+	if l.IdempotencyKey != "" {
+		return
+	}
+
+	k := l.KafkaKey
+	if k == "" {
+		k = source
+	}
+
+	if k != "" {
+		l.IdempotencyKey = fmt.Sprintf("%s:%d", k, idx)
+	}
+}
+
+// Expand приводит адресатов к единому виду:
+// в режиме personalize адресаты без переменных получаются из Addresses,
+// а Addresses всегда содержит всех адресатов письма
+func (l *Letter) Expand() {
+	if l.Personalize && len(l.Recipients) == 0 {
+		l.Recipients = make([]Recipient, len(l.Addresses))
+		for i, a := range l.Addresses {
+			l.Recipients[i].Address = a
+		}
+	}
+
+	if len(l.Recipients) > 0 && len(l.Addresses) == 0 {
+		l.Addresses = make([]string, len(l.Recipients))
+		for i := range l.Recipients {
+			l.Addresses[i] = l.Recipients[i].Address
+		}
+	}
+}
+
+// IsBulk - массовая рассылка или рассылка категории, таким письмам нужна отписка
+func (l *Letter) IsBulk() bool {
+	return l.Bulk || l.Category != ""
+}
+
+// SetStatusFromRecipients выставляет статус письма по статусам адресатов:
+// sent - отправлено всем, error - никому, partial - части адресатов,
+// failed - никому и повторять бесполезно (например, ошибка в шаблоне или неправильный адрес),
+// suppressed - все адресаты в списке подавления;
+// подавленные адресаты в остальных случаях не учитываются
+func (l *Letter) SetStatusFromRecipients() {
+	var sent, failed, suppressed int
+
+	for i := range l.Recipients {
+		switch l.Recipients[i].Status {
+		case "sent":
+			sent++
+		case "failed", "invalid":
+			failed++
+		case "suppressed":
+			suppressed++
+		}
+	}
+
+	active := len(l.Recipients) - suppressed
+
+	switch {
+	case active == 0:
+		l.Status = "suppressed"
+	case sent == active:
+		l.Status = "sent"
+	case failed == active:
+		l.Status = "failed"
+	case sent == 0:
+		l.Status = "error"
+	default:
+		l.Status = "partial"
+	}
 }
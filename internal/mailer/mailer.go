@@ -2,17 +2,24 @@
 package mailer
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"fmt"
 	"net/smtp"
+	"net/textproto"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 
+	"github.com/maris-cyber/mailsender/internal/bounce"
+	"github.com/maris-cyber/mailsender/internal/htmlproc"
 	"github.com/maris-cyber/mailsender/internal/letter"
 	"github.com/maris-cyber/mailsender/internal/limiter"
+	"github.com/maris-cyber/mailsender/internal/tmpl"
+	"github.com/maris-cyber/mailsender/internal/track"
 	"go.uber.org/zap"
 )
 
@@ -35,6 +42,10 @@ type Mailer struct {
 	Complete  chan *letter.Letter
 	lmt       *limiter.Limiter // rate limit
 	wg        *sync.WaitGroup
+	tpl       tmpl.Store          // шаблоны писем, может отсутствовать
+	html      *htmlproc.Processor // обработка html перед отправкой, может отсутствовать
+	tracker   *track.Tracker      // отслеживание открытий и переходов, может отсутствовать
+	verp      *bounce.VERP        // адрес отправителя конверта для отказов, может отсутствовать
 }
 
 // инициализировать
@@ -51,9 +62,30 @@ func New(ctx context.Context, lmt *limiter.Limiter, wg *sync.WaitGroup) (*Mailer
 	mH.lmt = lmt
 	mH.wg = wg
 
+	// встраивание CSS, чистка html и абсолютные ссылки, если включены
+	var errHTML error
+	if mH.html, errHTML = htmlproc.New(); errHTML != nil {
+		zap.S().Errorf("htmlproc.New error: %v\n", errHTML)
+	}
+
 	return &mH, err
 }
 
+// подключить хранилище шаблонов
+func (mH *Mailer) SetTemplates(tpl tmpl.Store) {
+	mH.tpl = tpl
+}
+
+// подключить отслеживание открытий и переходов по ссылкам
+func (mH *Mailer) SetTracker(tr *track.Tracker) {
+	mH.tracker = tr
+}
+
+// подключить VERP: отказы доставки приходят на адрес, по которому находится письмо и адресат
+func (mH *Mailer) SetVERP(v *bounce.VERP) {
+	mH.verp = v
+}
+
 // запустить пул отправлятелей сообщений
 func (mH *Mailer) Run(ctx context.Context) {
 	mH.wg.Add(mH.nSenders)
@@ -165,7 +197,7 @@ Waiting:
 
 					err := mH.SendLetter(smtpClient, ltr) // отправить письмо
 					if err != nil {
-						zap.S().Errorf("mH.SendLetter error: %v\n", err)
+						ltr.Log().Errorf("mH.SendLetter error: %v\n", err)
 					}
 
 					mH.Complete <- ltr // отправленное письмо в канал из которого читает очередь
@@ -181,9 +213,7 @@ Waiting:
 
 // отправить письмо
 func (mH *Mailer) SendLetter(smtpClient *smtp.Client, ltr *letter.Letter) error {
-	var err error
-
-	zap.S().Debugf("Sending letter %v\n", ltr)
+	ltr.Log().Debugf("Sending letter %v\n", ltr)
 
 	ltr.Status = "error" // если письмо не отправится по какой-то причине, статус уже выставлен
 
@@ -200,17 +230,266 @@ func (mH *Mailer) SendLetter(smtpClient *smtp.Client, ltr *letter.Letter) error
 	// ltr.Status = "sent"
 	// return nil
 
+	// письмо, принятое по smtp, уходит как есть: без шаблонов, отслеживания и отписки
+	if ltr.Raw != "" {
+		return mH.sendRaw(smtpClient, ltr)
+	}
+
+	if mH.perRecipient(ltr) && !ltr.Personalize {
+		ltr.Personalize = true
+		ltr.Expand()
+	}
+
+	if ltr.Personalize {
+		return mH.sendPersonal(smtpClient, ltr)
+	}
+
+	c, err := mH.content(ltr, nil)
+	if err != nil {
+		// ошибка в шаблоне или переменных, повторная отправка не поможет
+		ltr.Status = "failed"
+		ltr.Error = err.Error()
+
+		return fmt.Errorf("func Maiker.SendLetter can't render: %v", err)
+	}
+
+	headers := append(mH.messageID(ltr, -1), correlationID(ltr)...)
+
+	message, err := mH.transmit(smtpClient, mH.envelope(ltr, -1), ltr.Addresses, "", headers, c)
+	if err != nil {
+		return err
+	}
+
+	ltr.Status = "sent" // обработчик очереди использует этот статус, он пойдёт и в mongo, и в kafka
+
+	ltr.Log().Debugf("Complete sending letter %v\nmessage: %s\n", ltr, message)
+
+	return nil
+}
+
+// ссылка для отписки и токены отслеживания у каждого адресата свои,
+// поэтому массовая рассылка и отслеживаемое письмо отправляются каждому адресату отдельно
+func (mH *Mailer) perRecipient(ltr *letter.Letter) bool {
+	return mH.tracker != nil && (ltr.Track || ltr.IsBulk())
+}
+
+// отправить каждому адресату своё письмо, отрендеренное с его переменными
+// общий текст хранится в письме один раз, статус ведётся по каждому адресату
+func (mH *Mailer) sendPersonal(smtpClient *smtp.Client, ltr *letter.Letter) error {
+	var lastErr error
+
+	for i := range ltr.Recipients {
+		rcpt := &ltr.Recipients[i]
+
+		// письмо могло быть частично отправлено до перезапуска сервиса,
+		// адресат может быть в списке подавления или с неправильным адресом
+		if rcpt.Status == "sent" || rcpt.Status == "suppressed" || rcpt.Status == "invalid" {
+			continue
+		}
+
+		headers := append(mH.messageID(ltr, i), correlationID(ltr)...)
+		headers = append(headers, mH.unsubscribe(ltr, rcpt)...)
+
+		c, err := mH.content(ltr, rcpt)
+		if err != nil {
+			ltr.Log().Errorf("mH.sendPersonal can't render for %s: %v\n", rcpt.Address, err)
+
+			rcpt.Status = "failed"
+			ltr.Error = err.Error()
+			lastErr = err
+
+			continue
+		}
+
+		_, err = mH.transmit(smtpClient, mH.envelope(ltr, i), []string{rcpt.Address}, rcpt.Address, headers, c)
+		if err != nil {
+			ltr.Log().Errorf("mH.sendPersonal to %s error: %v\n", rcpt.Address, err)
+
+			rcpt.Status = "error"
+			lastErr = err
+
+			// сбросить незавершённую транзакцию, чтобы отправить следующим адресатам
+			if err = smtpClient.Reset(); err != nil {
+				return fmt.Errorf("func Maiker.sendPersonal can't smtpClient.Reset: %v", err)
+			}
+
+			continue
+		}
+
+		rcpt.Status = "sent"
+	}
+
+	ltr.SetStatusFromRecipients() // sent / partial / error / failed
+
+	ltr.Log().Debugf("Complete sending personal letter %v\n", ltr)
+
+	return lastErr
+}
+
+// заголовки для отписки в один клик (RFC 8058) для массовых рассылок
+// подписанная ссылка на mailsender также подставляется в переменную адресата Unsubscribe,
+// если отправитель не передал свою
+func (mH *Mailer) unsubscribe(ltr *letter.Letter, rcpt *letter.Recipient) []header {
+	if mH.tracker == nil || !ltr.IsBulk() {
+		return nil
+	}
+
+	u := mH.tracker.URL(track.UnsubscribePath, track.Claims{
+		LetterID: ltr.ID.Hex(),
+		Address:  rcpt.Address,
+		Category: ltr.Category,
+		Tenant:   ltr.Token,
+	})
+
+	if rcpt.Unsubscribe == "" {
+		rcpt.Unsubscribe = u
+	}
+
+	return []header{
+		{key: "List-Unsubscribe", val: "<" + u + ">"},
+		{key: "List-Unsubscribe-Post", val: "List-Unsubscribe=One-Click"},
+	}
+}
+
+// получить тему и тело письма для адресата
+// письмо с шаблоном рендерится, иначе в текст подставляются переменные адресата
+// rcpt == nil - одно письмо всем адресатам
+func (mH *Mailer) render(ltr *letter.Letter, rcpt *letter.Recipient) (*tmpl.Rendered, error) {
+	if ltr.TemplateID == "" {
+		if rcpt == nil {
+			return mH.postProcess(&tmpl.Rendered{Subject: ltr.Subject, HTML: ltr.Body})
+		}
+
+		return mH.postProcess(&tmpl.Rendered{Subject: personalize(ltr.Subject, rcpt), HTML: personalize(ltr.Body, rcpt)})
+	}
+
+	if mH.tpl == nil {
+		return nil, fmt.Errorf("template %s: templates are not configured", ltr.TemplateID)
+	}
+
+	// версия шаблона запоминается при постановке в очередь
+	t, err := mH.tpl.GetTemplate(ltr.TemplateID, ltr.TemplateVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := tmpl.Render(t, tmpl.Locale(ltr, rcpt), tmpl.Vars(ltr, rcpt))
+	if err != nil {
+		return nil, err
+	}
+
+	return mH.postProcess(c)
+}
+
+// отрендерить, обработать html и, если нужно, добавить отслеживание
+func (mH *Mailer) content(ltr *letter.Letter, rcpt *letter.Recipient) (*tmpl.Rendered, error) {
+	c, err := mH.render(ltr, rcpt)
+	if err != nil {
+		return nil, err
+	}
+
+	if mH.tracker == nil || !ltr.Track || c.HTML == "" {
+		return c, nil
+	}
+
+	address := ""
+	if rcpt != nil {
+		address = rcpt.Address
+	}
+
+	if c.HTML, err = mH.tracker.Rewrite(c.HTML, ltr.ID.Hex(), address); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// обработать html письма, если обработка включена
+func (mH *Mailer) postProcess(c *tmpl.Rendered) (*tmpl.Rendered, error) {
+	if mH.html == nil || c.HTML == "" {
+		return c, nil
+	}
+
+	h, err := mH.html.Process(c.HTML)
+	if err != nil {
+		return nil, err
+	}
+
+	c.HTML = h
+
+	return c, nil
+}
+
+// Preview - итоговое MIME сообщение по шаблону с тестовыми данными, без отправки
+func (mH *Mailer) Preview(t *tmpl.Template, ltr *letter.Letter, rcpt *letter.Recipient) (string, error) {
+	c, err := tmpl.Render(t, tmpl.Locale(ltr, rcpt), tmpl.Vars(ltr, rcpt))
+	if err != nil {
+		return "", err
+	}
+
+	if c, err = mH.postProcess(c); err != nil {
+		return "", err
+	}
+
+	to := ""
+	if rcpt != nil {
+		to = rcpt.Address
+	}
+
+	return buildMessage(mH.user, to, nil, c)
+}
+
+// адрес отправителя конверта: VERP письма и адресата idx (-1 - письмо на всех), если настроен
+func (mH *Mailer) envelope(ltr *letter.Letter, idx int) string {
+	if mH.verp == nil || ltr.ID.IsZero() {
+		return mH.user
+	}
+
+	return mH.verp.Encode(ltr.ID.Hex(), idx)
+}
+
+// Message-ID с меткой VERP, по нему жалоба (ARF) сопоставляется с письмом и адресатом
+// без VERP Message-ID проставит smtp сервер
+func (mH *Mailer) messageID(ltr *letter.Letter, idx int) []header {
+	if mH.verp == nil || ltr.ID.IsZero() {
+		return nil
+	}
+
+	return []header{{"Message-ID", mH.verp.MessageID(ltr.ID.Hex(), idx)}}
+}
+
+// X-Correlation-ID со сквозным ID запроса, чтобы письмо можно было найти в логах по жалобе получателя
+func correlationID(ltr *letter.Letter) []header {
+	if ltr.CorrelationID == "" {
+		return nil
+	}
+
+	return []header{{"X-Correlation-ID", ltr.CorrelationID}}
+}
+
+// одна smtp транзакция: отправитель конверта, адресаты, сообщение
+// to - заголовок To, если пустой, получатели не увидят адреса друг друга
+func (mH *Mailer) transmit(smtpClient *smtp.Client, from string, rcpts []string, to string, headers []header, c *tmpl.Rendered) (string, error) {
+	message, err := buildMessage(mH.user, to, headers, c)
+	if err != nil {
+		return "", fmt.Errorf("func Maiker.SendLetter can't buildMessage: %v", err)
+	}
+
+	return message, deliver(smtpClient, from, rcpts, message)
+}
+
+// отправить готовое сообщение
+func deliver(smtpClient *smtp.Client, from string, rcpts []string, message string) error {
 	// From
-	// From используется для всех один, потому что использую гугловый сервис, авторизующий отправителя
-	// наверное, можно попробоать отдавать разных отправителей
-	if err = smtpClient.Mail(mH.user); err != nil {
+	// в заголовке From всегда mH.user, потому что использую гугловый сервис, авторизующий отправителя
+	// в конверте - VERP, если настроен (сервер должен разрешать такой MAIL FROM)
+	if err := smtpClient.Mail(from); err != nil {
 		return fmt.Errorf("func Maiker.SendLetter can't smtpClient.Mail: %v", err)
 	}
 
 	// To
-	// получатели не увидят адреса друг друга
-	for _, rcpt := range ltr.Addresses {
-		if err = smtpClient.Rcpt(rcpt); err != nil {
+	for _, rcpt := range rcpts {
+		if err := smtpClient.Rcpt(rcpt); err != nil {
 			return fmt.Errorf("func Maiker.SendLetter can't smtpClient.Rcpt: %v", err)
 		}
 	}
@@ -221,8 +500,6 @@ func (mH *Mailer) SendLetter(smtpClient *smtp.Client, ltr *letter.Letter) error
 		return fmt.Errorf("func Maiker.SendLetter can't smtpClient.Data: %v", err)
 	}
 
-	message := fmt.Sprintf("From: %s\nSubject: %s\nContent-type: text/html; charset=utf-8\n\n%s", mH.user, ltr.Subject, ltr.Body)
-
 	_, err = w.Write([]byte(message))
 	if err != nil {
 		return fmt.Errorf("func Maiker.SendLetter can't w.Write: %v", err)
@@ -233,9 +510,55 @@ func (mH *Mailer) SendLetter(smtpClient *smtp.Client, ltr *letter.Letter) error
 		return fmt.Errorf("func Maiker.SendLetter can't w.Close: %v", err)
 	}
 
-	ltr.Status = "sent" // обработчик очереди использует этот статус, он пойдёт и в mongo, и в kafka
+	return nil
+}
 
-	zap.S().Debugf("Complete sending letter %v\nmessage: %s\n", ltr, message)
+// отправить исходное сообщение всем адресатам одной транзакцией
+func (mH *Mailer) sendRaw(smtpClient *smtp.Client, ltr *letter.Letter) error {
+	message := rawMessage(ltr.Raw, append(mH.messageID(ltr, -1), correlationID(ltr)...))
+
+	if err := deliver(smtpClient, mH.envelope(ltr, -1), ltr.Addresses, message); err != nil {
+		return err
+	}
+
+	ltr.Status = "sent"
+
+	ltr.Log().Debugf("Complete sending raw letter %s to %v", ltr.ID.Hex(), ltr.Addresses)
 
 	return nil
 }
+
+// rawMessage добавляет в начало исходного сообщения заголовки, которых в нём ещё нет:
+// заголовки отправителя не подменяются, а Message-ID с VERP ставится, только если его не было
+func rawMessage(raw string, headers []header) string {
+	h, err := textproto.NewReader(bufio.NewReader(strings.NewReader(raw))).ReadMIMEHeader()
+	if err != nil && len(h) == 0 {
+		h = textproto.MIMEHeader{}
+	}
+
+	var b strings.Builder
+
+	for _, hd := range headers {
+		if h.Get(hd.key) == "" {
+			fmt.Fprintf(&b, "%s: %s\r\n", hd.key, hd.val)
+		}
+	}
+
+	return b.String() + raw
+}
+
+// подставить переменные адресата в текст:
+// {{name}}, {{address}}, {{unsubscribe}} и {{ключ}} из Vars
+func personalize(s string, rcpt *letter.Recipient) string {
+	pairs := []string{
+		"{{name}}", rcpt.Name,
+		"{{address}}", rcpt.Address,
+		"{{unsubscribe}}", rcpt.Unsubscribe,
+	}
+
+	for k, v := range rcpt.Vars {
+		pairs = append(pairs, "{{"+k+"}}", v)
+	}
+
+	return strings.NewReplacer(pairs...).Replace(s)
+}
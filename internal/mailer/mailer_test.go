@@ -0,0 +1,196 @@
+package mailer
+
+import (
+	"mime"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/maris-cyber/mailsender/internal/bounce"
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"github.com/maris-cyber/mailsender/internal/tmpl"
+	"github.com/maris-cyber/mailsender/internal/track"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+
+	os.Exit(m.Run())
+}
+
+func Test_BuildMessage(t *testing.T) {
+	c := &tmpl.Rendered{Subject: "тема письма", HTML: "<p>туловище</p>", Text: "туловище"}
+
+	msg, err := buildMessage("sender@example.com", "suocq@mailto.plus", []header{{key: "X-Test", val: "1"}}, c)
+	if err != nil {
+		t.Fatalf("buildMessage error: %v", err)
+	}
+
+	m, err := mail.ReadMessage(strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("mail.ReadMessage error: %v", err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil || subject != c.Subject {
+		t.Errorf("Subject %q error %v", subject, err)
+	}
+
+	if m.Header.Get("X-Test") != "1" || m.Header.Get("To") != "suocq@mailto.plus" {
+		t.Errorf("headers %v", m.Header)
+	}
+
+	if !strings.HasPrefix(m.Header.Get("Content-Type"), "multipart/alternative") {
+		t.Errorf("Content-Type %s", m.Header.Get("Content-Type"))
+	}
+}
+
+func Test_Unsubscribe(t *testing.T) {
+	tr, err := newTestTracker()
+	if err != nil {
+		t.Fatalf("track.New error: %v", err)
+	}
+
+	mH := &Mailer{tracker: tr}
+
+	ltr := &letter.Letter{ID: primitive.NewObjectID(), Category: "news", Addresses: []string{"suocq@mailto.plus"}}
+	ltr.Personalize = true
+	ltr.Expand()
+
+	hs := mH.unsubscribe(ltr, &ltr.Recipients[0])
+	if len(hs) != 2 || hs[1].val != "List-Unsubscribe=One-Click" {
+		t.Fatalf("unsubscribe headers %v", hs)
+	}
+
+	u := strings.Trim(hs[0].val, "<>")
+	if u != ltr.Recipients[0].Unsubscribe {
+		t.Errorf("recipient Unsubscribe %q, want %q", ltr.Recipients[0].Unsubscribe, u)
+	}
+
+	c, err := tr.Verify(strings.TrimPrefix(u, "https://mail.example.com"+track.UnsubscribePath))
+	if err != nil || c.Address != "suocq@mailto.plus" || c.Category != "news" {
+		t.Errorf("unsubscribe token %v error %v", c, err)
+	}
+
+	// обычному письму отписка не нужна
+	if hs = mH.unsubscribe(&letter.Letter{}, &ltr.Recipients[0]); hs != nil {
+		t.Errorf("unsubscribe headers for non bulk letter %v", hs)
+	}
+}
+
+func Test_PerRecipient(t *testing.T) {
+	tr, err := newTestTracker()
+	if err != nil {
+		t.Fatalf("track.New error: %v", err)
+	}
+
+	mH := &Mailer{}
+	ltr := &letter.Letter{ID: primitive.NewObjectID(), Track: true, Body: "<p>привет</p>", Addresses: []string{"suocq@mailto.plus", "yhuzfu@mailto.plus"}}
+
+	// без трекера делить письмо незачем
+	if mH.perRecipient(ltr) {
+		t.Errorf("perRecipient without tracker")
+	}
+
+	mH.tracker = tr
+
+	if !mH.perRecipient(ltr) || !mH.perRecipient(&letter.Letter{Category: "news"}) || mH.perRecipient(&letter.Letter{}) {
+		t.Errorf("perRecipient with tracker")
+	}
+
+	// токен пикселя отслеживаемого письма несёт адресата
+	ltr.Personalize = true
+	ltr.Expand()
+
+	for i := range ltr.Recipients {
+		c, err := mH.content(ltr, &ltr.Recipients[i])
+		if err != nil {
+			t.Fatalf("content error: %v", err)
+		}
+
+		i0 := strings.Index(c.HTML, track.OpenPath)
+		if i0 < 0 {
+			t.Fatalf("no pixel in %s", c.HTML)
+		}
+
+		token := c.HTML[i0+len(track.OpenPath):]
+		token = token[:strings.IndexByte(token, '"')]
+
+		cl, err := tr.Verify(token)
+		if err != nil || cl.Address != ltr.Recipients[i].Address || cl.LetterID != ltr.ID.Hex() {
+			t.Errorf("pixel token %v error %v", cl, err)
+		}
+	}
+}
+
+func Test_VERP(t *testing.T) {
+	mH := &Mailer{user: "sender@gmail.com"}
+	ltr := &letter.Letter{ID: primitive.NewObjectID()}
+
+	// без VERP отправитель конверта - пользователь smtp, Message-ID не добавляется
+	if from := mH.envelope(ltr, 0); from != "sender@gmail.com" || mH.messageID(ltr, 0) != nil {
+		t.Errorf("envelope without VERP %q", from)
+	}
+
+	v, err := bounce.NewVERP("bounces@bounces.example.com", []byte("секрет"))
+	if err != nil {
+		t.Fatalf("bounce.NewVERP error: %v", err)
+	}
+
+	mH.verp = v
+
+	id, idx, err := v.Decode(mH.envelope(ltr, 3))
+	if err != nil || id != ltr.ID.Hex() || idx != 3 {
+		t.Errorf("envelope %q decoded %s %d error %v", mH.envelope(ltr, 3), id, idx, err)
+	}
+
+	hs := mH.messageID(ltr, -1)
+	if len(hs) != 1 || hs[0].key != "Message-ID" {
+		t.Fatalf("messageID headers %v", hs)
+	}
+
+	if id, idx, err = v.ParseMessageID(hs[0].val); err != nil || id != ltr.ID.Hex() || idx != -1 {
+		t.Errorf("Message-ID %q parsed %s %d error %v", hs[0].val, id, idx, err)
+	}
+}
+
+func Test_CorrelationID(t *testing.T) {
+	if hs := correlationID(&letter.Letter{}); hs != nil {
+		t.Errorf("correlationID headers without ID %v", hs)
+	}
+
+	hs := correlationID(&letter.Letter{CorrelationID: "req-1"})
+	if len(hs) != 1 || hs[0].key != "X-Correlation-ID" || hs[0].val != "req-1" {
+		t.Errorf("correlationID headers %v", hs)
+	}
+}
+
+func Test_RawMessage(t *testing.T) {
+	raw := "From: app@example.com\r\nMessage-ID: <1@example.com>\r\nSubject: Hi\r\n\r\nBody\r\n"
+	hs := []header{{"Message-ID", "<verp@example.com>"}, {"X-Correlation-ID", "req-1"}}
+
+	// Message-ID отправителя не подменяется
+	msg := rawMessage(raw, hs)
+	if msg != "X-Correlation-ID: req-1\r\n"+raw {
+		t.Errorf("rawMessage %q", msg)
+	}
+
+	raw = "From: app@example.com\r\nSubject: Hi\r\n\r\nBody\r\n"
+
+	msg = rawMessage(raw, hs)
+	if msg != "Message-ID: <verp@example.com>\r\nX-Correlation-ID: req-1\r\n"+raw {
+		t.Errorf("rawMessage without Message-ID %q", msg)
+	}
+}
+
+func newTestTracker() (*track.Tracker, error) {
+	os.Setenv(track.TRACK_SECRET, "секрет")
+	os.Setenv(track.TRACK_BASE_URL, "https://mail.example.com/")
+
+	return track.New()
+}
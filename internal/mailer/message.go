@@ -0,0 +1,97 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+
+	"github.com/maris-cyber/mailsender/internal/tmpl"
+)
+
+// дополнительный заголовок сообщения
+type header struct {
+	key string
+	val string
+}
+
+// собрать MIME сообщение
+// если есть и html, и текст - multipart/alternative, иначе одна часть
+// to - заголовок To, если пустой, получатели не увидят адреса друг друга
+func buildMessage(from, to string, headers []header, c *tmpl.Rendered) (string, error) {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+
+	if to != "" {
+		fmt.Fprintf(&b, "To: %s\r\n", to)
+	}
+
+	for _, h := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", h.key, h.val)
+	}
+
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", c.Subject))
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	if c.HTML == "" || c.Text == "" {
+		ct, body := "text/html; charset=utf-8", c.HTML
+		if c.HTML == "" {
+			ct, body = "text/plain; charset=utf-8", c.Text
+		}
+
+		fmt.Fprintf(&b, "Content-Type: %s\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n", ct)
+
+		if err := writeQP(&b, body); err != nil {
+			return "", err
+		}
+
+		return b.String(), nil
+	}
+
+	mw := multipart.NewWriter(&b)
+
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+
+	// по RFC 2046 предпочтительная часть идёт последней
+	parts := []struct {
+		ct   string
+		body string
+	}{
+		{"text/plain; charset=utf-8", c.Text},
+		{"text/html; charset=utf-8", c.HTML},
+	}
+
+	for _, p := range parts {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.ct},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", fmt.Errorf("multipart CreatePart error: %v", err)
+		}
+
+		if err = writeQP(pw, p.body); err != nil {
+			return "", err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return "", fmt.Errorf("multipart Close error: %v", err)
+	}
+
+	return b.String(), nil
+}
+
+func writeQP(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return fmt.Errorf("quotedprintable Write error: %v", err)
+	}
+
+	return qp.Close()
+}
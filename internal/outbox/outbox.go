@@ -0,0 +1,48 @@
+/*
+outbox - запись о статусе письма, которую нужно отправить в kafka.
+Очередь сохраняет её в той же базе и в той же транзакции, что и результат письма,
+а relay из пакета kfk отправляет записи по порядку и отмечает доставленными.
+Так статус попадает в kafka, даже если в момент сохранения kafka была недоступна.
+*/
+package outbox
+
+import (
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Record struct {
+	ID          primitive.ObjectID `bson:"_id"` // порядок отправки - по возрастанию ID
+	LetterID    primitive.ObjectID `bson:"letterid"`
+	Letter      letter.Letter      `bson:"letter"` // письмо на момент изменения статуса
+	Created     time.Time          `bson:"created"`
+	Delivered   bool               `bson:"delivered"`
+	DeliveredAt time.Time          `bson:"deliveredat,omitempty"`
+	Failed      bool               `bson:"failed,omitempty"` // статус не удалось закодировать, запись не отправляется и ждёт разбора
+	Error       string             `bson:"error,omitempty"`  // почему не удалось
+}
+
+// Store - база, из которой relay берёт недоставленные записи
+type Store interface {
+	// недоставленные записи по возрастанию ID, не больше limit, без неудавшихся
+	PendingOutbox(limit int) ([]Record, error)
+	MarkDelivered(ids []primitive.ObjectID) error
+	// запись, которую повтор не исправит: остаётся недоставленной с причиной, чтобы её можно было найти
+	MarkFailed(id primitive.ObjectID, reason string) error
+}
+
+// New - запись о текущем состоянии письма
+func New(l *letter.Letter) *Record {
+	r := &Record{
+		ID:       primitive.NewObjectID(),
+		LetterID: l.ID,
+		Created:  time.Now(),
+	}
+
+	l.Copy(&r.Letter)
+	r.Letter.Raw = "" // исходное сообщение для статуса не нужно, а места занимает много
+
+	return r
+}
@@ -6,10 +6,13 @@ package queue
 
 import (
 	"context"
+	"errors"
 	"runtime"
 	"sync"
 
 	"github.com/maris-cyber/mailsender/internal/letter"
+	"github.com/maris-cyber/mailsender/internal/suppress"
+	"github.com/maris-cyber/mailsender/internal/tmpl"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.uber.org/zap"
 )
@@ -20,6 +23,14 @@ type Qdb interface {
 	UpdateSttById(primitive.ObjectID, string) error
 	Stop() error
 	UpdateSttsAll(string, string) error
+	UpdateResult(*letter.Letter) error
+}
+
+// Outbox - база, которая сохраняет письмо или результат письма вместе с записью outbox в одной транзакции
+// статус из outbox отправляет в kafka relay (см. kfk.Relay), а не очередь через канал
+type Outbox interface {
+	CreateWithOutbox(*letter.Letter) error
+	UpdateResultWithOutbox(*letter.Letter) error
 }
 
 type Queue struct {
@@ -30,6 +41,9 @@ type Queue struct {
 	chFrmKfk      *chan *letter.Letter
 	mailerWG      *sync.WaitGroup
 	selfWG        *sync.WaitGroup
+	tpl           tmpl.Store     // шаблоны писем, чтобы запомнить версию при постановке в очередь
+	sup           suppress.Store // список подавления, проверяется перед отправкой
+	outbox        Outbox         // если задан, статусы в kafka идут через outbox
 }
 
 // конструктор очереди
@@ -49,11 +63,62 @@ func New(ctx context.Context, db Qdb, chToPrc *chan *letter.Letter, chFromPrc *c
 	return &qH, err
 }
 
+// подключить хранилище шаблонов
+func (qH *Queue) SetTemplates(tpl tmpl.Store) {
+	qH.tpl = tpl
+}
+
+// подключить список подавления
+func (qH *Queue) SetSuppressions(sup suppress.Store) {
+	qH.sup = sup
+}
+
+// подключить outbox
+func (qH *Queue) SetOutbox(ob Outbox) {
+	qH.outbox = ob
+}
+
 // добавить письмо в очередь
+// у письма с шаблоном запоминается текущая опубликованная версия шаблона,
+// если шаблона нет или указанная в письме версия не опубликована, письмо сохраняется со статусом "failed" и не отправляется
 func (qH *Queue) Put(ctx context.Context, qE *letter.Letter) error {
+	if qE.TemplateID != "" && qH.tpl != nil {
+		if err := tmpl.Pin(qH.tpl, qE); err != nil {
+			zap.S().Errorf("tmpl.Pin error: %v\n", err)
+
+			qE.Status = "failed"
+			qE.Error = err.Error()
+		}
+	}
+
+	// письмо, которое не будет отправлено, сохраняется сразу со статусом для kafka
+	if qE.Status == "failed" && qH.outbox != nil {
+		return qH.outbox.CreateWithOutbox(qE)
+	}
+
 	return qH.db.Create(qE)
 }
 
+// result сохраняет результат обработки письма и передаёт статус в kafka:
+// с outbox - записью в той же транзакции, без него - сразу в канал для kafka
+func (qH *Queue) result(e *letter.Letter) {
+	if qH.outbox != nil {
+		if err := qH.outbox.UpdateResultWithOutbox(e); err != nil {
+			e.Log().Errorf("qH.outbox.UpdateResultWithOutbox error: %v\n", err)
+		}
+
+		return
+	}
+
+	if err := qH.db.UpdateResult(e); err != nil {
+		e.Log().Errorf("qH.db.UpdateResult error: %v\n", err)
+	}
+
+	// отправить в канал для kafka
+	zap.S().Debugf("в канал fQtK отправлен %v", e)
+	*qH.chToKfk <- e
+}
+
 func (qH *Queue) Get(ctx context.Context, ty *letter.Letter) error {
 	return qH.db.Read(ty, "awaiting")
 }
@@ -79,20 +144,34 @@ func (qH *Queue) Run(ctx context.Context, stts string) error {
 			// это выполняем в методе Stop
 			return qH.Stop(ctx)
 		case frm := <-*qH.chFrmKfk:
-			zap.S().Debugf("Queue from chan %v", frm)
+			frm.Log().Debugf("Queue from chan %v", frm)
 
 			err = qH.Put(ctx, frm)
-			if err != nil {
-				zap.S().Errorf("qh.Put error: %v\n", err)
+			if errors.Is(err, letter.ErrDuplicate) {
+				// письмо уже в очереди: повторная публикация или повторное чтение из kafka
+				frm.Log().Debugf("qh.Put duplicate skipped: %v\n", err)
+				frm.Acknowledge(nil)
+
+				continue
 			}
-		case sended := <-*qH.chFromProcess:
-			err = qH.db.UpdateSttById(sended.ID, sended.Status)
+
+			// kafka отметит сообщение прочитанным, только когда все письма из него сохранены
+			frm.Acknowledge(err)
+
 			if err != nil {
-				zap.S().Errorf("qH.db.UpdateSttById error: %v\n", err)
+				frm.Log().Errorf("qh.Put error: %v\n", err)
+
+				continue
 			}
-			// отправить в канал для kafka
-			zap.S().Debugf("в канал fQtK отправлен %v", sended)
-			*qH.chToKfk <- sended
+
+			// письмо, которое не будет отправлено, сразу отправить в канал для kafka
+			// с outbox статус уже записан вместе с письмом
+			if frm.Status == "failed" && qH.outbox == nil {
+				*qH.chToKfk <- frm
+			}
+		case sended := <-*qH.chFromProcess:
+			// статус письма, статусы адресатов, подавленные адресаты, причина ошибки
+			qH.result(sended)
 		default:
 			err := qH.db.Read(obj, stts)
 			if err != nil {
@@ -101,6 +180,21 @@ func (qH *Queue) Run(ctx context.Context, stts string) error {
 				continue
 			}
 
+			// адресатов из списка подавления исключить до отправки
+			// если отправлять некому, письмо сразу отправить в канал для kafka
+			if qH.sup != nil {
+				if err = suppress.Filter(qH.sup, obj); err != nil {
+					zap.S().Errorf("suppress.Filter error: %v\n", err)
+				}
+
+				if obj.Status == "suppressed" {
+					qH.result(obj)
+					obj = letter.New()
+
+					continue
+				}
+			}
+
 			wg.Add(1)
 
 			err = qH.db.UpdateSttById(obj.ID, "processing")
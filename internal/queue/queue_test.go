@@ -2,10 +2,12 @@ package queue
 
 import (
 	"context"
+	"errors"
 	"os"
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/maris-cyber/mailsender/internal/db/mem"
 	"github.com/maris-cyber/mailsender/internal/letter"
@@ -79,3 +81,196 @@ func Test_Get(t *testing.T) {
 
 	zap.S().Debugf("Test MemDB Get %v\n", tL)
 }
+
+func Test_PutDuplicate(t *testing.T) {
+	tL := letter.Letter{
+		Addresses:      []string{"uuunet@mailto.plus"},
+		Status:         "awaiting",
+		IdempotencyKey: "queue-test:0",
+	}
+
+	if err := qH.Put(ctx, &tL); err != nil {
+		t.Fatalf("Test Queue can't Put: %v\n", err)
+	}
+
+	dup := tL
+	if err := qH.Put(ctx, &dup); !errors.Is(err, letter.ErrDuplicate) {
+		t.Errorf("Test Queue duplicate Put error %v, want ErrDuplicate\n", err)
+	}
+}
+
+func Test_Ack(t *testing.T) {
+	db, _ := mem.New(ctx)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	toSend := make(chan *letter.Letter, 1)
+	complete := make(chan *letter.Letter, 1)
+	toKfk := make(chan *letter.Letter, 1)
+	frmKfk := make(chan *letter.Letter, 1)
+
+	q, _ := New(ctx, db, &toSend, &complete, &toKfk, &frmKfk, &sync.WaitGroup{}, wg)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// статус, который очередь не выбирает для отправки
+	go q.Run(runCtx, "awaiting")
+
+	ack := make(chan error, 2)
+
+	for i := 0; i < 2; i++ {
+		// второй раз то же письмо - дубликат, тоже подтверждается
+		frmKfk <- &letter.Letter{Addresses: []string{"uuunet@mailto.plus"}, Status: "ack", IdempotencyKey: "ack:0", Ack: ack}
+
+		if err := <-ack; err != nil {
+			t.Errorf("Test Queue ack %d error: %v\n", i, err)
+		}
+	}
+
+	if len(db.Data) != 1 || db.Data[0].Ack != nil {
+		t.Errorf("Test Queue stored %v\n", db.Data)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func Test_RunMem(t *testing.T) {
+	db, _ := mem.New(ctx)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	toSend := make(chan *letter.Letter, 2)
+	complete := make(chan *letter.Letter, 2)
+	toKfk := make(chan *letter.Letter, 10)
+	frmKfk := make(chan *letter.Letter, 2)
+
+	q, _ := New(ctx, db, &toSend, &complete, &toKfk, &frmKfk, &sync.WaitGroup{}, wg)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go q.Run(runCtx, "awaiting")
+
+	// майлер: каждое письмо отправлено; статусы для kafka только считаются
+	var (
+		mu       sync.Mutex
+		sends    int
+		statuses int
+	)
+
+	go func() {
+		for {
+			select {
+			case l := <-toSend:
+				mu.Lock()
+				sends++
+				mu.Unlock()
+
+				l.Status = "sent"
+				complete <- l
+			case <-toKfk:
+				mu.Lock()
+				statuses++
+				mu.Unlock()
+			case <-runCtx.Done():
+				return
+			}
+		}
+	}()
+
+	// письма без ID, как из kafka: mem должен дать каждому свой
+	ack := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		frmKfk <- &letter.Letter{Addresses: []string{"uuunet@mailto.plus"}, Status: "awaiting", Ack: ack}
+
+		if err := <-ack; err != nil {
+			t.Fatalf("Test Queue mem ack %d error: %v\n", i, err)
+		}
+	}
+
+	done := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return statuses >= 2
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && !done() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// дать очереди время выбрать письмо снова, если статус не сохранился
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	wg.Wait()
+
+	if len(db.Data) != 2 || db.Data[0].ID.IsZero() || db.Data[0].ID == db.Data[1].ID ||
+		db.Data[0].Status != "sent" || db.Data[1].Status != "sent" {
+		t.Errorf("Test Queue mem letters %+v\n", db.Data)
+	}
+
+	// каждое письмо отправлено один раз
+	mu.Lock()
+	defer mu.Unlock()
+
+	if sends != 2 {
+		t.Errorf("Test Queue mem %d sends, want 2\n", sends)
+	}
+}
+
+func Test_Outbox(t *testing.T) {
+	db, _ := mem.New(ctx)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	toSend := make(chan *letter.Letter, 1)
+	complete := make(chan *letter.Letter, 1)
+	toKfk := make(chan *letter.Letter, 1)
+	frmKfk := make(chan *letter.Letter, 1)
+
+	q, _ := New(ctx, db, &toSend, &complete, &toKfk, &frmKfk, &sync.WaitGroup{}, wg)
+	q.SetOutbox(db)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go q.Run(runCtx, "awaiting")
+
+	// письмо без адресов сохраняется вместе со статусом в outbox
+	ack := make(chan error, 1)
+	frmKfk <- &letter.Letter{Status: "failed", Error: "no valid recipients", Ack: ack}
+
+	if err := <-ack; err != nil {
+		t.Fatalf("Test Queue outbox ack error: %v\n", err)
+	}
+
+	// результат отправки - тоже
+	complete <- &letter.Letter{ID: db.Data[0].ID, Status: "sent"}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if rs, _ := db.PendingOutbox(10); len(rs) == 2 {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	wg.Wait()
+
+	rs, _ := db.PendingOutbox(10)
+	if len(rs) != 2 || rs[0].Letter.Status != "failed" || rs[1].Letter.Status != "sent" || rs[0].LetterID != rs[1].LetterID {
+		t.Errorf("Test Queue outbox %+v\n", rs)
+	}
+
+	// с outbox статусы в канал для kafka не идут
+	select {
+	case l := <-toKfk:
+		t.Errorf("Test Queue outbox letter in kafka chan %v\n", l)
+	default:
+	}
+}
@@ -0,0 +1,153 @@
+/*
+suppress - пакет, обеспечивающий список подавления: адреса, на которые
+нельзя отправлять письма (жёсткий отказ, жалоба, отписка).
+Запись действует глобально, для одного токена (арендатора) или для одной категории писем.
+Очередь проверяет адресатов по списку перед тем, как отдать письмо mailer'у.
+*/
+package suppress
+
+import (
+	"strings"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// область действия
+const (
+	Global   = "global"
+	Tenant   = "tenant"   // Value - токен письма
+	Category = "category" // Value - категория письма
+)
+
+// причины
+const (
+	Bounce      = "bounce"
+	Complaint   = "complaint"
+	Unsubscribe = "unsubscribe"
+	Manual      = "manual"
+)
+
+type Entry struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	Address string             `bson:"address"`
+	Scope   string             `bson:"scope"`
+	Value   string             `bson:"value,omitempty"`
+	Reason  string             `bson:"reason"`
+	Created time.Time          `bson:"created"`
+}
+
+// Store - хранилище списка подавления
+// запись уникальна по адресу, области и значению, повторное добавление обновляет причину
+type Store interface {
+	AddSuppression(*Entry) error
+	FindSuppressions(addresses []string) ([]Entry, error)
+	RemoveSuppression(address, scope, value string) error
+}
+
+// Normalize приводит адрес к виду, в котором он хранится в списке
+func Normalize(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+// Valid проверяет область действия записи
+func (e *Entry) Valid() bool {
+	switch e.Scope {
+	case Global:
+		return e.Value == ""
+	case Tenant, Category:
+		return e.Value != ""
+	}
+
+	return false
+}
+
+// Applies - действует ли запись для письма
+func (e *Entry) Applies(ltr *letter.Letter) bool {
+	switch e.Scope {
+	case Global:
+		return true
+	case Tenant:
+		return e.Value == ltr.Token
+	case Category:
+		return ltr.Category != "" && e.Value == ltr.Category
+	}
+
+	return false
+}
+
+// Filter исключает из письма подавленных адресатов и записывает их в Suppressed
+// у персонального письма адресат получает статус "suppressed",
+// если отправлять некому, письмо получает статус "suppressed"
+func Filter(st Store, ltr *letter.Letter) error {
+	entries, err := st.FindSuppressions(ltr.Addresses)
+	if err != nil {
+		return err
+	}
+
+	suppressed := make(map[string]bool)
+
+	for i := range entries {
+		if entries[i].Applies(ltr) {
+			suppressed[entries[i].Address] = true
+		}
+	}
+
+	if len(suppressed) == 0 {
+		return nil
+	}
+
+	if len(ltr.Recipients) > 0 {
+		active := 0
+
+		for i := range ltr.Recipients {
+			r := &ltr.Recipients[i]
+
+			if r.Status != "sent" && r.Status != "suppressed" && r.Status != "invalid" && suppressed[Normalize(r.Address)] {
+				r.Status = "suppressed"
+				ltr.Suppressed = append(ltr.Suppressed, r.Address)
+			}
+
+			if r.Status != "suppressed" {
+				active++
+			}
+		}
+
+		// неперсональное письмо уходит по Addresses, подавленных там быть не должно
+		ltr.Addresses = without(ltr.Addresses, suppressed)
+
+		if active == 0 {
+			ltr.Status = "suppressed"
+		}
+
+		return nil
+	}
+
+	for _, a := range ltr.Addresses {
+		if suppressed[Normalize(a)] {
+			ltr.Suppressed = append(ltr.Suppressed, a)
+		}
+	}
+
+	ltr.Addresses = without(ltr.Addresses, suppressed)
+
+	if len(ltr.Addresses) == 0 {
+		ltr.Status = "suppressed"
+	}
+
+	return nil
+}
+
+// адреса без подавленных
+func without(addresses []string, suppressed map[string]bool) []string {
+	keep := addresses[:0:0]
+
+	for _, a := range addresses {
+		if !suppressed[Normalize(a)] {
+			keep = append(keep, a)
+		}
+	}
+
+	return keep
+}
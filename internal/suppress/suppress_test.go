@@ -0,0 +1,139 @@
+package suppress
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"go.uber.org/zap"
+)
+
+// список подавления для тестов
+type fakeStore []Entry
+
+func (fs *fakeStore) AddSuppression(e *Entry) error {
+	*fs = append(*fs, *e)
+
+	return nil
+}
+
+func (fs *fakeStore) FindSuppressions(addresses []string) ([]Entry, error) {
+	var res []Entry
+
+	for _, e := range *fs {
+		for _, a := range addresses {
+			if Normalize(a) == e.Address {
+				res = append(res, e)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func (fs *fakeStore) RemoveSuppression(address, scope, value string) error {
+	return nil
+}
+
+var st = &fakeStore{
+	{Address: "bounced@mailto.plus", Scope: Global, Reason: Bounce},
+	{Address: "tenant@mailto.plus", Scope: Tenant, Value: "Иван Иваныч", Reason: Manual},
+	{Address: "news@mailto.plus", Scope: Category, Value: "news", Reason: Unsubscribe},
+}
+
+func TestMain(m *testing.M) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+
+	os.Exit(m.Run())
+}
+
+func Test_FilterBulk(t *testing.T) {
+	ltr := letter.Letter{
+		Addresses: []string{"Bounced@Mailto.plus", "tenant@mailto.plus", "news@mailto.plus", "suocq@mailto.plus"},
+		Token:     "Иван Кузьмич",
+		Category:  "news",
+		Status:    "awaiting",
+	}
+
+	if err := Filter(st, &ltr); err != nil {
+		t.Fatalf("Filter error: %v", err)
+	}
+
+	// токен другой, поэтому tenant@ не подавлен
+	if strings.Join(ltr.Addresses, ",") != "tenant@mailto.plus,suocq@mailto.plus" {
+		t.Errorf("Filter addresses %v", ltr.Addresses)
+	}
+
+	if strings.Join(ltr.Suppressed, ",") != "Bounced@Mailto.plus,news@mailto.plus" {
+		t.Errorf("Filter suppressed %v", ltr.Suppressed)
+	}
+
+	if ltr.Status != "awaiting" {
+		t.Errorf("Filter status %s, want awaiting", ltr.Status)
+	}
+
+	all := letter.Letter{Addresses: []string{"bounced@mailto.plus"}, Status: "awaiting"}
+
+	if err := Filter(st, &all); err != nil || all.Status != "suppressed" {
+		t.Errorf("Filter all suppressed: status %s error %v", all.Status, err)
+	}
+}
+
+func Test_FilterPersonal(t *testing.T) {
+	ltr := letter.Letter{
+		Addresses:   []string{"bounced@mailto.plus", "tenant@mailto.plus", "suocq@mailto.plus"},
+		Token:       "Иван Иваныч",
+		Personalize: true,
+		Status:      "awaiting",
+	}
+	ltr.Expand()
+
+	if err := Filter(st, &ltr); err != nil {
+		t.Fatalf("Filter error: %v", err)
+	}
+
+	want := []string{"suppressed", "suppressed", ""}
+	for i, r := range ltr.Recipients {
+		if r.Status != want[i] {
+			t.Errorf("recipient %s status %q, want %q", r.Address, r.Status, want[i])
+		}
+	}
+
+	ltr.Recipients[2].Status = "sent"
+	ltr.SetStatusFromRecipients()
+
+	if ltr.Status != "sent" {
+		t.Errorf("letter status %s, want sent", ltr.Status)
+	}
+}
+
+func Test_FilterRecipients(t *testing.T) {
+	// адресаты со своими переменными, но письмо одно на всех: уходит по Addresses
+	ltr := letter.Letter{
+		Addresses: []string{"bounced@mailto.plus", "suocq@mailto.plus"},
+		Recipients: []letter.Recipient{
+			{Address: "Bounced@mailto.plus"},
+			{Address: "suocq@mailto.plus"},
+		},
+		Status: "awaiting",
+	}
+
+	if err := Filter(st, &ltr); err != nil {
+		t.Fatalf("Filter error: %v", err)
+	}
+
+	if ltr.Recipients[0].Status != "suppressed" || ltr.Recipients[1].Status != "" {
+		t.Errorf("Filter recipients %+v", ltr.Recipients)
+	}
+
+	if strings.Join(ltr.Addresses, ",") != "suocq@mailto.plus" || strings.Join(ltr.Suppressed, ",") != "Bounced@mailto.plus" {
+		t.Errorf("Filter addresses %v suppressed %v", ltr.Addresses, ltr.Suppressed)
+	}
+
+	if ltr.Status != "awaiting" {
+		t.Errorf("Filter status %s, want awaiting", ltr.Status)
+	}
+}
@@ -0,0 +1,137 @@
+package tmpl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	TEMPLATES_DIR = "TEMPLATES_DIR"
+)
+
+// DirStore - шаблоны в каталоге, каждый шаблон - подкаталог с именем ID
+// и файлами subject.tmpl, html.tmpl, text.tmpl,
+// варианты для локалей - такие же подкаталоги шаблона с именем локали
+// у шаблонов в каталоге одна опубликованная версия,
+// используется для начального наполнения реестра
+type DirStore struct {
+	dir string
+}
+
+// конструктор, каталог берётся из переменной окружения
+func NewDirStore() (*DirStore, error) {
+	dir, ok := os.LookupEnv(TEMPLATES_DIR)
+	if !ok {
+		return nil, fmt.Errorf("%s not defined", TEMPLATES_DIR)
+	}
+
+	zap.S().Debugf("templates dir: %s", dir)
+
+	return &DirStore{dir: dir}, nil
+}
+
+// список шаблонов в каталоге
+func (ds *DirStore) IDs() ([]string, error) {
+	entries, err := os.ReadDir(ds.dir)
+	if err != nil {
+		return nil, fmt.Errorf("templates dir read error: %v", err)
+	}
+
+	ids := make([]string, 0, len(entries))
+
+	for _, e := range entries {
+		if e.IsDir() {
+			ids = append(ids, e.Name())
+		}
+	}
+
+	return ids, nil
+}
+
+func (ds *DirStore) GetTemplate(id string, version int) (*Template, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return nil, fmt.Errorf("bad template id %q", id)
+	}
+
+	if version > 1 {
+		return nil, fmt.Errorf("template %s version %d: %w", id, version, ErrNotFound)
+	}
+
+	t := Template{ID: id, Version: 1, State: Published}
+
+	v, found, err := readVariant(filepath.Join(ds.dir, id))
+	if err != nil {
+		return nil, fmt.Errorf("template %s read error: %v", id, err)
+	}
+
+	if !found {
+		return nil, fmt.Errorf("template %s: %w", id, ErrNotFound)
+	}
+
+	t.Subject, t.HTML, t.Text = v.Subject, v.HTML, v.Text
+
+	// подкаталоги шаблона - варианты для локалей: welcome/ru, welcome/en-GB
+	entries, err := os.ReadDir(filepath.Join(ds.dir, id))
+	if err != nil {
+		return nil, fmt.Errorf("template %s read error: %v", id, err)
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		lv, ok, err := readVariant(filepath.Join(ds.dir, id, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("template %s/%s read error: %v", id, e.Name(), err)
+		}
+
+		if !ok {
+			continue
+		}
+
+		if t.Locales == nil {
+			t.Locales = make(map[string]Variant)
+		}
+
+		t.Locales[e.Name()] = lv
+	}
+
+	return &t, nil
+}
+
+// прочитать subject.tmpl, html.tmpl, text.tmpl из каталога
+func readVariant(dir string) (Variant, bool, error) {
+	var v Variant
+
+	parts := []struct {
+		file string
+		dst  *string
+	}{
+		{"subject.tmpl", &v.Subject},
+		{"html.tmpl", &v.HTML},
+		{"text.tmpl", &v.Text},
+	}
+
+	found := false
+
+	for _, p := range parts {
+		b, err := os.ReadFile(filepath.Join(dir, p.file))
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return v, false, err
+		}
+
+		*p.dst = strings.TrimRight(string(b), "\n")
+		found = true
+	}
+
+	return v, found, nil
+}
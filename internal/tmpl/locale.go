@@ -0,0 +1,146 @@
+package tmpl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// форматы дат и чисел по локалям
+type format struct {
+	date     string // layout для time.Format
+	datetime string
+	decimal  string // десятичный разделитель
+	group    string // разделитель разрядов
+}
+
+// "" - формат по умолчанию
+var formats = map[string]format{
+	"":      {date: "2006-01-02", datetime: "2006-01-02 15:04", decimal: ".", group: ""},
+	"en":    {date: "01/02/2006", datetime: "01/02/2006 3:04 PM", decimal: ".", group: ","},
+	"en-GB": {date: "02/01/2006", datetime: "02/01/2006 15:04", decimal: ".", group: ","},
+	"ru":    {date: "02.01.2006", datetime: "02.01.2006 15:04", decimal: ",", group: " "},
+	"uk":    {date: "02.01.2006", datetime: "02.01.2006 15:04", decimal: ",", group: " "},
+	"de":    {date: "02.01.2006", datetime: "02.01.2006 15:04", decimal: ",", group: "."},
+	"fr":    {date: "02/01/2006", datetime: "02/01/2006 15:04", decimal: ",", group: " "},
+}
+
+// Fallback - цепочка локалей от точной к общей: ru-RU -> ru -> "" (по умолчанию)
+func Fallback(locale string) []string {
+	locale = strings.TrimSpace(strings.ReplaceAll(locale, "_", "-"))
+	if locale == "" {
+		return []string{""}
+	}
+
+	parts := strings.Split(locale, "-")
+	parts[0] = strings.ToLower(parts[0])
+
+	// регион в верхнем регистре, как принято: ru-RU, en-GB
+	for i := 1; i < len(parts); i++ {
+		if len(parts[i]) == 2 {
+			parts[i] = strings.ToUpper(parts[i])
+		}
+	}
+
+	chain := make([]string, 0, len(parts)+1)
+	for i := len(parts); i > 0; i-- {
+		chain = append(chain, strings.Join(parts[:i], "-"))
+	}
+
+	return append(chain, "")
+}
+
+func formatFor(locale string) format {
+	for _, l := range Fallback(locale) {
+		if f, ok := formats[l]; ok {
+			return f
+		}
+	}
+
+	return formats[""]
+}
+
+// функции шаблона, форматирующие по локали:
+// {{date .when}}, {{datetime .when}} - дата в формате RFC 3339 или 2006-01-02
+// {{number .amount}} - число, количество знаков после точки сохраняется
+func funcs(locale string) template.FuncMap {
+	f := formatFor(locale)
+
+	return template.FuncMap{
+		"date": func(s string) (string, error) {
+			t, err := parseTime(s)
+			if err != nil {
+				return "", err
+			}
+
+			return t.Format(f.date), nil
+		},
+		"datetime": func(s string) (string, error) {
+			t, err := parseTime(s)
+			if err != nil {
+				return "", err
+			}
+
+			return t.Format(f.datetime), nil
+		},
+		"number": func(s string) (string, error) {
+			return formatNumber(s, f)
+		},
+	}
+}
+
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return t, fmt.Errorf("bad date %q", s)
+	}
+
+	return t, nil
+}
+
+func formatNumber(s string, f format) (string, error) {
+	s = strings.TrimSpace(s)
+
+	if _, err := strconv.ParseFloat(s, 64); err != nil || strings.ContainsAny(s, "eEinfINFxX") {
+		return "", fmt.Errorf("bad number %q", s)
+	}
+
+	sign := ""
+	if s[0] == '-' || s[0] == '+' {
+		if s[0] == '-' {
+			sign = "-"
+		}
+
+		s = s[1:]
+	}
+
+	intPart, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, frac = s[:i], s[i+1:]
+	}
+
+	var b strings.Builder
+
+	b.WriteString(sign)
+
+	for i, c := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteString(f.group)
+		}
+
+		b.WriteRune(c)
+	}
+
+	if frac != "" {
+		b.WriteString(f.decimal)
+		b.WriteString(frac)
+	}
+
+	return b.String(), nil
+}
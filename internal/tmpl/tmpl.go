@@ -0,0 +1,321 @@
+/*
+tmpl - пакет, обеспечивающий рендеринг писем по шаблонам.
+Письмо ссылается на шаблон по ID и передаёт переменные,
+из шаблона получаются тема, html и текстовая часть письма.
+Тема и текст рендерятся text/template, html - html/template с экранированием.
+Отсутствие переменной - ошибка, письмо с такой ошибкой не отправляется.
+
+У шаблона могут быть варианты для локалей, вариант выбирается по локали адресата
+или письма с откатом к более общей: ru-RU -> ru -> вариант по умолчанию.
+Функции date, datetime и number форматируют даты и числа по той же локали.
+
+Шаблоны хранятся в реестре (mem или mng) с версиями:
+новая версия создаётся черновиком (draft), после публикации (published) не меняется.
+Шаблон с синтаксической ошибкой в реестр не попадает (Validate).
+Письмо при постановке в очередь запоминает опубликованную версию шаблона,
+поэтому правка шаблона не меняет уже поставленные в очередь письма.
+*/
+package tmpl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"go.uber.org/zap"
+)
+
+const (
+	Draft     = "draft"
+	Published = "published"
+)
+
+var (
+	ErrNotFound     = errors.New("template not found")
+	ErrNotDraft     = errors.New("template version is not a draft")
+	ErrNotPublished = errors.New("template version is not published")
+	ErrInvalid      = errors.New("template is invalid")
+)
+
+// Template - версия шаблона письма
+// Subject, HTML, Text - вариант по умолчанию, Locales - варианты для локалей
+type Template struct {
+	ID      string             `bson:"id"`
+	Version int                `bson:"version"`
+	State   string             `bson:"state"` // draft / published
+	Subject string             `bson:"subject"`
+	HTML    string             `bson:"html"`
+	Text    string             `bson:"text"`
+	Locales map[string]Variant `bson:"locales,omitempty"` // ключ - локаль: ru, ru-RU, en
+	Created time.Time          `bson:"created"`
+	Updated time.Time          `bson:"updated"`
+}
+
+// Variant - вариант шаблона для локали
+type Variant struct {
+	Subject string `bson:"subject"`
+	HTML    string `bson:"html"`
+	Text    string `bson:"text"`
+}
+
+// Variant выбирает вариант шаблона для локали по цепочке Fallback
+func (t *Template) Variant(locale string) Variant {
+	for _, l := range Fallback(locale) {
+		if l == "" {
+			break
+		}
+
+		if v, ok := t.Locales[l]; ok {
+			return v
+		}
+	}
+
+	return Variant{Subject: t.Subject, HTML: t.HTML, Text: t.Text}
+}
+
+// Validate разбирает тему, html и текст всех вариантов шаблона,
+// чтобы ошибка синтаксиса обнаружилась при сохранении, а не при отправке писем
+// отсутствующие переменные так не найти, их покажет предпросмотр
+func (t *Template) Validate() error {
+	locales := make([]string, 0, len(t.Locales)+1)
+	locales = append(locales, "")
+
+	for l := range t.Locales {
+		locales = append(locales, l)
+	}
+
+	sort.Strings(locales[1:])
+
+	for _, l := range locales {
+		v := Variant{Subject: t.Subject, HTML: t.HTML, Text: t.Text}
+		if l != "" {
+			v = t.Locales[l]
+		}
+
+		name := t.ID
+		if l != "" {
+			name += "/" + l
+		}
+
+		fm := funcs(l)
+
+		_, err := parseText(name+"/subject", v.Subject, fm)
+		if err == nil {
+			_, err = parseText(name+"/text", v.Text, fm)
+		}
+
+		if err == nil {
+			_, err = parseHTML(name+"/html", v.HTML, fm)
+		}
+
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+	}
+
+	return nil
+}
+
+// Rendered - готовое содержимое письма
+type Rendered struct {
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// Store - хранилище шаблонов
+// version == 0 - последняя опубликованная версия
+type Store interface {
+	GetTemplate(id string, version int) (*Template, error)
+}
+
+// Registry - хранилище шаблонов с управлением версиями
+type Registry interface {
+	Store
+	CreateTemplate(*Template) error // новая версия-черновик, Version и State выставляются
+	UpdateTemplate(*Template) error // изменить черновик
+	PublishTemplate(id string, version int) error
+	DeleteTemplate(id string, version int) error // удалить можно только черновик
+	ListTemplates(id string) ([]Template, error) // все версии шаблона, id == "" - всех шаблонов
+}
+
+// Pin запоминает в письме версию шаблона, с которой оно будет отправлено
+// версия, указанная в письме, должна быть опубликована: черновик ещё можно изменить или удалить
+func Pin(st Store, ltr *letter.Letter) error {
+	if ltr.TemplateID == "" {
+		return nil
+	}
+
+	t, err := st.GetTemplate(ltr.TemplateID, ltr.TemplateVersion)
+	if err != nil {
+		return err
+	}
+
+	if t.State != Published {
+		return fmt.Errorf("template %s version %d: %w", t.ID, t.Version, ErrNotPublished)
+	}
+
+	ltr.TemplateVersion = t.Version
+
+	return nil
+}
+
+// Import переносит в реестр шаблоны из каталога,
+// которых в реестре ещё нет, и публикует их
+func Import(reg Registry, ds *DirStore) error {
+	ids, err := ds.IDs()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, err = reg.GetTemplate(id, 0); err == nil {
+			continue
+		}
+
+		t, err := ds.GetTemplate(id, 0)
+		if err != nil {
+			return err
+		}
+
+		if err = reg.CreateTemplate(t); err != nil {
+			return err
+		}
+
+		if err = reg.PublishTemplate(t.ID, t.Version); err != nil {
+			return err
+		}
+
+		zap.S().Debugf("template %s imported as version %d", t.ID, t.Version)
+	}
+
+	return nil
+}
+
+// отрендерить шаблон с переменными для локали
+func Render(t *Template, locale string, vars map[string]string) (*Rendered, error) {
+	var (
+		r   Rendered
+		err error
+	)
+
+	v := t.Variant(locale)
+	fm := funcs(locale)
+
+	if r.Subject, err = renderText(t.ID+"/subject", v.Subject, fm, vars); err != nil {
+		return nil, err
+	}
+
+	// тема уходит в заголовок, переводы строк в ней недопустимы
+	r.Subject = strings.Join(strings.Fields(r.Subject), " ")
+
+	if r.Text, err = renderText(t.ID+"/text", v.Text, fm, vars); err != nil {
+		return nil, err
+	}
+
+	if r.HTML, err = renderHTML(t.ID+"/html", v.HTML, fm, vars); err != nil {
+		return nil, err
+	}
+
+	if r.HTML == "" && r.Text == "" {
+		return nil, fmt.Errorf("template %s: empty body", t.ID)
+	}
+
+	return &r, nil
+}
+
+// Locale - локаль адресата, если не задана - локаль письма
+func Locale(ltr *letter.Letter, rcpt *letter.Recipient) string {
+	if rcpt != nil && rcpt.Locale != "" {
+		return rcpt.Locale
+	}
+
+	return ltr.Locale
+}
+
+// Vars собирает переменные для рендеринга:
+// переменные письма, поверх них переменные адресата,
+// а также Name, Address и Unsubscribe адресата
+func Vars(ltr *letter.Letter, rcpt *letter.Recipient) map[string]string {
+	vars := make(map[string]string, len(ltr.Vars)+3)
+
+	for k, v := range ltr.Vars {
+		vars[k] = v
+	}
+
+	if rcpt == nil {
+		return vars
+	}
+
+	for k, v := range rcpt.Vars {
+		vars[k] = v
+	}
+
+	vars["Name"] = rcpt.Name
+	vars["Address"] = rcpt.Address
+	vars["Unsubscribe"] = rcpt.Unsubscribe
+
+	return vars
+}
+
+func parseText(name, src string, fm texttemplate.FuncMap) (*texttemplate.Template, error) {
+	t, err := texttemplate.New(name).Option("missingkey=error").Funcs(fm).Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("template parse error: %v", err)
+	}
+
+	return t, nil
+}
+
+func parseHTML(name, src string, fm texttemplate.FuncMap) (*htmltemplate.Template, error) {
+	t, err := htmltemplate.New(name).Option("missingkey=error").Funcs(htmltemplate.FuncMap(fm)).Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("template parse error: %v", err)
+	}
+
+	return t, nil
+}
+
+func renderText(name, src string, fm texttemplate.FuncMap, vars map[string]string) (string, error) {
+	if src == "" {
+		return "", nil
+	}
+
+	t, err := parseText(name, src, fm)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+
+	if err = t.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("template execute error: %v", err)
+	}
+
+	return b.String(), nil
+}
+
+func renderHTML(name, src string, fm texttemplate.FuncMap, vars map[string]string) (string, error) {
+	if src == "" {
+		return "", nil
+	}
+
+	t, err := parseHTML(name, src, fm)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+
+	if err = t.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("template execute error: %v", err)
+	}
+
+	return b.String(), nil
+}
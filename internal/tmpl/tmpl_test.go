@@ -0,0 +1,205 @@
+package tmpl
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maris-cyber/mailsender/internal/letter"
+	"go.uber.org/zap"
+)
+
+// go test ./internal/tmpl -update перезаписывает golden файлы
+var update = flag.Bool("update", false, "update golden files")
+
+var ds *DirStore
+
+func TestMain(m *testing.M) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+
+	ds = &DirStore{dir: filepath.Join("testdata", "templates")}
+
+	os.Exit(m.Run())
+}
+
+func golden(t *testing.T, name string, r *Rendered) {
+	t.Helper()
+
+	got := "Subject: " + r.Subject + "\n--- html ---\n" + r.HTML + "\n--- text ---\n" + r.Text + "\n"
+	path := filepath.Join("testdata", "golden", name+".golden")
+
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0o600); err != nil {
+			t.Fatalf("can't update golden file: %v", err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("can't read golden file: %v", err)
+	}
+
+	if got != string(want) {
+		t.Errorf("Render %s mismatch\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func Test_Render(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		ltr  letter.Letter
+		rcpt *letter.Recipient
+	}{
+		{
+			name: "welcome",
+			id:   "welcome",
+			ltr:  letter.Letter{Vars: map[string]string{"city": "Москва"}},
+			rcpt: &letter.Recipient{Address: "suocq@mailto.plus", Name: "Иван", Unsubscribe: "https://example.com/u?id=1&t=2"},
+		},
+		{
+			// переменные адресата перекрывают переменные письма, html экранируется
+			name: "welcome_escaping",
+			id:   "welcome",
+			ltr:  letter.Letter{Vars: map[string]string{"city": "Москва"}},
+			rcpt: &letter.Recipient{
+				Address:     "tcuboa@mailto.plus",
+				Name:        "<script>alert(1)</script>\nПётр",
+				Unsubscribe: "javascript:alert(1)",
+				Vars:        map[string]string{"city": "Тверь & область"},
+			},
+		},
+		{
+			name: "plain",
+			id:   "plain",
+			ltr:  letter.Letter{Vars: map[string]string{"period": "октябрь", "total": "42"}},
+		},
+	}
+
+	invoice := map[string]string{"number": "17", "issued": "2021-12-15", "due": "2021-12-31T18:30:00Z", "amount": "-1234567.50"}
+
+	tests = append(tests, []struct {
+		name string
+		id   string
+		ltr  letter.Letter
+		rcpt *letter.Recipient
+	}{
+		// локаль адресата ru-RU откатывается к варианту ru
+		{
+			name: "invoice_ru",
+			id:   "invoice",
+			ltr:  letter.Letter{Vars: invoice, Locale: "en"},
+			rcpt: &letter.Recipient{Address: "suocq@mailto.plus", Locale: "ru_RU"},
+		},
+		{
+			name: "invoice_en_gb",
+			id:   "invoice",
+			ltr:  letter.Letter{Vars: invoice, Locale: "en-gb"},
+		},
+		// варианта для de нет, используется вариант по умолчанию, но числа и даты по-немецки
+		{
+			name: "invoice_de",
+			id:   "invoice",
+			ltr:  letter.Letter{Vars: invoice, Locale: "de-AT"},
+		},
+	}...)
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tpl, err := ds.GetTemplate(tc.id, 0)
+			if err != nil {
+				t.Fatalf("Get template %s error: %v", tc.id, err)
+			}
+
+			r, err := Render(tpl, Locale(&tc.ltr, tc.rcpt), Vars(&tc.ltr, tc.rcpt))
+			if err != nil {
+				t.Fatalf("Render error: %v", err)
+			}
+
+			golden(t, tc.name, r)
+		})
+	}
+}
+
+func Test_RenderMissingVar(t *testing.T) {
+	tpl, err := ds.GetTemplate("welcome", 0)
+	if err != nil {
+		t.Fatalf("Get template error: %v", err)
+	}
+
+	ltr := letter.Letter{}
+
+	_, err = Render(tpl, "", Vars(&ltr, &letter.Recipient{Address: "suocq@mailto.plus", Name: "Иван"}))
+	if err == nil {
+		t.Errorf("Render without city must fail")
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	tests := []struct {
+		tpl Template
+		bad bool
+	}{
+		{Template{ID: "ok", Subject: "Привет, {{.Name}}", HTML: "<p>{{.city}}</p>", Text: "{{date .day}}"}, false},
+		{Template{ID: "subject", Subject: "Привет, {{.Name"}, true},
+		{Template{ID: "html", HTML: "<p>{{if .x}}</p>"}, true},
+		{Template{ID: "text", Text: "{{nofunc .x}}"}, true},
+		{Template{ID: "locale", Text: "ok", Locales: map[string]Variant{"ru": {Text: "{{end}}"}}}, true},
+	}
+
+	for _, tt := range tests {
+		err := tt.tpl.Validate()
+		if tt.bad != (err != nil) || tt.bad && !errors.Is(err, ErrInvalid) {
+			t.Errorf("Validate %s = %v, want error %v", tt.tpl.ID, err, tt.bad)
+		}
+	}
+
+	// шаблоны из каталога корректны
+	tpl, err := ds.GetTemplate("welcome", 0)
+	if err != nil {
+		t.Fatalf("Get template error: %v", err)
+	}
+
+	if err = tpl.Validate(); err != nil {
+		t.Errorf("Validate welcome = %v", err)
+	}
+}
+
+func Test_DirStoreGet(t *testing.T) {
+	for _, id := range []string{"", "..", "../templates", "absent"} {
+		if _, err := ds.GetTemplate(id, 0); err == nil {
+			t.Errorf("Get %q must fail", id)
+		}
+	}
+}
+
+func Test_Fallback(t *testing.T) {
+	tests := map[string][]string{
+		"":           {""},
+		"ru":         {"ru", ""},
+		"ru-RU":      {"ru-RU", "ru", ""},
+		"EN_gb":      {"en-GB", "en", ""},
+		"zh-Hant-TW": {"zh-Hant-TW", "zh-Hant", "zh", ""},
+	}
+
+	for in, want := range tests {
+		got := Fallback(in)
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("Fallback(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func Test_FormatNumber(t *testing.T) {
+	for _, bad := range []string{"", "abc", "1e5", "NaN", "0x10"} {
+		if _, err := formatNumber(bad, formats[""]); err == nil {
+			t.Errorf("formatNumber(%q) must fail", bad)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+/*
+track - пакет, обеспечивающий отслеживание открытий писем и переходов по ссылкам.
+Ссылки в html письма заменяются на редирект через mailsender,
+в конец письма добавляется картинка-пиксель.
+И ссылка, и пиксель несут токен, подписанный HMAC, с ID письма и адресатом,
+поэтому подделать событие или использовать редирект для чужих ссылок нельзя.
+Тем же ключом подписываются ссылки для отписки в один клик (RFC 8058).
+*/
+package track
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	TRACK_SECRET   = "TRACK_SECRET"
+	TRACK_BASE_URL = "TRACK_BASE_URL"
+
+	OpenPath        = "/t/o/"
+	ClickPath       = "/t/c/"
+	UnsubscribePath = "/unsubscribe/"
+
+	sigLen = 16 // подпись укорочена, чтобы ссылки были не слишком длинными
+)
+
+// Claims - то, что несёт токен
+type Claims struct {
+	LetterID string `json:"l"`
+	Address  string `json:"r,omitempty"`
+	URL      string `json:"u,omitempty"`
+	Category string `json:"c,omitempty"` // для отписки
+	Tenant   string `json:"t,omitempty"` // для отписки
+}
+
+type Tracker struct {
+	key  []byte
+	base string // внешний адрес mailsender'а без / в конце
+}
+
+// конструктор, если отслеживание не настроено, возвращает nil
+func New() (*Tracker, error) {
+	tr := Tracker{}
+
+	secret, ok := os.LookupEnv(TRACK_SECRET)
+	if !ok {
+		return nil, nil
+	}
+
+	base, ok := os.LookupEnv(TRACK_BASE_URL)
+	if !ok {
+		return nil, fmt.Errorf("%s not defined", TRACK_BASE_URL)
+	}
+
+	u, err := url.Parse(base)
+	if err != nil || !u.IsAbs() {
+		return nil, fmt.Errorf("%s must be absolute url: %s", TRACK_BASE_URL, base)
+	}
+
+	tr.key = []byte(secret)
+	tr.base = strings.TrimRight(base, "/")
+
+	zap.S().Debugf("tracking base url: %s", tr.base)
+
+	return &tr, nil
+}
+
+// подписать
+func (tr *Tracker) Sign(c Claims) string {
+	payload, _ := json.Marshal(c) // ошибки быть не может, в Claims только строки
+
+	p := base64.RawURLEncoding.EncodeToString(payload)
+
+	return p + "." + base64.RawURLEncoding.EncodeToString(tr.mac(p))
+}
+
+// проверить подпись и прочитать токен
+func (tr *Tracker) Verify(token string) (Claims, error) {
+	var c Claims
+
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return c, fmt.Errorf("bad token format")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, tr.mac(token[:i])) {
+		return c, fmt.Errorf("bad token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return c, fmt.Errorf("bad token payload: %v", err)
+	}
+
+	if err = json.Unmarshal(payload, &c); err != nil {
+		return c, fmt.Errorf("bad token payload: %v", err)
+	}
+
+	return c, nil
+}
+
+func (tr *Tracker) mac(payload string) []byte {
+	m := hmac.New(sha256.New, tr.key)
+	m.Write([]byte(payload))
+
+	return m.Sum(nil)[:sigLen]
+}
+
+// URL - внешняя ссылка на эндпойнт mailsender'а с токеном
+func (tr *Tracker) URL(path string, c Claims) string {
+	return tr.base + path + tr.Sign(c)
+}
+
+// Rewrite заменяет http(s) ссылки на редирект с отслеживанием
+// и добавляет пиксель для отслеживания открытия
+func (tr *Tracker) Rewrite(src, letterID, address string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return "", fmt.Errorf("html.Parse error: %v", err)
+	}
+
+	var body *html.Node
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.DataAtom {
+			case atom.Body:
+				body = n
+			case atom.A:
+				tr.rewriteLink(n, letterID, address)
+			}
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	if body != nil {
+		body.AppendChild(&html.Node{
+			Type:     html.ElementNode,
+			Data:     "img",
+			DataAtom: atom.Img,
+			Attr: []html.Attribute{
+				{Key: "src", Val: tr.URL(OpenPath, Claims{LetterID: letterID, Address: address})},
+				{Key: "width", Val: "1"},
+				{Key: "height", Val: "1"},
+				{Key: "alt", Val: ""},
+				{Key: "style", Val: "display: block; border: 0"},
+			},
+		})
+	}
+
+	var b bytes.Buffer
+
+	if err = html.Render(&b, doc); err != nil {
+		return "", fmt.Errorf("html.Render error: %v", err)
+	}
+
+	return b.String(), nil
+}
+
+func (tr *Tracker) rewriteLink(n *html.Node, letterID, address string) {
+	for i := range n.Attr {
+		if !strings.EqualFold(n.Attr[i].Key, "href") {
+			continue
+		}
+
+		u, err := url.Parse(strings.TrimSpace(n.Attr[i].Val))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+
+		// ссылки на сам mailsender (например, отписка) не отслеживаются
+		if strings.HasPrefix(u.String(), tr.base+"/") {
+			continue
+		}
+
+		n.Attr[i].Val = tr.URL(ClickPath, Claims{LetterID: letterID, Address: address, URL: u.String()})
+	}
+}
@@ -0,0 +1,80 @@
+package track
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+var tr *Tracker
+
+func TestMain(m *testing.M) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+
+	tr = &Tracker{key: []byte("секрет"), base: "https://mail.example.com"}
+
+	os.Exit(m.Run())
+}
+
+func Test_SignVerify(t *testing.T) {
+	c := Claims{LetterID: "61b9f1c2e4b0a1a2b3c4d5e6", Address: "suocq@mailto.plus", URL: "https://example.com/?a=1&b=2"}
+
+	token := tr.Sign(c)
+
+	got, err := tr.Verify(token)
+	if err != nil {
+		t.Fatalf("Verify error: %v", err)
+	}
+
+	if got != c {
+		t.Errorf("Verify = %v, want %v", got, c)
+	}
+
+	// подделанный адресат
+	forged := Claims{LetterID: c.LetterID, Address: "tcuboa@mailto.plus", URL: c.URL}
+	payload := strings.SplitN(tr.Sign(forged), ".", 2)[0]
+	sig := strings.SplitN(token, ".", 2)[1]
+
+	for _, bad := range []string{"", "abc", payload + "." + sig, token + "x"} {
+		if _, err = tr.Verify(bad); err == nil {
+			t.Errorf("Verify(%q) must fail", bad)
+		}
+	}
+
+	other := &Tracker{key: []byte("другой"), base: tr.base}
+	if _, err = other.Verify(token); err == nil {
+		t.Errorf("Verify with other key must fail")
+	}
+}
+
+func Test_Rewrite(t *testing.T) {
+	src := `<html><body><p><a href="https://example.com/sale">распродажа</a>
+<a href="mailto:help@example.com">помощь</a>
+<a href="https://mail.example.com/unsubscribe/x">отписаться</a></p></body></html>`
+
+	res, err := tr.Rewrite(src, "61b9f1c2e4b0a1a2b3c4d5e6", "suocq@mailto.plus")
+	if err != nil {
+		t.Fatalf("Rewrite error: %v", err)
+	}
+
+	click := regexp.MustCompile(`href="https://mail\.example\.com/t/c/([^"]+)"`).FindStringSubmatch(res)
+	if click == nil {
+		t.Fatalf("link must be rewritten:\n%s", res)
+	}
+
+	c, err := tr.Verify(click[1])
+	if err != nil || c.URL != "https://example.com/sale" || c.Address != "suocq@mailto.plus" {
+		t.Errorf("click token %v error %v", c, err)
+	}
+
+	for _, want := range []string{`href="mailto:help@example.com"`, `href="https://mail.example.com/unsubscribe/x"`, `src="https://mail.example.com/t/o/`} {
+		if !strings.Contains(res, want) {
+			t.Errorf("Rewrite result must contain %s:\n%s", want, res)
+		}
+	}
+}